@@ -0,0 +1,195 @@
+// Copyright 2023 EnactTrust LTD All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+
+package main
+
+import (
+	"errors"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/veraison/enact-demo/pkg/node"
+)
+
+// Update windows stay open for a day unless a duration is given
+const defaultUpdateWindowDuration = 24 * time.Hour
+
+// Re-baselining endpoints: operators open an update window, the next quote
+// of the node is captured as a candidate golden value, and approving the
+// candidate makes it the node's golden value
+func setupBaselineRoutes(r *gin.Engine, nodeService *node.NodeService, operator gin.HandlerFunc) {
+	// POST /update-windows, Body: {"node_id": "...", "label": "...", "duration": "24h"}
+	r.POST("/update-windows", operator, func(c *gin.Context) {
+		var body struct {
+			NodeID   string `json:"node_id"`
+			Label    string `json:"label"`
+			Duration string `json:"duration"`
+		}
+		if err := c.ShouldBindJSON(&body); err != nil {
+			c.JSON(400, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+
+		duration := defaultUpdateWindowDuration
+		if body.Duration != "" {
+			var err error
+			duration, err = time.ParseDuration(body.Duration)
+			if err != nil {
+				c.JSON(400, gin.H{
+					"error": err.Error(),
+				})
+				return
+			}
+		}
+
+		window, err := nodeService.OpenUpdateWindow(body.NodeID, body.Label, duration)
+		if err != nil {
+			log.Println(err.Error())
+			c.JSON(errorStatus(err), gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+
+		c.JSON(201, window)
+	})
+
+	// GET /update-windows?limit=&offset=, newest first
+	r.GET("/update-windows", func(c *gin.Context) {
+		limit, offset, err := parsePage(c)
+		if err != nil {
+			c.JSON(400, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+
+		windows, total, err := nodeService.ListUpdateWindows(limit, offset)
+		if err != nil {
+			log.Println(err.Error())
+			c.JSON(500, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+
+		c.JSON(200, gin.H{
+			"update_windows": windows,
+			"total":          total,
+			"limit":          limit,
+			"offset":         offset,
+		})
+	})
+
+	r.POST("/update-windows/:id/close", operator, func(c *gin.Context) {
+		id, err := parseID(c)
+		if err != nil {
+			c.JSON(400, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+
+		err = nodeService.CloseUpdateWindow(id)
+		if err != nil {
+			log.Println(err.Error())
+			c.JSON(errorStatus(err), gin.H{
+				"error": err.Error(),
+			})
+		} else {
+			c.Status(204)
+		}
+	})
+
+	// GET /nodes/:id/candidates?limit=&offset=, newest first
+	r.GET("/nodes/:id/candidates", func(c *gin.Context) {
+		limit, offset, err := parsePage(c)
+		if err != nil {
+			c.JSON(400, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+
+		candidates, total, err := nodeService.ListCandidates(c.Param("id"), limit, offset)
+		if err != nil {
+			log.Println(err.Error())
+			c.JSON(errorStatus(err), gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+
+		c.JSON(200, gin.H{
+			"candidates": candidates,
+			"total":      total,
+			"limit":      limit,
+			"offset":     offset,
+		})
+	})
+
+	r.POST("/candidates/:id/approve", operator, func(c *gin.Context) {
+		id, err := parseID(c)
+		if err != nil {
+			c.JSON(400, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+
+		golden, err := nodeService.ApproveCandidate(id)
+		if err != nil {
+			log.Println(err.Error())
+			c.JSON(errorStatus(err), gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+
+		c.JSON(200, golden)
+	})
+
+	r.POST("/candidates/:id/reject", operator, func(c *gin.Context) {
+		id, err := parseID(c)
+		if err != nil {
+			c.JSON(400, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+
+		err = nodeService.RejectCandidate(id)
+		if err != nil {
+			log.Println(err.Error())
+			c.JSON(errorStatus(err), gin.H{
+				"error": err.Error(),
+			})
+		} else {
+			c.Status(204)
+		}
+	})
+}
+
+// parseID reads the numeric :id path parameter
+func parseID(c *gin.Context) (int64, error) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil || id < 1 {
+		return 0, errors.New("id must be a positive integer")
+	}
+
+	return id, nil
+}
@@ -0,0 +1,127 @@
+// Copyright 2023 EnactTrust LTD All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// client speaks the agent side of the backend /node API
+type client struct {
+	base string
+}
+
+var httpClient = &http.Client{Timeout: 30 * time.Second}
+
+// registerNode posts the AK and EK to /node/pem, the EK certificate only when
+// not nil
+func (c *client) registerNode(akPEM, akPublic, ekPEM, ekCert []byte, akName, label string) (uuid.UUID, error) {
+	files := map[string][]byte{
+		"ak_pub":    akPEM,
+		"ak_public": akPublic,
+		"ek_pub":    ekPEM,
+	}
+	if ekCert != nil {
+		files["ek_cert"] = ekCert
+	}
+
+	body, err := c.postForm("/node/pem", files, map[string]string{
+		"ak_name": akName,
+		"label":   label,
+	})
+	if err != nil {
+		return uuid.Nil, err
+	}
+
+	id, err := uuid.Parse(strings.TrimSpace(string(body)))
+	if err != nil {
+		return uuid.Nil, fmt.Errorf("unexpected /node/pem response %q", body)
+	}
+
+	return id, nil
+}
+
+func (c *client) secret(nodeID uuid.UUID) ([]byte, error) {
+	return c.postForm("/node/secret", nil, map[string]string{
+		"node_id": nodeID.String(),
+	})
+}
+
+// upload posts a quote to /node/golden or /node/evidence; blobField names
+// the evidence part, which differs between the two. The individual PCR
+// values are only sent when not nil.
+func (c *client) upload(path, blobField string, nodeID uuid.UUID, evidence, signature, pcrValues []byte) error {
+	files := map[string][]byte{
+		"node_id":        []byte(nodeID.String()),
+		blobField:        evidence,
+		"signature_blob": signature,
+	}
+	if pcrValues != nil {
+		files["pcr_values"] = pcrValues
+	}
+
+	_, err := c.postForm(path, files, nil)
+
+	return err
+}
+
+func (c *client) postForm(path string, files map[string][]byte, fields map[string]string) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	w := multipart.NewWriter(buf)
+
+	for name, data := range files {
+		part, err := w.CreateFormFile(name, name)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := part.Write(data); err != nil {
+			return nil, err
+		}
+	}
+
+	for name, value := range fields {
+		if err := w.WriteField(name, value); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	resp, err := httpClient.Post(c.base+path, w.FormDataContentType(), buf)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("POST %s: %s: %s", path, resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	return body, nil
+}
@@ -0,0 +1,289 @@
+// Copyright 2023 EnactTrust LTD All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+
+// agent-sim plays the EnactTrust agent against a TPM simulator (the
+// Microsoft reference simulator, or ibmswtpm2, listening on the mssim
+// ports). It onboards a node, provisions its golden values and then
+// uploads evidence, once or periodically.
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/veraison/enact-demo/pkg/wire"
+)
+
+type options struct {
+	backend      string
+	tpmCmd       string
+	tpmPlatform  string
+	pcrs         []int
+	plain        bool
+	label        string
+	stateFile    string
+	interval     time.Duration
+	extendPCR    int
+	attestations int
+	sendPCRs     bool
+	ak           string
+	bank         string
+	ekCert       string
+	wire         int
+}
+
+func main() {
+	var (
+		o    options
+		pcrs string
+		mode string
+	)
+
+	flag.StringVar(&o.backend, "backend", "http://localhost:8000", "base URL of the EnactTrust backend")
+	flag.StringVar(&o.tpmCmd, "tpm-cmd", "127.0.0.1:2321", "TPM simulator command address")
+	flag.StringVar(&o.tpmPlatform, "tpm-platform", "127.0.0.1:2322", "TPM simulator platform address")
+	flag.StringVar(&pcrs, "pcrs", "0,1,2,3,4,5,6,7", "comma separated PCRs to quote")
+	flag.StringVar(&mode, "challenge-mode", "plain", "challenge mode of the backend: credential or plain")
+	flag.StringVar(&o.label, "label", "", "label to register the node with")
+	flag.StringVar(&o.stateFile, "state", "agent-sim.node", "file remembering the node_id across runs")
+	flag.DurationVar(&o.interval, "interval", 0, "attest periodically at this interval (0 attests once)")
+	flag.IntVar(&o.extendPCR, "extend-pcr", -1, "extend this PCR with random data before every attestation")
+	flag.IntVar(&o.attestations, "count", 0, "stop after this many attestations when -interval is set (0 runs forever)")
+	flag.BoolVar(&o.sendPCRs, "pcr-values", true, "send the individual PCR values along each quote")
+	flag.StringVar(&o.ak, "ak", "ecc", "AK type: ecc (ECDSA P-256), ecc384 (ECDSA P-384) or rsa (RSASSA 2048)")
+	flag.StringVar(&o.bank, "bank", "sha256", "PCR bank to quote: sha1, sha256, sha384 or sha512")
+	flag.StringVar(&o.ekCert, "ek-cert", "", "EK certificate file to register the node with, for backends requiring one")
+	flag.IntVar(&o.wire, "wire", int(wire.V2), "agent wire format version: 2, or 1 for the legacy layout of older agents")
+	flag.Parse()
+
+	var err error
+	if o.pcrs, err = parsePCRs(pcrs); err != nil {
+		log.Fatal(err)
+	}
+
+	switch mode {
+	case "credential":
+	case "plain":
+		o.plain = true
+	default:
+		log.Fatalf("unknown challenge mode %q", mode)
+	}
+
+	if _, ok := akTemplates[o.ak]; !ok {
+		log.Fatalf("unknown AK type %q", o.ak)
+	}
+
+	if _, ok := pcrBanks[o.bank]; !ok {
+		log.Fatalf("unknown PCR bank %q", o.bank)
+	}
+
+	if o.wire != int(wire.Legacy) && o.wire != int(wire.V2) {
+		log.Fatalf("unknown wire format version %d", o.wire)
+	}
+
+	if err := run(o); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func run(o options) error {
+	tpm, err := openTPM(o.tpmCmd, o.tpmPlatform, akTemplates[o.ak], pcrBanks[o.bank])
+	if err != nil {
+		return err
+	}
+	defer tpm.Close()
+
+	c := &client{base: strings.TrimSuffix(o.backend, "/")}
+
+	nodeID, err := loadNodeID(o.stateFile)
+	if err != nil {
+		return err
+	}
+
+	if nodeID == uuid.Nil {
+		if nodeID, err = onboard(c, tpm, o); err != nil {
+			return err
+		}
+	} else {
+		log.Printf("node %s already onboarded (%s)", nodeID, o.stateFile)
+	}
+
+	for i := 1; ; i++ {
+		if err := attest(c, tpm, o, nodeID); err != nil {
+			if o.interval == 0 {
+				return err
+			}
+			log.Println(err)
+		}
+
+		if o.interval == 0 || i == o.attestations {
+			return nil
+		}
+
+		time.Sleep(o.interval)
+	}
+}
+
+// onboard registers the AK and EK, then provisions the current PCR state as
+// golden values
+func onboard(c *client, tpm *simTPM, o options) (uuid.UUID, error) {
+	akPEM, err := publicKeyPEM(tpm.akPub)
+	if err != nil {
+		return uuid.Nil, err
+	}
+
+	ekPEM, err := publicKeyPEM(tpm.ekPub)
+	if err != nil {
+		return uuid.Nil, err
+	}
+
+	// Simulators have no EK certificate, one issued by a test CA for the
+	// simulator EK can be given instead
+	var ekCert []byte
+	if o.ekCert != "" {
+		if ekCert, err = os.ReadFile(o.ekCert); err != nil {
+			return uuid.Nil, fmt.Errorf("reading EK certificate: %w", err)
+		}
+	}
+
+	nodeID, err := c.registerNode(akPEM, tpm.akPublic, ekPEM, ekCert, hex.EncodeToString(tpm.akName), o.label)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	log.Printf("registered node %s", nodeID)
+
+	if err := os.WriteFile(o.stateFile, []byte(nodeID.String()+"\n"), 0644); err != nil {
+		return uuid.Nil, fmt.Errorf("saving node_id: %w", err)
+	}
+
+	evidence, signature, pcrValues, err := quoteForNode(c, tpm, o, nodeID)
+	if err != nil {
+		return uuid.Nil, err
+	}
+
+	if err := c.upload("/node/golden", "golden_blob", nodeID, evidence, signature, pcrValues); err != nil {
+		return uuid.Nil, err
+	}
+	log.Printf("golden values provisioned for PCRs %v", o.pcrs)
+
+	return nodeID, nil
+}
+
+func attest(c *client, tpm *simTPM, o options, nodeID uuid.UUID) error {
+	if o.extendPCR >= 0 {
+		if err := tpm.extendRandom(o.extendPCR); err != nil {
+			return fmt.Errorf("extending PCR %d: %w", o.extendPCR, err)
+		}
+	}
+
+	evidence, signature, pcrValues, err := quoteForNode(c, tpm, o, nodeID)
+	if err != nil {
+		return err
+	}
+
+	if err := c.upload("/node/evidence", "evidence_blob", nodeID, evidence, signature, pcrValues); err != nil {
+		return err
+	}
+	log.Printf("evidence for node %s accepted", nodeID)
+
+	return nil
+}
+
+// quoteForNode fetches a fresh challenge and returns the evidence and
+// signature blobs of a quote over it, and with -pcr-values the values of the
+// quoted PCRs
+func quoteForNode(c *client, tpm *simTPM, o options, nodeID uuid.UUID) ([]byte, []byte, []byte, error) {
+	challenge, err := c.secret(nodeID)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	nonce := challenge
+	if !o.plain {
+		if nonce, err = tpm.activateCredential(challenge); err != nil {
+			return nil, nil, nil, fmt.Errorf("activating credential: %w", err)
+		}
+	}
+
+	attest, sig, err := tpm.quote(nonce, o.pcrs)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	evidence, signature, err := wire.Quote{
+		Version:   wire.Version(o.wire),
+		NodeID:    nodeID,
+		Attest:    attest,
+		Signature: sig,
+	}.Encode()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	var pcrValues []byte
+	if o.sendPCRs {
+		// Nothing extends the simulator PCRs between the quote and the read
+		if pcrValues, err = tpm.pcrValues(o.pcrs); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+
+	return evidence, signature, pcrValues, nil
+}
+
+func loadNodeID(path string) (uuid.UUID, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return uuid.Nil, nil
+	}
+	if err != nil {
+		return uuid.Nil, err
+	}
+
+	id, err := uuid.Parse(strings.TrimSpace(string(data)))
+	if err != nil {
+		return uuid.Nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return id, nil
+}
+
+func parsePCRs(s string) ([]int, error) {
+	var pcrs []int
+
+	for _, f := range strings.Split(s, ",") {
+		if f = strings.TrimSpace(f); f == "" {
+			continue
+		}
+
+		n, err := strconv.Atoi(f)
+		if err != nil || n < 0 || n > 23 {
+			return nil, fmt.Errorf("invalid PCR %q", f)
+		}
+		pcrs = append(pcrs, n)
+	}
+
+	if len(pcrs) == 0 {
+		return nil, errors.New("no PCRs selected")
+	}
+
+	return pcrs, nil
+}
@@ -0,0 +1,282 @@
+// Copyright 2023 EnactTrust LTD All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+	"github.com/google/go-tpm/tpmutil/mssim"
+)
+
+// ekTemplate is the TCG default RSA 2048 EK template (TCG EK Credential
+// Profile, template L-1). Its policy only admits the endorsement hierarchy
+// owner, hence the policy session in activateCredential.
+var ekTemplate = tpm2.Public{
+	Type:    tpm2.AlgRSA,
+	NameAlg: tpm2.AlgSHA256,
+	Attributes: tpm2.FlagFixedTPM | tpm2.FlagFixedParent | tpm2.FlagSensitiveDataOrigin |
+		tpm2.FlagAdminWithPolicy | tpm2.FlagRestricted | tpm2.FlagDecrypt,
+	AuthPolicy: []byte{
+		0x83, 0x71, 0x97, 0x67, 0x44, 0x84, 0xB3, 0xF8,
+		0x1A, 0x90, 0xCC, 0x8D, 0x46, 0xA5, 0xD7, 0x24,
+		0xFD, 0x52, 0xD7, 0x6E, 0x06, 0x52, 0x0B, 0x64,
+		0xF2, 0xA1, 0xDA, 0x1B, 0x33, 0x14, 0x69, 0xAA,
+	},
+	RSAParameters: &tpm2.RSAParams{
+		Symmetric: &tpm2.SymScheme{
+			Alg:     tpm2.AlgAES,
+			KeyBits: 128,
+			Mode:    tpm2.AlgCFB,
+		},
+		KeyBits:    2048,
+		ModulusRaw: make([]byte, 256),
+	},
+}
+
+// akTemplates are the AKs the backend verifies quotes with, by -ak name:
+// restricted ECDSA P-256, ECDSA P-384 and RSASSA 2048 signing keys
+var akTemplates = map[string]tpm2.Public{
+	"ecc":    eccAKTemplate,
+	"ecc384": ecc384AKTemplate,
+	"rsa":    rsaAKTemplate,
+}
+
+// pcrBanks are the PCR banks the simulator can quote, by -bank name
+var pcrBanks = map[string]tpm2.Algorithm{
+	"sha1":   tpm2.AlgSHA1,
+	"sha256": tpm2.AlgSHA256,
+	"sha384": tpm2.AlgSHA384,
+	"sha512": tpm2.AlgSHA512,
+}
+
+var eccAKTemplate = tpm2.Public{
+	Type:    tpm2.AlgECC,
+	NameAlg: tpm2.AlgSHA256,
+	Attributes: tpm2.FlagFixedTPM | tpm2.FlagFixedParent | tpm2.FlagSensitiveDataOrigin |
+		tpm2.FlagUserWithAuth | tpm2.FlagRestricted | tpm2.FlagSign,
+	ECCParameters: &tpm2.ECCParams{
+		Sign: &tpm2.SigScheme{
+			Alg:  tpm2.AlgECDSA,
+			Hash: tpm2.AlgSHA256,
+		},
+		CurveID: tpm2.CurveNISTP256,
+	},
+}
+
+var ecc384AKTemplate = tpm2.Public{
+	Type:    tpm2.AlgECC,
+	NameAlg: tpm2.AlgSHA384,
+	Attributes: tpm2.FlagFixedTPM | tpm2.FlagFixedParent | tpm2.FlagSensitiveDataOrigin |
+		tpm2.FlagUserWithAuth | tpm2.FlagRestricted | tpm2.FlagSign,
+	ECCParameters: &tpm2.ECCParams{
+		Sign: &tpm2.SigScheme{
+			Alg:  tpm2.AlgECDSA,
+			Hash: tpm2.AlgSHA384,
+		},
+		CurveID: tpm2.CurveNISTP384,
+	},
+}
+
+var rsaAKTemplate = tpm2.Public{
+	Type:    tpm2.AlgRSA,
+	NameAlg: tpm2.AlgSHA256,
+	Attributes: tpm2.FlagFixedTPM | tpm2.FlagFixedParent | tpm2.FlagSensitiveDataOrigin |
+		tpm2.FlagUserWithAuth | tpm2.FlagRestricted | tpm2.FlagSign,
+	RSAParameters: &tpm2.RSAParams{
+		Sign: &tpm2.SigScheme{
+			Alg:  tpm2.AlgRSASSA,
+			Hash: tpm2.AlgSHA256,
+		},
+		KeyBits: 2048,
+	},
+}
+
+// simTPM holds the simulator connection and the loaded EK and AK. Both keys
+// are primary keys, so they are re-derived identically on every run as long
+// as the simulator keeps its NV state.
+type simTPM struct {
+	rw     io.ReadWriteCloser
+	ek     tpmutil.Handle
+	ak     tpmutil.Handle
+	ekPub  crypto.PublicKey
+	akPub  crypto.PublicKey
+	akName []byte
+	// TPMT_PUBLIC of the AK, from which the backend computes its name
+	akPublic []byte
+	// PCR bank quoted, read and extended
+	bank tpm2.Algorithm
+}
+
+func openTPM(cmdAddr, platformAddr string, akTemplate tpm2.Public, bank tpm2.Algorithm) (*simTPM, error) {
+	rw, err := mssim.Open(mssim.Config{
+		CommandAddress:  cmdAddr,
+		PlatformAddress: platformAddr,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("opening TPM simulator: %w", err)
+	}
+
+	// mssim.Open power cycles the simulator, it needs a startup before
+	// accepting commands
+	if err := tpm2.Startup(rw, tpm2.StartupClear); err != nil {
+		rw.Close()
+		return nil, fmt.Errorf("TPM2_Startup: %w", err)
+	}
+
+	t := &simTPM{rw: rw, bank: bank}
+
+	t.ek, t.ekPub, err = tpm2.CreatePrimary(rw, tpm2.HandleEndorsement, tpm2.PCRSelection{}, "", "", ekTemplate)
+	if err != nil {
+		rw.Close()
+		return nil, fmt.Errorf("creating EK: %w", err)
+	}
+
+	ak, public, _, _, _, _, err := tpm2.CreatePrimaryEx(rw, tpm2.HandleEndorsement, tpm2.PCRSelection{}, "", "", akTemplate)
+	if err != nil {
+		t.Close()
+		return nil, fmt.Errorf("creating AK: %w", err)
+	}
+	t.ak = ak
+	t.akPublic = public
+
+	pub, err := tpm2.DecodePublic(public)
+	if err != nil {
+		t.Close()
+		return nil, fmt.Errorf("decoding AK public area: %w", err)
+	}
+
+	if t.akPub, err = pub.Key(); err != nil {
+		t.Close()
+		return nil, err
+	}
+
+	name, err := pub.Name()
+	if err != nil {
+		t.Close()
+		return nil, err
+	}
+
+	if t.akName, err = name.Digest.Encode(); err != nil {
+		t.Close()
+		return nil, err
+	}
+
+	return t, nil
+}
+
+func (t *simTPM) Close() error {
+	for _, h := range []tpmutil.Handle{t.ak, t.ek} {
+		if h != 0 {
+			tpm2.FlushContext(t.rw, h)
+		}
+	}
+
+	return t.rw.Close()
+}
+
+// activateCredential recovers the nonce from a /node/secret credential
+// challenge, i.e. a TPM2B_ID_OBJECT followed by a TPM2B_ENCRYPTED_SECRET
+func (t *simTPM) activateCredential(challenge []byte) ([]byte, error) {
+	var credBlob, secret tpmutil.U16Bytes
+
+	rest, err := tpmutil.Unpack(challenge, &credBlob, &secret)
+	if err != nil {
+		return nil, fmt.Errorf("malformed credential challenge: %w", err)
+	}
+	if rest != len(challenge) {
+		return nil, fmt.Errorf("malformed credential challenge: %d trailing bytes", len(challenge)-rest)
+	}
+
+	session, _, err := tpm2.StartAuthSession(t.rw, tpm2.HandleNull, tpm2.HandleNull,
+		make([]byte, 16), nil, tpm2.SessionPolicy, tpm2.AlgNull, tpm2.AlgSHA256)
+	if err != nil {
+		return nil, fmt.Errorf("starting policy session: %w", err)
+	}
+	defer tpm2.FlushContext(t.rw, session)
+
+	auth := tpm2.AuthCommand{Session: tpm2.HandlePasswordSession, Attributes: tpm2.AttrContinueSession}
+	if _, _, err := tpm2.PolicySecret(t.rw, tpm2.HandleEndorsement, auth, session, nil, nil, nil, 0); err != nil {
+		return nil, fmt.Errorf("TPM2_PolicySecret: %w", err)
+	}
+
+	return tpm2.ActivateCredentialUsingAuth(t.rw, []tpm2.AuthCommand{
+		auth,
+		{Session: session, Attributes: tpm2.AttrContinueSession},
+	}, t.ak, t.ek, credBlob, secret)
+}
+
+// quote returns the TPMS_ATTEST and TPMT_SIGNATURE of a TPM2_Quote over
+// pcrs, both in TPM (big endian) wire format
+func (t *simTPM) quote(nonce []byte, pcrs []int) ([]byte, []byte, error) {
+	sel := tpm2.PCRSelection{Hash: t.bank, PCRs: pcrs}
+
+	attest, sig, err := tpm2.QuoteRaw(t.rw, t.ak, "", "", nonce, sel, tpm2.AlgNull)
+	if err != nil {
+		return nil, nil, fmt.Errorf("TPM2_Quote: %w", err)
+	}
+
+	return attest, sig, nil
+}
+
+// pcrValues reads the values of pcrs in the quoted bank and concatenates them in
+// ascending PCR order, the layout of the optional pcr_values upload
+func (t *simTPM) pcrValues(pcrs []int) ([]byte, error) {
+	sorted := append([]int(nil), pcrs...)
+	sort.Ints(sorted)
+
+	buf := &bytes.Buffer{}
+	for _, pcr := range sorted {
+		value, err := tpm2.ReadPCR(t.rw, pcr, t.bank)
+		if err != nil {
+			return nil, fmt.Errorf("TPM2_PCR_Read(%d): %w", pcr, err)
+		}
+		buf.Write(value)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// extendRandom extends pcr with a random digest, to simulate a change of
+// the measured state
+func (t *simTPM) extendRandom(pcr int) error {
+	h, err := t.bank.Hash()
+	if err != nil {
+		return err
+	}
+
+	digest := make([]byte, h.Size())
+	if _, err := rand.Read(digest); err != nil {
+		return err
+	}
+
+	return tpm2.PCRExtend(t.rw, tpmutil.Handle(pcr), t.bank, digest, "")
+}
+
+func publicKeyPEM(k crypto.PublicKey) ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(k)
+	if err != nil {
+		return nil, err
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), nil
+}
@@ -0,0 +1,110 @@
+// Copyright 2023 EnactTrust LTD All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+
+// mock-veraison serves the mock Veraison provisioning and verification APIs
+// on the ports used by a default Veraison deployment, so that the backend can
+// run without one.
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/veraison/ear"
+	"github.com/veraison/enact-demo/pkg/veraison/mock"
+)
+
+func main() {
+	verificationAddr := flag.String("verification-addr", ":8080", "listen address of the challenge-response API")
+	provisioningAddr := flag.String("provisioning-addr", ":8888", "listen address of the provisioning API")
+	verdict := flag.String("verdict", "affirming", "EAR status to report: affirming, warning, contraindicated or none")
+	keyFile := flag.String("key", "", "PEM file holding the P-256 EAR signing key (generated if unset)")
+	jwkOut := flag.String("jwk-out", "", "write the EAR verification key as JWK to this file")
+	flag.Parse()
+
+	tier, ok := ear.StringToTrustTier[*verdict]
+	if !ok {
+		log.Fatalf("unknown verdict %q", *verdict)
+	}
+
+	var key *ecdsa.PrivateKey
+	if *keyFile != "" {
+		k, err := loadKey(*keyFile)
+		if err != nil {
+			log.Fatalf("loading signing key: %v", err)
+		}
+		key = k
+	}
+
+	m, err := mock.New(key)
+	if err != nil {
+		log.Fatal(err)
+	}
+	m.SetVerdict(tier)
+
+	pub, err := m.PublicKeyJWK()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *jwkOut != "" {
+		if err := os.WriteFile(*jwkOut, pub, 0644); err != nil {
+			log.Fatalf("writing JWK: %v", err)
+		}
+	}
+	fmt.Printf("EAR verification key: %s\n", pub)
+
+	errs := make(chan error, 2)
+	go func() { errs <- http.ListenAndServe(*provisioningAddr, m) }()
+	go func() { errs <- http.ListenAndServe(*verificationAddr, m) }()
+
+	log.Printf("mock-veraison: verdict %q, provisioning on %s, verification on %s",
+		*verdict, *provisioningAddr, *verificationAddr)
+
+	log.Fatal(<-errs)
+}
+
+func loadKey(path string) (*ecdsa.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+
+	switch block.Type {
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		ecKey, ok := k.(*ecdsa.PrivateKey)
+		if !ok {
+			return nil, errors.New("not an ECDSA key")
+		}
+		return ecKey, nil
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+	}
+}
@@ -1,7 +1,432 @@
+// Copyright 2023 EnactTrust LTD All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+
 package config
 
-// "github.com/kelseyhightower/envconfig"
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pelletier/go-toml/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// Environments the backend knows how to run in
+const (
+	EnvDev        = "dev"
+	EnvStaging    = "staging"
+	EnvProduction = "production"
+)
+
+// Session store backends
+const (
+	SessionStoreMemory = "memory"
+	SessionStoreSQLite = "sqlite"
+)
+
+// How the Veraison nonce is delivered to the node by /node/secret
+const (
+	// The nonce is protected with TPM2_MakeCredential so that only the TPM
+	// holding the node's EK and AK can recover it
+	ChallengeModeCredential = "credential"
+	// The nonce is returned as is, for legacy agents
+	ChallengeModePlain = "plain"
+)
+
+// Who appraises node evidence
+const (
+	// Evidence is forwarded to the Veraison services
+	VerifierVeraison = "veraison"
+	// Evidence is appraised in-process against the golden values stored in
+	// the backend database
+	VerifierLocal = "local"
+)
+
+// DefaultEARPublicKey is the JWK of the key used by the Veraison demo
+// deployment to sign attestation results.
+const DefaultEARPublicKey = `{
+	"kty": "EC",
+	"crv": "P-256",
+	"x": "usWxHK2PmfnHKwXPS54m0kTcGJ90UiglWiGahtagnv8",
+	"y": "IBOL-C3BttVivg-lSreASjpkttcsz-1rb7btKLv8EX4"
+}`
 
 type Config struct {
-	Env string
+	Env       string          `yaml:"env" toml:"env"`
+	Server    ServerConfig    `yaml:"server" toml:"server"`
+	Database  DatabaseConfig  `yaml:"database" toml:"database"`
+	Veraison  VeraisonConfig  `yaml:"veraison" toml:"veraison"`
+	Sessions  SessionsConfig  `yaml:"sessions" toml:"sessions"`
+	Challenge ChallengeConfig `yaml:"challenge" toml:"challenge"`
+	Verifier  VerifierConfig  `yaml:"verifier" toml:"verifier"`
+	EK        EKConfig        `yaml:"ek" toml:"ek"`
+}
+
+type ServerConfig struct {
+	// Address the HTTP API listens on, e.g. ":8000"
+	ListenAddr string `yaml:"listen_addr" toml:"listen_addr"`
+	// Bearer token the operator routes (approvals, update windows,
+	// revocations, policies) require. Mandatory outside dev; when empty in
+	// dev, the operator routes are open.
+	OperatorToken string `yaml:"operator_token" toml:"operator_token"`
+}
+
+type DatabaseConfig struct {
+	// Path of the SQLite database file
+	Path string `yaml:"path" toml:"path"`
+}
+
+type VeraisonConfig struct {
+	// Challenge-response newSession endpoint of the verification service
+	NewSessionURI string `yaml:"new_session_uri" toml:"new_session_uri"`
+	// Submit endpoint of the endorsement provisioning service
+	SubmitURI string `yaml:"submit_uri" toml:"submit_uri"`
+	// Size in bytes of the nonce requested for each session
+	NonceSize uint `yaml:"nonce_size" toml:"nonce_size"`
+	// JWK used to verify the EAR returned by Veraison. Ignored if
+	// EARPublicKeyFile is set.
+	EARPublicKey string `yaml:"ear_public_key" toml:"ear_public_key"`
+	// Path to a file containing the JWK used to verify the EAR
+	EARPublicKeyFile string `yaml:"ear_public_key_file" toml:"ear_public_key_file"`
+}
+
+type SessionsConfig struct {
+	// Where Veraison sessions are kept: "sqlite" (survives restarts) or "memory"
+	Store string `yaml:"store" toml:"store"`
+	// How long a node may take to answer the challenge, e.g. "5m"
+	TTL string `yaml:"ttl" toml:"ttl"`
+}
+
+type ChallengeConfig struct {
+	// "plain" (default, what existing agents expect) or "credential"
+	Mode string `yaml:"mode" toml:"mode"`
+}
+
+type VerifierConfig struct {
+	// "veraison" (default) or "local"
+	Mode string `yaml:"mode" toml:"mode"`
+}
+
+type EKConfig struct {
+	// PEM or DER file, or directory of such files, holding the TPM
+	// manufacturer root and intermediate CAs. When set, nodes must register
+	// with an EK certificate issued by one of them; when empty, EK
+	// certificates are optional and not validated.
+	CABundle string `yaml:"ca_bundle" toml:"ca_bundle"`
+	// PEM or DER revocation lists of the CAs of the bundle
+	CRLs []string `yaml:"crls" toml:"crls"`
+}
+
+// SessionTTL returns the parsed TTL. It must only be called on a validated
+// configuration.
+func (s SessionsConfig) SessionTTL() time.Duration {
+	d, _ := time.ParseDuration(s.TTL)
+	return d
+}
+
+// Default returns the configuration used when nothing else is specified.
+// It matches the values that used to be hardcoded in the backend.
+func Default() *Config {
+	return &Config{
+		Env: EnvDev,
+		Server: ServerConfig{
+			ListenAddr: ":8000",
+		},
+		Database: DatabaseConfig{
+			Path: "./enact.db",
+		},
+		Veraison: VeraisonConfig{
+			NewSessionURI: "http://localhost:8080/challenge-response/v1/newSession",
+			SubmitURI:     "http://localhost:8888/endorsement-provisioning/v1/submit",
+			NonceSize:     16,
+			EARPublicKey:  DefaultEARPublicKey,
+		},
+		Sessions: SessionsConfig{
+			Store: SessionStoreSQLite,
+			TTL:   "5m",
+		},
+		Challenge: ChallengeConfig{
+			Mode: ChallengeModePlain,
+		},
+		Verifier: VerifierConfig{
+			Mode: VerifierVeraison,
+		},
+	}
+}
+
+// Load builds the configuration in layers: defaults, then the config file
+// (YAML or TOML, selected with -config or ENACT_CONFIG), then ENACT_*
+// environment variables and finally command-line flags. The result is
+// validated before being returned.
+func Load(args []string) (*Config, error) {
+	cfg := Default()
+
+	fs := flag.NewFlagSet("enact-backend", flag.ContinueOnError)
+	configFile := fs.String("config", os.Getenv("ENACT_CONFIG"), "path to a YAML or TOML config file")
+	env := fs.String("env", "", "deployment environment (dev, staging, production)")
+	listenAddr := fs.String("listen", "", "address the HTTP API listens on")
+	operatorToken := fs.String("operator-token", "", "bearer token of the operator routes (prefer ENACT_OPERATOR_TOKEN, flags are visible to other users)")
+	dbPath := fs.String("db", "", "path of the SQLite database")
+	newSessionURI := fs.String("veraison-session-uri", "", "Veraison challenge-response newSession URI")
+	submitURI := fs.String("veraison-submit-uri", "", "Veraison endorsement provisioning submit URI")
+	nonceSize := fs.Uint("nonce-size", 0, "size in bytes of the Veraison session nonce")
+	earKeyFile := fs.String("ear-public-key-file", "", "file containing the JWK used to verify EARs")
+	sessionStore := fs.String("session-store", "", "where Veraison sessions are kept (sqlite, memory)")
+	sessionTTL := fs.String("session-ttl", "", "lifetime of a Veraison session, e.g. 5m")
+	challengeMode := fs.String("challenge-mode", "", "how /node/secret delivers the nonce (credential, plain)")
+	verifierMode := fs.String("verifier", "", "who appraises evidence (veraison, local)")
+	ekCABundle := fs.String("ek-ca-bundle", "", "file or directory of the TPM manufacturer CAs EK certificates must chain to")
+	ekCRLs := fs.String("ek-crls", "", "comma separated revocation lists of the EK CAs")
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if *configFile != "" {
+		if err := cfg.loadFile(*configFile); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := cfg.loadEnv(); err != nil {
+		return nil, err
+	}
+
+	// Only flags that were explicitly passed override the other layers
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "env":
+			cfg.Env = *env
+		case "listen":
+			cfg.Server.ListenAddr = *listenAddr
+		case "operator-token":
+			cfg.Server.OperatorToken = *operatorToken
+		case "db":
+			cfg.Database.Path = *dbPath
+		case "veraison-session-uri":
+			cfg.Veraison.NewSessionURI = *newSessionURI
+		case "veraison-submit-uri":
+			cfg.Veraison.SubmitURI = *submitURI
+		case "nonce-size":
+			cfg.Veraison.NonceSize = *nonceSize
+		case "ear-public-key-file":
+			cfg.Veraison.EARPublicKeyFile = *earKeyFile
+		case "session-store":
+			cfg.Sessions.Store = *sessionStore
+		case "session-ttl":
+			cfg.Sessions.TTL = *sessionTTL
+		case "challenge-mode":
+			cfg.Challenge.Mode = *challengeMode
+		case "verifier":
+			cfg.Verifier.Mode = *verifierMode
+		case "ek-ca-bundle":
+			cfg.EK.CABundle = *ekCABundle
+		case "ek-crls":
+			cfg.EK.CRLs = splitList(*ekCRLs)
+		}
+	})
+
+	if err := cfg.resolveEARPublicKey(); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+func (cfg *Config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("reading config file: %w", err)
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		err = dec.Decode(cfg)
+	case ".toml":
+		err = toml.NewDecoder(bytes.NewReader(data)).DisallowUnknownFields().Decode(cfg)
+	default:
+		return fmt.Errorf("unsupported config file extension %q (want .yaml, .yml or .toml)", filepath.Ext(path))
+	}
+
+	if err != nil {
+		return fmt.Errorf("parsing config file %s: %w", path, err)
+	}
+
+	return nil
+}
+
+func (cfg *Config) loadEnv() error {
+	lookup := func(key string, dst *string) {
+		if v, ok := os.LookupEnv(key); ok {
+			*dst = v
+		}
+	}
+
+	lookup("ENACT_ENV", &cfg.Env)
+	lookup("ENACT_LISTEN_ADDR", &cfg.Server.ListenAddr)
+	lookup("ENACT_OPERATOR_TOKEN", &cfg.Server.OperatorToken)
+	lookup("ENACT_DB_PATH", &cfg.Database.Path)
+	lookup("ENACT_VERAISON_NEW_SESSION_URI", &cfg.Veraison.NewSessionURI)
+	lookup("ENACT_VERAISON_SUBMIT_URI", &cfg.Veraison.SubmitURI)
+	lookup("ENACT_VERAISON_EAR_PUBLIC_KEY", &cfg.Veraison.EARPublicKey)
+	lookup("ENACT_VERAISON_EAR_PUBLIC_KEY_FILE", &cfg.Veraison.EARPublicKeyFile)
+	lookup("ENACT_SESSION_STORE", &cfg.Sessions.Store)
+	lookup("ENACT_SESSION_TTL", &cfg.Sessions.TTL)
+	lookup("ENACT_CHALLENGE_MODE", &cfg.Challenge.Mode)
+	lookup("ENACT_VERIFIER", &cfg.Verifier.Mode)
+	lookup("ENACT_EK_CA_BUNDLE", &cfg.EK.CABundle)
+
+	if v, ok := os.LookupEnv("ENACT_EK_CRLS"); ok {
+		cfg.EK.CRLs = splitList(v)
+	}
+
+	if v, ok := os.LookupEnv("ENACT_VERAISON_NONCE_SIZE"); ok {
+		n, err := strconv.ParseUint(v, 10, 32)
+		if err != nil {
+			return fmt.Errorf("ENACT_VERAISON_NONCE_SIZE: %w", err)
+		}
+		cfg.Veraison.NonceSize = uint(n)
+	}
+
+	return nil
+}
+
+func (cfg *Config) resolveEARPublicKey() error {
+	if cfg.Veraison.EARPublicKeyFile == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(cfg.Veraison.EARPublicKeyFile)
+	if err != nil {
+		return fmt.Errorf("reading EAR public key: %w", err)
+	}
+	cfg.Veraison.EARPublicKey = string(data)
+
+	return nil
+}
+
+// Validate checks that the configuration is complete and consistent
+func (cfg Config) Validate() error {
+	switch cfg.Env {
+	case EnvDev, EnvStaging, EnvProduction:
+	default:
+		return fmt.Errorf("env: unknown environment %q", cfg.Env)
+	}
+
+	if cfg.Server.ListenAddr == "" {
+		return errors.New("server.listen_addr: must not be empty")
+	}
+
+	if cfg.Env != EnvDev && cfg.Server.OperatorToken == "" {
+		return fmt.Errorf("server.operator_token: must be set in %s", cfg.Env)
+	}
+
+	if cfg.Database.Path == "" {
+		return errors.New("database.path: must not be empty")
+	}
+
+	// The local verifier does not talk to Veraison
+	if cfg.Verifier.Mode != VerifierLocal {
+		if err := validateURI(cfg.Veraison.NewSessionURI); err != nil {
+			return fmt.Errorf("veraison.new_session_uri: %w", err)
+		}
+
+		if err := validateURI(cfg.Veraison.SubmitURI); err != nil {
+			return fmt.Errorf("veraison.submit_uri: %w", err)
+		}
+
+		if strings.TrimSpace(cfg.Veraison.EARPublicKey) == "" {
+			return errors.New("veraison.ear_public_key: must not be empty")
+		}
+	}
+
+	// Veraison refuses nonces outside of this range
+	if cfg.Veraison.NonceSize < 8 || cfg.Veraison.NonceSize > 64 {
+		return fmt.Errorf("veraison.nonce_size: must be between 8 and 64, got %d", cfg.Veraison.NonceSize)
+	}
+
+	switch cfg.Sessions.Store {
+	case SessionStoreMemory, SessionStoreSQLite:
+	default:
+		return fmt.Errorf("sessions.store: unknown store %q", cfg.Sessions.Store)
+	}
+
+	ttl, err := time.ParseDuration(cfg.Sessions.TTL)
+	if err != nil {
+		return fmt.Errorf("sessions.ttl: %w", err)
+	}
+	if ttl <= 0 {
+		return fmt.Errorf("sessions.ttl: must be positive, got %s", ttl)
+	}
+
+	switch cfg.Challenge.Mode {
+	case ChallengeModeCredential, ChallengeModePlain:
+	default:
+		return fmt.Errorf("challenge.mode: unknown mode %q", cfg.Challenge.Mode)
+	}
+
+	switch cfg.Verifier.Mode {
+	case VerifierVeraison, VerifierLocal:
+	default:
+		return fmt.Errorf("verifier.mode: unknown verifier %q", cfg.Verifier.Mode)
+	}
+
+	if len(cfg.EK.CRLs) > 0 && cfg.EK.CABundle == "" {
+		return errors.New("ek.crls: revocation lists need an ek.ca_bundle")
+	}
+
+	return nil
+}
+
+// splitList splits a comma separated list, dropping empty items
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
+
+func validateURI(s string) error {
+	u, err := url.Parse(s)
+	if err != nil {
+		return err
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("%q is not an http(s) URI", s)
+	}
+
+	if u.Host == "" {
+		return fmt.Errorf("%q has no host", s)
+	}
+
+	return nil
 }
@@ -0,0 +1,234 @@
+// Copyright 2023 EnactTrust LTD All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeFile writes a config file in a temporary directory and returns its path
+func writeFile(t *testing.T, name string, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestLoadDefaults(t *testing.T) {
+	cfg, err := Load(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(cfg, Default()) {
+		t.Errorf("got %+v", cfg)
+	}
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	path := writeFile(t, "enact.yaml", `
+server:
+  listen_addr: ":1"
+database:
+  path: file.db
+sessions:
+  ttl: 1m
+`)
+
+	cases := []struct {
+		name   string
+		env    map[string]string
+		args   []string
+		listen string
+		db     string
+		ttl    string
+	}{
+		{"file", nil, nil, ":1", "file.db", "1m"},
+		{"env over file", map[string]string{"ENACT_LISTEN_ADDR": ":2", "ENACT_SESSION_TTL": "2m"}, nil, ":2", "file.db", "2m"},
+		{"flag over env", map[string]string{"ENACT_LISTEN_ADDR": ":2", "ENACT_DB_PATH": "env.db"}, []string{"-listen", ":3"}, ":3", "env.db", "1m"},
+		{"flag over file", nil, []string{"-db", "flag.db", "-session-ttl", "3m"}, ":1", "flag.db", "3m"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			t.Setenv("ENACT_CONFIG", path)
+			for k, v := range c.env {
+				t.Setenv(k, v)
+			}
+
+			cfg, err := Load(c.args)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if cfg.Server.ListenAddr != c.listen || cfg.Database.Path != c.db || cfg.Sessions.TTL != c.ttl {
+				t.Errorf("listen %q, db %q, ttl %q", cfg.Server.ListenAddr, cfg.Database.Path, cfg.Sessions.TTL)
+			}
+
+			// Settings in no layer keep their default
+			if cfg.Veraison.SubmitURI != Default().Veraison.SubmitURI {
+				t.Errorf("submit URI %q", cfg.Veraison.SubmitURI)
+			}
+		})
+	}
+}
+
+func TestLoadFileFormats(t *testing.T) {
+	yamlPath := writeFile(t, "enact.yml", `
+env: staging
+server:
+  operator_token: s3cret
+veraison:
+  nonce_size: 32
+sessions:
+  store: memory
+ek:
+  ca_bundle: ./cas
+  crls: [a.crl, b.crl]
+`)
+
+	tomlPath := writeFile(t, "enact.toml", `
+env = "staging"
+
+[server]
+operator_token = "s3cret"
+
+[veraison]
+nonce_size = 32
+
+[sessions]
+store = "memory"
+
+[ek]
+ca_bundle = "./cas"
+crls = ["a.crl", "b.crl"]
+`)
+
+	yamlCfg, err := Load([]string{"-config", yamlPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tomlCfg, err := Load([]string{"-config", tomlPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(yamlCfg, tomlCfg) {
+		t.Errorf("YAML %+v, TOML %+v", yamlCfg, tomlCfg)
+	}
+
+	if yamlCfg.Env != EnvStaging || yamlCfg.Server.OperatorToken != "s3cret" || yamlCfg.Veraison.NonceSize != 32 || yamlCfg.Sessions.Store != SessionStoreMemory ||
+		!reflect.DeepEqual(yamlCfg.EK.CRLs, []string{"a.crl", "b.crl"}) {
+		t.Errorf("got %+v", yamlCfg)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	cases := []struct {
+		name string
+		file string
+		body string
+		env  map[string]string
+		args []string
+		want string
+	}{
+		{"unknown YAML field", "enact.yaml", "database:\n  file: x.db\n", nil, nil, "parsing config file"},
+		{"unknown TOML field", "enact.toml", "[database]\nfile = \"x.db\"\n", nil, nil, "parsing config file"},
+		{"extension", "enact.json", "{}", nil, nil, "unsupported config file extension"},
+		{"env nonce size", "", "", map[string]string{"ENACT_VERAISON_NONCE_SIZE": "sixteen"}, nil, "ENACT_VERAISON_NONCE_SIZE"},
+		{"unknown flag", "", "", nil, []string{"-nope"}, "not defined"},
+		{"missing EAR key file", "", "", nil, []string{"-ear-public-key-file", "/nonexistent/key.jwk"}, "reading EAR public key"},
+		{"invalid value", "", "", map[string]string{"ENACT_SESSION_STORE": "redis"}, nil, "sessions.store"},
+		{"production without operator token", "", "", map[string]string{"ENACT_ENV": "production"}, nil, "server.operator_token"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			args := c.args
+			if c.file != "" {
+				args = append([]string{"-config", writeFile(t, c.file, c.body)}, args...)
+			}
+			for k, v := range c.env {
+				t.Setenv(k, v)
+			}
+
+			_, err := Load(args)
+			if err == nil || !strings.Contains(err.Error(), c.want) {
+				t.Errorf("got %v, want %q", err, c.want)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	cases := []struct {
+		name   string
+		modify func(cfg *Config)
+		want   string
+	}{
+		{"default", func(cfg *Config) {}, ""},
+		{"env", func(cfg *Config) { cfg.Env = "test" }, "env"},
+		{"listen address", func(cfg *Config) { cfg.Server.ListenAddr = "" }, "server.listen_addr"},
+		{"operator token in production", func(cfg *Config) { cfg.Env = EnvProduction }, "server.operator_token"},
+		{"operator token in staging", func(cfg *Config) {
+			cfg.Env = EnvStaging
+			cfg.Server.OperatorToken = "s3cret"
+		}, ""},
+		{"database path", func(cfg *Config) { cfg.Database.Path = "" }, "database.path"},
+		{"session URI scheme", func(cfg *Config) { cfg.Veraison.NewSessionURI = "ftp://localhost/newSession" }, "veraison.new_session_uri"},
+		{"submit URI host", func(cfg *Config) { cfg.Veraison.SubmitURI = "http:///submit" }, "veraison.submit_uri"},
+		{"nonce too small", func(cfg *Config) { cfg.Veraison.NonceSize = 7 }, "veraison.nonce_size"},
+		{"nonce too large", func(cfg *Config) { cfg.Veraison.NonceSize = 65 }, "veraison.nonce_size"},
+		{"EAR key", func(cfg *Config) { cfg.Veraison.EARPublicKey = " \n" }, "veraison.ear_public_key"},
+		{"session store", func(cfg *Config) { cfg.Sessions.Store = "redis" }, "sessions.store"},
+		{"session TTL", func(cfg *Config) { cfg.Sessions.TTL = "5" }, "sessions.ttl"},
+		{"negative session TTL", func(cfg *Config) { cfg.Sessions.TTL = "-1m" }, "sessions.ttl"},
+		{"challenge mode", func(cfg *Config) { cfg.Challenge.Mode = "sealed" }, "challenge.mode"},
+		{"verifier", func(cfg *Config) { cfg.Verifier.Mode = "remote" }, "verifier.mode"},
+		{"CRLs without CAs", func(cfg *Config) { cfg.EK.CRLs = []string{"a.crl"} }, "ek.crls"},
+		{"local verifier without Veraison", func(cfg *Config) {
+			cfg.Verifier.Mode = VerifierLocal
+			cfg.Veraison.NewSessionURI = ""
+			cfg.Veraison.SubmitURI = ""
+			cfg.Veraison.EARPublicKey = ""
+		}, ""},
+		{"local verifier nonce size", func(cfg *Config) {
+			cfg.Verifier.Mode = VerifierLocal
+			cfg.Veraison.NonceSize = 4
+		}, "veraison.nonce_size"},
+	}
+
+	for _, c := range cases {
+		cfg := Default()
+		c.modify(cfg)
+
+		err := cfg.Validate()
+		if c.want == "" {
+			if err != nil {
+				t.Errorf("%s: %v", c.name, err)
+			}
+		} else if err == nil || !strings.HasPrefix(err.Error(), c.want+":") {
+			t.Errorf("%s: got %v, want %s error", c.name, err, c.want)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+// Copyright 2023 EnactTrust LTD All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+
+package main
+
+import (
+	"log"
+
+	"github.com/gin-gonic/gin"
+	"github.com/veraison/enact-demo/pkg/node"
+)
+
+// TPM firmware policies, which fail the appraisal of nodes running a
+// firmware older than allowed or known vulnerable, and the alerts they raise
+func setupFirmwareRoutes(r *gin.Engine, nodeService *node.NodeService, operator gin.HandlerFunc) {
+	r.GET("/firmware/policies", func(c *gin.Context) {
+		policies, err := nodeService.ListFirmwarePolicies()
+		if err != nil {
+			log.Println(err.Error())
+			c.JSON(500, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+
+		c.JSON(200, gin.H{
+			"policies": policies,
+		})
+	})
+
+	// POST /firmware/policies, Body: {"manufacturer": "IFX", "kind": "minimum"|"vulnerable",
+	//     "version": "7.85", "reason": "..."}
+	r.POST("/firmware/policies", operator, func(c *gin.Context) {
+		var body node.FirmwarePolicy
+		if err := c.ShouldBindJSON(&body); err != nil {
+			c.JSON(400, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+
+		policy, err := nodeService.AddFirmwarePolicy(body)
+		if err != nil {
+			log.Println(err.Error())
+			c.JSON(errorStatus(err), gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+
+		c.JSON(201, policy)
+	})
+
+	r.DELETE("/firmware/policies/:id", operator, func(c *gin.Context) {
+		id, err := parseID(c)
+		if err != nil {
+			c.JSON(400, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+
+		err = nodeService.DeleteFirmwarePolicy(id)
+		if err != nil {
+			log.Println(err.Error())
+			c.JSON(errorStatus(err), gin.H{
+				"error": err.Error(),
+			})
+		} else {
+			c.Status(204)
+		}
+	})
+
+	// GET /alerts?node_id=&limit=&offset=, newest first
+	r.GET("/alerts", func(c *gin.Context) {
+		limit, offset, err := parsePage(c)
+		if err != nil {
+			c.JSON(400, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+
+		alerts, total, err := nodeService.ListAlerts(c.Query("node_id"), limit, offset)
+		if err != nil {
+			log.Println(err.Error())
+			c.JSON(errorStatus(err), gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+
+		c.JSON(200, gin.H{
+			"alerts": alerts,
+			"total":  total,
+			"limit":  limit,
+			"offset": offset,
+		})
+	})
+
+	r.POST("/alerts/:id/ack", operator, func(c *gin.Context) {
+		id, err := parseID(c)
+		if err != nil {
+			c.JSON(400, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+
+		err = nodeService.AcknowledgeAlert(id)
+		if err != nil {
+			log.Println(err.Error())
+			c.JSON(errorStatus(err), gin.H{
+				"error": err.Error(),
+			})
+		} else {
+			c.Status(204)
+		}
+	})
+}
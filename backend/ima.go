@@ -0,0 +1,86 @@
+// Copyright 2023 EnactTrust LTD All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+
+package main
+
+import (
+	"log"
+
+	"github.com/gin-gonic/gin"
+	"github.com/veraison/enact-demo/pkg/node"
+)
+
+// IMA allow-list: the known-good files the IMA measurement lists sent along
+// evidence are checked against
+func setupIMARoutes(r *gin.Engine, nodeService *node.NodeService, operator gin.HandlerFunc) {
+	r.GET("/ima/allowlist", func(c *gin.Context) {
+		entries, err := nodeService.ListIMAAllowlist()
+		if err != nil {
+			log.Println(err.Error())
+			c.JSON(500, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+
+		c.JSON(200, gin.H{
+			"entries": entries,
+		})
+	})
+
+	// POST /ima/allowlist, Body: {"entries": [{"path": "/usr/bin/bash", "digest": "sha256:..."}]}
+	r.POST("/ima/allowlist", operator, func(c *gin.Context) {
+		var body struct {
+			Entries []node.IMAAllowlistEntry `json:"entries" binding:"required,dive"`
+		}
+		if err := c.ShouldBindJSON(&body); err != nil {
+			c.JSON(400, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+
+		added, err := nodeService.AddIMAAllowlistEntries(body.Entries)
+		if err != nil {
+			log.Println(err.Error())
+			c.JSON(errorStatus(err), gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+
+		c.JSON(200, gin.H{
+			"added": added,
+		})
+	})
+
+	r.DELETE("/ima/allowlist/:id", operator, func(c *gin.Context) {
+		id, err := parseID(c)
+		if err != nil {
+			c.JSON(400, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+
+		err = nodeService.DeleteIMAAllowlistEntry(id)
+		if err != nil {
+			log.Println(err.Error())
+			c.JSON(errorStatus(err), gin.H{
+				"error": err.Error(),
+			})
+		} else {
+			c.Status(204)
+		}
+	})
+}
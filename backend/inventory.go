@@ -0,0 +1,283 @@
+// Copyright 2023 EnactTrust LTD All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/veraison/enact-demo/pkg/node"
+)
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 500
+)
+
+// Read endpoints used by operators and the EnactTrust FrontEnd
+func setupInventoryRoutes(r *gin.Engine, nodeService *node.NodeService, operator gin.HandlerFunc) {
+	// GET /nodes?limit=&offset=&sort=created_at|state|label&order=asc|desc
+	//     &created_after=&created_before=&state=&label=&in_good_state=
+	//     &firmware_version=
+	r.GET("/nodes", func(c *gin.Context) {
+		query, err := parseListNodesQuery(c)
+		if err != nil {
+			c.JSON(400, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+
+		nodes, total, err := nodeService.ListNodes(query)
+		if err != nil {
+			log.Println(err.Error())
+			c.JSON(500, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+
+		c.JSON(200, gin.H{
+			"nodes":  nodes,
+			"total":  total,
+			"limit":  query.Limit,
+			"offset": query.Offset,
+		})
+	})
+
+	r.GET("/nodes/:id", func(c *gin.Context) {
+		n, err := nodeService.GetNode(c.Param("id"))
+		if errors.Is(err, node.ErrNotFound) {
+			c.JSON(404, gin.H{
+				"error": err.Error(),
+			})
+		} else if err != nil {
+			log.Println(err.Error())
+			c.JSON(500, gin.H{
+				"error": err.Error(),
+			})
+		} else {
+			c.JSON(200, n)
+		}
+	})
+
+	// GET /nodes/:id/attestations?limit=&offset=, newest first
+	r.GET("/nodes/:id/attestations", func(c *gin.Context) {
+		limit, offset, err := parsePage(c)
+		if err != nil {
+			c.JSON(400, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+
+		attestations, total, err := nodeService.ListAttestations(c.Param("id"), limit, offset)
+		if err != nil {
+			log.Println(err.Error())
+			c.JSON(errorStatus(err), gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+
+		c.JSON(200, gin.H{
+			"attestations": attestations,
+			"total":        total,
+			"limit":        limit,
+			"offset":       offset,
+		})
+	})
+
+	r.GET("/nodes/:id/golden", func(c *gin.Context) {
+		golden, err := nodeService.ListGoldenValues(c.Param("id"))
+		if err != nil {
+			log.Println(err.Error())
+			c.JSON(errorStatus(err), gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+
+		c.JSON(200, gin.H{
+			"golden_values": golden,
+		})
+	})
+
+	// GET /nodes/:id/drift?limit=&offset=, newest first
+	r.GET("/nodes/:id/drift", func(c *gin.Context) {
+		limit, offset, err := parsePage(c)
+		if err != nil {
+			c.JSON(400, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+
+		events, total, err := nodeService.ListDriftEvents(c.Param("id"), limit, offset)
+		if err != nil {
+			log.Println(err.Error())
+			c.JSON(errorStatus(err), gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+
+		c.JSON(200, gin.H{
+			"drift_events": events,
+			"total":        total,
+			"limit":        limit,
+			"offset":       offset,
+		})
+	})
+
+	// PUT /nodes/:id/label, Body: {"label": "..."}
+	r.PUT("/nodes/:id/label", operator, func(c *gin.Context) {
+		var body struct {
+			Label string `json:"label"`
+		}
+		if err := c.ShouldBindJSON(&body); err != nil {
+			c.JSON(400, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+
+		err := nodeService.SetLabel(c.Param("id"), body.Label)
+		if errors.Is(err, node.ErrNotFound) {
+			c.JSON(404, gin.H{
+				"error": err.Error(),
+			})
+		} else if err != nil {
+			log.Println(err.Error())
+			c.JSON(500, gin.H{
+				"error": err.Error(),
+			})
+		} else {
+			c.Status(204)
+		}
+	})
+
+	r.POST("/nodes/:id/revoke", operator, func(c *gin.Context) {
+		err := nodeService.Revoke(c.Param("id"))
+		if err != nil {
+			log.Println(err.Error())
+			c.JSON(errorStatus(err), gin.H{
+				"error": err.Error(),
+			})
+		} else {
+			c.Status(204)
+		}
+	})
+}
+
+func parseListNodesQuery(c *gin.Context) (node.ListNodesQuery, error) {
+	query := node.ListNodesQuery{
+		SortBy: c.DefaultQuery("sort", node.SortByCreatedAt),
+		State:  node.State(c.Query("state")),
+		Label:  c.Query("label"),
+
+		FirmwareVersion: c.Query("firmware_version"),
+	}
+
+	var err error
+
+	query.Limit, query.Offset, err = parsePage(c)
+	if err != nil {
+		return query, err
+	}
+
+	switch c.DefaultQuery("order", "asc") {
+	case "asc":
+	case "desc":
+		query.Descending = true
+	default:
+		return query, errors.New(`order must be "asc" or "desc"`)
+	}
+
+	switch query.SortBy {
+	case node.SortByCreatedAt, node.SortByState, node.SortByLabel:
+	default:
+		return query, fmt.Errorf("cannot sort by %q", query.SortBy)
+	}
+
+	if query.State != "" && !query.State.Valid() {
+		return query, fmt.Errorf("unknown state %q", query.State)
+	}
+
+	if v := c.Query("created_after"); v != "" {
+		query.CreatedAfter, err = parseQueryDate(v)
+		if err != nil {
+			return query, fmt.Errorf("created_after: %v", err)
+		}
+	}
+
+	if v := c.Query("created_before"); v != "" {
+		query.CreatedBefore, err = parseQueryDate(v)
+		if err != nil {
+			return query, fmt.Errorf("created_before: %v", err)
+		}
+	}
+
+	if v := c.Query("in_good_state"); v != "" {
+		inGoodState, err := strconv.ParseBool(v)
+		if err != nil {
+			return query, fmt.Errorf("in_good_state: %v", err)
+		}
+		query.InGoodState = &inGoodState
+	}
+
+	return query, nil
+}
+
+// parsePage reads the limit and offset pagination parameters
+func parsePage(c *gin.Context) (int, int, error) {
+	limit := defaultPageSize
+	offset := 0
+
+	var err error
+
+	if v := c.Query("limit"); v != "" {
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxPageSize {
+			return 0, 0, fmt.Errorf("limit must be between 1 and %d", maxPageSize)
+		}
+	}
+
+	if v := c.Query("offset"); v != "" {
+		offset, err = strconv.Atoi(v)
+		if err != nil || offset < 0 {
+			return 0, 0, errors.New("offset must be a non-negative integer")
+		}
+	}
+
+	return limit, offset, nil
+}
+
+// parseQueryDate accepts RFC 3339 timestamps and plain dates, and converts
+// them to the UTC layout nodes.created_at is stored in
+func parseQueryDate(v string) (string, error) {
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		t, err = time.Parse("2006-01-02", v)
+		if err != nil {
+			return "", errors.New("expected an RFC 3339 timestamp or a YYYY-MM-DD date")
+		}
+	}
+
+	return t.UTC().Format("2006-01-02 15:04:05"), nil
+}
@@ -15,100 +15,260 @@ package main
 
 import (
 	"bytes"
+	"errors"
 	"io"
 	"log"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"strings"
 
 	"github.com/gin-gonic/gin"
-	"github.com/veraison/apiclient/verification"
+	"github.com/google/uuid"
+	"github.com/veraison/enact-demo/config"
 	"github.com/veraison/enact-demo/pkg/db"
+	"github.com/veraison/enact-demo/pkg/ekcert"
 	"github.com/veraison/enact-demo/pkg/node"
+	"github.com/veraison/enact-demo/pkg/session"
 	"github.com/veraison/enact-demo/pkg/veraison"
+	"github.com/veraison/enact-demo/pkg/wire"
 )
 
 var (
-	EntryPoint           = "http://localhost:8080/challenge-response/v1/newSession"
-	VeraisonSessionTable = map[string]string{}
 	FakeNodeID           = "7dd5db06-d2f5-4e0d-8a9c-9baaa5a446ef"
 	FakeGolden           = []byte{0x00, 0x01, 0x02, 0x03}
 	TPMEvidenceMediaType = "application/vnd.enacttrust.tpm-evidence"
 )
 
-var globalCfg *verification.ChallengeResponseConfig
-
-func setupServices() *node.NodeService {
+func setupServices(cfg *config.Config) (*node.NodeService, error) {
 	// DB setup
-	db, err := db.InitDatabaseConnection()
+	db, err := db.InitDatabaseConnection(cfg.Database.Path)
 	if err != nil {
 		log.Println(err.Error())
+		return nil, err
 	}
 
 	// Init repos
 	nodeRepo := node.NewNodeRepo(db)
+	attestationRepo := node.NewAttestationRepo(db)
+	goldenRepo := node.NewGoldenValueRepo(db)
+	driftRepo := node.NewDriftRepo(db)
+	baselineRepo := node.NewBaselineRepo(db)
+	policyRepo := node.NewPCRPolicyRepo(db)
+	allowlistRepo := node.NewIMAAllowlistRepo(db)
+	firmwareRepo := node.NewFirmwarePolicyRepo(db)
+	alertRepo := node.NewAlertRepo(db)
+
+	var sessionStore session.SessionStore
+	switch cfg.Sessions.Store {
+	case config.SessionStoreMemory:
+		sessionStore = session.NewMemoryStore()
+	default:
+		sessionStore = session.NewSQLiteStore(db)
+	}
+
+	var verifier node.Verifier
+	switch cfg.Verifier.Mode {
+	case config.VerifierLocal:
+		verifier = node.NewLocalVerifier(goldenRepo, cfg.Veraison.NonceSize)
+	default:
+		// Init clients for external services
+		veraisonClient, err := veraison.NewClient(cfg.Veraison)
+		if err != nil {
+			return nil, err
+		}
+		verifier = node.NewVeraisonVerifier(veraisonClient)
+	}
+
+	// Without a CA bundle, EK certificates are neither required nor validated
+	var ekVerifier *ekcert.Verifier
+	if cfg.EK.CABundle != "" {
+		ekVerifier, err = ekcert.NewVerifier(cfg.EK.CABundle, cfg.EK.CRLs)
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	// Init services (domains) and pass repos to them
-	nodeService := node.NewService(nodeRepo)
+	nodeService := node.NewService(cfg, node.Deps{
+		Nodes:        nodeRepo,
+		Attestations: attestationRepo,
+		Golden:       goldenRepo,
+		Drift:        driftRepo,
+		Baseline:     baselineRepo,
+		Policies:     policyRepo,
+		Allowlist:    allowlistRepo,
+		Firmware:     firmwareRepo,
+		Alerts:       alertRepo,
+		Sessions:     sessionStore,
+		Verifier:     verifier,
+		EKVerifier:   ekVerifier,
+	})
+
+	return nodeService, nil
+}
 
-	return nodeService
+// errorStatus maps the errors of the node service to HTTP status codes
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, node.ErrNotFound):
+		return 404
+	case errors.Is(err, node.ErrNoAKName),
+		errors.Is(err, node.ErrInvalidTransition),
+		errors.Is(err, node.ErrStateConflict),
+		errors.Is(err, node.ErrNodeRevoked),
+		errors.Is(err, node.ErrReplayedNonce),
+		errors.Is(err, node.ErrUpdateWindowClosed),
+		errors.Is(err, node.ErrCandidateDecided),
+		errors.Is(err, node.ErrClockAnomaly),
+		errors.Is(err, session.ErrNotFound):
+		return 409
+	case errors.Is(err, node.ErrNonceMismatch),
+		errors.Is(err, node.ErrInvalidUpdateWindow),
+		errors.Is(err, node.ErrEmptyPCRSelection),
+		errors.Is(err, node.ErrPCRSelectionPolicy),
+		errors.Is(err, node.ErrInvalidPCRSelection),
+		errors.Is(err, node.ErrPCRValuesMismatch),
+		errors.Is(err, node.ErrInvalidEventLog),
+		errors.Is(err, node.ErrEventLogMismatch),
+		errors.Is(err, node.ErrInvalidIMALog),
+		errors.Is(err, node.ErrIMALogMismatch),
+		errors.Is(err, node.ErrInvalidAllowlistEntry),
+		errors.Is(err, node.ErrUnsupportedSignature),
+		errors.Is(err, node.ErrUnsupportedAK),
+		errors.Is(err, node.ErrMalformedQuote),
+		errors.Is(err, node.ErrAKNameMismatch),
+		errors.Is(err, node.ErrInvalidFirmwarePolicy),
+		errors.Is(err, wire.ErrTruncated),
+		errors.Is(err, wire.ErrTrailingData),
+		errors.Is(err, wire.ErrInvalidField),
+		errors.Is(err, wire.ErrUnsupportedSignature),
+		errors.Is(err, wire.ErrUnsupportedVersion),
+		errors.Is(err, wire.ErrVersionMismatch):
+		return 400
+	case errors.Is(err, node.ErrFirmwarePolicy),
+		errors.Is(err, node.ErrBadSignature):
+		return 403
+	case errors.Is(err, node.ErrStaleNonce):
+		return 410
+	default:
+		return 500
+	}
 }
 
-func setupRoutes(nodeService *node.NodeService) *gin.Engine {
+// readFormFile returns the content of the named multipart file
+func readFormFile(c *gin.Context, name string) ([]byte, error) {
+	header, err := c.FormFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return readFileHeader(header)
+}
+
+// readOptionalFormFile returns the content of the named multipart file, nil
+// if the request has none
+func readOptionalFormFile(c *gin.Context, name string) ([]byte, error) {
+	header, err := c.FormFile(name)
+	if errors.Is(err, http.ErrMissingFile) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return readFileHeader(header)
+}
+
+func readFileHeader(header *multipart.FileHeader) ([]byte, error) {
+	file, err := header.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return io.ReadAll(file)
+}
+
+// setupRoutes registers the node routes, and the operator ones behind the
+// operator token
+func setupRoutes(nodeService *node.NodeService, operatorToken string) *gin.Engine {
 	// Init with the Logger and Recovery middleware already attached
 	r := gin.Default()
 
 	r.POST("/node/pem", func(c *gin.Context) {
-		// Read POST submitted files - this gets their file headers
-		ak_pub, err := c.FormFile("ak_pub")
+		// The AK is sent as its TPMT_PUBLIC, its public key, or both
+		ak_pub, err := readOptionalFormFile(c, "ak_pub")
 		if err != nil {
 			log.Println(err.Error())
 			c.JSON(400, gin.H{
 				"error": err.Error(),
 			})
+			return
 		}
 
-		ek_pub, err := c.FormFile("ek_pub")
+		ak_public, err := readOptionalFormFile(c, "ak_public")
 		if err != nil {
 			log.Println(err.Error())
 			c.JSON(400, gin.H{
 				"error": err.Error(),
 			})
+			return
 		}
 
-		ak_name := c.PostForm("ak_name")
-		_ = ak_name
-
-		// Allocate buffers, so we can read the files
-		ak_pub_buf := bytes.NewBuffer(nil)
-		ek_pub_buf := bytes.NewBuffer(nil)
+		if ak_pub == nil && ak_public == nil {
+			c.JSON(400, gin.H{
+				"error": "ak_pub or ak_public required",
+			})
+			return
+		}
 
-		// Get multipart.File from FileHeader
-		ak_file, err := ak_pub.Open()
+		// The EK is sent as its certificate, its public key, or both
+		ek_pub, err := readOptionalFormFile(c, "ek_pub")
 		if err != nil {
 			log.Println(err.Error())
 			c.JSON(400, gin.H{
 				"error": err.Error(),
 			})
+			return
 		}
-		ek_file, err := ek_pub.Open()
+
+		ek_cert, err := readOptionalFormFile(c, "ek_cert")
 		if err != nil {
 			log.Println(err.Error())
 			c.JSON(400, gin.H{
 				"error": err.Error(),
 			})
+			return
 		}
 
-		// Read the file into a buffer
-		_, err = io.Copy(ak_pub_buf, ak_file)
-		if err != nil {
-			log.Println(err.Error())
-		}
-		_, err = io.Copy(ek_pub_buf, ek_file)
-		if err != nil {
-			log.Println(err.Error())
+		if ek_pub == nil && ek_cert == nil {
+			c.JSON(400, gin.H{
+				"error": "ek_pub or ek_cert required",
+			})
+			return
 		}
-		// Store ak_name and ek_pub, so we can use them in /node/secret
+
+		ak_name := c.PostForm("ak_name")
+		ak_parent_qn := c.PostForm("ak_parent_qn")
+		label := c.PostForm("label")
+
+		// Store ak_name and the EK, so we can use them in /node/secret
 		// Handle first step of node onboarding
-		nodeID, err := nodeService.HandleReceivePEM(ak_pub_buf.String(), ek_pub_buf.String())
-		if err != nil {
+		nodeID, err := nodeService.HandleReceivePEM(string(ak_pub), ak_public, string(ek_pub), string(ek_cert), ak_name, ak_parent_qn, label)
+		if errors.Is(err, node.ErrInvalidAKName) || errors.Is(err, node.ErrNoAKName) ||
+			errors.Is(err, node.ErrInvalidAKPub) || errors.Is(err, node.ErrUnsupportedAK) ||
+			errors.Is(err, node.ErrNoEKCertificate) || errors.Is(err, node.ErrInvalidEKCertificate) ||
+			errors.Is(err, node.ErrInvalidAKPublic) || errors.Is(err, node.ErrNotAttestationKey) ||
+			errors.Is(err, node.ErrAKNameMismatch) || errors.Is(err, node.ErrInvalidParentQN) {
+			c.JSON(400, gin.H{
+				"error": err.Error(),
+			})
+		} else if errors.Is(err, node.ErrUntrustedEK) {
+			c.JSON(403, gin.H{
+				"error": err.Error(),
+			})
+		} else if err != nil {
 			log.Println(err.Error())
 			c.JSON(500, gin.H{
 				"error": err.Error(),
@@ -120,37 +280,38 @@ func setupRoutes(nodeService *node.NodeService) *gin.Engine {
 	})
 
 	r.POST("/node/secret", func(c *gin.Context) {
-		nodeID := c.PostForm("node_id")
+		nodeID, err := uuid.Parse(strings.TrimSpace(c.PostForm("node_id")))
+		if err != nil {
+			log.Println(err.Error())
+			c.JSON(400, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
 
 		// 1. call Veraison frontend
-		// 2. store the session_id (regenerated on every call to /session) to make calls later
-		cfg, sessionCtx, sessionURI, err := veraison.CreateVeraisonSession()
-
-		globalCfg = cfg
+		// 2. store the session (regenerated on every call to /session) and associate it
+		// with node_id, so we can use it later to call Veraison
+		// 3. encrypt the nonce to the node's EK and AK name, unless in plain mode
+		challenge, err := nodeService.NewChallenge(nodeID)
 
 		if err != nil {
 			log.Println(err.Error())
 			// 500 = Session or challenge creation failed
-			c.JSON(500, gin.H{
+			c.JSON(errorStatus(err), gin.H{
 				"error": err.Error(),
 			})
 		} else {
-			log.Println("nonce:", sessionCtx.Nonce)
-			log.Println(`sessionURI: `, sessionURI)
-
-			// store session_id and associate it with node_id, so we can use it later to call Veraison
-			VeraisonSessionTable[nodeID] = sessionURI
-
 			// Option 1 -> binary [] written in the HTTP response body stream without a content type, but with correct response code
 			//  RFC2046 says "The "octet-stream" subtype is used to indicate that a body contains arbitrary binary data"
 			// 	and "The recommended action for an implementation that receives an "application/octet-stream" entity
 			// 	is to simply offer to put the data in a file
-			c.Data(201, "application/octet-stream", sessionCtx.Nonce)
+			c.Data(201, "application/octet-stream", challenge)
 
 			// Option 2 -> binary [] passed to the writer interface, with correct response code 201 Created
 			// c.Writer.WriteHeader(201)
 			// c.Header("Content-Type", "application/octet-stream")
-			// c.Writer.Write(sessionCtx.Nonce)
+			// c.Writer.Write(challenge)
 
 		}
 	})
@@ -158,91 +319,57 @@ func setupRoutes(nodeService *node.NodeService) *gin.Engine {
 	// Note: ./agent onboard -> sends PEM, then sends GOLDEN
 	// ./agent -> sends EVIDENCE
 	r.POST("/node/golden", func(c *gin.Context) {
-		node_id_blob, err := c.FormFile("node_id")
+		node_id, err := readFormFile(c, "node_id")
 		if err != nil {
 			log.Println(err.Error())
 			c.JSON(400, gin.H{
 				"error": err.Error(),
 			})
+			return
 		}
-		// Read POST submitted files - this gets their file headers
-		golden_blob, err := c.FormFile("golden_blob")
+		golden_blob, err := readFormFile(c, "golden_blob")
 		if err != nil {
 			log.Println(err.Error())
 			c.JSON(400, gin.H{
 				"error": err.Error(),
 			})
+			return
 		}
-		signature_blob, err := c.FormFile("signature_blob")
+		signature_blob, err := readFormFile(c, "signature_blob")
 		if err != nil {
 			log.Println(err.Error())
 			c.JSON(400, gin.H{
 				"error": err.Error(),
 			})
+			return
 		}
 
-		// Allocate buffers, so we can read the files
-		node_id_blob_buff := bytes.NewBuffer(nil)
-
-		// Get multipart.File from FileHeader
-		node_id_blob_file, err := node_id_blob.Open()
-		if err != nil {
-			log.Println(err.Error())
-		}
-
-		// Read the file into a buffer
-		_, err = io.Copy(node_id_blob_buff, node_id_blob_file)
-		if err != nil {
-			log.Println(err.Error())
-		}
-
-		// Allocate buffers, so we can read the files
-		golden_blob_buf := bytes.NewBuffer(nil)
-
-		// Get multipart.File from FileHeader
-		golden_blob_file, err := golden_blob.Open()
-		if err != nil {
-			log.Println(err.Error())
-		}
-
-		// Read the file into a buffer
-		_, err = io.Copy(golden_blob_buf, golden_blob_file)
-		if err != nil {
-			log.Println(err.Error())
-		}
-
-		// signature_blog
-		signature_blob_buf := bytes.NewBuffer(nil)
-		signature_blob_file, err := signature_blob.Open()
+		log.Println("golden_blob length: ", len(golden_blob))
+		log.Println("signature_blob length: ", len(signature_blob))
+		// Optional individual PCR values of the quote
+		pcr_values, err := readOptionalFormFile(c, "pcr_values")
 		if err != nil {
 			log.Println(err.Error())
 			c.JSON(400, gin.H{
 				"error": err.Error(),
 			})
+			return
 		}
-		_, err = io.Copy(signature_blob_buf, signature_blob_file)
-		if err != nil {
-			log.Println(err.Error())
-			c.JSON(400, gin.H{
-				"error": err.Error(),
-			})
-		}
-		log.Println("golden_blob_buff length: ", len(golden_blob_buf.Bytes()))
-		log.Println("signature_blob_buff length: ", len(signature_blob_buf.Bytes()))
-		// evidenceDigest, uuidNodeId, err := nodeService.HandleGoldenValue(nodeID, golden_blob_buf, signature_blob_buf)
-		bigEndianBuf, evidenceDigest, nonce, uuidNodeId, err := nodeService.ProcessEvidence(node_id_blob_buff.String(), golden_blob_buf, signature_blob_buf)
-		_ = nonce
+
+		attachments := node.EvidenceAttachments{PCRValues: pcr_values}
+
+		bigEndianBuf, evidenceDigest, _, uuidNodeId, err := nodeService.ProcessEvidence(string(node_id), bytes.NewBuffer(golden_blob), bytes.NewBuffer(signature_blob), attachments)
 
 		if err != nil {
 			log.Println(err.Error())
-			c.JSON(500, gin.H{
+			c.JSON(errorStatus(err), gin.H{
 				"error": err.Error(),
 			})
 		} else {
-			err = nodeService.RouteGoldenValueToVeraison(globalCfg, VeraisonSessionTable[node_id_blob_buff.String()], uuidNodeId, bigEndianBuf, evidenceDigest)
+			err = nodeService.RouteGoldenValueToVeraison(uuidNodeId, bigEndianBuf, evidenceDigest, attachments)
 			if err != nil {
 				log.Println(err.Error())
-				c.JSON(500, gin.H{
+				c.JSON(errorStatus(err), gin.H{
 					"error": err.Error(),
 				})
 			} else {
@@ -252,95 +379,77 @@ func setupRoutes(nodeService *node.NodeService) *gin.Engine {
 	})
 
 	r.POST("/node/evidence", func(c *gin.Context) {
-		// Read POST submitted files - this gets their file headers
-		// nodeID := c.PostForm("node_id")
-		node_id_blob, err := c.FormFile("node_id")
+		node_id, err := readFormFile(c, "node_id")
 		if err != nil {
 			log.Println(err.Error())
 			c.JSON(400, gin.H{
 				"error": err.Error(),
 			})
+			return
 		}
-
-		evidence_blob, err := c.FormFile("evidence_blob")
+		evidence_blob, err := readFormFile(c, "evidence_blob")
 		if err != nil {
 			log.Println(err.Error())
 			c.JSON(400, gin.H{
 				"error": err.Error(),
 			})
+			return
 		}
-		signature_blob, err := c.FormFile("signature_blob")
+		signature_blob, err := readFormFile(c, "signature_blob")
 		if err != nil {
 			log.Println(err.Error())
 			c.JSON(400, gin.H{
 				"error": err.Error(),
 			})
+			return
 		}
 
-		// Allocate buffers, so we can read the files
-		node_id_blob_buff := bytes.NewBuffer(nil)
-
-		// Get multipart.File from FileHeader
-		node_id_blob_file, err := node_id_blob.Open()
-		if err != nil {
-			log.Println(err.Error())
-		}
-
-		// Read the file into a buffer
-		_, err = io.Copy(node_id_blob_buff, node_id_blob_file)
-		if err != nil {
-			log.Println(err.Error())
-		}
-
-		// Allocate buffers, so we can read the files
-		evidence_blob_buf := bytes.NewBuffer(nil)
-
-		// Get multipart.File from FileHeader
-		evidence_blob_file, err := evidence_blob.Open()
-		if err != nil {
-			log.Println(err.Error())
-		}
-
-		// Read the file into a buffer
-		_, err = io.Copy(evidence_blob_buf, evidence_blob_file)
+		// Optional individual PCR values of the quote
+		pcr_values, err := readOptionalFormFile(c, "pcr_values")
 		if err != nil {
 			log.Println(err.Error())
+			c.JSON(400, gin.H{
+				"error": err.Error(),
+			})
+			return
 		}
 
-		signature_blob_buf := bytes.NewBuffer(nil)
-		signature_blob_file, err := signature_blob.Open()
+		// Optional binary TCG event log of the measured boot
+		event_log, err := readOptionalFormFile(c, "event_log")
 		if err != nil {
 			log.Println(err.Error())
 			c.JSON(400, gin.H{
 				"error": err.Error(),
 			})
+			return
 		}
-		_, err = io.Copy(signature_blob_buf, signature_blob_file)
+
+		// Optional IMA runtime measurement list, ascii or binary
+		ima_log, err := readOptionalFormFile(c, "ima_log")
 		if err != nil {
 			log.Println(err.Error())
 			c.JSON(400, gin.H{
 				"error": err.Error(),
 			})
+			return
 		}
 
-		// err = nodeService.HandleEvidence(nodeID, evidence_blob_buf, signature_blob_buf)
-		bigEndianBuf, evidenceDigest, nonce, uuidNodeId, err := nodeService.ProcessEvidence(node_id_blob_buff.String(), evidence_blob_buf, signature_blob_buf)
-		_ = nonce
+		attachments := node.EvidenceAttachments{PCRValues: pcr_values, EventLog: event_log, IMALog: ima_log}
+
+		bigEndianBuf, evidenceDigest, _, uuidNodeId, err := nodeService.ProcessEvidence(string(node_id), bytes.NewBuffer(evidence_blob), bytes.NewBuffer(signature_blob), attachments)
 
 		if err != nil {
 			log.Println(err.Error())
-			c.JSON(500, gin.H{
+			c.JSON(errorStatus(err), gin.H{
 				"error": err.Error(),
 			})
 		} else {
 			log.Println("nodeid:")
-			log.Println(node_id_blob_buff.String())
-			log.Println("veraisonSessiontable")
-			log.Println(VeraisonSessionTable)
-			err = nodeService.RouteEvidenceToVeraison(globalCfg, VeraisonSessionTable[node_id_blob_buff.String()], uuidNodeId, bigEndianBuf, evidenceDigest)
+			log.Println(string(node_id))
+			err = nodeService.RouteEvidenceToVeraison(uuidNodeId, bigEndianBuf, evidenceDigest, attachments)
 			if err != nil {
 				log.Println(err.Error())
-				c.JSON(500, gin.H{
+				c.JSON(errorStatus(err), gin.H{
 					"error": err.Error(),
 				})
 			} else {
@@ -349,13 +458,37 @@ func setupRoutes(nodeService *node.NodeService) *gin.Engine {
 		}
 	})
 
+	operator := requireOperator(operatorToken)
+
+	setupInventoryRoutes(r, nodeService, operator)
+	setupBaselineRoutes(r, nodeService, operator)
+	setupPolicyRoutes(r, nodeService, operator)
+	setupIMARoutes(r, nodeService, operator)
+	setupFirmwareRoutes(r, nodeService, operator)
+
 	return r
 }
 
 func main() {
-	nodeService := setupServices()
+	cfg, err := config.Load(os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if cfg.Env == config.EnvProduction {
+		gin.SetMode(gin.ReleaseMode)
+	}
+
+	nodeService, err := setupServices(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if cfg.Server.OperatorToken == "" {
+		log.Println("no operator token: the operator routes are open to anyone")
+	}
 
-	gin := setupRoutes(nodeService)
+	r := setupRoutes(nodeService, cfg.Server.OperatorToken)
 
-	gin.Run(":8000")
+	r.Run(cfg.Server.ListenAddr)
 }
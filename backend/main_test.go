@@ -0,0 +1,173 @@
+// Copyright 2023 EnactTrust LTD All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+
+package main
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// multipartBody returns a multipart form with the files, and its content type
+func multipartBody(t *testing.T, files map[string]string, fields map[string]string) (*bytes.Buffer, string) {
+	body := &bytes.Buffer{}
+	w := multipart.NewWriter(body)
+
+	for name, content := range files {
+		part, err := w.CreateFormFile(name, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		part.Write([]byte(content))
+	}
+	for name, value := range fields {
+		if err := w.WriteField(name, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return body, w.FormDataContentType()
+}
+
+// TestUploadBadMultipart checks that the evidence and golden value handlers
+// answer bad forms with 400 before processing them
+func TestUploadBadMultipart(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	// Requests never reach the node service
+	r := setupRoutes(nil, "")
+
+	for _, route := range []struct{ path, blob string }{
+		{"/node/golden", "golden_blob"},
+		{"/node/evidence", "evidence_blob"},
+	} {
+		complete := map[string]string{"node_id": FakeNodeID, route.blob: "blob", "signature_blob": "signature"}
+
+		truncated, truncatedType := multipartBody(t, complete, nil)
+		truncated.Truncate(truncated.Len() - 20)
+
+		unterminated := &bytes.Buffer{}
+		unterminated.WriteString("--b\r\nContent-Disposition: form-data; name=\"node_id\"; filename=\"node_id\"\r\n\r\n" + FakeNodeID)
+
+		missing, missingType := multipartBody(t, map[string]string{"node_id": FakeNodeID, route.blob: "blob"}, nil)
+		notFile, notFileType := multipartBody(t, map[string]string{route.blob: "blob", "signature_blob": "signature"}, map[string]string{"node_id": FakeNodeID})
+
+		cases := []struct {
+			name        string
+			body        *bytes.Buffer
+			contentType string
+		}{
+			{"truncated", truncated, truncatedType},
+			{"unterminated part", unterminated, "multipart/form-data; boundary=b"},
+			{"missing signature", missing, missingType},
+			{"node ID not a file", notFile, notFileType},
+			{"not multipart", bytes.NewBufferString(FakeNodeID), "text/plain"},
+		}
+
+		for _, c := range cases {
+			req := httptest.NewRequest(http.MethodPost, route.path, c.body)
+			req.Header.Set("Content-Type", c.contentType)
+			rec := httptest.NewRecorder()
+
+			r.ServeHTTP(rec, req)
+
+			if rec.Code != http.StatusBadRequest {
+				t.Errorf("%s %s: status %d: %s", route.path, c.name, rec.Code, rec.Body.String())
+			}
+		}
+	}
+}
+
+// TestOperatorRoutes checks that the operator routes refuse requests without
+// the operator token before processing them
+func TestOperatorRoutes(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	routes := []struct{ method, path string }{
+		{http.MethodPut, "/nodes/" + FakeNodeID + "/label"},
+		{http.MethodPost, "/nodes/" + FakeNodeID + "/revoke"},
+		{http.MethodPost, "/update-windows"},
+		{http.MethodPost, "/update-windows/1/close"},
+		{http.MethodPost, "/candidates/1/approve"},
+		{http.MethodPost, "/candidates/1/reject"},
+		{http.MethodPut, "/nodes/" + FakeNodeID + "/pcr-policy"},
+		{http.MethodDelete, "/nodes/" + FakeNodeID + "/pcr-policy"},
+		{http.MethodPut, "/labels/edge/pcr-policy"},
+		{http.MethodDelete, "/labels/edge/pcr-policy"},
+		{http.MethodPost, "/ima/allowlist"},
+		{http.MethodDelete, "/ima/allowlist/1"},
+		{http.MethodPost, "/firmware/policies"},
+		{http.MethodDelete, "/firmware/policies/1"},
+		{http.MethodPost, "/alerts/1/ack"},
+	}
+
+	// Requests never reach the node service
+	r := setupRoutes(nil, "s3cret")
+
+	for _, route := range routes {
+		for _, auth := range []string{"", "Bearer", "Bearer wrong", "s3cret", "Basic s3cret"} {
+			req := httptest.NewRequest(route.method, route.path, nil)
+			if auth != "" {
+				req.Header.Set("Authorization", auth)
+			}
+			rec := httptest.NewRecorder()
+
+			r.ServeHTTP(rec, req)
+
+			if rec.Code != http.StatusUnauthorized || rec.Header().Get("WWW-Authenticate") == "" {
+				t.Errorf("%s %s with %q: status %d", route.method, route.path, auth, rec.Code)
+			}
+		}
+	}
+
+	// With the token, or without one configured, requests reach the handlers,
+	// which refuse the bad IDs and bodies
+	cases := []struct {
+		name  string
+		token string
+		auth  string
+	}{
+		{"token", "s3cret", "Bearer s3cret"},
+		{"no token configured", "", ""},
+	}
+
+	for _, c := range cases {
+		r := setupRoutes(nil, c.token)
+
+		for _, route := range []struct{ method, path string }{
+			{http.MethodPost, "/candidates/first/approve"},
+			{http.MethodPost, "/update-windows"},
+			{http.MethodPut, "/labels/edge/pcr-policy"},
+		} {
+			req := httptest.NewRequest(route.method, route.path, nil)
+			if c.auth != "" {
+				req.Header.Set("Authorization", c.auth)
+			}
+			rec := httptest.NewRecorder()
+
+			r.ServeHTTP(rec, req)
+
+			if rec.Code != http.StatusBadRequest {
+				t.Errorf("%s: %s %s: status %d: %s", c.name, route.method, route.path, rec.Code, rec.Body.String())
+			}
+		}
+	}
+}
@@ -0,0 +1,43 @@
+// Copyright 2023 EnactTrust LTD All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+
+package main
+
+import (
+	"crypto/subtle"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// requireOperator returns the middleware of the operator routes, which
+// change what nodes are trusted with: it answers 401 to requests without
+// "Authorization: Bearer <token>". An empty token, only allowed in dev,
+// leaves the routes open.
+func requireOperator(token string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if token == "" {
+			return
+		}
+
+		auth := c.GetHeader("Authorization")
+		bearer := strings.TrimPrefix(auth, "Bearer ")
+		if bearer == auth || subtle.ConstantTimeCompare([]byte(bearer), []byte(token)) != 1 {
+			c.Header("WWW-Authenticate", `Bearer realm="operator"`)
+			c.AbortWithStatusJSON(401, gin.H{
+				"error": "operator token required",
+			})
+			return
+		}
+	}
+}
@@ -13,7 +13,11 @@
 
 package db
 
-import "github.com/jmoiron/sqlx"
+import (
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
 
 const create_schema string = `
 	CREATE TABLE IF NOT EXISTS nodes (
@@ -22,16 +26,205 @@ const create_schema string = `
 		ek_pub STRING,
 		created_at STRING,
 		in_good_state INTEGER
-	);`
+	);
+
+	CREATE TABLE IF NOT EXISTS veraison_sessions (
+		node_id TEXT NOT NULL PRIMARY KEY,
+		session_uri TEXT NOT NULL,
+		nonce BLOB NOT NULL,
+		new_session_uri TEXT NOT NULL,
+		nonce_size INTEGER NOT NULL,
+		delete_session INTEGER NOT NULL,
+		created_at TIMESTAMP NOT NULL,
+		expires_at TIMESTAMP NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS attestations (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		node_id TEXT NOT NULL,
+		created_at TEXT NOT NULL,
+		session_uri TEXT,
+		nonce BLOB,
+		pcr_digest BLOB,
+		status TEXT NOT NULL,
+		trust_vector TEXT,
+		raw_ear TEXT
+	);
+
+	CREATE INDEX IF NOT EXISTS attestations_node_id ON attestations (node_id);
+
+	CREATE TABLE IF NOT EXISTS consumed_nonces (
+		nonce BLOB NOT NULL PRIMARY KEY,
+		node_id TEXT NOT NULL,
+		consumed_at TIMESTAMP NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS golden_values (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		node_id TEXT NOT NULL,
+		pcr_digest BLOB NOT NULL,
+		created_at TEXT NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS golden_values_node_id ON golden_values (node_id);
+
+	CREATE TABLE IF NOT EXISTS drift_events (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		node_id TEXT NOT NULL,
+		attestation_id INTEGER,
+		created_at TEXT NOT NULL,
+		expected_digest BLOB,
+		expected_pcr_selection TEXT NOT NULL,
+		observed_digest BLOB NOT NULL,
+		observed_pcr_selection TEXT NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS drift_events_node_id ON drift_events (node_id);
+
+	CREATE TABLE IF NOT EXISTS update_windows (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		node_id TEXT NOT NULL DEFAULT '',
+		label TEXT NOT NULL DEFAULT '',
+		created_at TEXT NOT NULL,
+		expires_at TIMESTAMP NOT NULL,
+		closed_at TEXT
+	);
+
+	CREATE TABLE IF NOT EXISTS golden_candidates (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		window_id INTEGER NOT NULL,
+		node_id TEXT NOT NULL,
+		attestation_id INTEGER,
+		pcr_digest BLOB NOT NULL,
+		pcr_selection TEXT NOT NULL,
+		status TEXT NOT NULL,
+		created_at TEXT NOT NULL,
+		decided_at TEXT,
+		UNIQUE (window_id, node_id)
+	);
+
+	CREATE INDEX IF NOT EXISTS golden_candidates_node_id ON golden_candidates (node_id);
+
+	CREATE TABLE IF NOT EXISTS pcr_policies (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		node_id TEXT NOT NULL DEFAULT '',
+		label TEXT NOT NULL DEFAULT '',
+		pcr_selection TEXT NOT NULL,
+		created_at TEXT NOT NULL,
+		UNIQUE (node_id, label)
+	);
+
+	CREATE TABLE IF NOT EXISTS ima_allowlist (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		path TEXT NOT NULL,
+		digest TEXT NOT NULL,
+		created_at TEXT NOT NULL,
+		UNIQUE (path, digest)
+	);
 
-func InitDatabaseConnection() (*sqlx.DB, error) {
-	db, err := sqlx.Open("sqlite3", "./enact.db")
+	CREATE TABLE IF NOT EXISTS firmware_policies (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		manufacturer TEXT NOT NULL DEFAULT '',
+		kind TEXT NOT NULL,
+		version TEXT NOT NULL,
+		reason TEXT NOT NULL DEFAULT '',
+		created_at TEXT NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS alerts (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		node_id TEXT NOT NULL,
+		attestation_id INTEGER,
+		kind TEXT NOT NULL,
+		firmware_version TEXT NOT NULL DEFAULT '',
+		message TEXT NOT NULL,
+		created_at TEXT NOT NULL,
+		acknowledged_at TEXT
+	);
+
+	CREATE INDEX IF NOT EXISTS alerts_node_id ON alerts (node_id);
+
+	CREATE UNIQUE INDEX IF NOT EXISTS alerts_open
+		ON alerts (node_id, kind, firmware_version)
+		WHERE acknowledged_at IS NULL;`
+
+// Columns added after a table was first created. Text columns are declared
+// TEXT: STRING has NUMERIC affinity in SQLite, which stores a label such as
+// "007" as the integer 7. SQLite has no
+// "ADD COLUMN IF NOT EXISTS", so the migrations are run on every start and
+// "duplicate column" errors are ignored.
+var add_columns = []string{
+	`ALTER TABLE nodes ADD COLUMN ak_name STRING;`,
+	`ALTER TABLE nodes ADD COLUMN label TEXT NOT NULL DEFAULT '';`,
+	`ALTER TABLE nodes ADD COLUMN state TEXT NOT NULL DEFAULT 'registered';`,
+	`ALTER TABLE nodes ADD COLUMN last_attested_at TEXT;`,
+	`ALTER TABLE nodes ADD COLUMN ek_cert TEXT NOT NULL DEFAULT '';`,
+	`ALTER TABLE nodes ADD COLUMN ek_manufacturer TEXT NOT NULL DEFAULT '';`,
+	`ALTER TABLE nodes ADD COLUMN ek_model TEXT NOT NULL DEFAULT '';`,
+	`ALTER TABLE nodes ADD COLUMN ak_public TEXT NOT NULL DEFAULT '';`,
+	`ALTER TABLE nodes ADD COLUMN firmware_version TEXT NOT NULL DEFAULT '';`,
+	`ALTER TABLE nodes ADD COLUMN ak_parent_qn TEXT NOT NULL DEFAULT '';`,
+	`ALTER TABLE nodes ADD COLUMN firmware_obfuscated INTEGER;`,
+	`ALTER TABLE golden_values ADD COLUMN pcr_selection TEXT NOT NULL DEFAULT '';`,
+	`ALTER TABLE golden_values ADD COLUMN superseded_at TEXT;`,
+	`ALTER TABLE golden_values ADD COLUMN pcr_values TEXT;`,
+	`ALTER TABLE golden_candidates ADD COLUMN pcr_values TEXT;`,
+	`ALTER TABLE golden_values ADD COLUMN pcr_digest_alg INTEGER NOT NULL DEFAULT 0;`,
+	`ALTER TABLE golden_candidates ADD COLUMN pcr_digest_alg INTEGER NOT NULL DEFAULT 0;`,
+	`ALTER TABLE golden_values ADD COLUMN version INTEGER;`,
+	`ALTER TABLE attestations ADD COLUMN pcr_values TEXT;`,
+	`ALTER TABLE attestations ADD COLUMN event_log_claims TEXT;`,
+	`ALTER TABLE attestations ADD COLUMN ima_result TEXT;`,
+	`ALTER TABLE attestations ADD COLUMN clock_info TEXT;`,
+	`ALTER TABLE attestations ADD COLUMN clock_events TEXT NOT NULL DEFAULT '';`,
+	`ALTER TABLE drift_events ADD COLUMN changed_pcrs TEXT NOT NULL DEFAULT '';`,
+}
+
+// Fixes to the data of columns added by earlier migrations, which are left
+// as they were applied, and indexes on those columns. They must be safe to
+// run on every start.
+var backfills = []string{
+	// ak_name was added nullable, nodes registered before it have none
+	`UPDATE nodes SET ak_name = '' WHERE ak_name IS NULL;`,
+	// The PCR digest algorithm was not recorded before pcr_digest_alg, when
+	// only SHA-256, SHA-384 and SHA-512 quotes were accepted: the TPM
+	// algorithm ID follows from the digest size
+	`UPDATE golden_values SET pcr_digest_alg = CASE length(pcr_digest) WHEN 32 THEN 11 WHEN 48 THEN 12 WHEN 64 THEN 13 ELSE 0 END WHERE pcr_digest_alg = 0;`,
+	`UPDATE golden_candidates SET pcr_digest_alg = CASE length(pcr_digest) WHEN 32 THEN 11 WHEN 48 THEN 12 WHEN 64 THEN 13 ELSE 0 END WHERE pcr_digest_alg = 0;`,
+	// Golden values were submitted with the tag-versions 0, 1, ... in the
+	// order they were inserted before version was recorded
+	`UPDATE golden_values SET version = (SELECT COUNT(*) FROM golden_values g WHERE g.node_id = golden_values.node_id AND g.id < golden_values.id) WHERE version IS NULL;`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS golden_values_version ON golden_values (node_id, version);`,
+}
+
+// dsnOptions make concurrent handlers wait for the write lock, rather than
+// fail with "database is locked", and let readers run alongside the writer
+const dsnOptions = "_busy_timeout=5000&_journal_mode=WAL"
+
+func InitDatabaseConnection(path string) (*sqlx.DB, error) {
+	separator := "?"
+	if strings.Contains(path, "?") {
+		separator = "&"
+	}
+
+	db, err := sqlx.Open("sqlite3", path+separator+dsnOptions)
 	if err != nil {
 		return nil, err
 	}
 	if _, err := db.Exec(create_schema); err != nil {
 		return nil, err
 	}
+	for _, migration := range add_columns {
+		_, err := db.Exec(migration)
+		if err != nil && !strings.Contains(err.Error(), "duplicate column name") {
+			return nil, err
+		}
+	}
+	for _, backfill := range backfills {
+		if _, err := db.Exec(backfill); err != nil {
+			return nil, err
+		}
+	}
 
 	return db, nil
 }
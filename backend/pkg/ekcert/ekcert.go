@@ -0,0 +1,358 @@
+// Copyright 2023 EnactTrust LTD All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+
+// Package ekcert parses TPM endorsement key certificates (TCG EK Credential
+// Profile for TPM Family 2.0), extracts the TPM manufacturer, model and
+// version they certify and validates them against the root and intermediate
+// CAs of TPM manufacturers, with revocation lists.
+package ekcert
+
+import (
+	"bytes"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidCertificate = errors.New("invalid EK certificate")
+	// The certificate does not chain to a CA of the bundle
+	ErrUntrusted = errors.New("EK certificate not issued by a trusted TPM manufacturer CA")
+	ErrRevoked   = errors.New("EK certificate revoked")
+)
+
+var (
+	oidSubjectAltName = asn1.ObjectIdentifier{2, 5, 29, 17}
+
+	// TPM attributes of the EK certificate subject alternative name
+	oidTPMManufacturer = asn1.ObjectIdentifier{2, 23, 133, 2, 1}
+	oidTPMModel        = asn1.ObjectIdentifier{2, 23, 133, 2, 2}
+	oidTPMVersion      = asn1.ObjectIdentifier{2, 23, 133, 2, 3}
+)
+
+// Context specific tag of the directoryName choice of GeneralName
+const directoryNameTag = 4
+
+// TPM is the TPM an EK certificate was issued for
+type TPM struct {
+	// TCG vendor ID of the manufacturer, e.g. "IFX" or "NTC", or the
+	// "id:XXXXXXXX" form of the certificate if it is not printable
+	Manufacturer string `json:"manufacturer"`
+	// Part number of the TPM, as chosen by the manufacturer
+	Model string `json:"model"`
+	// Firmware version, "id:XXXXXXXX"
+	Version string `json:"version"`
+}
+
+// Parse parses a PEM, DER or base64 DER encoded EK certificate. The TPM
+// attributes of an EK certificate are in a subject alternative name holding a
+// single directory name, which the x509 package does not handle: it is marked
+// as handled once decoded here, so that it does not fail verification when
+// critical, as it must be for certificates with an empty subject.
+func Parse(data []byte) (*x509.Certificate, *TPM, error) {
+	der := data
+	if block, _ := pem.Decode(data); block != nil {
+		der = block.Bytes
+	} else if decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data))); err == nil {
+		der = decoded
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", ErrInvalidCertificate, err)
+	}
+
+	tpm, err := tpmAttributes(cert)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", ErrInvalidCertificate, err)
+	}
+
+	return cert, tpm, nil
+}
+
+// tpmAttributes reads the TPM attributes from the directory names of the
+// subject alternative name, or from the subject for certificates that put
+// them there
+func tpmAttributes(cert *x509.Certificate) (*TPM, error) {
+	tpm := &TPM{}
+
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(oidSubjectAltName) {
+			continue
+		}
+
+		var names []asn1.RawValue
+		if rest, err := asn1.Unmarshal(ext.Value, &names); err != nil {
+			return nil, fmt.Errorf("subject alternative name: %v", err)
+		} else if len(rest) != 0 {
+			return nil, errors.New("subject alternative name: trailing data")
+		}
+
+		for _, name := range names {
+			if name.Class != asn1.ClassContextSpecific || name.Tag != directoryNameTag {
+				continue
+			}
+
+			var rdns pkix.RDNSequence
+			if rest, err := asn1.Unmarshal(name.Bytes, &rdns); err != nil {
+				return nil, fmt.Errorf("subject alternative name directory name: %v", err)
+			} else if len(rest) != 0 {
+				return nil, errors.New("subject alternative name directory name: trailing data")
+			}
+
+			for _, rdn := range rdns {
+				tpm.set(rdn)
+			}
+		}
+
+		unhandled := cert.UnhandledCriticalExtensions[:0]
+		for _, oid := range cert.UnhandledCriticalExtensions {
+			if !oid.Equal(oidSubjectAltName) {
+				unhandled = append(unhandled, oid)
+			}
+		}
+		cert.UnhandledCriticalExtensions = unhandled
+	}
+
+	if tpm.Manufacturer == "" {
+		tpm.set(cert.Subject.Names)
+	}
+
+	return tpm, nil
+}
+
+func (t *TPM) set(attributes []pkix.AttributeTypeAndValue) {
+	for _, atv := range attributes {
+		value, ok := atv.Value.(string)
+		if !ok {
+			continue
+		}
+
+		switch {
+		case atv.Type.Equal(oidTPMManufacturer):
+			t.Manufacturer = vendorID(value)
+		case atv.Type.Equal(oidTPMModel):
+			t.Model = value
+		case atv.Type.Equal(oidTPMVersion):
+			t.Version = value
+		}
+	}
+}
+
+// vendorID decodes the "id:XXXXXXXX" TPM manufacturer attribute, the hex
+// encoding of the four ASCII characters of the TCG vendor ID, padded with
+// NULs: "id:49465800" is "IFX"
+func vendorID(id string) string {
+	raw, err := hex.DecodeString(strings.TrimPrefix(strings.ToLower(id), "id:"))
+	if err != nil || len(raw) != 4 {
+		return id
+	}
+
+	vendor := strings.TrimSpace(string(bytes.TrimRight(raw, "\x00")))
+	for _, c := range []byte(vendor) {
+		if c < 0x20 || c > 0x7e {
+			return id
+		}
+	}
+
+	if vendor == "" {
+		return id
+	}
+
+	return vendor
+}
+
+// Verifier validates EK certificates against a bundle of CA certificates and
+// the revocation lists of these CAs
+type Verifier struct {
+	roots         *x509.CertPool
+	intermediates *x509.CertPool
+	crls          []*pkix.CertificateList
+}
+
+// NewVerifier loads the CA certificates found in bundle, a file or a
+// directory of files, and the revocation lists of the crls files. Files are
+// PEM or DER encoded; self-signed certificates become roots and the others
+// intermediates.
+func NewVerifier(bundle string, crls []string) (*Verifier, error) {
+	v := &Verifier{
+		roots:         x509.NewCertPool(),
+		intermediates: x509.NewCertPool(),
+	}
+
+	files, err := bundleFiles(bundle)
+	if err != nil {
+		return nil, err
+	}
+
+	count := 0
+	for _, file := range files {
+		certs, err := readCertificates(file)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, cert := range certs {
+			if bytes.Equal(cert.RawIssuer, cert.RawSubject) && cert.CheckSignatureFrom(cert) == nil {
+				v.roots.AddCert(cert)
+			} else {
+				v.intermediates.AddCert(cert)
+			}
+			count++
+		}
+	}
+
+	if count == 0 {
+		return nil, fmt.Errorf("no CA certificates in %s", bundle)
+	}
+
+	for _, file := range crls {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("reading CRL: %w", err)
+		}
+
+		crl, err := x509.ParseCRL(data)
+		if err != nil {
+			return nil, fmt.Errorf("parsing CRL %s: %w", file, err)
+		}
+
+		if crl.HasExpired(time.Now()) {
+			log.Printf("CRL %s is past its next update (%s)", file, crl.TBSCertList.NextUpdate)
+		}
+
+		v.crls = append(v.crls, crl)
+	}
+
+	return v, nil
+}
+
+func bundleFiles(bundle string) ([]string, error) {
+	info, err := os.Stat(bundle)
+	if err != nil {
+		return nil, fmt.Errorf("reading CA bundle: %w", err)
+	}
+
+	if !info.IsDir() {
+		return []string{bundle}, nil
+	}
+
+	entries, err := os.ReadDir(bundle)
+	if err != nil {
+		return nil, fmt.Errorf("reading CA bundle: %w", err)
+	}
+
+	var files []string
+	for _, e := range entries {
+		if !e.IsDir() {
+			files = append(files, filepath.Join(bundle, e.Name()))
+		}
+	}
+
+	return files, nil
+}
+
+// readCertificates reads the PEM certificates of a file, or its single DER
+// certificate
+func readCertificates(file string) ([]*x509.Certificate, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("reading CA bundle: %w", err)
+	}
+
+	var certs []*x509.Certificate
+
+	rest := data
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("parsing CA certificate in %s: %w", file, err)
+		}
+		certs = append(certs, cert)
+	}
+
+	if len(certs) == 0 {
+		cert, err := x509.ParseCertificate(data)
+		if err != nil {
+			return nil, fmt.Errorf("parsing CA certificate %s: %w", file, err)
+		}
+		certs = append(certs, cert)
+	}
+
+	return certs, nil
+}
+
+// Verify checks that the EK certificate chains to a root of the bundle and
+// that neither it nor its intermediates are revoked by a CRL of their issuer
+func (v *Verifier) Verify(cert *x509.Certificate, now time.Time) error {
+	chains, err := cert.Verify(x509.VerifyOptions{
+		Roots:         v.roots,
+		Intermediates: v.intermediates,
+		CurrentTime:   now,
+		// EK certificates carry the tcg-kp-EKCertificate extended key usage
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrUntrusted, err)
+	}
+
+	// Every chain ends at a root of the bundle: one without revoked
+	// certificates vouches for the EK
+	for _, chain := range chains {
+		if err = v.checkRevocation(chain); err == nil {
+			return nil
+		}
+	}
+
+	return err
+}
+
+func (v *Verifier) checkRevocation(chain []*x509.Certificate) error {
+	for i := 0; i+1 < len(chain); i++ {
+		cert, issuer := chain[i], chain[i+1]
+
+		for _, crl := range v.crls {
+			if issuer.CheckCRLSignature(crl) != nil {
+				continue
+			}
+
+			for _, revoked := range crl.TBSCertList.RevokedCertificates {
+				if revoked.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+					return fmt.Errorf("%w: %q serial %x revoked by %q on %s", ErrRevoked,
+						cert.Subject.String(), cert.SerialNumber, issuer.Subject.String(), revoked.RevocationTime)
+				}
+			}
+		}
+	}
+
+	return nil
+}
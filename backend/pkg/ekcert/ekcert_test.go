@@ -0,0 +1,370 @@
+// Copyright 2023 EnactTrust LTD All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+
+package ekcert
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var (
+	testNow = time.Date(2023, 6, 1, 0, 0, 0, 0, time.UTC)
+
+	oidEKCertificate = asn1.ObjectIdentifier{2, 23, 133, 8, 1}
+)
+
+// testCA is a CA issuing certificates and revocation lists
+type testCA struct {
+	cert   *x509.Certificate
+	key    crypto.Signer
+	serial int64
+}
+
+func newKey(t *testing.T) *ecdsa.PrivateKey {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return key
+}
+
+// newCA creates a root CA, or an intermediate CA when parent is not nil
+func newCA(t *testing.T, name string, parent *testCA) *testCA {
+	t.Helper()
+
+	key := newKey(t)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             testNow.AddDate(-5, 0, 0),
+		NotAfter:              testNow.AddDate(20, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	ca := &testCA{key: key, serial: 1}
+	issuer, signer := template, crypto.Signer(key)
+	if parent != nil {
+		template.SerialNumber = parent.nextSerial()
+		issuer, signer = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, issuer, key.Public(), signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ca.cert, err = x509.ParseCertificate(der); err != nil {
+		t.Fatal(err)
+	}
+
+	return ca
+}
+
+func (ca *testCA) nextSerial() *big.Int {
+	ca.serial++
+	return big.NewInt(ca.serial)
+}
+
+// tpmSAN builds the critical subject alternative name of an EK certificate,
+// a directory name holding the TPM attributes
+func tpmSAN(t *testing.T, manufacturer, model, version string) pkix.Extension {
+	t.Helper()
+
+	name, err := asn1.Marshal(pkix.RDNSequence{
+		{{Type: oidTPMManufacturer, Value: manufacturer}},
+		{{Type: oidTPMModel, Value: model}},
+		{{Type: oidTPMVersion, Value: version}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	san, err := asn1.Marshal([]asn1.RawValue{{
+		Class:      asn1.ClassContextSpecific,
+		Tag:        directoryNameTag,
+		IsCompound: true,
+		Bytes:      name,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return pkix.Extension{Id: oidSubjectAltName, Critical: true, Value: san}
+}
+
+// issueEK issues an EK certificate with an empty subject, valid until
+// notAfter
+func (ca *testCA) issueEK(t *testing.T, notAfter time.Time) []byte {
+	t.Helper()
+
+	template := &x509.Certificate{
+		SerialNumber:       ca.nextSerial(),
+		NotBefore:          testNow.AddDate(-1, 0, 0),
+		NotAfter:           notAfter,
+		KeyUsage:           x509.KeyUsageKeyEncipherment,
+		UnknownExtKeyUsage: []asn1.ObjectIdentifier{oidEKCertificate},
+		ExtraExtensions:    []pkix.Extension{tpmSAN(t, "id:49465800", "SLB9670", "id:000D0005")},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, newKey(t).Public(), ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return der
+}
+
+// revoke writes a CRL of the CA revoking the serial numbers
+func (ca *testCA) revoke(t *testing.T, dir string, serials ...*big.Int) string {
+	t.Helper()
+
+	var revoked []pkix.RevokedCertificate
+	for _, serial := range serials {
+		revoked = append(revoked, pkix.RevokedCertificate{SerialNumber: serial, RevocationTime: testNow.AddDate(0, -1, 0)})
+	}
+
+	der, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:              big.NewInt(1),
+		ThisUpdate:          testNow.AddDate(0, -1, 0),
+		NextUpdate:          testNow.AddDate(0, 1, 0),
+		RevokedCertificates: revoked,
+	}, ca.cert, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := os.CreateTemp(dir, "*.crl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	if _, err := file.Write(der); err != nil {
+		t.Fatal(err)
+	}
+
+	return file.Name()
+}
+
+func writePEM(t *testing.T, file string, certs ...*x509.Certificate) {
+	t.Helper()
+
+	var data []byte
+	for _, cert := range certs {
+		data = append(data, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})...)
+	}
+
+	if err := os.WriteFile(file, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParse(t *testing.T) {
+	root := newCA(t, "TPM Root CA", nil)
+	der := root.issueEK(t, testNow.AddDate(10, 0, 0))
+
+	encodings := map[string][]byte{
+		"DER":    der,
+		"PEM":    pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		"base64": []byte(base64.StdEncoding.EncodeToString(der) + "\n"),
+	}
+
+	for name, data := range encodings {
+		cert, tpm, err := Parse(data)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		if *tpm != (TPM{Manufacturer: "IFX", Model: "SLB9670", Version: "id:000D0005"}) {
+			t.Errorf("%s: TPM %+v", name, tpm)
+		}
+
+		// The critical subject alternative name is handled
+		if len(cert.UnhandledCriticalExtensions) != 0 {
+			t.Errorf("%s: unhandled critical extensions %v", name, cert.UnhandledCriticalExtensions)
+		}
+	}
+
+	if _, _, err := Parse([]byte("not a certificate")); !errors.Is(err, ErrInvalidCertificate) {
+		t.Fatal(err)
+	}
+}
+
+func TestVendorID(t *testing.T) {
+	cases := map[string]string{
+		"id:49465800": "IFX",
+		"id:4E544300": "NTC",
+		"id:53544D20": "STM",
+		"ID:494E5443": "INTC",
+		"id:00000000": "id:00000000",
+		"id:01020304": "id:01020304",
+		"id:4946":     "id:4946",
+		"IFX":         "IFX",
+	}
+
+	for id, want := range cases {
+		if got := vendorID(id); got != want {
+			t.Errorf("%s: %q", id, got)
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	dir := t.TempDir()
+
+	root := newCA(t, "TPM Root CA", nil)
+	intermediate := newCA(t, "TPM Intermediate CA", root)
+	revokedIntermediate := newCA(t, "TPM Revoked Intermediate CA", root)
+	other := newCA(t, "Other Root CA", nil)
+
+	valid := intermediate.issueEK(t, testNow.AddDate(10, 0, 0))
+	expired := intermediate.issueEK(t, testNow.AddDate(0, 0, -1))
+	revoked := intermediate.issueEK(t, testNow.AddDate(10, 0, 0))
+	underRevoked := revokedIntermediate.issueEK(t, testNow.AddDate(10, 0, 0))
+	untrusted := other.issueEK(t, testNow.AddDate(10, 0, 0))
+	direct := root.issueEK(t, testNow.AddDate(10, 0, 0))
+
+	serialOf := func(der []byte) *big.Int {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cert.SerialNumber
+	}
+
+	bundle := filepath.Join(dir, "bundle")
+	if err := os.Mkdir(bundle, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	writePEM(t, filepath.Join(bundle, "root.pem"), root.cert)
+	writePEM(t, filepath.Join(bundle, "intermediates.pem"), intermediate.cert, revokedIntermediate.cert)
+
+	crls := []string{
+		intermediate.revoke(t, dir, serialOf(revoked)),
+		root.revoke(t, dir, revokedIntermediate.cert.SerialNumber),
+		// Not signed by the issuer of the certificates it lists
+		other.revoke(t, dir, serialOf(valid), serialOf(direct)),
+	}
+
+	v, err := NewVerifier(bundle, crls)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name string
+		der  []byte
+		err  error
+	}{
+		{"valid", valid, nil},
+		{"issued by the root", direct, nil},
+		{"expired", expired, ErrUntrusted},
+		{"untrusted", untrusted, ErrUntrusted},
+		{"revoked", revoked, ErrRevoked},
+		{"revoked intermediate", underRevoked, ErrRevoked},
+	}
+
+	for _, c := range cases {
+		cert, _, err := Parse(c.der)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+
+		err = v.Verify(cert, testNow)
+		if (c.err == nil) != (err == nil) || (c.err != nil && !errors.Is(err, c.err)) {
+			t.Errorf("%s: %v", c.name, err)
+		}
+	}
+}
+
+func TestNewVerifier(t *testing.T) {
+	dir := t.TempDir()
+
+	root := newCA(t, "TPM Root CA", nil)
+	intermediate := newCA(t, "TPM Intermediate CA", root)
+
+	// A single file holding the whole chain
+	bundle := filepath.Join(dir, "bundle.pem")
+	writePEM(t, bundle, root.cert, intermediate.cert)
+
+	v, err := NewVerifier(bundle, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, _, err := Parse(intermediate.issueEK(t, testNow.AddDate(10, 0, 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := v.Verify(cert, testNow); err != nil {
+		t.Fatal(err)
+	}
+
+	// A DER certificate alone in its file
+	der := filepath.Join(dir, "root.der")
+	if err := os.WriteFile(der, root.cert.Raw, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewVerifier(der, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	garbage := filepath.Join(dir, "garbage")
+	if err := os.WriteFile(garbage, []byte("garbage"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	empty := filepath.Join(dir, "empty")
+	if err := os.Mkdir(empty, 0o700); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name   string
+		bundle string
+		crls   []string
+	}{
+		{"missing bundle", filepath.Join(dir, "missing"), nil},
+		{"empty bundle", empty, nil},
+		{"malformed bundle", garbage, nil},
+		{"missing CRL", bundle, []string{filepath.Join(dir, "missing.crl")}},
+		{"malformed CRL", bundle, []string{garbage}},
+	}
+
+	for _, c := range cases {
+		if _, err := NewVerifier(c.bundle, c.crls); err == nil {
+			t.Errorf("%s: no error", c.name)
+		}
+	}
+}
@@ -18,6 +18,7 @@ import (
 	"fmt"
 	"log"
 
+	"github.com/google/go-tpm/tpm2"
 	"github.com/google/uuid"
 	"github.com/veraison/corim/comid"
 	"github.com/veraison/corim/corim"
@@ -133,47 +134,151 @@ func RepackageNodePEM(akPub string, nodeID uuid.UUID) (*corim.UnsignedCorim, err
 	return buildCorim(CorimTemplate, &c)
 }
 
+// Digest is a measured value together with its hash algorithm, given as a
+// named information hash algorithm ID (swid.Sha256, swid.Sha384, ...)
+type Digest struct {
+	AlgID uint64
+	Value []byte
+}
+
+// Measurement is one golden value of a node: the digests of a single PCR or
+// component, possibly in several algorithms
+type Measurement struct {
+	// PCR the digests are for. Nil when the measurement is not a single PCR,
+	// e.g. the composite PCR digest of a quote or a component digest.
+	PCR *uint64
+	// Optional name of the measured component. It cannot be combined with
+	// PCR, since both end up in the measurement key.
+	Label string
+	// At least one digest is required
+	Digests []Digest
+}
+
+// LabelNamespace is the namespace of the name-based UUIDs that key labelled
+// measurements. The CoMID measurement key has no text form, so a label is
+// carried as uuid.NewSHA1(LabelNamespace, []byte(label)), which the verifier
+// can compute for the labels it expects.
+var LabelNamespace = uuid.MustParse("5b5e0b7f-3f38-4b8c-9a5c-e6a5c3a1e7d1")
+
+// LabelKey returns the measurement key of a labelled measurement
+func LabelKey(label string) uuid.UUID {
+	return uuid.NewSHA1(LabelNamespace, []byte(label))
+}
+
+func (m Measurement) toComid() (*comid.Measurement, error) {
+	if len(m.Digests) == 0 {
+		return nil, errors.New("no digests")
+	}
+
+	var cm *comid.Measurement
+
+	switch {
+	case m.PCR != nil && m.Label != "":
+		return nil, errors.New("a measurement is keyed either by PCR or by label")
+	case m.PCR != nil:
+		cm = comid.NewUintMeasurement(*m.PCR)
+	case m.Label != "":
+		cm = comid.NewUUIDMeasurement(comid.UUID(LabelKey(m.Label)))
+	default:
+		cm = &comid.Measurement{}
+	}
+
+	if cm == nil {
+		return nil, errors.New("cannot set measurement key")
+	}
+
+	for i, d := range m.Digests {
+		if cm.AddDigest(d.AlgID, d.Value) == nil {
+			return nil, fmt.Errorf("digest at index %d: invalid %d bytes value for algorithm %d", i, len(d.Value), d.AlgID)
+		}
+	}
+
+	return cm, nil
+}
+
+// GoldenTagID returns the CoMID tag-id of the golden values of a node. All
+// the golden values CoMIDs of a node share it, so that each new tag-version
+// supersedes the previous ones.
+func GoldenTagID(nodeID uuid.UUID) uuid.UUID {
+	return uuid.NewSHA1(nodeID, []byte("golden-values"))
+}
+
 func goldenValues(
-	algID uint64, digest []byte, nodeID uuid.UUID, comidTemplate, corimTemplate string,
+	measurements []Measurement, nodeID uuid.UUID, version uint, comidTemplate, corimTemplate string,
 ) (*corim.UnsignedCorim, error) {
+	if len(measurements) == 0 {
+		return nil, errors.New("no golden values")
+	}
+
 	c := comid.Comid{}
 
 	if err := c.FromJSON([]byte(comidTemplate)); err != nil {
 		return nil, fmt.Errorf("parsing CoMID JSON template: %s (%w)", comidTemplate, err)
 	}
 
-	gv := (*c.Triples.ReferenceValues)[0]
+	if c.SetTagIdentity(GoldenTagID(nodeID).String(), version) == nil {
+		return nil, fmt.Errorf("cannot set tag identity")
+	}
+
+	// All golden values of the node go in the one reference-values triple
+	gv := &(*c.Triples.ReferenceValues)[0]
 
 	if gv.Environment.Instance.SetUUID(nodeID) == nil {
 		return nil, fmt.Errorf("cannot set nodeID")
 	}
 
-    fmt.Println(fmt.Sprintf("algID=0x%x len of digest = %d \n digest = 0x%x", algID, len(digest), digest))
-	if gv.Measurements[0].AddDigest(algID, digest) == nil {
-		return nil, fmt.Errorf("cannot set golden value")
+	gv.Measurements = comid.Measurements{}
+
+	for i, m := range measurements {
+		cm, err := m.toComid()
+		if err != nil {
+			return nil, fmt.Errorf("golden value at index %d: %w", i, err)
+		}
+
+		gv.Measurements.AddMeasurement(cm)
 	}
 
 	return buildCorim(corimTemplate, &c)
 }
 
-func RepackageEvidence(nodeID uuid.UUID, evidenceDigest []byte) ([]byte, error) {
-	var algID = swid.Sha256
-	corim, err := goldenValues(algID, evidenceDigest, nodeID, gvComidTemplate, CorimTemplate)
+// RepackageGoldenValues packages all the golden values of a node as a CoRIM
+// with a single reference-values triple, and returns its CBOR encoding. The
+// CoMID is issued with the given tag-version: 0 for the first golden values
+// of the node, and for golden values replacing earlier ones, e.g. after a
+// firmware upgrade, one greater than that of the golden values superseded.
+func RepackageGoldenValues(nodeID uuid.UUID, version uint, measurements []Measurement) ([]byte, error) {
+	corim, err := goldenValues(measurements, nodeID, version, gvComidTemplate, CorimTemplate)
 	if err != nil {
-		log.Fatal(err)
 		return nil, err
 	}
 
-	log.Println(`successfully repacked evidence as corim`)
+	log.Printf("successfully repacked %d golden values as corim", len(measurements))
 
 	cbor, err := corim.ToCBOR()
 	if err != nil {
-		log.Fatal(err)
 		return nil, err
 	}
 
 	log.Println(`successfully converted corim to cbor`)
 
-	fmt.Printf("\n>> golden values: %x\n", cbor)
 	return cbor, nil
 }
+
+// Named information hash algorithms, by TPM algorithm ID
+var digestAlgIDs = map[tpm2.Algorithm]uint64{
+	tpm2.AlgSHA256: swid.Sha256,
+	tpm2.AlgSHA384: swid.Sha384,
+	tpm2.AlgSHA512: swid.Sha512,
+}
+
+// DigestAlgID returns the named information hash algorithm of a digest
+// computed with the TPM hash algorithm, e.g. that of the quote signature
+// scheme for a composite PCR digest. SHA-1 has no named information ID.
+func DigestAlgID(alg tpm2.Algorithm) (uint64, error) {
+	algID, ok := digestAlgIDs[alg]
+	if !ok {
+		return 0, fmt.Errorf("no named information hash algorithm for %v", alg)
+	}
+
+	return algID, nil
+}
@@ -0,0 +1,216 @@
+// Copyright 2023 EnactTrust LTD All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+
+package enactcorim
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/uuid"
+	"github.com/veraison/corim/comid"
+	"github.com/veraison/corim/corim"
+	"github.com/veraison/swid"
+)
+
+var testNodeID = uuid.MustParse("7dd5db06-d2f5-4e0d-8a9c-9baaa5a446ef")
+
+// decodeComid decodes the CBOR of a CoRIM carrying a single CoMID
+func decodeComid(t *testing.T, data []byte) *comid.Comid {
+	t.Helper()
+
+	u := corim.UnsignedCorim{}
+	if err := u.FromCBOR(data); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(u.Tags) != 1 || !bytes.HasPrefix(u.Tags[0], corim.ComidTag) {
+		t.Fatalf("tags %x", u.Tags)
+	}
+
+	c := comid.Comid{}
+	if err := c.FromCBOR(u.Tags[0][len(corim.ComidTag):]); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Valid(); err != nil {
+		t.Fatal(err)
+	}
+
+	return &c
+}
+
+// mkeyCBOR returns the CBOR of a measurement key, nil if it is not set
+func mkeyCBOR(t *testing.T, key *comid.Mkey) []byte {
+	t.Helper()
+
+	if key == nil || !key.IsSet() {
+		return nil
+	}
+
+	data, err := key.MarshalCBOR()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return data
+}
+
+func TestRepackageGoldenValues(t *testing.T) {
+	pcr0, pcr7 := uint64(0), uint64(7)
+	composite := bytes.Repeat([]byte{0xd1}, 32)
+
+	measurements := []Measurement{
+		{Digests: []Digest{{AlgID: swid.Sha256, Value: composite}}},
+		{PCR: &pcr0, Digests: []Digest{{AlgID: swid.Sha256, Value: bytes.Repeat([]byte{0x00}, 32)}}},
+		{PCR: &pcr7, Digests: []Digest{
+			{AlgID: swid.Sha256, Value: bytes.Repeat([]byte{0x07}, 32)},
+			{AlgID: swid.Sha384, Value: bytes.Repeat([]byte{0x77}, 48)},
+		}},
+		{Label: "bootloader", Digests: []Digest{{AlgID: swid.Sha256, Value: bytes.Repeat([]byte{0xb0}, 32)}}},
+		{Label: "kernel", Digests: []Digest{{AlgID: swid.Sha512, Value: bytes.Repeat([]byte{0x4e}, 64)}}},
+	}
+
+	data, err := RepackageGoldenValues(testNodeID, 3, measurements)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := decodeComid(t, data)
+
+	if c.TagIdentity.TagID.String() != GoldenTagID(testNodeID).String() || c.TagIdentity.TagVersion != 3 {
+		t.Fatalf("tag identity %v", c.TagIdentity)
+	}
+
+	if c.Triples.ReferenceValues == nil || len(*c.Triples.ReferenceValues) != 1 {
+		t.Fatalf("reference values %+v", c.Triples.ReferenceValues)
+	}
+
+	rv := (*c.Triples.ReferenceValues)[0]
+
+	instance, err := rv.Environment.Instance.GetUUID()
+	if err != nil || uuid.UUID(instance) != testNodeID {
+		t.Fatalf("instance %v, %v", instance, err)
+	}
+
+	if len(rv.Measurements) != len(measurements) {
+		t.Fatalf("%d measurements", len(rv.Measurements))
+	}
+
+	for i, m := range measurements {
+		got := rv.Measurements[i]
+
+		var want *comid.Measurement
+		switch {
+		case m.PCR != nil:
+			want = comid.NewUintMeasurement(*m.PCR)
+		case m.Label != "":
+			want = comid.NewUUIDMeasurement(comid.UUID(LabelKey(m.Label)))
+		default:
+			want = &comid.Measurement{}
+		}
+
+		if !bytes.Equal(mkeyCBOR(t, got.Key), mkeyCBOR(t, want.Key)) {
+			t.Errorf("measurement %d: key %x", i, mkeyCBOR(t, got.Key))
+		}
+
+		if got.Val.Digests == nil || len(*got.Val.Digests) != len(m.Digests) {
+			t.Fatalf("measurement %d: digests %v", i, got.Val.Digests)
+		}
+
+		for j, d := range m.Digests {
+			entry := (*got.Val.Digests)[j]
+			if entry.HashAlgID != d.AlgID || !bytes.Equal(entry.HashValue, d.Value) {
+				t.Errorf("measurement %d: digest %d is %v", i, j, entry)
+			}
+		}
+	}
+}
+
+func TestRepackageGoldenValuesErrors(t *testing.T) {
+	cases := []struct {
+		name         string
+		measurements []Measurement
+	}{
+		{"no measurements", nil},
+		{"no digests", []Measurement{{}}},
+		{"digest size", []Measurement{{Digests: []Digest{{AlgID: swid.Sha256, Value: make([]byte, 20)}}}}},
+		{"PCR and label", []Measurement{{PCR: new(uint64), Label: "kernel", Digests: []Digest{{AlgID: swid.Sha256, Value: make([]byte, 32)}}}}},
+	}
+
+	for _, c := range cases {
+		if _, err := RepackageGoldenValues(testNodeID, 0, c.measurements); err == nil {
+			t.Errorf("%s: no error", c.name)
+		}
+	}
+}
+
+func TestRepackageNodePEM(t *testing.T) {
+	const akPub = "-----BEGIN PUBLIC KEY-----\nMFkwEwYHKoZIzj0CAQYIKoZIzj0DAQcDQgAE\n-----END PUBLIC KEY-----\n"
+
+	u, err := RepackageNodePEM(akPub, testNodeID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := u.ToCBOR()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := decodeComid(t, data)
+
+	if c.Triples.AttestVerifKeys == nil || len(*c.Triples.AttestVerifKeys) != 1 {
+		t.Fatalf("attester verification keys %+v", c.Triples.AttestVerifKeys)
+	}
+
+	avk := (*c.Triples.AttestVerifKeys)[0]
+
+	instance, err := avk.Environment.Instance.GetUUID()
+	if err != nil || uuid.UUID(instance) != testNodeID {
+		t.Fatalf("instance %v, %v", instance, err)
+	}
+
+	if len(avk.VerifKeys) != 1 || avk.VerifKeys[0].Key != akPub {
+		t.Fatalf("keys %+v", avk.VerifKeys)
+	}
+}
+
+func TestLabelKey(t *testing.T) {
+	if LabelKey("kernel") != LabelKey("kernel") {
+		t.Error("label key is not deterministic")
+	}
+
+	if LabelKey("kernel") == LabelKey("bootloader") {
+		t.Error("labels share a key")
+	}
+
+	if LabelKey("kernel").Version() != 5 {
+		t.Errorf("label key version %d", LabelKey("kernel").Version())
+	}
+}
+
+func TestDigestAlgID(t *testing.T) {
+	for alg, want := range map[tpm2.Algorithm]uint64{tpm2.AlgSHA256: swid.Sha256, tpm2.AlgSHA384: swid.Sha384, tpm2.AlgSHA512: swid.Sha512} {
+		if got, err := DigestAlgID(alg); err != nil || got != want {
+			t.Errorf("%v: %d, %v", alg, got, err)
+		}
+	}
+
+	for _, alg := range []tpm2.Algorithm{tpm2.AlgSHA1, tpm2.AlgSHA3_256, tpm2.AlgNull} {
+		if _, err := DigestAlgID(alg); err == nil {
+			t.Errorf("%v has a named information hash algorithm", alg)
+		}
+	}
+}
@@ -0,0 +1,275 @@
+// Copyright 2023 EnactTrust LTD All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+
+package eventlog
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/google/go-tpm/tpm2"
+)
+
+// Claims are the facts about the boot of a node extracted from its event log
+type Claims struct {
+	// Value of the SecureBoot UEFI variable measured in PCR 7, nil if it was
+	// not measured
+	SecureBoot *bool `json:"secure_boot,omitempty"`
+	// Secure Boot variables (PK, KEK, db, dbx, ...) measured in PCR 7, by
+	// name, with the digest of their measurement
+	SecureBootVariables map[string][]byte `json:"secure_boot_variables,omitempty"`
+	// Version string of the static CRTM, usually the firmware version
+	CRTMVersion string `json:"crtm_version,omitempty"`
+	// UEFI applications started by the firmware (PCR 4), in boot order: shim,
+	// boot loaders, EFI stub kernels
+	BootApplications []BootApplication `json:"boot_applications,omitempty"`
+	// Kernel image and command line, as measured by GRUB in PCR 8
+	Kernel        string `json:"kernel,omitempty"`
+	KernelCmdline string `json:"kernel_cmdline,omitempty"`
+	// Files loaded by GRUB (PCR 9): kernel, initrd, configuration, modules.
+	// The digests are those of the file contents, so the paths are not
+	// covered by the quote.
+	BootFiles []string `json:"boot_files,omitempty"`
+	// Sequence numbers of the events whose data does not hash to their
+	// digest, and whose claims were dropped
+	UnverifiedEvents []int `json:"unverified_events,omitempty"`
+}
+
+// BootApplication is a UEFI image loaded during boot
+type BootApplication struct {
+	// File path of the image, empty if its device path has none. The digest
+	// is that of the image, not of the device path, so the path is not
+	// covered by the quote.
+	Path string `json:"path"`
+	// Digest of the image in the bank the claims were extracted for
+	Digest []byte `json:"digest"`
+}
+
+// UEFI variable names of the Secure Boot configuration measured in PCR 7
+var secureBootVariables = map[string]bool{
+	"SecureBoot": true,
+	"PK":         true,
+	"KEK":        true,
+	"db":         true,
+	"dbx":        true,
+	"dbt":        true,
+	"dbr":        true,
+}
+
+// GRUB measures its commands in PCR 8, logging them as "<prefix>: <command
+// line>" but hashing the command line alone
+var grubPrefixes = []string{
+	"kernel_cmdline: ",
+	"module_cmdline: ",
+	"grub_cmd: ",
+}
+
+const grubKernelCmdline = "kernel_cmdline: "
+
+// Claims extracts the claims of the events measured into the given PCRs,
+// taking digests from the given bank. The replay only covers the event
+// digests: claims are only taken from the data of the events whose digest
+// is the hash of that data (the S-CRTM version, the Secure Boot variables
+// and the GRUB commands), and events whose data does not match are listed
+// in UnverifiedEvents instead. The paths of the boot applications and GRUB
+// files are not covered by their digests. Events whose data cannot be
+// decoded are skipped.
+func (l *Log) Claims(bank tpm2.Algorithm, pcrs map[int]bool) *Claims {
+	c := &Claims{}
+
+	for _, e := range l.Events {
+		if !pcrs[e.PCR] {
+			continue
+		}
+
+		switch {
+		case e.Type == EvSCRTMVersion:
+			if !c.verified(bank, e, e.Data) {
+				continue
+			}
+
+			c.CRTMVersion = decodeVersion(e.Data)
+
+		case e.Type == EvEFIBootServicesApplication && e.PCR == 4:
+			c.BootApplications = append(c.BootApplications, BootApplication{
+				Path:   imageLoadPath(e.Data),
+				Digest: e.Digests[bank],
+			})
+
+		case e.Type == EvEFIVariableDriverConfig && e.PCR == 7:
+			name, value, ok := decodeVariable(e.Data)
+			if !ok || !secureBootVariables[name] || !c.verified(bank, e, e.Data) {
+				continue
+			}
+
+			if c.SecureBootVariables == nil {
+				c.SecureBootVariables = map[string][]byte{}
+			}
+			c.SecureBootVariables[name] = e.Digests[bank]
+
+			if name == "SecureBoot" {
+				enabled := len(value) == 1 && value[0] == 1
+				c.SecureBoot = &enabled
+			}
+
+		case e.Type == EvIPL && e.PCR == 8:
+			cmd := strings.TrimRight(string(e.Data), "\x00")
+			if !c.verified(bank, e, []byte(trimGrubPrefix(cmd))) {
+				continue
+			}
+
+			if strings.HasPrefix(cmd, grubKernelCmdline) {
+				fields := strings.SplitN(strings.TrimPrefix(cmd, grubKernelCmdline), " ", 2)
+				c.Kernel = fields[0]
+				c.KernelCmdline = ""
+				if len(fields) == 2 {
+					c.KernelCmdline = fields[1]
+				}
+			}
+
+		case e.Type == EvIPL && e.PCR == 9:
+			c.BootFiles = append(c.BootFiles, strings.TrimRight(string(e.Data), "\x00"))
+		}
+	}
+
+	return c
+}
+
+// verified tells whether the measured data hashes to the digest of the event
+// in the bank, and records the event as unverified otherwise
+func (c *Claims) verified(bank tpm2.Algorithm, e Event, measured []byte) bool {
+	digest, ok := e.Digests[bank]
+	if ok {
+		if h, err := bank.Hash(); err == nil {
+			hh := h.New()
+			hh.Write(measured)
+			if bytes.Equal(hh.Sum(nil), digest) {
+				return true
+			}
+		}
+	}
+
+	c.UnverifiedEvents = append(c.UnverifiedEvents, e.Sequence)
+
+	return false
+}
+
+// trimGrubPrefix returns the part of a GRUB command that GRUB hashes
+func trimGrubPrefix(cmd string) string {
+	for _, prefix := range grubPrefixes {
+		if strings.HasPrefix(cmd, prefix) {
+			return strings.TrimPrefix(cmd, prefix)
+		}
+	}
+
+	return cmd
+}
+
+// decodeVersion decodes the UCS-2 version string of EV_S_CRTM_VERSION, which
+// some firmwares record as plain ASCII instead
+func decodeVersion(data []byte) string {
+	if len(data) >= 2 && len(data)%2 == 0 && data[1] == 0 {
+		return decodeUCS2(data)
+	}
+
+	return strings.TrimRight(string(data), "\x00")
+}
+
+func decodeUCS2(data []byte) string {
+	u := make([]uint16, 0, len(data)/2)
+	for i := 0; i+1 < len(data); i += 2 {
+		c := binary.LittleEndian.Uint16(data[i:])
+		if c == 0 {
+			break
+		}
+		u = append(u, c)
+	}
+
+	return string(utf16.Decode(u))
+}
+
+// decodeVariable decodes a UEFI_VARIABLE_DATA: the variable GUID, the
+// lengths of its name (in characters) and data, its UCS-2 name and data
+func decodeVariable(data []byte) (string, []byte, bool) {
+	const header = 16 + 8 + 8
+
+	if len(data) < header {
+		return "", nil, false
+	}
+
+	nameLen := binary.LittleEndian.Uint64(data[16:])
+	dataLen := binary.LittleEndian.Uint64(data[24:])
+
+	rest := uint64(len(data) - header)
+	if nameLen > rest/2 || dataLen > rest-2*nameLen {
+		return "", nil, false
+	}
+
+	name := decodeUCS2(data[header : header+2*nameLen])
+	value := data[header+2*nameLen : header+2*nameLen+dataLen]
+
+	return name, value, true
+}
+
+// imageLoadPath returns the file path of the device path of an
+// UEFI_IMAGE_LOAD_EVENT, e.g. "\EFI\ubuntu\shimx64.efi"
+func imageLoadPath(data []byte) string {
+	// ImageLocationInMemory, ImageLengthInMemory, ImageLinkTimeAddress and
+	// LengthOfDevicePath
+	const header = 4 * 8
+
+	if len(data) < header {
+		return ""
+	}
+
+	pathLen := binary.LittleEndian.Uint64(data[24:])
+	if pathLen > uint64(len(data)-header) {
+		return ""
+	}
+
+	return devicePathFile(data[header : header+pathLen])
+}
+
+// devicePathFile concatenates the file path nodes (media type 4, subtype 4)
+// of an EFI device path
+func devicePathFile(dp []byte) string {
+	const (
+		mediaDevicePath = 0x04
+		filePathSubtype = 0x04
+		endDevicePath   = 0x7F
+	)
+
+	var path bytes.Buffer
+
+	for len(dp) >= 4 {
+		nodeType, subType := dp[0], dp[1]
+		length := int(binary.LittleEndian.Uint16(dp[2:]))
+		if length < 4 || length > len(dp) {
+			break
+		}
+
+		if nodeType == endDevicePath {
+			break
+		}
+
+		if nodeType == mediaDevicePath && subType == filePathSubtype {
+			path.WriteString(decodeUCS2(dp[4:length]))
+		}
+
+		dp = dp[length:]
+	}
+
+	return path.String()
+}
@@ -0,0 +1,320 @@
+// Copyright 2023 EnactTrust LTD All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+
+// Package eventlog parses the binary TCG PC Client measured-boot event log
+// (TCG PC Client Platform Firmware Profile, section 10), replays it into PCR
+// values and extracts claims about the boot from its events.
+package eventlog
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/google/go-tpm/tpm2"
+)
+
+// EventType is the type of an event log entry
+type EventType uint32
+
+const (
+	EvPrebootCert          EventType = 0x00
+	EvPostCode             EventType = 0x01
+	EvNoAction             EventType = 0x03
+	EvSeparator            EventType = 0x04
+	EvAction               EventType = 0x05
+	EvEventTag             EventType = 0x06
+	EvSCRTMContents        EventType = 0x07
+	EvSCRTMVersion         EventType = 0x08
+	EvCPUMicrocode         EventType = 0x09
+	EvPlatformConfigFlags  EventType = 0x0A
+	EvTableOfDevices       EventType = 0x0B
+	EvCompactHash          EventType = 0x0C
+	EvIPL                  EventType = 0x0D
+	EvIPLPartitionData     EventType = 0x0E
+	EvNonhostCode          EventType = 0x0F
+	EvNonhostConfig        EventType = 0x10
+	EvNonhostInfo          EventType = 0x11
+	EvOmitBootDeviceEvents EventType = 0x12
+
+	EvEFIVariableDriverConfig    EventType = 0x80000001
+	EvEFIVariableBoot            EventType = 0x80000002
+	EvEFIBootServicesApplication EventType = 0x80000003
+	EvEFIBootServicesDriver      EventType = 0x80000004
+	EvEFIRuntimeServicesDriver   EventType = 0x80000005
+	EvEFIGPTEvent                EventType = 0x80000006
+	EvEFIAction                  EventType = 0x80000007
+	EvEFIPlatformFirmwareBlob    EventType = 0x80000008
+	EvEFIHandoffTables           EventType = 0x80000009
+	EvEFIPlatformFirmwareBlob2   EventType = 0x8000000A
+	EvEFIHandoffTables2          EventType = 0x8000000B
+	EvEFIVariableBoot2           EventType = 0x8000000C
+	EvEFIHCRTMEvent              EventType = 0x80000010
+	EvEFIVariableAuthority       EventType = 0x800000E0
+)
+
+// Limits protecting the parser from hostile logs
+const (
+	// Highest PCR index of a TPM with 24 PCRs
+	maxPCR = 23
+	// More digest algorithms than any TPM implements
+	maxAlgorithms = 16
+	// Largest digest, SHA-512
+	maxDigestSize = 64
+)
+
+var (
+	ErrMalformed = errors.New("malformed event log")
+	// The log has no digests in the requested bank
+	ErrNoBank = errors.New("event log has no digests for the PCR bank")
+)
+
+// specIDSignature opens the first event of a crypto agile log
+var specIDSignature = []byte("Spec ID Event03\x00")
+
+// Event is one entry of the event log
+type Event struct {
+	// Position of the event in the log, from 0
+	Sequence int
+	PCR      int
+	Type     EventType
+	// Digests of the event, by bank
+	Digests map[tpm2.Algorithm][]byte
+	Data    []byte
+}
+
+// Log is a parsed event log
+type Log struct {
+	// Digest algorithms of the log and their digest sizes. A legacy log only
+	// has SHA-1.
+	Algorithms map[tpm2.Algorithm]int
+	// Events following the header event, in log order
+	Events []Event
+}
+
+// Parse parses a crypto agile (TCG_PCR_EVENT2) or a legacy SHA-1 only
+// (TCG_PCR_EVENT) event log
+func Parse(data []byte) (*Log, error) {
+	r := &reader{buf: data}
+
+	header, err := r.legacyEvent()
+	if err != nil {
+		return nil, fmt.Errorf("header event: %w", err)
+	}
+
+	log := &Log{
+		Algorithms: map[tpm2.Algorithm]int{tpm2.AlgSHA1: 20},
+	}
+
+	agile := header.Type == EvNoAction && header.PCR == 0 && bytes.HasPrefix(header.Data, specIDSignature)
+	if agile {
+		if log.Algorithms, err = parseSpecID(header.Data); err != nil {
+			return nil, err
+		}
+	} else {
+		// The first event of a legacy log is a regular one
+		log.Events = append(log.Events, *header)
+	}
+
+	for r.remaining() > 0 {
+		var e *Event
+		if agile {
+			e, err = r.agileEvent(log.Algorithms)
+		} else {
+			e, err = r.legacyEvent()
+		}
+		if err != nil {
+			return nil, fmt.Errorf("event %d: %w", len(log.Events)+1, err)
+		}
+
+		e.Sequence = len(log.Events)
+		log.Events = append(log.Events, *e)
+	}
+
+	return log, nil
+}
+
+// parseSpecID reads the digest algorithms of the log from the
+// TCG_EfiSpecIdEvent of its header
+func parseSpecID(data []byte) (map[tpm2.Algorithm]int, error) {
+	r := &reader{buf: data}
+
+	// signature, platformClass, specVersionMinor, specVersionMajor,
+	// specErrata and uintnSize
+	if _, err := r.bytes(len(specIDSignature) + 4 + 4); err != nil {
+		return nil, fmt.Errorf("spec ID event: %w", err)
+	}
+
+	count, err := r.uint32()
+	if err != nil {
+		return nil, fmt.Errorf("spec ID event: %w", err)
+	}
+	if count == 0 || count > maxAlgorithms {
+		return nil, fmt.Errorf("%w: spec ID event lists %d algorithms", ErrMalformed, count)
+	}
+
+	algorithms := map[tpm2.Algorithm]int{}
+
+	for i := uint32(0); i < count; i++ {
+		alg, err := r.uint16()
+		if err != nil {
+			return nil, fmt.Errorf("spec ID event: %w", err)
+		}
+
+		size, err := r.uint16()
+		if err != nil {
+			return nil, fmt.Errorf("spec ID event: %w", err)
+		}
+		if size == 0 || size > maxDigestSize {
+			return nil, fmt.Errorf("%w: %d bytes digests for algorithm %#x", ErrMalformed, size, alg)
+		}
+
+		algorithms[tpm2.Algorithm(alg)] = int(size)
+	}
+
+	return algorithms, nil
+}
+
+// reader reads little endian event log fields, failing with ErrMalformed
+// instead of reading past the end of the log
+type reader struct {
+	buf []byte
+	off int
+}
+
+func (r *reader) remaining() int {
+	return len(r.buf) - r.off
+}
+
+func (r *reader) bytes(n int) ([]byte, error) {
+	if n < 0 || n > r.remaining() {
+		return nil, fmt.Errorf("%w: %d bytes needed at offset %d, %d left", ErrMalformed, n, r.off, r.remaining())
+	}
+
+	b := r.buf[r.off : r.off+n]
+	r.off += n
+
+	return b, nil
+}
+
+func (r *reader) uint16() (uint16, error) {
+	b, err := r.bytes(2)
+	if err != nil {
+		return 0, err
+	}
+
+	return binary.LittleEndian.Uint16(b), nil
+}
+
+func (r *reader) uint32() (uint32, error) {
+	b, err := r.bytes(4)
+	if err != nil {
+		return 0, err
+	}
+
+	return binary.LittleEndian.Uint32(b), nil
+}
+
+// header reads the PCR index and event type common to both event formats
+func (r *reader) header() (*Event, error) {
+	pcr, err := r.uint32()
+	if err != nil {
+		return nil, err
+	}
+	if pcr > maxPCR {
+		return nil, fmt.Errorf("%w: PCR %d", ErrMalformed, pcr)
+	}
+
+	eventType, err := r.uint32()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Event{
+		PCR:     int(pcr),
+		Type:    EventType(eventType),
+		Digests: map[tpm2.Algorithm][]byte{},
+	}, nil
+}
+
+// data reads the size prefixed event data
+func (r *reader) data() ([]byte, error) {
+	size, err := r.uint32()
+	if err != nil {
+		return nil, err
+	}
+	if int64(size) > int64(r.remaining()) {
+		return nil, fmt.Errorf("%w: %d bytes of event data, %d left", ErrMalformed, size, r.remaining())
+	}
+
+	return r.bytes(int(size))
+}
+
+// legacyEvent reads a TCG_PCR_EVENT
+func (r *reader) legacyEvent() (*Event, error) {
+	e, err := r.header()
+	if err != nil {
+		return nil, err
+	}
+
+	digest, err := r.bytes(20)
+	if err != nil {
+		return nil, err
+	}
+	e.Digests[tpm2.AlgSHA1] = digest
+
+	if e.Data, err = r.data(); err != nil {
+		return nil, err
+	}
+
+	return e, nil
+}
+
+// agileEvent reads a TCG_PCR_EVENT2 with digests in the given algorithms
+func (r *reader) agileEvent(algorithms map[tpm2.Algorithm]int) (*Event, error) {
+	e, err := r.header()
+	if err != nil {
+		return nil, err
+	}
+
+	count, err := r.uint32()
+	if err != nil {
+		return nil, err
+	}
+	if count > uint32(len(algorithms)) {
+		return nil, fmt.Errorf("%w: %d digests, the log has %d algorithms", ErrMalformed, count, len(algorithms))
+	}
+
+	for i := uint32(0); i < count; i++ {
+		alg, err := r.uint16()
+		if err != nil {
+			return nil, err
+		}
+
+		size, ok := algorithms[tpm2.Algorithm(alg)]
+		if !ok {
+			return nil, fmt.Errorf("%w: digest algorithm %#x not in the spec ID event", ErrMalformed, alg)
+		}
+
+		if e.Digests[tpm2.Algorithm(alg)], err = r.bytes(size); err != nil {
+			return nil, err
+		}
+	}
+
+	if e.Data, err = r.data(); err != nil {
+		return nil, err
+	}
+
+	return e, nil
+}
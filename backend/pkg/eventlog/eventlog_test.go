@@ -0,0 +1,468 @@
+// Copyright 2023 EnactTrust LTD All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+
+package eventlog
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"reflect"
+	"testing"
+	"unicode/utf16"
+
+	"github.com/google/go-tpm/tpm2"
+)
+
+// testEvent is an event of a test log, whose digests are the hashes of
+// measured, or of data when measured is nil
+type testEvent struct {
+	pcr      uint32
+	typ      EventType
+	data     []byte
+	measured []byte
+}
+
+func le16(v uint16) []byte {
+	b := make([]byte, 2)
+	binary.LittleEndian.PutUint16(b, v)
+	return b
+}
+
+func le32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, v)
+	return b
+}
+
+func le64(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, v)
+	return b
+}
+
+func digestOf(t *testing.T, alg tpm2.Algorithm, data []byte) []byte {
+	t.Helper()
+
+	h, err := alg.Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hh := h.New()
+	hh.Write(data)
+
+	return hh.Sum(nil)
+}
+
+func (e testEvent) digest(t *testing.T, alg tpm2.Algorithm) []byte {
+	if e.measured != nil {
+		return digestOf(t, alg, e.measured)
+	}
+
+	return digestOf(t, alg, e.data)
+}
+
+// specIDEvent builds the TCG_EfiSpecIdEvent listing the algorithms
+func specIDEvent(t *testing.T, algs []tpm2.Algorithm) []byte {
+	var b bytes.Buffer
+
+	b.Write(specIDSignature)
+	b.Write(le32(0))         // platformClass
+	b.Write([]byte{0, 2, 0}) // specVersionMinor, specVersionMajor, specErrata
+	b.WriteByte(2)           // uintnSize
+	b.Write(le32(uint32(len(algs))))
+	for _, alg := range algs {
+		b.Write(le16(uint16(alg)))
+		b.Write(le16(uint16(len(digestOf(t, alg, nil)))))
+	}
+	b.WriteByte(0) // vendorInfoSize
+
+	return b.Bytes()
+}
+
+// legacyEvent encodes a TCG_PCR_EVENT
+func legacyEvent(t *testing.T, e testEvent) []byte {
+	var b bytes.Buffer
+
+	b.Write(le32(e.pcr))
+	b.Write(le32(uint32(e.typ)))
+	b.Write(e.digest(t, tpm2.AlgSHA1))
+	b.Write(le32(uint32(len(e.data))))
+	b.Write(e.data)
+
+	return b.Bytes()
+}
+
+// agileLog encodes a crypto agile log with digests in the algorithms
+func agileLog(t *testing.T, algs []tpm2.Algorithm, events ...testEvent) []byte {
+	t.Helper()
+
+	var b bytes.Buffer
+
+	b.Write(legacyEvent(t, testEvent{typ: EvNoAction, data: specIDEvent(t, algs), measured: []byte{}}))
+	for _, e := range events {
+		b.Write(le32(e.pcr))
+		b.Write(le32(uint32(e.typ)))
+		b.Write(le32(uint32(len(algs))))
+		for _, alg := range algs {
+			b.Write(le16(uint16(alg)))
+			b.Write(e.digest(t, alg))
+		}
+		b.Write(le32(uint32(len(e.data))))
+		b.Write(e.data)
+	}
+
+	return b.Bytes()
+}
+
+// legacyLog encodes a SHA-1 only log
+func legacyLog(t *testing.T, events ...testEvent) []byte {
+	t.Helper()
+
+	var b bytes.Buffer
+	for _, e := range events {
+		b.Write(legacyEvent(t, e))
+	}
+
+	return b.Bytes()
+}
+
+func ucs2(s string) []byte {
+	var b []byte
+	for _, c := range utf16.Encode([]rune(s)) {
+		b = append(b, le16(c)...)
+	}
+
+	return b
+}
+
+// uefiVariable encodes a UEFI_VARIABLE_DATA
+func uefiVariable(name string, value []byte) []byte {
+	var b bytes.Buffer
+
+	b.Write(make([]byte, 16))
+	b.Write(le64(uint64(len([]rune(name)))))
+	b.Write(le64(uint64(len(value))))
+	b.Write(ucs2(name))
+	b.Write(value)
+
+	return b.Bytes()
+}
+
+// imageLoadEvent encodes a UEFI_IMAGE_LOAD_EVENT with a file path device
+// path
+func imageLoadEvent(path string) []byte {
+	var dp bytes.Buffer
+
+	file := append(ucs2(path), 0, 0)
+	dp.Write([]byte{0x04, 0x04})
+	dp.Write(le16(uint16(4 + len(file))))
+	dp.Write(file)
+	dp.Write([]byte{0x7f, 0xff, 4, 0})
+
+	var b bytes.Buffer
+	b.Write(le64(0x1000))
+	b.Write(le64(0x2000))
+	b.Write(le64(0))
+	b.Write(le64(uint64(dp.Len())))
+	b.Write(dp.Bytes())
+
+	return b.Bytes()
+}
+
+var separator = testEvent{typ: EvSeparator, data: []byte{0, 0, 0, 0}}
+
+// extend extends the digests of the events into a PCR starting from initial
+func extend(t *testing.T, alg tpm2.Algorithm, initial []byte, events ...testEvent) []byte {
+	value := initial
+	for _, e := range events {
+		value = digestOf(t, alg, append(append([]byte{}, value...), e.digest(t, alg)...))
+	}
+
+	return value
+}
+
+func TestParse(t *testing.T) {
+	events := []testEvent{
+		{pcr: 0, typ: EvSCRTMVersion, data: ucs2("1.0\x00")},
+		{pcr: 7, typ: EvSeparator, data: []byte{0, 0, 0, 0}},
+	}
+
+	cases := []struct {
+		name       string
+		data       []byte
+		algorithms map[tpm2.Algorithm]int
+	}{
+		{"agile", agileLog(t, []tpm2.Algorithm{tpm2.AlgSHA1, tpm2.AlgSHA256}, events...), map[tpm2.Algorithm]int{tpm2.AlgSHA1: 20, tpm2.AlgSHA256: 32}},
+		{"agile SHA-384", agileLog(t, []tpm2.Algorithm{tpm2.AlgSHA384}, events...), map[tpm2.Algorithm]int{tpm2.AlgSHA384: 48}},
+		{"legacy", legacyLog(t, events...), map[tpm2.Algorithm]int{tpm2.AlgSHA1: 20}},
+	}
+
+	for _, c := range cases {
+		l, err := Parse(c.data)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+
+		if !reflect.DeepEqual(l.Algorithms, c.algorithms) {
+			t.Errorf("%s: algorithms %v", c.name, l.Algorithms)
+		}
+
+		if len(l.Events) != len(events) {
+			t.Fatalf("%s: %d events", c.name, len(l.Events))
+		}
+
+		for i, want := range events {
+			got := l.Events[i]
+			if got.Sequence != i || got.PCR != int(want.pcr) || got.Type != want.typ || !bytes.Equal(got.Data, want.data) {
+				t.Errorf("%s: event %d is %+v", c.name, i, got)
+			}
+
+			for alg := range c.algorithms {
+				if !bytes.Equal(got.Digests[alg], want.digest(t, alg)) {
+					t.Errorf("%s: event %d %v digest %x", c.name, i, alg, got.Digests[alg])
+				}
+			}
+		}
+	}
+}
+
+func TestReplay(t *testing.T) {
+	banks := []tpm2.Algorithm{tpm2.AlgSHA1, tpm2.AlgSHA256}
+	zero := func(alg tpm2.Algorithm) []byte { return make([]byte, len(digestOf(t, alg, nil))) }
+	locality3 := func(alg tpm2.Algorithm) []byte {
+		v := zero(alg)
+		v[len(v)-1] = 3
+		return v
+	}
+
+	crtm := testEvent{pcr: 0, typ: EvSCRTMVersion, data: ucs2("1.0\x00")}
+	startup := testEvent{pcr: 0, typ: EvNoAction, data: append([]byte("StartupLocality\x00"), 3)}
+	action := testEvent{pcr: 4, typ: EvEFIAction, data: []byte("Calling EFI Application from Boot Option")}
+
+	cases := []struct {
+		name string
+		data []byte
+		bank tpm2.Algorithm
+		want map[int][]byte
+	}{
+		{
+			name: "agile SHA-256",
+			data: agileLog(t, banks, crtm, separator, action, testEvent{pcr: 4, typ: EvSeparator, data: separator.data}),
+			bank: tpm2.AlgSHA256,
+			want: map[int][]byte{
+				0: extend(t, tpm2.AlgSHA256, zero(tpm2.AlgSHA256), crtm, separator),
+				4: extend(t, tpm2.AlgSHA256, zero(tpm2.AlgSHA256), action, separator),
+			},
+		},
+		{
+			name: "agile SHA-1",
+			data: agileLog(t, banks, crtm, separator),
+			bank: tpm2.AlgSHA1,
+			want: map[int][]byte{0: extend(t, tpm2.AlgSHA1, zero(tpm2.AlgSHA1), crtm, separator)},
+		},
+		{
+			name: "startup locality",
+			data: agileLog(t, banks, startup, crtm),
+			bank: tpm2.AlgSHA256,
+			want: map[int][]byte{0: extend(t, tpm2.AlgSHA256, locality3(tpm2.AlgSHA256), crtm)},
+		},
+		{
+			name: "legacy",
+			data: legacyLog(t, crtm, separator),
+			bank: tpm2.AlgSHA1,
+			want: map[int][]byte{0: extend(t, tpm2.AlgSHA1, zero(tpm2.AlgSHA1), crtm, separator)},
+		},
+	}
+
+	for _, c := range cases {
+		l, err := Parse(c.data)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+
+		got, err := l.Replay(c.bank)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: replayed %x, want %x", c.name, got, c.want)
+		}
+	}
+}
+
+// TestReplayKnownValue replays the separator into PCR 7 as any firmware
+// does when it measures nothing else there
+func TestReplayKnownValue(t *testing.T) {
+	l, err := Parse(agileLog(t, []tpm2.Algorithm{tpm2.AlgSHA256}, testEvent{pcr: 7, typ: EvSeparator, data: separator.data}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pcrs, err := l.Replay(tpm2.AlgSHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// SHA-256(zeros || SHA-256(00000000))
+	const want = "3d458cfe55cc03ea1f443f1562beec8df51c75e14a9fcf9a7234a13f198e7969"
+	if hex.EncodeToString(pcrs[7]) != want {
+		t.Fatalf("PCR 7 is %x", pcrs[7])
+	}
+}
+
+func TestReplayNoBank(t *testing.T) {
+	l, err := Parse(legacyLog(t, separator))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := l.Replay(tpm2.AlgSHA256); !errors.Is(err, ErrNoBank) {
+		t.Fatal(err)
+	}
+}
+
+func TestParseMalformed(t *testing.T) {
+	sha256 := []tpm2.Algorithm{tpm2.AlgSHA256}
+	valid := agileLog(t, sha256, separator)
+	header := agileLog(t, sha256)
+
+	// The size of the event data, at the end of the log but for the
+	// separator data
+	dataSize := len(valid) - 4 - 4
+
+	withUint32 := func(data []byte, off int, v uint32) []byte {
+		b := append([]byte{}, data...)
+		binary.LittleEndian.PutUint32(b[off:], v)
+		return b
+	}
+
+	// Offset of the number of algorithms in the spec ID event, after the
+	// header event fields and the spec ID fields before it
+	algCount := 4 + 4 + 20 + 4 + len(specIDSignature) + 4 + 4
+
+	cases := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"truncated header", header[:10]},
+		{"truncated spec ID", header[:len(header)-3]},
+		{"truncated event", valid[:len(header)+6]},
+		{"truncated digest", valid[:len(header)+4+4+4+2+16]},
+		{"truncated data", valid[:len(valid)-1]},
+		{"oversized data", withUint32(valid, dataSize, 0xffffffff)},
+		{"oversized header data", withUint32(header, 4+4+20, uint32(len(header)))},
+		{"PCR out of range", withUint32(valid, len(header), 24)},
+		{"too many digests", withUint32(valid, len(header)+8, 2)},
+		{"too many algorithms", withUint32(header, algCount, maxAlgorithms+1)},
+		{"no algorithms", withUint32(header, algCount, 0)},
+		{"unknown digest algorithm", func() []byte {
+			b := append([]byte{}, valid...)
+			binary.LittleEndian.PutUint16(b[len(header)+12:], uint16(tpm2.AlgSHA1))
+			return b
+		}()},
+		{"oversized digest", func() []byte {
+			b := append([]byte{}, header...)
+			binary.LittleEndian.PutUint16(b[algCount+4+2:], maxDigestSize+1)
+			return b
+		}()},
+	}
+
+	for _, c := range cases {
+		if _, err := Parse(c.data); !errors.Is(err, ErrMalformed) {
+			t.Errorf("%s: %v", c.name, err)
+		}
+	}
+
+	// Cut anywhere within its only event, the log is malformed
+	for n := len(header) + 1; n < len(valid); n++ {
+		if _, err := Parse(valid[:n]); !errors.Is(err, ErrMalformed) {
+			t.Errorf("truncated to %d bytes: %v", n, err)
+		}
+	}
+}
+
+func TestClaims(t *testing.T) {
+	enabled := true
+
+	crtm := testEvent{pcr: 0, typ: EvSCRTMVersion, data: ucs2("2.17.1249\x00")}
+	secureBoot := testEvent{pcr: 7, typ: EvEFIVariableDriverConfig, data: uefiVariable("SecureBoot", []byte{1})}
+	pk := testEvent{pcr: 7, typ: EvEFIVariableDriverConfig, data: uefiVariable("PK", []byte("pk"))}
+	shim := testEvent{pcr: 4, typ: EvEFIBootServicesApplication, data: imageLoadEvent(`\EFI\ubuntu\shimx64.efi`), measured: []byte("shim")}
+	kernel := testEvent{pcr: 8, typ: EvIPL, data: []byte("kernel_cmdline: /vmlinuz-6.1 root=/dev/sda1 ro\x00"), measured: []byte("/vmlinuz-6.1 root=/dev/sda1 ro")}
+	grubCmd := testEvent{pcr: 8, typ: EvIPL, data: []byte("grub_cmd: linux /vmlinuz-6.1\x00"), measured: []byte("linux /vmlinuz-6.1")}
+	bootFile := testEvent{pcr: 9, typ: EvIPL, data: []byte("/boot/vmlinuz-6.1\x00"), measured: []byte("kernel image")}
+
+	// Events whose data was replaced after they were measured
+	forgedCRTM := testEvent{pcr: 0, typ: EvSCRTMVersion, data: ucs2("9.9\x00"), measured: ucs2("2.17.1249\x00")}
+	forgedSecureBoot := testEvent{pcr: 7, typ: EvEFIVariableDriverConfig, data: uefiVariable("SecureBoot", []byte{1}), measured: uefiVariable("SecureBoot", []byte{0})}
+	forgedKernel := testEvent{pcr: 8, typ: EvIPL, data: []byte("kernel_cmdline: /vmlinuz-6.1 root=/dev/sda1 ro\x00"), measured: []byte("/vmlinuz-6.1 root=/dev/sda1 ro init=/bin/sh")}
+
+	all := map[int]bool{0: true, 4: true, 7: true, 8: true, 9: true}
+	sha256 := []tpm2.Algorithm{tpm2.AlgSHA256}
+
+	cases := []struct {
+		name   string
+		events []testEvent
+		pcrs   map[int]bool
+		want   Claims
+	}{
+		{
+			name:   "verified",
+			events: []testEvent{crtm, shim, secureBoot, pk, grubCmd, kernel, bootFile},
+			pcrs:   all,
+			want: Claims{
+				SecureBoot: &enabled,
+				SecureBootVariables: map[string][]byte{
+					"SecureBoot": secureBoot.digest(t, tpm2.AlgSHA256),
+					"PK":         pk.digest(t, tpm2.AlgSHA256),
+				},
+				CRTMVersion:      "2.17.1249",
+				BootApplications: []BootApplication{{Path: `\EFI\ubuntu\shimx64.efi`, Digest: shim.digest(t, tpm2.AlgSHA256)}},
+				Kernel:           "/vmlinuz-6.1",
+				KernelCmdline:    "root=/dev/sda1 ro",
+				BootFiles:        []string{"/boot/vmlinuz-6.1"},
+			},
+		},
+		{
+			name:   "unverified",
+			events: []testEvent{forgedCRTM, forgedSecureBoot, pk, forgedKernel},
+			pcrs:   all,
+			want: Claims{
+				SecureBootVariables: map[string][]byte{"PK": pk.digest(t, tpm2.AlgSHA256)},
+				UnverifiedEvents:    []int{0, 1, 3},
+			},
+		},
+		{
+			name:   "PCR selection",
+			events: []testEvent{crtm, secureBoot, kernel},
+			pcrs:   map[int]bool{0: true},
+			want:   Claims{CRTMVersion: "2.17.1249"},
+		},
+	}
+
+	for _, c := range cases {
+		l, err := Parse(agileLog(t, sha256, c.events...))
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+
+		if got := l.Claims(tpm2.AlgSHA256, c.pcrs); !reflect.DeepEqual(*got, c.want) {
+			t.Errorf("%s: claims %+v, want %+v", c.name, *got, c.want)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright 2023 EnactTrust LTD All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+
+package eventlog
+
+import (
+	"bytes"
+	_ "crypto/sha1"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"fmt"
+
+	"github.com/google/go-tpm/tpm2"
+)
+
+// startupLocality is the EV_NO_ACTION event telling the locality the TPM
+// was started from, which becomes the last byte of the initial PCR 0
+var startupLocality = []byte("StartupLocality\x00")
+
+// Replay extends, in the given bank, the digests of the events into PCRs
+// starting from zero, and returns the resulting value of every PCR the log
+// extends
+func (l *Log) Replay(bank tpm2.Algorithm) (map[int][]byte, error) {
+	size, ok := l.Algorithms[bank]
+	if !ok {
+		return nil, fmt.Errorf("%w %v", ErrNoBank, bank)
+	}
+
+	h, err := bank.Hash()
+	if err != nil {
+		return nil, err
+	}
+
+	pcrs := map[int][]byte{}
+
+	for _, e := range l.Events {
+		if e.Type == EvNoAction {
+			// Not extended, but may set the initial value of PCR 0
+			if e.PCR == 0 && bytes.HasPrefix(e.Data, startupLocality) && len(e.Data) > len(startupLocality) {
+				initial := make([]byte, size)
+				initial[size-1] = e.Data[len(startupLocality)]
+				pcrs[0] = initial
+			}
+			continue
+		}
+
+		digest, ok := e.Digests[bank]
+		if !ok {
+			return nil, fmt.Errorf("%w: event %d has no %v digest", ErrMalformed, e.Sequence, bank)
+		}
+
+		value, ok := pcrs[e.PCR]
+		if !ok {
+			value = make([]byte, size)
+		}
+
+		hh := h.New()
+		hh.Write(value)
+		hh.Write(digest)
+		pcrs[e.PCR] = hh.Sum(nil)
+	}
+
+	return pcrs, nil
+}
@@ -0,0 +1,371 @@
+// Copyright 2023 EnactTrust LTD All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+
+// Package ima parses the Linux IMA runtime measurement list, in its ascii
+// (ascii_runtime_measurements) or binary (binary_runtime_measurements) form,
+// and replays it into PCR values.
+package ima
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Template names
+const (
+	// Original template: SHA-1 file digest and a name of at most 255 bytes
+	TemplateIMA = "ima"
+	// d-ng|n-ng
+	TemplateIMANG = "ima-ng"
+	// d-ng|n-ng|sig
+	TemplateIMASig = "ima-sig"
+	// d-ng|n-ng|buf
+	TemplateIMABuf = "ima-buf"
+)
+
+// Name of the first entry, measuring the boot aggregate of PCRs 0-7 (or 0-9)
+const BootAggregate = "boot_aggregate"
+
+// Limits protecting the parser from hostile lists
+const (
+	maxPCR          = 23
+	maxTemplateName = 255
+	maxTemplateData = 64 * 1024
+	// Room the "ima" template reserves for the file name in the template data
+	imaNameLen = 256
+	sha1Size   = 20
+)
+
+var ErrMalformed = errors.New("malformed IMA measurement list")
+
+// Entry is one measurement of the list
+type Entry struct {
+	PCR int
+	// SHA-1 template hash, all zero for a violation: a file measured while
+	// open for writing, or written while open for measurement
+	TemplateHash []byte
+	Template     string
+	// Template data, as hashed into the template hash. Nil when it cannot be
+	// rebuilt from an ascii entry of an unknown template.
+	TemplateData []byte
+	// File digest and its hash algorithm, e.g. "sha256"
+	Algorithm  string
+	FileDigest []byte
+	// File path, or the name of a buffer measurement
+	Path string
+}
+
+// Violation tells whether the entry records a measurement violation
+func (e *Entry) Violation() bool {
+	return bytes.Equal(e.TemplateHash, make([]byte, sha1Size))
+}
+
+// Decoded tells whether the file digest and path were decoded from the
+// template data, which they are for the templates known to this package
+func (e *Entry) Decoded() bool {
+	switch e.Template {
+	case TemplateIMA, TemplateIMANG, TemplateIMASig, TemplateIMABuf:
+		return true
+	default:
+		return false
+	}
+}
+
+// Digest formats the file digest as in the ascii list, e.g. "sha256:ab01..."
+func (e *Entry) Digest() string {
+	return e.Algorithm + ":" + hex.EncodeToString(e.FileDigest)
+}
+
+// Log is a parsed measurement list
+type Log struct {
+	Entries []Entry
+}
+
+// Parse parses an ascii or a binary measurement list. A binary list starts
+// with a little endian PCR index, which an ascii one cannot.
+func Parse(data []byte) (*Log, error) {
+	if len(data) >= 4 && binary.LittleEndian.Uint32(data) <= maxPCR {
+		return parseBinary(data)
+	}
+
+	return parseASCII(data)
+}
+
+func parseBinary(data []byte) (*Log, error) {
+	log := &Log{}
+	r := &reader{buf: data}
+
+	for r.remaining() > 0 {
+		e, err := r.entry()
+		if err != nil {
+			return nil, fmt.Errorf("entry %d: %w", len(log.Entries), err)
+		}
+
+		log.Entries = append(log.Entries, *e)
+	}
+
+	return log, nil
+}
+
+// parseASCII parses lines of "<pcr> <template hash> <template> <fields>".
+// Fields are space separated, so the optional signature of ima-sig is taken
+// to be the last field of a line with more than one field after the path.
+func parseASCII(data []byte) (*Log, error) {
+	log := &Log{}
+	s := bufio.NewScanner(bytes.NewReader(data))
+	s.Buffer(nil, maxTemplateData)
+
+	for s.Scan() {
+		line := s.Text()
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		e, err := asciiEntry(line)
+		if err != nil {
+			return nil, fmt.Errorf("entry %d: %w", len(log.Entries), err)
+		}
+
+		log.Entries = append(log.Entries, *e)
+	}
+
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMalformed, err)
+	}
+
+	return log, nil
+}
+
+func asciiEntry(line string) (*Entry, error) {
+	f := strings.Fields(line)
+	if len(f) < 5 {
+		return nil, fmt.Errorf("%w: %q", ErrMalformed, line)
+	}
+
+	e := &Entry{Template: f[2]}
+
+	if _, err := fmt.Sscanf(f[0], "%d", &e.PCR); err != nil || e.PCR < 0 || e.PCR > maxPCR {
+		return nil, fmt.Errorf("%w: PCR %q", ErrMalformed, f[0])
+	}
+
+	var err error
+	if e.TemplateHash, err = hex.DecodeString(f[1]); err != nil || len(e.TemplateHash) != sha1Size {
+		return nil, fmt.Errorf("%w: template hash %q", ErrMalformed, f[1])
+	}
+
+	if e.Template == TemplateIMA {
+		e.Algorithm = "sha1"
+		if e.FileDigest, err = hex.DecodeString(f[3]); err != nil || len(e.FileDigest) != sha1Size {
+			return nil, fmt.Errorf("%w: file digest %q", ErrMalformed, f[3])
+		}
+		e.Path = strings.Join(f[4:], " ")
+		e.TemplateData = imaTemplateData(e.FileDigest, e.Path)
+
+		return e, nil
+	}
+
+	alg := strings.SplitN(f[3], ":", 2)
+	if len(alg) != 2 {
+		return nil, fmt.Errorf("%w: file digest %q", ErrMalformed, f[3])
+	}
+
+	e.Algorithm = alg[0]
+	if e.FileDigest, err = hex.DecodeString(alg[1]); err != nil {
+		return nil, fmt.Errorf("%w: file digest %q", ErrMalformed, f[3])
+	}
+
+	path := f[4:]
+	var extra []byte
+
+	switch e.Template {
+	case TemplateIMANG:
+	case TemplateIMASig, TemplateIMABuf:
+		if len(path) > 1 || e.Template == TemplateIMABuf {
+			if extra, err = hex.DecodeString(path[len(path)-1]); err != nil {
+				return nil, fmt.Errorf("%w: %s field %q", ErrMalformed, e.Template, path[len(path)-1])
+			}
+			path = path[:len(path)-1]
+		}
+	default:
+		// The template data of unknown templates cannot be rebuilt
+		e.Path = strings.Join(path, " ")
+		return e, nil
+	}
+
+	e.Path = strings.Join(path, " ")
+
+	fields := [][]byte{dngField(e.Algorithm, e.FileDigest), append([]byte(e.Path), 0)}
+	if e.Template != TemplateIMANG {
+		fields = append(fields, extra)
+	}
+	e.TemplateData = templateData(fields)
+
+	return e, nil
+}
+
+// imaTemplateData builds the template data of the "ima" template: the SHA-1
+// file digest and the name, zero padded
+func imaTemplateData(digest []byte, name string) []byte {
+	data := make([]byte, sha1Size+imaNameLen)
+	copy(data, digest)
+	copy(data[sha1Size:sha1Size+imaNameLen-1], name)
+
+	return data
+}
+
+// dngField builds a d-ng field: "<algorithm>:", a NUL and the digest
+func dngField(alg string, digest []byte) []byte {
+	return append(append([]byte(alg+":"), 0), digest...)
+}
+
+// templateData concatenates length prefixed fields
+func templateData(fields [][]byte) []byte {
+	var b bytes.Buffer
+	for _, f := range fields {
+		binary.Write(&b, binary.LittleEndian, uint32(len(f)))
+		b.Write(f)
+	}
+
+	return b.Bytes()
+}
+
+// reader reads little endian binary list fields, failing with ErrMalformed
+// instead of reading past the end of the list
+type reader struct {
+	buf []byte
+	off int
+}
+
+func (r *reader) remaining() int {
+	return len(r.buf) - r.off
+}
+
+func (r *reader) bytes(n int) ([]byte, error) {
+	if n < 0 || n > r.remaining() {
+		return nil, fmt.Errorf("%w: %d bytes needed at offset %d, %d left", ErrMalformed, n, r.off, r.remaining())
+	}
+
+	b := r.buf[r.off : r.off+n]
+	r.off += n
+
+	return b, nil
+}
+
+func (r *reader) uint32() (uint32, error) {
+	b, err := r.bytes(4)
+	if err != nil {
+		return 0, err
+	}
+
+	return binary.LittleEndian.Uint32(b), nil
+}
+
+// sized reads a length prefixed field of at most max bytes
+func (r *reader) sized(max uint32) ([]byte, error) {
+	n, err := r.uint32()
+	if err != nil {
+		return nil, err
+	}
+	if n > max {
+		return nil, fmt.Errorf("%w: %d bytes field, at most %d", ErrMalformed, n, max)
+	}
+
+	return r.bytes(int(n))
+}
+
+// entry reads "<pcr> <template hash> <template name> <template data>". The
+// "ima" template data is not length prefixed, and its name is.
+func (r *reader) entry() (*Entry, error) {
+	pcr, err := r.uint32()
+	if err != nil {
+		return nil, err
+	}
+	if pcr > maxPCR {
+		return nil, fmt.Errorf("%w: PCR %d", ErrMalformed, pcr)
+	}
+
+	e := &Entry{PCR: int(pcr)}
+
+	if e.TemplateHash, err = r.bytes(sha1Size); err != nil {
+		return nil, err
+	}
+
+	name, err := r.sized(maxTemplateName)
+	if err != nil {
+		return nil, err
+	}
+	e.Template = string(name)
+
+	if e.Template == TemplateIMA {
+		e.Algorithm = "sha1"
+		if e.FileDigest, err = r.bytes(sha1Size); err != nil {
+			return nil, err
+		}
+
+		path, err := r.sized(imaNameLen - 1)
+		if err != nil {
+			return nil, err
+		}
+		e.Path = string(path)
+		e.TemplateData = imaTemplateData(e.FileDigest, e.Path)
+
+		return e, nil
+	}
+
+	if e.TemplateData, err = r.sized(maxTemplateData); err != nil {
+		return nil, err
+	}
+
+	if err := e.decodeFields(); err != nil {
+		return nil, err
+	}
+
+	return e, nil
+}
+
+// decodeFields decodes the d-ng and n-ng fields that the templates known to
+// this package start with. Fields of other templates are left undecoded.
+func (e *Entry) decodeFields() error {
+	switch e.Template {
+	case TemplateIMANG, TemplateIMASig, TemplateIMABuf:
+	default:
+		return nil
+	}
+
+	r := &reader{buf: e.TemplateData}
+
+	dng, err := r.sized(maxTemplateData)
+	if err != nil {
+		return err
+	}
+
+	i := bytes.IndexByte(dng, 0)
+	if i < 1 || dng[i-1] != ':' {
+		return fmt.Errorf("%w: d-ng field without algorithm", ErrMalformed)
+	}
+	e.Algorithm = string(dng[:i-1])
+	e.FileDigest = dng[i+1:]
+
+	nng, err := r.sized(maxTemplateData)
+	if err != nil {
+		return err
+	}
+	e.Path = string(bytes.TrimRight(nng, "\x00"))
+
+	return nil
+}
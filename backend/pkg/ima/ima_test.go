@@ -0,0 +1,379 @@
+// Copyright 2023 EnactTrust LTD All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+
+package ima
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/google/go-tpm/tpm2"
+)
+
+// testEntry is a measurement of a test list
+type testEntry struct {
+	pcr      int
+	template string
+	alg      string
+	digest   []byte
+	path     string
+	// Signature of ima-sig or buffer of ima-buf, nil for none
+	extra []byte
+}
+
+// data returns the template data of the entry
+func (e testEntry) data() []byte {
+	switch e.template {
+	case TemplateIMA:
+		return imaTemplateData(e.digest, e.path)
+	case TemplateIMANG:
+		return templateData([][]byte{dngField(e.alg, e.digest), append([]byte(e.path), 0)})
+	default:
+		return templateData([][]byte{dngField(e.alg, e.digest), append([]byte(e.path), 0), e.extra})
+	}
+}
+
+func (e testEntry) templateHash() []byte {
+	sum := sha1.Sum(e.data())
+	return sum[:]
+}
+
+// ascii formats the entry as a line of ascii_runtime_measurements
+func (e testEntry) ascii() string {
+	digest := hex.EncodeToString(e.digest)
+	if e.template != TemplateIMA {
+		digest = e.alg + ":" + digest
+	}
+
+	line := fmt.Sprintf("%d %x %s %s %s", e.pcr, e.templateHash(), e.template, digest, e.path)
+	if e.extra != nil {
+		line += " " + hex.EncodeToString(e.extra)
+	}
+
+	return line + "\n"
+}
+
+func le32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, v)
+	return b
+}
+
+// binaryEntry encodes an entry of binary_runtime_measurements with the
+// template hash and data given
+func binaryEntry(pcr int, templateHash []byte, template string, data []byte) []byte {
+	var b bytes.Buffer
+
+	b.Write(le32(uint32(pcr)))
+	b.Write(templateHash)
+	b.Write(le32(uint32(len(template))))
+	b.WriteString(template)
+	b.Write(le32(uint32(len(data))))
+	b.Write(data)
+
+	return b.Bytes()
+}
+
+// binary formats the entry as in binary_runtime_measurements
+func (e testEntry) binary() []byte {
+	if e.template == TemplateIMA {
+		var b bytes.Buffer
+
+		b.Write(le32(uint32(e.pcr)))
+		b.Write(e.templateHash())
+		b.Write(le32(uint32(len(e.template))))
+		b.WriteString(e.template)
+		b.Write(e.digest)
+		b.Write(le32(uint32(len(e.path))))
+		b.WriteString(e.path)
+
+		return b.Bytes()
+	}
+
+	return binaryEntry(e.pcr, e.templateHash(), e.template, e.data())
+}
+
+func asciiList(entries ...testEntry) []byte {
+	var b strings.Builder
+	for _, e := range entries {
+		b.WriteString(e.ascii())
+	}
+
+	return []byte(b.String())
+}
+
+func binaryList(entries ...testEntry) []byte {
+	var b bytes.Buffer
+	for _, e := range entries {
+		b.Write(e.binary())
+	}
+
+	return b.Bytes()
+}
+
+var (
+	bootAggregate = testEntry{pcr: 10, template: TemplateIMANG, alg: "sha256", digest: bytes.Repeat([]byte{0xba}, 32), path: BootAggregate}
+	imaEntry      = testEntry{pcr: 10, template: TemplateIMA, alg: "sha1", digest: bytes.Repeat([]byte{0x01}, 20), path: "/usr/bin/bash"}
+	ngEntry       = testEntry{pcr: 10, template: TemplateIMANG, alg: "sha256", digest: bytes.Repeat([]byte{0x02}, 32), path: "/usr/lib/libc.so.6"}
+	sigEntry      = testEntry{pcr: 10, template: TemplateIMASig, alg: "sha512", digest: bytes.Repeat([]byte{0x03}, 64), path: "/usr/sbin/sshd", extra: []byte{0x03, 0x02, 0x04}}
+	bufEntry      = testEntry{pcr: 10, template: TemplateIMABuf, alg: "sha256", digest: bytes.Repeat([]byte{0x04}, 32), path: "kexec-cmdline", extra: []byte("root=/dev/sda1")}
+	otherPCR      = testEntry{pcr: 11, template: TemplateIMANG, alg: "sha256", digest: bytes.Repeat([]byte{0x05}, 32), path: "/etc/hosts"}
+)
+
+var allEntries = []testEntry{bootAggregate, imaEntry, ngEntry, sigEntry, bufEntry, otherPCR}
+
+func TestParse(t *testing.T) {
+	for name, data := range map[string][]byte{
+		"ascii":  asciiList(allEntries...),
+		"binary": binaryList(allEntries...),
+	} {
+		l, err := Parse(data)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		if len(l.Entries) != len(allEntries) {
+			t.Fatalf("%s: %d entries", name, len(l.Entries))
+		}
+
+		for i, want := range allEntries {
+			got := l.Entries[i]
+			if got.PCR != want.pcr || got.Template != want.template || got.Algorithm != want.alg ||
+				!bytes.Equal(got.FileDigest, want.digest) || got.Path != want.path {
+				t.Errorf("%s: entry %d is %+v", name, i, got)
+			}
+
+			if !bytes.Equal(got.TemplateHash, want.templateHash()) || !bytes.Equal(got.TemplateData, want.data()) {
+				t.Errorf("%s: entry %d template hash %x, data %x", name, i, got.TemplateHash, got.TemplateData)
+			}
+
+			if !got.Decoded() || got.Violation() {
+				t.Errorf("%s: entry %d decoded %v, violation %v", name, i, got.Decoded(), got.Violation())
+			}
+		}
+	}
+}
+
+// extend extends the template data hashes of the entries into a PCR
+func extend(t *testing.T, bank tpm2.Algorithm, value []byte, entries ...testEntry) []byte {
+	h, err := bank.Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, e := range entries {
+		th := h.New()
+		th.Write(e.data())
+
+		hh := h.New()
+		hh.Write(value)
+		hh.Write(th.Sum(nil))
+		value = hh.Sum(nil)
+	}
+
+	return value
+}
+
+func TestReplay(t *testing.T) {
+	// The kernel logs violations with the template data of the file
+	violation := binaryEntry(10, make([]byte, 20), TemplateIMANG, otherPCR.data())
+
+	for _, bank := range []tpm2.Algorithm{tpm2.AlgSHA1, tpm2.AlgSHA256, tpm2.AlgSHA384} {
+		h, err := bank.Hash()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		zero := make([]byte, h.Size())
+		ones := bytes.Repeat([]byte{0xff}, h.Size())
+
+		afterBoot := extend(t, bank, zero, bootAggregate)
+		afterNG := extend(t, bank, afterBoot, ngEntry)
+
+		hh := h.New()
+		hh.Write(afterNG)
+		hh.Write(ones)
+		afterViolation := hh.Sum(nil)
+
+		data := append(binaryList(bootAggregate, ngEntry, otherPCR), violation...)
+		data = append(data, sigEntry.binary()...)
+
+		l, err := Parse(data)
+		if err != nil {
+			t.Fatal(bank, err)
+		}
+
+		values, err := l.Replay(bank, 10)
+		if err != nil {
+			t.Fatal(bank, err)
+		}
+
+		want := [][]byte{
+			afterBoot,
+			afterNG,
+			// Entries of other PCRs leave the value as it was
+			afterNG,
+			afterViolation,
+			extend(t, bank, afterViolation, sigEntry),
+		}
+
+		if !reflect.DeepEqual(values, want) {
+			t.Errorf("%v: replayed %x, want %x", bank, values, want)
+		}
+	}
+}
+
+func TestReplayTemplateHash(t *testing.T) {
+	// The path of the entry was replaced after it was measured
+	tampered := ngEntry
+	tampered.path = "/usr/lib/libevil.so"
+	forgedLine := strings.Replace(ngEntry.ascii(), ngEntry.path, tampered.path, 1)
+	forgedBinary := binaryEntry(10, ngEntry.templateHash(), TemplateIMANG, tampered.data())
+
+	sum := sha1.Sum([]byte("custom fields"))
+	unknown := binaryEntry(10, sum[:], "ima-custom", []byte("custom fields"))
+
+	cases := []struct {
+		name string
+		data []byte
+		ok   bool
+		// Error of a list that is not replayed, nil for any
+		err error
+	}{
+		{"ascii path", []byte(bootAggregate.ascii() + forgedLine), false, ErrTemplateHash},
+		{"binary path", append(bootAggregate.binary(), forgedBinary...), false, ErrTemplateHash},
+		// The template data cannot be rebuilt
+		{"ascii unknown template", []byte(bootAggregate.ascii() + "10 " + strings.Repeat("ab", 20) + " ima-custom sha256:00 /etc/passwd\n"), false, nil},
+		{"binary unknown template", append(bootAggregate.binary(), unknown...), true, nil},
+	}
+
+	for _, c := range cases {
+		l, err := Parse(c.data)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+
+		for _, bank := range []tpm2.Algorithm{tpm2.AlgSHA1, tpm2.AlgSHA256} {
+			_, err := l.Replay(bank, 10)
+			if c.ok != (err == nil) || (c.err != nil && !errors.Is(err, c.err)) {
+				t.Errorf("%s: %v: %v", c.name, bank, err)
+			}
+		}
+	}
+
+	// Entries of unknown templates are replayed but not decoded
+	l, err := Parse(append(bootAggregate.binary(), unknown...))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if l.Entries[1].Decoded() || l.Entries[1].Path != "" {
+		t.Fatalf("unknown template entry %+v", l.Entries[1])
+	}
+
+	// Only the entries of the replayed PCR are checked
+	l, err = Parse([]byte(bootAggregate.ascii() + strings.Replace(forgedLine, "10 ", "11 ", 1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := l.Replay(tpm2.AlgSHA256, 10); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParseMalformed(t *testing.T) {
+	valid := binaryList(ngEntry)
+
+	withUint32 := func(data []byte, off int, v uint32) []byte {
+		b := append([]byte{}, data...)
+		binary.LittleEndian.PutUint32(b[off:], v)
+		return b
+	}
+
+	// Offsets of the template name and data sizes
+	nameSize := 4 + 20
+	dataSize := nameSize + 4 + len(TemplateIMANG)
+
+	cases := []struct {
+		name string
+		data []byte
+	}{
+		{"PCR out of range", withUint32(valid, 0, 24)},
+		{"oversized template name", withUint32(valid, nameSize, maxTemplateName+1)},
+		{"oversized template data", withUint32(valid, dataSize, maxTemplateData+1)},
+		{"template data past the end", withUint32(valid, dataSize, uint32(len(valid)))},
+		{"d-ng field past the end", withUint32(valid, dataSize+4, 0xffff)},
+		{"d-ng field without algorithm", binaryEntry(10, ngEntry.templateHash(), TemplateIMANG, templateData([][]byte{[]byte("sha256"), []byte("x\x00")}))},
+		{"ima name too long", func() []byte {
+			e := imaEntry
+			e.path = strings.Repeat("a", imaNameLen)
+			return e.binary()
+		}()},
+		{"ascii fields", []byte("10 " + strings.Repeat("ab", 20) + " ima-ng sha256:00\n")},
+		{"ascii PCR", []byte("x " + strings.Repeat("ab", 20) + " ima-ng sha256:00 /bin/sh\n")},
+		{"ascii template hash", []byte("10 abcd ima-ng sha256:00 /bin/sh\n")},
+		{"ascii file digest", []byte("10 " + strings.Repeat("ab", 20) + " ima-ng sha256 /bin/sh\n")},
+		{"ascii ima digest", []byte("10 " + strings.Repeat("ab", 20) + " ima 0102 /bin/sh\n")},
+		{"ascii buffer", []byte("10 " + strings.Repeat("ab", 20) + " ima-buf sha256:00 kexec-cmdline xyz\n")},
+		{"ascii line too long", []byte("10 " + strings.Repeat("ab", 20) + " ima-ng sha256:00 /" + strings.Repeat("a", maxTemplateData) + "\n")},
+	}
+
+	for _, c := range cases {
+		if _, err := Parse(c.data); !errors.Is(err, ErrMalformed) {
+			t.Errorf("%s: %v", c.name, err)
+		}
+	}
+
+	// Cut anywhere within an entry, the list is malformed. A list shorter
+	// than a PCR index is taken as ascii.
+	list := binaryList(bootAggregate, imaEntry)
+	boundary := len(bootAggregate.binary())
+	for n := 4; n < len(list); n++ {
+		if n == boundary {
+			continue
+		}
+
+		if _, err := Parse(list[:n]); !errors.Is(err, ErrMalformed) {
+			t.Errorf("truncated to %d bytes: %v", n, err)
+		}
+	}
+}
+
+// TestTemplateHashSHA256 checks that the template hash of the SHA-256 bank
+// is computed over the template data, not over the SHA-1 template hash
+func TestTemplateHashSHA256(t *testing.T) {
+	l, err := Parse(binaryList(ngEntry))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	values, err := l.Replay(tpm2.AlgSHA256, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	th := sha256.Sum256(ngEntry.data())
+	want := sha256.Sum256(append(make([]byte, 32), th[:]...))
+	if !bytes.Equal(values[0], want[:]) {
+		t.Fatalf("PCR 10 is %x", values[0])
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright 2023 EnactTrust LTD All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+
+package ima
+
+import (
+	"bytes"
+	"crypto/sha1"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"errors"
+	"fmt"
+
+	"github.com/google/go-tpm/tpm2"
+)
+
+// ErrTemplateHash is returned for an entry whose template hash is not the
+// hash of its template data, which would let the file digest and path differ
+// from what was extended into the PCR
+var ErrTemplateHash = errors.New("template hash does not match the template data")
+
+// Replay extends the template hashes of the entries into the PCR, starting
+// from zero, and returns the value of the PCR after each entry: values[i]
+// follows entries[i], whichever PCR it extends. The template hash of every
+// entry extending the PCR, violations aside, is checked against its template
+// data, which must be known. Outside the SHA-1 bank the template hash is the
+// hash of the template data in the bank algorithm, as computed by kernels
+// since 5.8. Violations extend all ones.
+func (l *Log) Replay(bank tpm2.Algorithm, pcr int) ([][]byte, error) {
+	h, err := bank.Hash()
+	if err != nil {
+		return nil, err
+	}
+
+	value := make([]byte, h.Size())
+	values := make([][]byte, len(l.Entries))
+
+	for i, e := range l.Entries {
+		if e.PCR == pcr {
+			var th []byte
+
+			switch {
+			case e.Violation():
+				th = bytes.Repeat([]byte{0xff}, h.Size())
+			case e.TemplateData == nil:
+				return nil, fmt.Errorf("entry %d: no template data to hash for template %q", i, e.Template)
+			default:
+				if sum := sha1.Sum(e.TemplateData); !bytes.Equal(sum[:], e.TemplateHash) {
+					return nil, fmt.Errorf("entry %d: %w", i, ErrTemplateHash)
+				}
+
+				hh := h.New()
+				hh.Write(e.TemplateData)
+				th = hh.Sum(nil)
+			}
+
+			hh := h.New()
+			hh.Write(value)
+			hh.Write(th)
+			value = hh.Sum(nil)
+		}
+
+		values[i] = value
+	}
+
+	return values, nil
+}
@@ -0,0 +1,315 @@
+// Copyright 2023 EnactTrust LTD All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+
+package node
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+	"github.com/google/uuid"
+)
+
+var (
+	ErrInvalidAKPublic = errors.New("invalid AK public area")
+	// The AK public area lacks one of the restricted, sign and fixedTPM
+	// attributes, or may decrypt
+	ErrNotAttestationKey = errors.New("AK public area is not an attestation key")
+	// The AK name, public key or quote signer disagree with the AK public
+	// area
+	ErrAKNameMismatch = errors.New("AK name mismatch")
+	// The qualified name of the parent of the AK is malformed, or sent
+	// without the AK public area
+	ErrInvalidParentQN = errors.New("invalid AK parent qualified name")
+)
+
+// Attributes without which a TPM object cannot be trusted to sign only
+// TPM-generated structures with a key that never leaves the TPM
+const akAttributes = tpm2.FlagRestricted | tpm2.FlagSign | tpm2.FlagFixedTPM
+
+// Hierarchies a primary AK may be created in, whose handles are their
+// qualified names
+var hierarchies = []tpmutil.Handle{
+	tpm2.HandleEndorsement,
+	tpm2.HandleOwner,
+	tpm2.HandlePlatform,
+	tpm2.HandleNull,
+}
+
+// registeredAK is the AK of a registering node as stored with it
+type registeredAK struct {
+	// PEM public key
+	pub string
+	// Hex encoded name and TPMT_PUBLIC, the latter empty for nodes that
+	// registered a bare public key
+	name   string
+	public string
+	// Hex encoded qualified name of the parent of the AK, empty for a
+	// primary AK
+	parentQN string
+}
+
+// checkAK checks the AK of a registering node. When its TPMT_PUBLIC is sent,
+// the AK must be an attestation key, its name is computed and must be ak_name
+// if given, and its public key, which must be ak_pub if given, is derived
+// from it; parentQN, if given, is the qualified name of the key the AK was
+// created under. Otherwise ak_pub and ak_name are taken as is.
+func checkAK(akPub string, akPublic []byte, akName string, parentQN string) (*registeredAK, error) {
+	if akPublic == nil {
+		// The qualified name of the AK is only checked against its public
+		// area
+		if parentQN != "" {
+			return nil, fmt.Errorf("%w: sent without ak_public", ErrInvalidParentQN)
+		}
+
+		// Quotes can only be verified with an ECDSA or RSA AK
+		if _, err := parseKey(akPub); err != nil {
+			return nil, err
+		}
+
+		return &registeredAK{pub: akPub, name: akName}, nil
+	}
+
+	pub, raw, err := decodeAKPublic(akPublic)
+	if err != nil {
+		return nil, err
+	}
+
+	if pub.Attributes&akAttributes != akAttributes || pub.Attributes&tpm2.FlagDecrypt != 0 {
+		return nil, fmt.Errorf("%w: attributes %#x", ErrNotAttestationKey, uint32(pub.Attributes))
+	}
+
+	key, err := pub.Key()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidAKPublic, err)
+	}
+
+	pem, err := publicKeyPEM(key)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidAKPublic, err)
+	}
+
+	// Same restrictions on the key type as for a bare public key
+	if _, err := parseKey(pem); err != nil {
+		return nil, err
+	}
+
+	name, err := akNameOf(pub, raw)
+	if err != nil {
+		return nil, err
+	}
+
+	if akName != "" {
+		sent, err := parseAKName(akName)
+		if err != nil {
+			return nil, err
+		}
+
+		if sent.Alg != name.Alg || !bytes.Equal(sent.Value, name.Value) {
+			return nil, fmt.Errorf("%w: ak_name is not the name of the AK public area", ErrAKNameMismatch)
+		}
+	}
+
+	if akPub != "" {
+		sent, err := parseKey(akPub)
+		if err != nil {
+			return nil, err
+		}
+
+		sentPEM, err := publicKeyPEM(sent)
+		if err != nil {
+			return nil, err
+		}
+
+		if sentPEM != pem {
+			return nil, fmt.Errorf("%w: ak_pub is not the key of the AK public area", ErrAKNameMismatch)
+		}
+	}
+
+	encoded, err := name.Encode()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidAKPublic, err)
+	}
+
+	ak := &registeredAK{
+		pub:    pem,
+		name:   hex.EncodeToString(encoded),
+		public: hex.EncodeToString(raw),
+	}
+
+	if parentQN != "" {
+		qn, err := parseName(parentQN, ErrInvalidParentQN)
+		if err != nil {
+			return nil, err
+		}
+
+		encoded, err := qn.Encode()
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidParentQN, err)
+		}
+
+		ak.parentQN = hex.EncodeToString(encoded)
+	}
+
+	return ak, nil
+}
+
+// decodeAKPublic decodes a TPMT_PUBLIC, or a TPM2B_PUBLIC as returned by
+// TPM2_ReadPublic, and returns it with its TPMT_PUBLIC bytes
+func decodeAKPublic(buf []byte) (tpm2.Public, []byte, error) {
+	if len(buf) > 2 && int(binary.BigEndian.Uint16(buf)) == len(buf)-2 {
+		buf = buf[2:]
+	}
+
+	pub, err := tpm2.DecodePublic(buf)
+	if err != nil {
+		return tpm2.Public{}, nil, fmt.Errorf("%w: %v", ErrInvalidAKPublic, err)
+	}
+
+	return pub, buf, nil
+}
+
+// akNameOf computes the TPM name of an AK, its name algorithm followed by
+// the digest of its TPMT_PUBLIC as the TPM marshals it
+func akNameOf(pub tpm2.Public, raw []byte) (*tpm2.HashValue, error) {
+	h, err := pub.NameAlg.Hash()
+	if err != nil {
+		return nil, fmt.Errorf("%w: name algorithm: %v", ErrInvalidAKPublic, err)
+	}
+
+	return &tpm2.HashValue{Alg: pub.NameAlg, Value: hashOf(h, raw)}, nil
+}
+
+// qualifiedName computes the qualified name of an AK: the digest, with the
+// AK name algorithm, of the qualified name of its parent followed by the AK
+// name. The qualified name of a hierarchy is its handle.
+func qualifiedName(parentQN []byte, name *tpm2.HashValue) (*tpm2.HashValue, error) {
+	encoded, err := name.Encode()
+	if err != nil {
+		return nil, err
+	}
+
+	h, err := name.Alg.Hash()
+	if err != nil {
+		return nil, err
+	}
+
+	return &tpm2.HashValue{
+		Alg:   name.Alg,
+		Value: hashOf(h, append(append([]byte{}, parentQN...), encoded...)),
+	}, nil
+}
+
+// primaryQualifiedName computes the qualified name of a primary AK of the
+// hierarchy
+func primaryQualifiedName(hierarchy tpmutil.Handle, name *tpm2.HashValue) (*tpm2.HashValue, error) {
+	var handle [4]byte
+	binary.BigEndian.PutUint32(handle[:], uint32(hierarchy))
+
+	return qualifiedName(handle[:], name)
+}
+
+// checkQualifiedSigner checks that the quote was signed by the AK of the
+// node: its qualified signer must be the qualified name of the AK under the
+// parent registered with it, or as a primary key of one of the hierarchies.
+// Nodes that registered without the AK public area are not checked.
+func (n *NodeService) checkQualifiedSigner(nodeID uuid.UUID, et EnactToken) error {
+	node, err := n.repo.GetNodeById(nodeID.String())
+	if err != nil {
+		return err
+	}
+
+	_, _, err = signingHierarchy(node, et)
+
+	return err
+}
+
+// signingHierarchy checks the qualified signer of the quote as
+// checkQualifiedSigner does, and returns the hierarchy the AK of the node is
+// a primary key of. The hierarchy is not known, ok being false, for AKs
+// created under another key and for nodes registered without the AK public
+// area.
+func signingHierarchy(node *Node, et EnactToken) (hierarchy tpmutil.Handle, ok bool, err error) {
+	if node.AK_Public == "" {
+		return 0, false, nil
+	}
+
+	raw, err := hex.DecodeString(node.AK_Public)
+	if err != nil {
+		return 0, false, err
+	}
+
+	pub, public, err := decodeAKPublic(raw)
+	if err != nil {
+		return 0, false, err
+	}
+
+	name, err := akNameOf(pub, public)
+	if err != nil {
+		return 0, false, err
+	}
+
+	signer := et.AttestationData.QualifiedSigner.Digest
+	if signer == nil {
+		return 0, false, fmt.Errorf("%w: quote has no qualified signer", ErrAKNameMismatch)
+	}
+
+	if node.AK_Parent_QN != "" {
+		parentQN, err := hex.DecodeString(node.AK_Parent_QN)
+		if err != nil {
+			return 0, false, err
+		}
+
+		qn, err := qualifiedName(parentQN, name)
+		if err != nil {
+			return 0, false, err
+		}
+
+		if signer.Alg == qn.Alg && bytes.Equal(signer.Value, qn.Value) {
+			return 0, false, nil
+		}
+
+		return 0, false, fmt.Errorf("%w: quote signed by %x, not by the AK of the node", ErrAKNameMismatch, signer.Value)
+	}
+
+	for _, hierarchy := range hierarchies {
+		qn, err := primaryQualifiedName(hierarchy, name)
+		if err != nil {
+			return 0, false, err
+		}
+
+		if signer.Alg == qn.Alg && bytes.Equal(signer.Value, qn.Value) {
+			return hierarchy, true, nil
+		}
+	}
+
+	return 0, false, fmt.Errorf("%w: quote signed by %x, not by the AK of the node", ErrAKNameMismatch, signer.Value)
+}
+
+// obfuscated tells whether the TPM obfuscated the firmware version and the
+// reset and restart counts of the quote, which it does unless the AK is in
+// the endorsement or platform hierarchy. known is false for AKs whose
+// hierarchy is not known, whose quotes may or may not be obfuscated.
+func obfuscated(node *Node, et EnactToken) (obfuscated bool, known bool) {
+	hierarchy, ok, err := signingHierarchy(node, et)
+	if err != nil || !ok {
+		return false, false
+	}
+
+	return hierarchy != tpm2.HandleEndorsement && hierarchy != tpm2.HandlePlatform, true
+}
@@ -0,0 +1,206 @@
+// Copyright 2023 EnactTrust LTD All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+
+package node
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"testing"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+)
+
+// testAK is the public area of an ECDSA P-256 attestation key
+type testAK struct {
+	key *ecdsa.PrivateKey
+	raw []byte
+}
+
+func newTestAK(t *testing.T, attributes tpm2.KeyProp) *testAK {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	raw, err := tpm2.Public{
+		Type:       tpm2.AlgECC,
+		NameAlg:    tpm2.AlgSHA256,
+		Attributes: attributes,
+		ECCParameters: &tpm2.ECCParams{
+			Sign:    &tpm2.SigScheme{Alg: tpm2.AlgECDSA, Hash: tpm2.AlgSHA256},
+			CurveID: tpm2.CurveNISTP256,
+			Point:   tpm2.ECPoint{XRaw: key.X.FillBytes(make([]byte, 32)), YRaw: key.Y.FillBytes(make([]byte, 32))},
+		},
+	}.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testAK{key: key, raw: raw}
+}
+
+const testAKAttributes = tpm2.FlagRestricted | tpm2.FlagSign | tpm2.FlagFixedTPM | tpm2.FlagFixedParent |
+	tpm2.FlagSensitiveDataOrigin | tpm2.FlagUserWithAuth
+
+// name computes the TPM name of the AK: the SHA-256 name algorithm followed
+// by the digest of its public area
+func (ak *testAK) name() []byte {
+	sum := sha256.Sum256(ak.raw)
+	return append([]byte{0x00, 0x0b}, sum[:]...)
+}
+
+// qualifiedName computes the qualified name of the AK under the parent
+func (ak *testAK) qualifiedName(parentQN []byte) []byte {
+	sum := sha256.Sum256(append(append([]byte{}, parentQN...), ak.name()...))
+	return append([]byte{0x00, 0x0b}, sum[:]...)
+}
+
+func handleQN(h tpmutil.Handle) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, uint32(h))
+	return b
+}
+
+func (ak *testAK) pem(t *testing.T) string {
+	t.Helper()
+
+	pem, err := publicKeyPEM(ak.key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return pem
+}
+
+func TestCheckAK(t *testing.T) {
+	ak := newTestAK(t, testAKAttributes)
+	other := newTestAK(t, testAKAttributes)
+
+	tpm2b := append([]byte{byte(len(ak.raw) >> 8), byte(len(ak.raw))}, ak.raw...)
+	parentQN := ak.qualifiedName(handleQN(tpm2.HandleEndorsement))
+
+	cases := []struct {
+		name     string
+		akPub    string
+		akPublic []byte
+		akName   string
+		parentQN string
+		err      error
+		// Expected name and parent qualified name, hex encoded
+		wantName     string
+		wantParentQN string
+	}{
+		{name: "public area", akPublic: ak.raw, wantName: hex.EncodeToString(ak.name())},
+		{name: "TPM2B public area", akPublic: tpm2b, wantName: hex.EncodeToString(ak.name())},
+		{name: "matching name and key", akPub: ak.pem(t), akPublic: ak.raw, akName: hex.EncodeToString(ak.name()), wantName: hex.EncodeToString(ak.name())},
+		{name: "parent", akPublic: ak.raw, parentQN: hex.EncodeToString(parentQN), wantName: hex.EncodeToString(ak.name()), wantParentQN: hex.EncodeToString(parentQN)},
+		{name: "bare key", akPub: ak.pem(t), akName: "000b" + hex.EncodeToString(make([]byte, 32)), wantName: "000b" + hex.EncodeToString(make([]byte, 32))},
+		{name: "other name", akPublic: ak.raw, akName: hex.EncodeToString(other.name()), err: ErrAKNameMismatch},
+		{name: "malformed name", akPublic: ak.raw, akName: "000b00", err: ErrInvalidAKName},
+		{name: "other key", akPub: other.pem(t), akPublic: ak.raw, err: ErrAKNameMismatch},
+		{name: "not restricted", akPublic: newTestAK(t, testAKAttributes&^tpm2.FlagRestricted).raw, err: ErrNotAttestationKey},
+		{name: "not fixedTPM", akPublic: newTestAK(t, testAKAttributes&^tpm2.FlagFixedTPM).raw, err: ErrNotAttestationKey},
+		{name: "decrypt", akPublic: newTestAK(t, testAKAttributes|tpm2.FlagDecrypt).raw, err: ErrNotAttestationKey},
+		{name: "malformed public area", akPublic: []byte{0x00, 0x23, 0x00}, err: ErrInvalidAKPublic},
+		{name: "malformed parent", akPublic: ak.raw, parentQN: "000b00", err: ErrInvalidParentQN},
+		{name: "parent without public area", akPub: ak.pem(t), parentQN: hex.EncodeToString(parentQN), err: ErrInvalidParentQN},
+	}
+
+	for _, c := range cases {
+		got, err := checkAK(c.akPub, c.akPublic, c.akName, c.parentQN)
+		if c.err != nil {
+			if !errors.Is(err, c.err) {
+				t.Errorf("%s: %v", c.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+
+		if got.name != c.wantName || got.parentQN != c.wantParentQN || got.pub != ak.pem(t) {
+			t.Errorf("%s: registered %+v", c.name, got)
+		}
+
+		if c.akPublic != nil && got.public != hex.EncodeToString(ak.raw) {
+			t.Errorf("%s: public area %s", c.name, got.public)
+		}
+	}
+}
+
+func TestSigningHierarchy(t *testing.T) {
+	ak := newTestAK(t, testAKAttributes)
+	parentQN := newTestAK(t, testAKAttributes).qualifiedName(handleQN(tpm2.HandleEndorsement))
+
+	primary := &Node{AK_Public: hex.EncodeToString(ak.raw)}
+	child := &Node{AK_Public: hex.EncodeToString(ak.raw), AK_Parent_QN: hex.EncodeToString(parentQN)}
+	bare := &Node{}
+
+	cases := []struct {
+		name      string
+		node      *Node
+		signer    []byte
+		hierarchy tpmutil.Handle
+		ok        bool
+		err       error
+	}{
+		{"endorsement", primary, ak.qualifiedName(handleQN(tpm2.HandleEndorsement)), tpm2.HandleEndorsement, true, nil},
+		{"owner", primary, ak.qualifiedName(handleQN(tpm2.HandleOwner)), tpm2.HandleOwner, true, nil},
+		{"platform", primary, ak.qualifiedName(handleQN(tpm2.HandlePlatform)), tpm2.HandlePlatform, true, nil},
+		{"null", primary, ak.qualifiedName(handleQN(tpm2.HandleNull)), tpm2.HandleNull, true, nil},
+		{"child", child, ak.qualifiedName(parentQN), 0, false, nil},
+		{"child signing as primary", child, ak.qualifiedName(handleQN(tpm2.HandleEndorsement)), 0, false, ErrAKNameMismatch},
+		{"primary signing as child", primary, ak.qualifiedName(parentQN), 0, false, ErrAKNameMismatch},
+		{"other key", primary, newTestAK(t, testAKAttributes).qualifiedName(handleQN(tpm2.HandleEndorsement)), 0, false, ErrAKNameMismatch},
+		{"no qualified signer", primary, nil, 0, false, ErrAKNameMismatch},
+		{"bare key", bare, nil, 0, false, nil},
+	}
+
+	for _, c := range cases {
+		et := EnactToken{AttestationData: &tpm2.AttestationData{}}
+		if c.signer != nil {
+			qn, err := parseAKName(hex.EncodeToString(c.signer))
+			if err != nil {
+				t.Fatal(err)
+			}
+			et.AttestationData.QualifiedSigner.Digest = qn
+		}
+
+		hierarchy, ok, err := signingHierarchy(c.node, et)
+		if (c.err == nil) != (err == nil) || (c.err != nil && !errors.Is(err, c.err)) {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+
+		if hierarchy != c.hierarchy || ok != c.ok {
+			t.Errorf("%s: hierarchy %#x, %v", c.name, hierarchy, ok)
+		}
+
+		// Firmware versions and counts are only in clear for the
+		// endorsement and platform hierarchies, and may be obfuscated
+		// when the hierarchy is not known
+		wantObfuscated := c.ok && c.hierarchy != tpm2.HandleEndorsement && c.hierarchy != tpm2.HandlePlatform
+		if isObfuscated, known := obfuscated(c.node, et); isObfuscated != wantObfuscated || known != c.ok {
+			t.Errorf("%s: obfuscated %v, known %v", c.name, isObfuscated, known)
+		}
+	}
+}
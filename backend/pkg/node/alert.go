@@ -0,0 +1,166 @@
+// Copyright 2023 EnactTrust LTD All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+
+package node
+
+import (
+	"log"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Kinds of alerts
+const (
+	// The TPM firmware of the node is older than a minimum policy allows
+	AlertFirmwareBelowMinimum = "firmware_below_minimum"
+	// The TPM firmware of the node is a known vulnerable version
+	AlertFirmwareVulnerable = "firmware_vulnerable"
+	// The TPM obfuscated the firmware version of the node, so that the
+	// firmware policies applying to it cannot be enforced
+	AlertFirmwareUnenforceable = "firmware_unenforceable"
+)
+
+// Alert records a condition of a node that needs the attention of an
+// operator until acknowledged
+type Alert struct {
+	ID     int64  `db:"id" json:"id"`
+	NodeID string `db:"node_id" json:"node_id"`
+	// Attestation that raised the alert
+	AttestationID   *int64 `db:"attestation_id" json:"attestation_id"`
+	Kind            string `db:"kind" json:"kind"`
+	FirmwareVersion string `db:"firmware_version" json:"firmware_version"`
+	Message         string `db:"message" json:"message"`
+	Created_At      string `db:"created_at" json:"created_at"`
+	// Nil until an operator acknowledges the alert
+	Acknowledged_At *string `db:"acknowledged_at" json:"acknowledged_at"`
+}
+
+type AlertRepository interface {
+	// RaiseAlert records the alert unless the same one, of the same kind
+	// and firmware version, is still unacknowledged for the node
+	RaiseAlert(alert Alert) error
+	// ListAlerts returns the alerts of the node, or of all nodes if node_id
+	// is empty, newest first
+	ListAlerts(node_id string, limit int, offset int) ([]Alert, int, error)
+	// AcknowledgeAlert returns ErrNotFound if there is no such alert
+	AcknowledgeAlert(id int64, acknowledged_at string) error
+}
+
+type SQLiteAlertRepo struct {
+	db *sqlx.DB
+}
+
+func NewAlertRepo(db *sqlx.DB) AlertRepository {
+	return &SQLiteAlertRepo{
+		db: db,
+	}
+}
+
+func (repo SQLiteAlertRepo) RaiseAlert(alert Alert) error {
+	const query = `
+		INSERT INTO alerts (
+			node_id,
+			attestation_id,
+			kind,
+			firmware_version,
+			message,
+			created_at
+		)
+		VALUES (
+			:node_id,
+			:attestation_id,
+			:kind,
+			:firmware_version,
+			:message,
+			:created_at
+		)
+		ON CONFLICT DO NOTHING;`
+
+	_, err := repo.db.NamedExec(query, &alert)
+	if err != nil {
+		log.Println(err.Error())
+		return err
+	}
+
+	return nil
+}
+
+func (repo SQLiteAlertRepo) ListAlerts(node_id string, limit int, offset int) ([]Alert, int, error) {
+	var alerts []Alert = []Alert{}
+
+	var total int
+	err := repo.db.Get(&total, `SELECT COUNT(*) FROM alerts WHERE $1 = '' OR node_id = $1;`, node_id)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	const query = `
+		SELECT
+			id,
+			node_id,
+			attestation_id,
+			kind,
+			firmware_version,
+			message,
+			created_at,
+			acknowledged_at
+		FROM alerts
+		WHERE $1 = '' OR node_id = $1
+		ORDER BY id DESC
+		LIMIT $2 OFFSET $3;`
+
+	err = repo.db.Select(&alerts, query, node_id, limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return alerts, total, nil
+}
+
+func (repo SQLiteAlertRepo) AcknowledgeAlert(id int64, acknowledged_at string) error {
+	const query = `
+		UPDATE alerts
+		SET acknowledged_at = COALESCE(acknowledged_at, $1)
+		WHERE id = $2;`
+
+	response, err := repo.db.Exec(query, acknowledged_at, id)
+	if err != nil {
+		log.Println(err.Error())
+		return err
+	}
+
+	if count, err := response.RowsAffected(); err != nil {
+		return err
+	} else if count == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+// ListAlerts returns the alerts of the node, or of all nodes if nodeID is
+// empty, newest first
+func (n *NodeService) ListAlerts(nodeID string, limit int, offset int) ([]Alert, int, error) {
+	if nodeID != "" {
+		if _, err := n.repo.GetNodeById(nodeID); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	return n.alerts.ListAlerts(nodeID, limit, offset)
+}
+
+func (n *NodeService) AcknowledgeAlert(id int64) error {
+	return n.alerts.AcknowledgeAlert(id, time.Now().UTC().String())
+}
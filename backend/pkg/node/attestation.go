@@ -0,0 +1,247 @@
+// Copyright 2023 EnactTrust LTD All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+
+package node
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/veraison/ear"
+	"github.com/veraison/enact-demo/pkg/veraison"
+)
+
+// Attestation is one appraisal of a node's evidence
+type Attestation struct {
+	ID         int64  `db:"id" json:"id"`
+	NodeID     string `db:"node_id" json:"node_id"`
+	Created_At string `db:"created_at" json:"created_at"`
+	SessionURI string `db:"session_uri" json:"session_uri"`
+	Nonce      []byte `db:"nonce" json:"nonce"`
+	PCRDigest  []byte `db:"pcr_digest" json:"pcr_digest"`
+	// Individual PCRs of the quote, when the agent sent them
+	PCRValues PCRValues `db:"pcr_values" json:"pcr_values,omitempty"`
+	// Claims extracted from the measured-boot event log, when the agent sent
+	// one
+	EventLogClaims JSON `db:"event_log_claims" json:"event_log_claims,omitempty"`
+	// Appraisal of the IMA measurement list, when the agent sent one
+	IMAResult JSON `db:"ima_result" json:"ima_result,omitempty"`
+	// TPM clock and reset counters of the quote, and what changed since the
+	// previous attestation of the node, e.g. "reboot"
+	ClockInfo   *ClockInfo `db:"clock_info" json:"clock_info,omitempty"`
+	ClockEvents string     `db:"clock_events" json:"clock_events,omitempty"`
+	// EAR status of the TPM_ENACTTRUST submod, or "unverifiable" when the EAR
+	// could not be verified
+	Status      string `db:"status" json:"status"`
+	TrustVector JSON   `db:"trust_vector" json:"trust_vector"`
+	RawEAR      string `db:"raw_ear" json:"raw_ear"`
+}
+
+const AttestationStatusUnverifiable = "unverifiable"
+
+// JSON is a JSON document stored as text, NULL when empty
+type JSON json.RawMessage
+
+func (j JSON) Value() (driver.Value, error) {
+	if len(j) == 0 {
+		return nil, nil
+	}
+
+	return string(j), nil
+}
+
+func (j *JSON) Scan(src interface{}) error {
+	switch s := src.(type) {
+	case nil:
+		*j = nil
+		return nil
+	case string:
+		*j = JSON(s)
+		return nil
+	case []byte:
+		*j = append(JSON(nil), s...)
+		return nil
+	default:
+		return fmt.Errorf("cannot scan %T into JSON", src)
+	}
+}
+
+func (j JSON) MarshalJSON() ([]byte, error) {
+	if len(j) == 0 {
+		return []byte("null"), nil
+	}
+
+	return j, nil
+}
+
+type AttestationRepository interface {
+	// InsertAttestation stores the attestation and returns its ID
+	InsertAttestation(attestation Attestation) (int64, error)
+	// ListAttestations returns the node's attestations, newest first
+	ListAttestations(node_id string, limit int, offset int) ([]Attestation, int, error)
+	// LastClockInfo returns the ClockInfo of the node's latest attestation
+	// without clock anomaly, nil if there is none
+	LastClockInfo(node_id string) (*ClockInfo, error)
+}
+
+type SQLiteAttestationRepo struct {
+	db *sqlx.DB
+}
+
+func NewAttestationRepo(db *sqlx.DB) AttestationRepository {
+	return &SQLiteAttestationRepo{
+		db: db,
+	}
+}
+
+func (repo SQLiteAttestationRepo) InsertAttestation(attestation Attestation) (int64, error) {
+	const query = `
+		INSERT INTO attestations (
+			node_id,
+			created_at,
+			session_uri,
+			nonce,
+			pcr_digest,
+			pcr_values,
+			event_log_claims,
+			ima_result,
+			clock_info,
+			clock_events,
+			status,
+			trust_vector,
+			raw_ear
+		)
+		VALUES (
+			:node_id,
+			:created_at,
+			:session_uri,
+			:nonce,
+			:pcr_digest,
+			:pcr_values,
+			:event_log_claims,
+			:ima_result,
+			:clock_info,
+			:clock_events,
+			:status,
+			:trust_vector,
+			:raw_ear
+		);`
+
+	res, err := repo.db.NamedExec(query, &attestation)
+	if err != nil {
+		log.Println(err.Error())
+		return 0, err
+	}
+
+	return res.LastInsertId()
+}
+
+func (repo SQLiteAttestationRepo) ListAttestations(node_id string, limit int, offset int) ([]Attestation, int, error) {
+	var attestations []Attestation = []Attestation{}
+
+	var total int
+	err := repo.db.Get(&total, `SELECT COUNT(*) FROM attestations WHERE node_id = $1;`, node_id)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	const query = `
+		SELECT
+			id,
+			node_id,
+			created_at,
+			session_uri,
+			nonce,
+			pcr_digest,
+			pcr_values,
+			event_log_claims,
+			ima_result,
+			clock_info,
+			clock_events,
+			status,
+			trust_vector,
+			raw_ear
+		FROM attestations
+		WHERE node_id = $1
+		ORDER BY id DESC
+		LIMIT $2 OFFSET $3;`
+
+	err = repo.db.Select(&attestations, query, node_id, limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return attestations, total, nil
+}
+
+func (repo SQLiteAttestationRepo) LastClockInfo(node_id string) (*ClockInfo, error) {
+	var infos []ClockInfo
+
+	// Anomalous quotes are recorded but must not become the reference
+	const query = `
+		SELECT clock_info
+		FROM attestations
+		WHERE node_id = $1
+			AND clock_info IS NOT NULL
+			AND clock_events NOT LIKE '%rollback%'
+			AND clock_events NOT LIKE '%replay%'
+		ORDER BY id DESC
+		LIMIT 1;`
+
+	err := repo.db.Select(&infos, query, node_id)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(infos) == 0 {
+		return nil, nil
+	}
+
+	return &infos[0], nil
+}
+
+// newAttestation fills in the appraisal part of an attestation record from
+// the decoded EAR, if any
+func newAttestation(result *ear.AttestationResult, rawEAR []byte) Attestation {
+	attestation := Attestation{
+		Status: AttestationStatusUnverifiable,
+		RawEAR: string(rawEAR),
+	}
+
+	if result == nil {
+		return attestation
+	}
+
+	appraisal, ok := result.Submods[veraison.EnactTrustSubmod]
+	if !ok {
+		return attestation
+	}
+
+	if appraisal.Status != nil {
+		attestation.Status = appraisal.Status.String()
+	}
+
+	if appraisal.TrustVector != nil {
+		tv, err := json.Marshal(appraisal.TrustVector)
+		if err != nil {
+			log.Println(err)
+		} else {
+			attestation.TrustVector = tv
+		}
+	}
+
+	return attestation
+}
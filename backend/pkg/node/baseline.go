@@ -0,0 +1,580 @@
+// Copyright 2023 EnactTrust LTD All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+
+package node
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+var (
+	// An update window is opened either for a node or for a label
+	ErrInvalidUpdateWindow = errors.New("update window needs either a node_id or a label, and a positive duration")
+	ErrUpdateWindowClosed  = errors.New("update window is closed")
+	ErrCandidateDecided    = errors.New("candidate golden value was already approved or rejected")
+)
+
+// UpdateWindow lets the next quote of a node, or of each node carrying a
+// label, be captured as a candidate golden value, e.g. to re-baseline nodes
+// after a firmware upgrade
+type UpdateWindow struct {
+	ID int64 `db:"id" json:"id"`
+	// Exactly one of NodeID and Label is set
+	NodeID     string    `db:"node_id" json:"node_id,omitempty"`
+	Label      string    `db:"label" json:"label,omitempty"`
+	Created_At string    `db:"created_at" json:"created_at"`
+	ExpiresAt  time.Time `db:"expires_at" json:"expires_at"`
+	// Time the window was closed, nil while it is open. Node windows close
+	// once their candidate is captured, label windows when they expire or
+	// are closed by the operator.
+	Closed_At *string `db:"closed_at" json:"closed_at"`
+}
+
+// Open tells whether the window still captures quotes
+func (w UpdateWindow) Open(now time.Time) bool {
+	return w.Closed_At == nil && now.Before(w.ExpiresAt)
+}
+
+type CandidateStatus string
+
+const (
+	CandidatePending  CandidateStatus = "pending"
+	CandidateApproved CandidateStatus = "approved"
+	CandidateRejected CandidateStatus = "rejected"
+)
+
+// GoldenCandidate is a quote captured during an update window, waiting for
+// an operator to approve it as the node's new golden value
+type GoldenCandidate struct {
+	ID       int64  `db:"id" json:"id"`
+	WindowID int64  `db:"window_id" json:"window_id"`
+	NodeID   string `db:"node_id" json:"node_id"`
+	// Attestation recording the appraisal of the captured quote, nil if the
+	// verifier produced no result
+	AttestationID *int64          `db:"attestation_id" json:"attestation_id"`
+	PCRDigest     []byte          `db:"pcr_digest" json:"pcr_digest"`
+	PCRDigestAlg  uint16          `db:"pcr_digest_alg" json:"pcr_digest_alg"`
+	PCRSelection  string          `db:"pcr_selection" json:"pcr_selection"`
+	PCRValues     PCRValues       `db:"pcr_values" json:"pcr_values,omitempty"`
+	Status        CandidateStatus `db:"status" json:"status"`
+	Created_At    string          `db:"created_at" json:"created_at"`
+	Decided_At    *string         `db:"decided_at" json:"decided_at"`
+}
+
+type BaselineRepository interface {
+	InsertUpdateWindow(window UpdateWindow) (int64, error)
+	GetUpdateWindow(id int64) (*UpdateWindow, error)
+	// ListUpdateWindows returns the update windows, newest first
+	ListUpdateWindows(limit int, offset int) ([]UpdateWindow, int, error)
+	// UnclosedUpdateWindows returns the windows of the node or of its label
+	// that were not closed, oldest first. Expired ones are included.
+	UnclosedUpdateWindows(node_id string, label string) ([]UpdateWindow, error)
+	// CloseUpdateWindow returns ErrUpdateWindowClosed if the window was
+	// already closed
+	CloseUpdateWindow(id int64, closed_at string) error
+
+	// InsertCandidate returns sql.ErrNoRows if the window already holds a
+	// candidate of the node
+	InsertCandidate(candidate GoldenCandidate) (int64, error)
+	GetCandidate(id int64) (*GoldenCandidate, error)
+	// ListCandidates returns the node's candidates, newest first
+	ListCandidates(node_id string, limit int, offset int) ([]GoldenCandidate, int, error)
+	// DecideCandidate sets the status of a pending candidate, returning
+	// ErrCandidateDecided if it is no longer pending
+	DecideCandidate(id int64, status CandidateStatus, decided_at string) error
+	// ReopenCandidate sets an approved candidate back to pending, when its
+	// approval could not be completed
+	ReopenCandidate(id int64) error
+}
+
+type SQLiteBaselineRepo struct {
+	db *sqlx.DB
+}
+
+func NewBaselineRepo(db *sqlx.DB) BaselineRepository {
+	return &SQLiteBaselineRepo{
+		db: db,
+	}
+}
+
+const updateWindowColumns = `
+			id,
+			node_id,
+			label,
+			created_at,
+			expires_at,
+			closed_at`
+
+const candidateColumns = `
+			id,
+			window_id,
+			node_id,
+			attestation_id,
+			pcr_digest,
+			pcr_digest_alg,
+			pcr_selection,
+			pcr_values,
+			status,
+			created_at,
+			decided_at`
+
+func (repo SQLiteBaselineRepo) InsertUpdateWindow(window UpdateWindow) (int64, error) {
+	const query = `
+		INSERT INTO update_windows (
+			node_id,
+			label,
+			created_at,
+			expires_at
+		)
+		VALUES (
+			:node_id,
+			:label,
+			:created_at,
+			:expires_at
+		);`
+
+	response, err := repo.db.NamedExec(query, &window)
+	if err != nil {
+		log.Println(err.Error())
+		return 0, err
+	}
+
+	return response.LastInsertId()
+}
+
+func (repo SQLiteBaselineRepo) GetUpdateWindow(id int64) (*UpdateWindow, error) {
+	window := UpdateWindow{}
+
+	err := repo.db.Get(&window, `SELECT`+updateWindowColumns+` FROM update_windows WHERE id = $1;`, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &window, nil
+}
+
+func (repo SQLiteBaselineRepo) ListUpdateWindows(limit int, offset int) ([]UpdateWindow, int, error) {
+	var windows []UpdateWindow = []UpdateWindow{}
+
+	var total int
+	err := repo.db.Get(&total, `SELECT COUNT(*) FROM update_windows;`)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	query := `
+		SELECT` + updateWindowColumns + `
+		FROM update_windows
+		ORDER BY id DESC
+		LIMIT $1 OFFSET $2;`
+
+	err = repo.db.Select(&windows, query, limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return windows, total, nil
+}
+
+func (repo SQLiteBaselineRepo) UnclosedUpdateWindows(node_id string, label string) ([]UpdateWindow, error) {
+	var windows []UpdateWindow = []UpdateWindow{}
+
+	query := `
+		SELECT` + updateWindowColumns + `
+		FROM update_windows
+		WHERE closed_at IS NULL AND (node_id = $1 OR (label != '' AND label = $2))
+		ORDER BY id;`
+
+	err := repo.db.Select(&windows, query, node_id, label)
+	if err != nil {
+		return nil, err
+	}
+
+	return windows, nil
+}
+
+func (repo SQLiteBaselineRepo) CloseUpdateWindow(id int64, closed_at string) error {
+	const query = `
+		UPDATE update_windows
+		SET closed_at = $1
+		WHERE id = $2 AND closed_at IS NULL;`
+
+	response, err := repo.db.Exec(query, closed_at, id)
+	if err != nil {
+		log.Println(err.Error())
+		return err
+	}
+
+	if count, err := response.RowsAffected(); err != nil {
+		return err
+	} else if count == 0 {
+		if _, err := repo.GetUpdateWindow(id); err != nil {
+			return err
+		}
+		return ErrUpdateWindowClosed
+	}
+
+	return nil
+}
+
+func (repo SQLiteBaselineRepo) InsertCandidate(candidate GoldenCandidate) (int64, error) {
+	const query = `
+		INSERT OR IGNORE INTO golden_candidates (
+			window_id,
+			node_id,
+			attestation_id,
+			pcr_digest,
+			pcr_digest_alg,
+			pcr_selection,
+			pcr_values,
+			status,
+			created_at
+		)
+		VALUES (
+			:window_id,
+			:node_id,
+			:attestation_id,
+			:pcr_digest,
+			:pcr_digest_alg,
+			:pcr_selection,
+			:pcr_values,
+			:status,
+			:created_at
+		);`
+
+	response, err := repo.db.NamedExec(query, &candidate)
+	if err != nil {
+		log.Println(err.Error())
+		return 0, err
+	}
+
+	if count, err := response.RowsAffected(); err != nil {
+		return 0, err
+	} else if count == 0 {
+		return 0, sql.ErrNoRows
+	}
+
+	return response.LastInsertId()
+}
+
+func (repo SQLiteBaselineRepo) GetCandidate(id int64) (*GoldenCandidate, error) {
+	candidate := GoldenCandidate{}
+
+	err := repo.db.Get(&candidate, `SELECT`+candidateColumns+` FROM golden_candidates WHERE id = $1;`, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &candidate, nil
+}
+
+func (repo SQLiteBaselineRepo) ListCandidates(node_id string, limit int, offset int) ([]GoldenCandidate, int, error) {
+	var candidates []GoldenCandidate = []GoldenCandidate{}
+
+	var total int
+	err := repo.db.Get(&total, `SELECT COUNT(*) FROM golden_candidates WHERE node_id = $1;`, node_id)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	query := `
+		SELECT` + candidateColumns + `
+		FROM golden_candidates
+		WHERE node_id = $1
+		ORDER BY id DESC
+		LIMIT $2 OFFSET $3;`
+
+	err = repo.db.Select(&candidates, query, node_id, limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return candidates, total, nil
+}
+
+func (repo SQLiteBaselineRepo) DecideCandidate(id int64, status CandidateStatus, decided_at string) error {
+	const query = `
+		UPDATE golden_candidates
+		SET status = $1, decided_at = $2
+		WHERE id = $3 AND status = $4;`
+
+	response, err := repo.db.Exec(query, status, decided_at, id, CandidatePending)
+	if err != nil {
+		log.Println(err.Error())
+		return err
+	}
+
+	if count, err := response.RowsAffected(); err != nil {
+		return err
+	} else if count == 0 {
+		if _, err := repo.GetCandidate(id); err != nil {
+			return err
+		}
+		return ErrCandidateDecided
+	}
+
+	return nil
+}
+
+func (repo SQLiteBaselineRepo) ReopenCandidate(id int64) error {
+	const query = `
+		UPDATE golden_candidates
+		SET status = $1, decided_at = NULL
+		WHERE id = $2 AND status = $3;`
+
+	_, err := repo.db.Exec(query, CandidatePending, id, CandidateApproved)
+	if err != nil {
+		log.Println(err.Error())
+	}
+
+	return err
+}
+
+// OpenUpdateWindow opens an update window for the node with the given ID,
+// or for all the nodes carrying the label, lasting for the given duration
+func (n *NodeService) OpenUpdateWindow(nodeID string, label string, duration time.Duration) (*UpdateWindow, error) {
+	if (nodeID == "") == (label == "") || duration <= 0 {
+		return nil, ErrInvalidUpdateWindow
+	}
+
+	if nodeID != "" {
+		node, err := n.repo.GetNodeById(nodeID)
+		if err != nil {
+			return nil, err
+		}
+
+		switch node.State {
+		case StateRevoked:
+			return nil, ErrNodeRevoked
+		case StateRegistered:
+			// Its first golden values still go to /node/golden
+			return nil, fmt.Errorf("%w: node has no golden values to update", ErrInvalidTransition)
+		}
+	}
+
+	now := time.Now().UTC()
+
+	window := UpdateWindow{
+		NodeID:     nodeID,
+		Label:      label,
+		Created_At: now.String(),
+		ExpiresAt:  now.Add(duration),
+	}
+
+	id, err := n.baseline.InsertUpdateWindow(window)
+	if err != nil {
+		return nil, err
+	}
+	window.ID = id
+
+	return &window, nil
+}
+
+func (n *NodeService) CloseUpdateWindow(id int64) error {
+	return n.baseline.CloseUpdateWindow(id, time.Now().UTC().String())
+}
+
+// ListUpdateWindows returns the update windows, newest first
+func (n *NodeService) ListUpdateWindows(limit int, offset int) ([]UpdateWindow, int, error) {
+	return n.baseline.ListUpdateWindows(limit, offset)
+}
+
+// ListCandidates returns the golden value candidates captured for the node,
+// newest first
+func (n *NodeService) ListCandidates(nodeID string, limit int, offset int) ([]GoldenCandidate, int, error) {
+	_, err := n.repo.GetNodeById(nodeID)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return n.baseline.ListCandidates(nodeID, limit, offset)
+}
+
+// ApproveCandidate stores the candidate as the node's golden value,
+// superseding the ones in force, submits it to the verifier and returns the
+// new golden value
+func (n *NodeService) ApproveCandidate(id int64) (*GoldenValue, error) {
+	candidate, err := n.baseline.GetCandidate(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if candidate.Status != CandidatePending {
+		return nil, ErrCandidateDecided
+	}
+
+	node, err := n.repo.GetNodeById(candidate.NodeID)
+	if err != nil {
+		return nil, err
+	}
+
+	if node.State == StateRevoked {
+		return nil, ErrNodeRevoked
+	}
+
+	now := time.Now().UTC().String()
+
+	// Claim the candidate before it reaches the verifier, so that concurrent
+	// approvals cannot submit it twice
+	err = n.baseline.DecideCandidate(id, CandidateApproved, now)
+	if err != nil {
+		return nil, err
+	}
+
+	golden, err := n.provisionCandidate(node, candidate, now)
+	if err != nil {
+		// The verifier never received the candidate, it can be approved again
+		if err := n.baseline.ReopenCandidate(id); err != nil {
+			log.Println(err)
+		}
+
+		return nil, err
+	}
+
+	log.Printf("node %s re-baselined to %x (%s)", candidate.NodeID, candidate.PCRDigest, candidate.PCRSelection)
+
+	return golden, nil
+}
+
+// provisionCandidate stores a claimed candidate as the only golden value of
+// the node in force, then submits it to the verifier with the tag-version
+// allocated by the store. Storing first means that nothing the verifier
+// accepted can be missing locally; a submission that fails withdraws the
+// stored value, without freeing its version.
+func (n *NodeService) provisionCandidate(node *Node, candidate *GoldenCandidate, now string) (*GoldenValue, error) {
+	golden := GoldenValue{
+		NodeID:       candidate.NodeID,
+		PCRDigest:    candidate.PCRDigest,
+		PCRDigestAlg: candidate.PCRDigestAlg,
+		PCRSelection: candidate.PCRSelection,
+		PCRValues:    candidate.PCRValues,
+		Created_At:   now,
+	}
+
+	var err error
+
+	golden.ID, golden.Version, err = n.golden.ReplaceGoldenValues(golden)
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+
+	err = n.verifier.ProvisionGolden(node, golden, golden.Version)
+	if err != nil {
+		log.Println(err)
+
+		if err := n.golden.WithdrawGoldenValue(golden); err != nil {
+			log.Printf("node %s: golden value %d refused by the verifier but still in force: %v", golden.NodeID, golden.ID, err)
+		}
+
+		return nil, err
+	}
+
+	return &golden, nil
+}
+
+func (n *NodeService) RejectCandidate(id int64) error {
+	return n.baseline.DecideCandidate(id, CandidateRejected, time.Now().UTC().String())
+}
+
+// captureCandidate records the quote as a golden value candidate if an
+// update window of the node or of its label is open and holds no candidate
+// of the node yet. Only quotes signed by the node's AK are captured, whatever
+// the verifier made of them. Failures are only logged: the appraisal itself
+// is recorded regardless.
+func (n *NodeService) captureCandidate(node *Node, token []byte, digest []byte, selection string, values PCRValues, attestationID *int64) {
+	windows, err := n.baseline.UnclosedUpdateWindows(node.ID.String(), node.Label)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	now := time.Now().UTC()
+
+	for _, window := range windows {
+		if !window.Open(now) {
+			continue
+		}
+
+		if err := verifyTokenSignature(node, token); err != nil {
+			log.Printf("not capturing a golden value candidate for node %s: %v", node.ID, err)
+			return
+		}
+
+		digestAlg, err := quoteDigestAlg(token)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+
+		_, err = n.baseline.InsertCandidate(GoldenCandidate{
+			WindowID:      window.ID,
+			NodeID:        node.ID.String(),
+			AttestationID: attestationID,
+			PCRDigest:     digest,
+			PCRDigestAlg:  uint16(digestAlg),
+			PCRSelection:  selection,
+			PCRValues:     values,
+			Status:        CandidatePending,
+			Created_At:    now.String(),
+		})
+		if errors.Is(err, sql.ErrNoRows) {
+			// Already captured during this window
+			continue
+		}
+		if err != nil {
+			log.Println(err)
+			return
+		}
+
+		log.Printf("captured golden value candidate %x (%s) for node %s in update window %d",
+			digest, selection, node.ID, window.ID)
+
+		if window.NodeID != "" {
+			err = n.baseline.CloseUpdateWindow(window.ID, now.String())
+			if err != nil {
+				log.Println(err)
+			}
+		}
+
+		return
+	}
+}
+
+// verifyTokenSignature checks the signature of the big endian token against
+// the AK of the node
+func verifyTokenSignature(node *Node, token []byte) error {
+	et := EnactToken{}
+	if err := et.Decode(token); err != nil {
+		return err
+	}
+
+	key, err := parseKey(node.AK_Pub)
+	if err != nil {
+		return err
+	}
+
+	return et.VerifySignature(key)
+}
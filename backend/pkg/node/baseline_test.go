@@ -0,0 +1,248 @@
+// Copyright 2023 EnactTrust LTD All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+
+package node
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/veraison/enact-demo/pkg/db"
+)
+
+var errSubmit = errors.New("submission failed")
+
+// provisionStub records the versions golden values are submitted with,
+// refusing them while fail is set
+type provisionStub struct {
+	Verifier
+	mu       sync.Mutex
+	fail     bool
+	versions []uint
+}
+
+func (v *provisionStub) ProvisionGolden(node *Node, golden GoldenValue, version uint) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if v.fail {
+		return errSubmit
+	}
+	v.versions = append(v.versions, version)
+
+	return nil
+}
+
+// newBaselineService returns a node service over a fresh database holding a
+// node with its first golden value, and a candidate of the node for each of
+// the digests
+func newBaselineService(t *testing.T, verifier Verifier, digests ...[]byte) (*NodeService, *Node, []int64) {
+	database, err := db.InitDatabaseConnection(filepath.Join(t.TempDir(), "enact.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { database.Close() })
+
+	node := &Node{ID: uuid.New(), State: StateAttestingOK}
+
+	n := &NodeService{
+		repo:     nodeStub{nodes: map[string]*Node{node.ID.String(): node}},
+		golden:   NewGoldenValueRepo(database),
+		baseline: NewBaselineRepo(database),
+		verifier: verifier,
+	}
+
+	now := time.Now().UTC().String()
+
+	_, err = n.golden.InsertGoldenValue(GoldenValue{NodeID: node.ID.String(), PCRDigest: []byte{0}, Created_At: now})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ids []int64
+	for i, digest := range digests {
+		id, err := n.baseline.InsertCandidate(GoldenCandidate{
+			WindowID:     int64(i + 1),
+			NodeID:       node.ID.String(),
+			PCRDigest:    digest,
+			PCRSelection: "sha256:0",
+			Status:       CandidatePending,
+			Created_At:   now,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+
+	return n, node, ids
+}
+
+// inForce returns the only golden value of the node in force
+func inForce(t *testing.T, n *NodeService, node *Node) GoldenValue {
+	golden, err := n.golden.ListGoldenValues(node.ID.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(golden) != 1 {
+		t.Fatalf("%d golden values in force", len(golden))
+	}
+
+	return golden[0]
+}
+
+func TestApproveCandidate(t *testing.T) {
+	verifier := &provisionStub{}
+	n, node, ids := newBaselineService(t, verifier, []byte{1}, []byte{2})
+
+	golden, err := n.ApproveCandidate(ids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if golden.Version != 1 || !bytes.Equal(inForce(t, n, node).PCRDigest, []byte{1}) {
+		t.Errorf("approved as version %d", golden.Version)
+	}
+
+	if _, err := n.ApproveCandidate(ids[0]); !errors.Is(err, ErrCandidateDecided) {
+		t.Errorf("approved twice: %v", err)
+	}
+
+	// A refused submission leaves the candidate pending and the earlier
+	// golden value in force
+	verifier.fail = true
+	if _, err := n.ApproveCandidate(ids[1]); !errors.Is(err, errSubmit) {
+		t.Fatalf("refused submission: %v", err)
+	}
+
+	candidate, err := n.baseline.GetCandidate(ids[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if candidate.Status != CandidatePending || candidate.Decided_At != nil {
+		t.Errorf("refused candidate %s", candidate.Status)
+	}
+	if g := inForce(t, n, node); g.ID != golden.ID || g.Superseded_At != nil {
+		t.Errorf("golden value %d in force after the refusal, want %d", g.ID, golden.ID)
+	}
+
+	// The version of the refused submission is not reused
+	verifier.fail = false
+	golden, err = n.ApproveCandidate(ids[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if golden.Version != 3 || !bytes.Equal(inForce(t, n, node).PCRDigest, []byte{2}) {
+		t.Errorf("approved as version %d", golden.Version)
+	}
+
+	if want := []uint{1, 3}; len(verifier.versions) != 2 || verifier.versions[0] != want[0] || verifier.versions[1] != want[1] {
+		t.Errorf("submitted versions %v, want %v", verifier.versions, want)
+	}
+}
+
+// TestApproveCandidatesConcurrently checks that concurrent approvals of
+// different candidates of a node never submit the same version
+func TestApproveCandidatesConcurrently(t *testing.T) {
+	const count = 8
+
+	digests := make([][]byte, count)
+	for i := range digests {
+		digests[i] = []byte{byte(i + 1)}
+	}
+
+	verifier := &provisionStub{}
+	n, node, ids := newBaselineService(t, verifier, digests...)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, count)
+
+	for _, id := range ids {
+		wg.Add(1)
+		go func(id int64) {
+			defer wg.Done()
+			if _, err := n.ApproveCandidate(id); err != nil {
+				errs <- err
+			}
+		}(id)
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+
+	versions := verifier.versions
+	sort.Slice(versions, func(i, j int) bool { return versions[i] < versions[j] })
+	for i, version := range versions {
+		if version != uint(i+1) {
+			t.Fatalf("submitted versions %v", versions)
+		}
+	}
+	if len(versions) != count {
+		t.Fatalf("%d submissions", len(versions))
+	}
+
+	inForce(t, n, node)
+}
+
+func TestWithdrawGoldenValue(t *testing.T) {
+	n, node, _ := newBaselineService(t, &provisionStub{})
+	first := inForce(t, n, node)
+
+	replace := func(digest byte) GoldenValue {
+		golden := GoldenValue{NodeID: node.ID.String(), PCRDigest: []byte{digest}, Created_At: time.Now().UTC().String()}
+
+		var err error
+		golden.ID, golden.Version, err = n.golden.ReplaceGoldenValues(golden)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return golden
+	}
+
+	second := replace(2)
+	third := replace(3)
+
+	// The second value was already replaced, withdrawing it changes nothing
+	if err := n.golden.WithdrawGoldenValue(second); err != nil {
+		t.Fatal(err)
+	}
+	if g := inForce(t, n, node); g.ID != third.ID {
+		t.Errorf("golden value %d in force, want %d", g.ID, third.ID)
+	}
+
+	if err := n.golden.WithdrawGoldenValue(third); err != nil {
+		t.Fatal(err)
+	}
+	if g := inForce(t, n, node); g.ID != second.ID {
+		t.Errorf("golden value %d in force, want %d", g.ID, second.ID)
+	}
+
+	if fourth := replace(4); fourth.Version != 3 {
+		t.Errorf("version %d after withdrawing version %d", fourth.Version, third.Version)
+	}
+
+	if first.Version != 0 || second.Version != 1 || third.Version != 2 {
+		t.Errorf("versions %d, %d, %d", first.Version, second.Version, third.Version)
+	}
+}
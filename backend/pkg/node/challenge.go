@@ -0,0 +1,57 @@
+// Copyright 2023 EnactTrust LTD All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+
+package node
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/google/go-tpm/tpm2/credactivation"
+)
+
+// Size of the seed protecting the credential; it has to match the symmetric
+// algorithm of the EK, which is AES-128 for the default TCG EK templates.
+const ekSymBlockSize = 16
+
+var ErrNoAKName = errors.New("node was registered without an AK name")
+
+// makeCredentialChallenge encrypts the nonce the way TPM2_MakeCredential does,
+// binding it to the node's EK and AK name. Only the TPM holding both keys can
+// recover it with TPM2_ActivateCredential.
+//
+// The returned blob is the TPM2B_ID_OBJECT (credentialBlob) immediately
+// followed by the TPM2B_ENCRYPTED_SECRET (secret), both big endian as in
+// TPM wire format.
+func makeCredentialChallenge(node *Node, nonce []byte) ([]byte, error) {
+	if node.AK_Name == "" {
+		return nil, ErrNoAKName
+	}
+
+	akName, err := parseAKName(node.AK_Name)
+	if err != nil {
+		return nil, err
+	}
+
+	ekPub, err := parsePublicKey(node.EK_Pub)
+	if err != nil {
+		return nil, fmt.Errorf("EK_pub: %w", err)
+	}
+
+	credBlob, encSecret, err := credactivation.Generate(akName, ekPub, ekSymBlockSize, nonce)
+	if err != nil {
+		return nil, fmt.Errorf("generating credential: %w", err)
+	}
+
+	return append(credBlob, encSecret...), nil
+}
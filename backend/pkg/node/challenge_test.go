@@ -0,0 +1,184 @@
+// Copyright 2023 EnactTrust LTD All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+
+package node
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+)
+
+// Symmetric key size of the default TCG RSA EK template: AES-128
+const ekTemplateKeyBits = 128
+
+// activateCredential recovers the credential of the challenge as
+// TPM2_ActivateCredential does (TPM 2.0 Part 1, section 24) with an RSA EK
+// of the default TCG template and a SHA-256 AK name
+func activateCredential(ek *rsa.PrivateKey, akName []byte, challenge []byte) ([]byte, error) {
+	var idObject, encSecret tpmutil.U16Bytes
+
+	read, err := tpmutil.Unpack(challenge, &idObject, &encSecret)
+	if err != nil {
+		return nil, err
+	}
+	if read != len(challenge) {
+		return nil, fmt.Errorf("%d trailing bytes", len(challenge)-read)
+	}
+
+	var integrity tpmutil.U16Bytes
+	read, err = tpmutil.Unpack(idObject, &integrity)
+	if err != nil {
+		return nil, err
+	}
+	encIdentity := idObject[read:]
+
+	seed, err := rsa.DecryptOAEP(sha256.New(), nil, ek, encSecret, []byte("IDENTITY\x00"))
+	if err != nil {
+		return nil, fmt.Errorf("decrypting seed: %w", err)
+	}
+
+	macKey, err := tpm2.KDFa(tpm2.AlgSHA256, seed, "INTEGRITY", nil, nil, sha256.Size*8)
+	if err != nil {
+		return nil, err
+	}
+
+	mac := hmac.New(sha256.New, macKey)
+	mac.Write(encIdentity)
+	mac.Write(akName)
+	if !hmac.Equal(mac.Sum(nil), integrity) {
+		return nil, errors.New("integrity check failed")
+	}
+
+	// The TPM derives a key of the EK symmetric algorithm size
+	symKey, err := tpm2.KDFa(tpm2.AlgSHA256, seed, "STORAGE", akName, nil, ekTemplateKeyBits)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(symKey)
+	if err != nil {
+		return nil, err
+	}
+
+	cv := make([]byte, len(encIdentity))
+	cipher.NewCFBDecrypter(block, make([]byte, aes.BlockSize)).XORKeyStream(cv, encIdentity)
+
+	var credential tpmutil.U16Bytes
+	if _, err := tpmutil.Unpack(cv, &credential); err != nil {
+		return nil, err
+	}
+
+	return credential, nil
+}
+
+func TestMakeCredentialChallenge(t *testing.T) {
+	ek, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherEK, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ekPEM, err := publicKeyPEM(ek.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ak := newTestAK(t, testAKAttributes)
+	otherAK := newTestAK(t, testAKAttributes)
+
+	node := &Node{EK_Pub: ekPEM, AK_Name: hex.EncodeToString(ak.name())}
+	nonce := bytes.Repeat([]byte{0x4e}, 16)
+
+	challenge, err := makeCredentialChallenge(node, nonce)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name   string
+		ek     *rsa.PrivateKey
+		akName []byte
+		ok     bool
+	}{
+		{"node TPM", ek, ak.name(), true},
+		{"other AK", ek, otherAK.name(), false},
+		{"other EK", otherEK, ak.name(), false},
+	}
+
+	for _, c := range cases {
+		got, err := activateCredential(c.ek, c.akName, challenge)
+		if c.ok && (err != nil || !bytes.Equal(got, nonce)) {
+			t.Errorf("%s: recovered %x, %v", c.name, got, err)
+		}
+		if !c.ok && err == nil {
+			t.Errorf("%s: recovered %x", c.name, got)
+		}
+	}
+
+	// Each challenge is protected with a fresh seed
+	again, err := makeCredentialChallenge(node, nonce)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(again, challenge) {
+		t.Error("challenges are identical")
+	}
+}
+
+func TestMakeCredentialChallengeErrors(t *testing.T) {
+	ek, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ekPEM, err := publicKeyPEM(ek.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ak := newTestAK(t, testAKAttributes)
+	akName := hex.EncodeToString(ak.name())
+
+	cases := []struct {
+		name string
+		node *Node
+		err  error
+	}{
+		{"no AK name", &Node{EK_Pub: ekPEM}, ErrNoAKName},
+		{"malformed AK name", &Node{EK_Pub: ekPEM, AK_Name: "000b00"}, ErrInvalidAKName},
+		{"ECC EK", &Node{EK_Pub: ak.pem(t), AK_Name: akName}, nil},
+		{"no EK", &Node{AK_Name: akName}, nil},
+	}
+
+	for _, c := range cases {
+		_, err := makeCredentialChallenge(c.node, make([]byte, 16))
+		if err == nil || (c.err != nil && !errors.Is(err, c.err)) {
+			t.Errorf("%s: %v", c.name, err)
+		}
+	}
+}
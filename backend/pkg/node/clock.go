@@ -0,0 +1,163 @@
+// Copyright 2023 EnactTrust LTD All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+
+package node
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// The TPM clock or reset counters of a quote went backwards since the
+// previous attestation of the node, or the quote is a replay of it
+var ErrClockAnomaly = errors.New("TPM clock anomaly")
+
+// Events recorded when comparing the ClockInfo of a quote with that of the
+// previous attestation of the node
+const (
+	// The TPM was reset, i.e. the node rebooted
+	ClockEventReboot = "reboot"
+	// The TPM was restarted, i.e. the node resumed from hibernation
+	ClockEventRestart = "restart"
+	// The clock is behind the previous one although the TPM reports it safe
+	ClockEventClockRollback = "clock_rollback"
+	// The reset or restart count is behind the previous one
+	ClockEventCounterRollback = "counter_rollback"
+	// The clock and counters are those of the previous quote
+	ClockEventReplay = "replay"
+)
+
+// Events that make the appraisal fail
+var clockAnomalies = map[string]bool{
+	ClockEventClockRollback:   true,
+	ClockEventCounterRollback: true,
+	ClockEventReplay:          true,
+}
+
+// ClockInfo is the TPMS_CLOCK_INFO of a quote. It is stored as JSON, NULL
+// for attestations recorded before it was tracked.
+type ClockInfo struct {
+	// Milliseconds the TPM has been powered since it was last cleared
+	Clock uint64 `json:"clock"`
+	// TPM resets, i.e. reboots, since the TPM was last cleared
+	ResetCount uint32 `json:"reset_count"`
+	// TPM restarts, i.e. resumes, since the last reset
+	RestartCount uint32 `json:"restart_count"`
+	// No clock value greater than this one was reported before: false after
+	// an unorderly shutdown lost clock updates
+	Safe bool `json:"safe"`
+	// The counts are obfuscated by an offset, the same for all quotes of the
+	// AK, so that they may wrap around
+	Obfuscated bool `json:"obfuscated,omitempty"`
+}
+
+func (c ClockInfo) Value() (driver.Value, error) {
+	b, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+
+	return string(b), nil
+}
+
+func (c *ClockInfo) Scan(src interface{}) error {
+	switch s := src.(type) {
+	case string:
+		return json.Unmarshal([]byte(s), c)
+	case []byte:
+		return json.Unmarshal(s, c)
+	default:
+		return fmt.Errorf("cannot scan %T into ClockInfo", src)
+	}
+}
+
+// clockInfoOf returns the ClockInfo of the big endian token quoted by the AK
+// of the node
+func clockInfoOf(node *Node, token []byte) (*ClockInfo, error) {
+	et := EnactToken{}
+	if err := et.Decode(token); err != nil {
+		return nil, err
+	}
+
+	info := et.AttestationData.ClockInfo
+
+	// Counts that may be obfuscated are taken as obfuscated, as a rollback
+	// of counts in clear fails the appraisal
+	isObfuscated, known := obfuscated(node, et)
+
+	return &ClockInfo{
+		Clock:        info.Clock,
+		ResetCount:   info.ResetCount,
+		RestartCount: info.RestartCount,
+		Safe:         info.Safe == 1,
+		Obfuscated:   isObfuscated || !known,
+	}, nil
+}
+
+// clockEvents compares the ClockInfo of a quote with that of the previous
+// attestation of the node, nil for its first one. The clock keeps counting
+// across reboots, but may fall back after an unorderly shutdown, which the TPM
+// reports by clearing Safe. Obfuscated counts only tell whether they changed.
+func clockEvents(prev *ClockInfo, cur *ClockInfo) []string {
+	if prev == nil || cur == nil {
+		return nil
+	}
+
+	// Obfuscated counts may wrap around, which cannot be told from a
+	// rollback
+	wraps := prev.Obfuscated || cur.Obfuscated
+	behind := func(prev, cur uint32) bool {
+		return cur < prev && !wraps
+	}
+
+	var events []string
+
+	switch {
+	case behind(prev.ResetCount, cur.ResetCount):
+		events = append(events, ClockEventCounterRollback)
+	case cur.ResetCount != prev.ResetCount:
+		events = append(events, ClockEventReboot)
+	case behind(prev.RestartCount, cur.RestartCount):
+		events = append(events, ClockEventCounterRollback)
+	case cur.RestartCount != prev.RestartCount:
+		events = append(events, ClockEventRestart)
+	case cur.Clock == prev.Clock:
+		events = append(events, ClockEventReplay)
+	}
+
+	if cur.Clock < prev.Clock && cur.Safe {
+		events = append(events, ClockEventClockRollback)
+	}
+
+	return events
+}
+
+// checkClockEvents returns ErrClockAnomaly if one of the events makes the
+// appraisal fail
+func checkClockEvents(events []string) error {
+	var anomalies []string
+	for _, e := range events {
+		if clockAnomalies[e] {
+			anomalies = append(anomalies, e)
+		}
+	}
+
+	if len(anomalies) == 0 {
+		return nil
+	}
+
+	return fmt.Errorf("%w: %s", ErrClockAnomaly, strings.Join(anomalies, ", "))
+}
@@ -0,0 +1,84 @@
+// Copyright 2023 EnactTrust LTD All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+
+package node
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestClockEvents(t *testing.T) {
+	prev := &ClockInfo{Clock: 5000, ResetCount: 10, RestartCount: 2, Safe: true}
+
+	obfuscated := *prev
+	obfuscated.Obfuscated = true
+
+	cases := []struct {
+		name      string
+		prev      *ClockInfo
+		cur       ClockInfo
+		events    []string
+		anomalous bool
+	}{
+		{"clock ticking", prev, ClockInfo{Clock: 6000, ResetCount: 10, RestartCount: 2, Safe: true}, nil, false},
+		{"reboot", prev, ClockInfo{Clock: 7000, ResetCount: 11, RestartCount: 0, Safe: true}, []string{ClockEventReboot}, false},
+		{"restart", prev, ClockInfo{Clock: 7000, ResetCount: 10, RestartCount: 3, Safe: true}, []string{ClockEventRestart}, false},
+		{"replay", prev, *prev, []string{ClockEventReplay}, true},
+		{"reset count rollback", prev, ClockInfo{Clock: 7000, ResetCount: 9, RestartCount: 5, Safe: true}, []string{ClockEventCounterRollback}, true},
+		{"restart count rollback", prev, ClockInfo{Clock: 7000, ResetCount: 10, RestartCount: 1, Safe: true}, []string{ClockEventCounterRollback}, true},
+		{"clock rollback", prev, ClockInfo{Clock: 4000, ResetCount: 10, RestartCount: 2, Safe: true}, []string{ClockEventClockRollback}, true},
+		{"unsafe clock behind", prev, ClockInfo{Clock: 4000, ResetCount: 11, RestartCount: 0, Safe: false}, []string{ClockEventReboot}, false},
+		{"reboot with clock rollback", prev, ClockInfo{Clock: 4000, ResetCount: 11, RestartCount: 0, Safe: true}, []string{ClockEventReboot, ClockEventClockRollback}, true},
+		{"first attestation", nil, ClockInfo{Clock: 1}, nil, false},
+		// Obfuscated counts may wrap around
+		{"obfuscated reboot", &obfuscated, ClockInfo{Clock: 7000, ResetCount: 3, RestartCount: 0, Safe: true, Obfuscated: true}, []string{ClockEventReboot}, false},
+		{"obfuscated restart", &obfuscated, ClockInfo{Clock: 7000, ResetCount: 10, RestartCount: 1, Safe: true, Obfuscated: true}, []string{ClockEventRestart}, false},
+		{"obfuscated replay", &obfuscated, obfuscated, []string{ClockEventReplay}, true},
+		{"obfuscated clock rollback", &obfuscated, ClockInfo{Clock: 4000, ResetCount: 10, RestartCount: 2, Safe: true, Obfuscated: true}, []string{ClockEventClockRollback}, true},
+	}
+
+	for _, c := range cases {
+		cur := c.cur
+		events := clockEvents(c.prev, &cur)
+		if !reflect.DeepEqual(events, c.events) {
+			t.Errorf("%s: events %v, want %v", c.name, events, c.events)
+		}
+
+		if err := checkClockEvents(events); c.anomalous != errors.Is(err, ErrClockAnomaly) {
+			t.Errorf("%s: %v", c.name, err)
+		}
+	}
+}
+
+func TestClockInfoScan(t *testing.T) {
+	want := ClockInfo{Clock: 5000, ResetCount: 10, RestartCount: 2, Safe: true, Obfuscated: true}
+
+	value, err := want.Value()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, src := range []interface{}{value, []byte(value.(string))} {
+		var got ClockInfo
+		if err := got.Scan(src); err != nil || got != want {
+			t.Errorf("scanned %T into %+v, %v", src, got, err)
+		}
+	}
+
+	var got ClockInfo
+	if err := got.Scan(int64(1)); err == nil {
+		t.Error("scanned an integer")
+	}
+}
@@ -0,0 +1,154 @@
+// Copyright 2023 EnactTrust LTD All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+
+package node
+
+import (
+	"log"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// DriftEvent records evidence whose PCR digest matches none of the node's
+// golden values
+type DriftEvent struct {
+	ID     int64  `db:"id" json:"id"`
+	NodeID string `db:"node_id" json:"node_id"`
+	// Attestation recording the appraisal of the drifted evidence, nil if
+	// the verifier produced no result
+	AttestationID *int64 `db:"attestation_id" json:"attestation_id"`
+	Created_At    string `db:"created_at" json:"created_at"`
+	// Most recent golden value of the node, preferably over the same PCRs
+	ExpectedDigest       []byte `db:"expected_digest" json:"expected_digest"`
+	ExpectedPCRSelection string `db:"expected_pcr_selection" json:"expected_pcr_selection"`
+	ObservedDigest       []byte `db:"observed_digest" json:"observed_digest"`
+	ObservedPCRSelection string `db:"observed_pcr_selection" json:"observed_pcr_selection"`
+	// PCRs whose value differs from the expected golden value, e.g.
+	// "sha256:7". Empty unless both the evidence and the golden value came
+	// with individual PCR values.
+	ChangedPCRs string `db:"changed_pcrs" json:"changed_pcrs"`
+}
+
+type DriftRepository interface {
+	InsertDriftEvent(event DriftEvent) error
+	// ListDriftEvents returns the node's drift events, newest first
+	ListDriftEvents(node_id string, limit int, offset int) ([]DriftEvent, int, error)
+}
+
+type SQLiteDriftRepo struct {
+	db *sqlx.DB
+}
+
+func NewDriftRepo(db *sqlx.DB) DriftRepository {
+	return &SQLiteDriftRepo{
+		db: db,
+	}
+}
+
+func (repo SQLiteDriftRepo) InsertDriftEvent(event DriftEvent) error {
+	const query = `
+		INSERT INTO drift_events (
+			node_id,
+			attestation_id,
+			created_at,
+			expected_digest,
+			expected_pcr_selection,
+			observed_digest,
+			observed_pcr_selection,
+			changed_pcrs
+		)
+		VALUES (
+			:node_id,
+			:attestation_id,
+			:created_at,
+			:expected_digest,
+			:expected_pcr_selection,
+			:observed_digest,
+			:observed_pcr_selection,
+			:changed_pcrs
+		);`
+
+	_, err := repo.db.NamedExec(query, &event)
+	if err != nil {
+		log.Println(err.Error())
+		return err
+	}
+
+	return nil
+}
+
+func (repo SQLiteDriftRepo) ListDriftEvents(node_id string, limit int, offset int) ([]DriftEvent, int, error) {
+	var events []DriftEvent = []DriftEvent{}
+
+	var total int
+	err := repo.db.Get(&total, `SELECT COUNT(*) FROM drift_events WHERE node_id = $1;`, node_id)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	const query = `
+		SELECT
+			id,
+			node_id,
+			attestation_id,
+			created_at,
+			expected_digest,
+			expected_pcr_selection,
+			observed_digest,
+			observed_pcr_selection,
+			changed_pcrs
+		FROM drift_events
+		WHERE node_id = $1
+		ORDER BY id DESC
+		LIMIT $2 OFFSET $3;`
+
+	err = repo.db.Select(&events, query, node_id, limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return events, total, nil
+}
+
+// detectDrift compares the evidence digest with the node's golden values.
+// It returns the drift event to record, or nil if the digest matches a
+// golden value or the node has none to compare with. With the individual
+// PCR values of the evidence, the event also names the PCRs that changed.
+func detectDrift(golden []GoldenValue, nodeID string, digest []byte, selection string, values PCRValues) *DriftEvent {
+	if len(golden) == 0 {
+		return nil
+	}
+
+	var expected *GoldenValue
+	for i := range golden {
+		g := &golden[i]
+		if g.Matches(digest, selection) {
+			return nil
+		}
+
+		// golden values are oldest first, keep the latest, preferably over
+		// the same PCRs
+		if expected == nil || g.PCRSelection == selection || expected.PCRSelection != selection {
+			expected = g
+		}
+	}
+
+	return &DriftEvent{
+		NodeID:               nodeID,
+		ExpectedDigest:       expected.PCRDigest,
+		ExpectedPCRSelection: expected.PCRSelection,
+		ObservedDigest:       digest,
+		ObservedPCRSelection: selection,
+		ChangedPCRs:          changedPCRs(expected.PCRValues, values, selection),
+	}
+}
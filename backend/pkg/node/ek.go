@@ -0,0 +1,97 @@
+// Copyright 2023 EnactTrust LTD All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+
+package node
+
+import (
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/veraison/enact-demo/pkg/ekcert"
+)
+
+var (
+	// An EK CA bundle is configured and the node sent no EK certificate
+	ErrNoEKCertificate      = errors.New("EK certificate required")
+	ErrInvalidEKCertificate = errors.New("invalid EK certificate")
+	// The EK certificate does not chain to a configured CA, or is revoked
+	ErrUntrustedEK = errors.New("EK not vouched for by a trusted TPM manufacturer")
+)
+
+// registeredEK is the EK of a registering node as stored with it
+type registeredEK struct {
+	// PEM public key, or the EK_pub sent by the agent when it sent no
+	// certificate
+	pub          string
+	cert         string
+	manufacturer string
+	model        string
+}
+
+// checkEK validates the EK certificate of a registering node against the
+// configured CAs, and checks that the EK public key, if sent as well, is the
+// certified one. Without an EK certificate the EK public key is stored as is,
+// unless EK certificates are required.
+func (n *NodeService) checkEK(ekPub string, ekCert string) (*registeredEK, error) {
+	if ekCert == "" {
+		if n.ekVerifier != nil {
+			return nil, ErrNoEKCertificate
+		}
+
+		return &registeredEK{pub: ekPub}, nil
+	}
+
+	cert, tpm, err := ekcert.Parse([]byte(ekCert))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidEKCertificate, err)
+	}
+
+	if n.ekVerifier != nil {
+		if err := n.ekVerifier.Verify(cert, time.Now()); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrUntrustedEK, err)
+		}
+	} else {
+		log.Printf("EK certificate of %s %s accepted without validation, no EK CA bundle configured", tpm.Manufacturer, tpm.Model)
+	}
+
+	pub, err := publicKeyPEM(cert.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidEKCertificate, err)
+	}
+
+	if ekPub != "" {
+		key, err := parsePublicKey(ekPub)
+		if err != nil {
+			return nil, fmt.Errorf("%w: EK public key: %v", ErrInvalidEKCertificate, err)
+		}
+
+		sent, err := publicKeyPEM(key)
+		if err != nil {
+			return nil, fmt.Errorf("%w: EK public key: %v", ErrInvalidEKCertificate, err)
+		}
+
+		if sent != pub {
+			return nil, fmt.Errorf("%w: EK public key is not the certified one", ErrInvalidEKCertificate)
+		}
+	}
+
+	return &registeredEK{
+		pub:          pub,
+		cert:         string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})),
+		manufacturer: tpm.Manufacturer,
+		model:        tpm.Model,
+	}, nil
+}
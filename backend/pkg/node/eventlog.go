@@ -0,0 +1,109 @@
+// Copyright 2023 EnactTrust LTD All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+
+package node
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/veraison/enact-demo/pkg/eventlog"
+)
+
+var (
+	// The event log sent along a quote cannot be parsed
+	ErrInvalidEventLog = errors.New("invalid event log")
+	// The event log does not replay to the quoted PCRs
+	ErrEventLogMismatch = errors.New("event log does not match the quoted PCRs")
+)
+
+// eventLogClaims parses the event log sent along the quote of the big endian
+// token and replays it in the bank of the quote. With the individual PCR
+// values of the quote, every quoted PCR the log extends must replay to its
+// value. Without them, the replayed PCRs, zero for those the log does not
+// extend, must hash to the quote PCR digest. It returns the claims of the
+// events measured into quoted PCRs, or nil claims for a nil log.
+func eventLogClaims(token []byte, raw []byte, values PCRValues) (*eventlog.Claims, error) {
+	if raw == nil {
+		return nil, nil
+	}
+
+	et := EnactToken{}
+	if err := et.Decode(token); err != nil {
+		return nil, err
+	}
+
+	quote := et.AttestationData.AttestedQuoteInfo
+	if quote == nil {
+		return nil, errors.New("token is not a quote")
+	}
+
+	log, err := eventlog.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidEventLog, err)
+	}
+
+	bank := quote.PCRSelection.Hash
+
+	replayed, err := log.Replay(bank)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidEventLog, err)
+	}
+
+	pcrs := append([]int(nil), quote.PCRSelection.PCRs...)
+	sort.Ints(pcrs)
+
+	quoted := map[int]bool{}
+	for _, pcr := range pcrs {
+		quoted[pcr] = true
+	}
+
+	if values != nil {
+		for _, pcr := range pcrs {
+			if r, ok := replayed[pcr]; ok && !bytes.Equal(r, values.Get(pcr)) {
+				return nil, fmt.Errorf("%w: PCR %d", ErrEventLogMismatch, pcr)
+			}
+		}
+
+		return log.Claims(bank, quoted), nil
+	}
+
+	size := log.Algorithms[bank]
+
+	var concatenated []byte
+	for _, pcr := range pcrs {
+		r, ok := replayed[pcr]
+		if !ok {
+			r = make([]byte, size)
+		}
+		concatenated = append(concatenated, r...)
+	}
+
+	alg, err := signatureHash(et.Signature)
+	if err != nil {
+		return nil, err
+	}
+
+	h, err := alg.Hash()
+	if err != nil {
+		return nil, err
+	}
+
+	if !bytes.Equal(hashOf(h, concatenated), quote.PCRDigest) {
+		return nil, fmt.Errorf("%w: replayed PCRs do not hash to the quote PCR digest", ErrEventLogMismatch)
+	}
+
+	return log.Claims(bank, quoted), nil
+}
@@ -0,0 +1,323 @@
+// Copyright 2023 EnactTrust LTD All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+
+package node
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+var (
+	ErrInvalidFirmwarePolicy = errors.New("invalid firmware policy")
+	// The TPM firmware of the node is older than allowed or known vulnerable
+	ErrFirmwarePolicy = errors.New("TPM firmware version not allowed by policy")
+)
+
+// Kinds of firmware policies
+const (
+	// Versions older than the policy one are not allowed
+	FirmwarePolicyMinimum = "minimum"
+	// The policy version is known vulnerable
+	FirmwarePolicyVulnerable = "vulnerable"
+)
+
+// FirmwarePolicy restricts the TPM firmware versions of the nodes whose EK
+// certificate names the manufacturer, or of all nodes when it is empty
+type FirmwarePolicy struct {
+	ID int64 `db:"id" json:"id"`
+	// TCG vendor ID, e.g. "IFX", as recorded from the EK certificate
+	Manufacturer string `db:"manufacturer" json:"manufacturer"`
+	Kind         string `db:"kind" json:"kind" binding:"required"`
+	// Firmware version, as formatted by formatFirmwareVersion
+	Version string `db:"version" json:"version" binding:"required"`
+	// Why the version is not allowed, e.g. an advisory ID
+	Reason     string `db:"reason" json:"reason"`
+	Created_At string `db:"created_at" json:"created_at"`
+}
+
+// formatFirmwareVersion formats the 64 bits TPMS_ATTEST firmwareVersion as
+// four dot separated 16 bits numbers, most significant first: TPMs put the
+// major and minor version in the upper 32 bits, e.g. "7.85.4555.0"
+func formatFirmwareVersion(v uint64) string {
+	return fmt.Sprintf("%d.%d.%d.%d", v>>48, (v>>32)&0xffff, (v>>16)&0xffff, v&0xffff)
+}
+
+// parseFirmwareVersion parses up to four dot separated 16 bits numbers, the
+// missing ones being zero, so that "7.85" is "7.85.0.0"
+func parseFirmwareVersion(s string) (uint64, error) {
+	parts := strings.Split(strings.TrimSpace(s), ".")
+	if len(parts) > 4 {
+		return 0, fmt.Errorf("%w: version %q has more than 4 parts", ErrInvalidFirmwarePolicy, s)
+	}
+
+	var v uint64
+	for i := 0; i < 4; i++ {
+		var n uint64
+		if i < len(parts) {
+			var err error
+			n, err = strconv.ParseUint(parts[i], 10, 16)
+			if err != nil {
+				return 0, fmt.Errorf("%w: version %q: %v", ErrInvalidFirmwarePolicy, s, err)
+			}
+		}
+		v = v<<16 | n
+	}
+
+	return v, nil
+}
+
+type FirmwarePolicyRepository interface {
+	AddFirmwarePolicy(policy FirmwarePolicy) (int64, error)
+	ListFirmwarePolicies() ([]FirmwarePolicy, error)
+	// DeleteFirmwarePolicy returns ErrNotFound if there is no such policy
+	DeleteFirmwarePolicy(id int64) error
+}
+
+type SQLiteFirmwarePolicyRepo struct {
+	db *sqlx.DB
+}
+
+func NewFirmwarePolicyRepo(db *sqlx.DB) FirmwarePolicyRepository {
+	return &SQLiteFirmwarePolicyRepo{
+		db: db,
+	}
+}
+
+func (repo SQLiteFirmwarePolicyRepo) AddFirmwarePolicy(policy FirmwarePolicy) (int64, error) {
+	const query = `
+		INSERT INTO firmware_policies (
+			manufacturer,
+			kind,
+			version,
+			reason,
+			created_at
+		)
+		VALUES (
+			:manufacturer,
+			:kind,
+			:version,
+			:reason,
+			:created_at
+		);`
+
+	response, err := repo.db.NamedExec(query, &policy)
+	if err != nil {
+		log.Println(err.Error())
+		return 0, err
+	}
+
+	return response.LastInsertId()
+}
+
+func (repo SQLiteFirmwarePolicyRepo) ListFirmwarePolicies() ([]FirmwarePolicy, error) {
+	var policies []FirmwarePolicy = []FirmwarePolicy{}
+
+	const query = `
+		SELECT
+			id,
+			manufacturer,
+			kind,
+			version,
+			reason,
+			created_at
+		FROM firmware_policies
+		ORDER BY manufacturer, kind, id;`
+
+	err := repo.db.Select(&policies, query)
+	if err != nil {
+		return nil, err
+	}
+
+	return policies, nil
+}
+
+func (repo SQLiteFirmwarePolicyRepo) DeleteFirmwarePolicy(id int64) error {
+	const query = `DELETE FROM firmware_policies WHERE id = $1;`
+
+	response, err := repo.db.Exec(query, id)
+	if err != nil {
+		log.Println(err.Error())
+		return err
+	}
+
+	if count, err := response.RowsAffected(); err != nil {
+		return err
+	} else if count == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+// AddFirmwarePolicy validates the policy and stores it with its version in
+// canonical form
+func (n *NodeService) AddFirmwarePolicy(policy FirmwarePolicy) (*FirmwarePolicy, error) {
+	switch policy.Kind {
+	case FirmwarePolicyMinimum, FirmwarePolicyVulnerable:
+	default:
+		return nil, fmt.Errorf("%w: kind must be %q or %q", ErrInvalidFirmwarePolicy, FirmwarePolicyMinimum, FirmwarePolicyVulnerable)
+	}
+
+	v, err := parseFirmwareVersion(policy.Version)
+	if err != nil {
+		return nil, err
+	}
+
+	policy.Manufacturer = strings.TrimSpace(policy.Manufacturer)
+	policy.Version = formatFirmwareVersion(v)
+	policy.Created_At = time.Now().UTC().String()
+
+	policy.ID, err = n.firmware.AddFirmwarePolicy(policy)
+	if err != nil {
+		return nil, err
+	}
+
+	return &policy, nil
+}
+
+func (n *NodeService) ListFirmwarePolicies() ([]FirmwarePolicy, error) {
+	return n.firmware.ListFirmwarePolicies()
+}
+
+func (n *NodeService) DeleteFirmwarePolicy(id int64) error {
+	return n.firmware.DeleteFirmwarePolicy(id)
+}
+
+// recordFirmwareVersion records with the node the firmware version of the
+// TPM that produced the big endian token and whether the TPM obfuscated it,
+// nil when it may have, and returns them
+func (n *NodeService) recordFirmwareVersion(node *Node, token []byte) (uint64, *bool, error) {
+	et := EnactToken{}
+	if err := et.Decode(token); err != nil {
+		return 0, nil, err
+	}
+
+	version := et.AttestationData.FirmwareVersion
+
+	var obfuscatedVersion *bool
+	if isObfuscated, known := obfuscated(node, et); known {
+		obfuscatedVersion = &isObfuscated
+	}
+
+	err := n.repo.UpdateFirmwareVersion(node.ID.String(), formatFirmwareVersion(version), obfuscatedVersion)
+	if err != nil {
+		log.Println(err)
+	}
+
+	return version, obfuscatedVersion, nil
+}
+
+// firmwareAlerts returns an alert for every policy of the node manufacturer,
+// or of all manufacturers, that the firmware version breaks. An obfuscated
+// version breaks none, but raises a single alert if a policy applies.
+func firmwareAlerts(policies []FirmwarePolicy, node *Node, version uint64, obfuscatedVersion *bool) []Alert {
+	var alerts []Alert
+
+	for _, p := range policies {
+		if p.Manufacturer != "" && !strings.EqualFold(p.Manufacturer, node.EK_Manufacturer) {
+			continue
+		}
+
+		if obfuscatedVersion != nil && *obfuscatedVersion {
+			return []Alert{{
+				NodeID:          node.ID.String(),
+				Kind:            AlertFirmwareUnenforceable,
+				FirmwareVersion: formatFirmwareVersion(version),
+				Message:         "TPM firmware version obfuscated, the AK is outside the endorsement and platform hierarchies: firmware policies cannot be enforced",
+			}}
+		}
+
+		v, err := parseFirmwareVersion(p.Version)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+
+		alert := Alert{
+			NodeID:          node.ID.String(),
+			FirmwareVersion: formatFirmwareVersion(version),
+		}
+
+		switch {
+		case p.Kind == FirmwarePolicyMinimum && version < v:
+			alert.Kind = AlertFirmwareBelowMinimum
+			alert.Message = fmt.Sprintf("TPM firmware %s is older than the minimum %s", alert.FirmwareVersion, p.Version)
+		case p.Kind == FirmwarePolicyVulnerable && version == v:
+			alert.Kind = AlertFirmwareVulnerable
+			alert.Message = fmt.Sprintf("TPM firmware %s is known vulnerable", alert.FirmwareVersion)
+		default:
+			continue
+		}
+
+		if p.Reason != "" {
+			alert.Message += ": " + p.Reason
+		}
+
+		alerts = append(alerts, alert)
+	}
+
+	return alerts
+}
+
+// checkFirmware records the firmware version of the TPM that produced the
+// token with the node, and returns the alerts of the policies it breaks
+func (n *NodeService) checkFirmware(node *Node, token []byte) ([]Alert, error) {
+	version, obfuscatedVersion, err := n.recordFirmwareVersion(node, token)
+	if err != nil {
+		return nil, err
+	}
+
+	policies, err := n.firmware.ListFirmwarePolicies()
+	if err != nil {
+		return nil, err
+	}
+
+	return firmwareAlerts(policies, node, version, obfuscatedVersion), nil
+}
+
+// breaksFirmwarePolicy tells whether one of the alerts is for a broken
+// firmware policy, which fails the appraisal
+func breaksFirmwarePolicy(alerts []Alert) bool {
+	for _, alert := range alerts {
+		if alert.Kind == AlertFirmwareBelowMinimum || alert.Kind == AlertFirmwareVulnerable {
+			return true
+		}
+	}
+
+	return false
+}
+
+// raiseAlerts stores the alerts, linking them to the attestation that raised
+// them when there is one. Failures are only logged: the appraisal itself is
+// recorded regardless.
+func (n *NodeService) raiseAlerts(alerts []Alert, attestationID *int64) {
+	now := time.Now().UTC().String()
+
+	for _, alert := range alerts {
+		log.Printf("node %s: %s", alert.NodeID, alert.Message)
+
+		alert.AttestationID = attestationID
+		alert.Created_At = now
+
+		if err := n.alerts.RaiseAlert(alert); err != nil {
+			log.Println(err)
+		}
+	}
+}
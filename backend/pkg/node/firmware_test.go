@@ -0,0 +1,74 @@
+// Copyright 2023 EnactTrust LTD All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+
+package node
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestFirmwareAlerts(t *testing.T) {
+	node := &Node{ID: uuid.New(), EK_Manufacturer: "IFX"}
+	version, err := parseFirmwareVersion("7.85.4555")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clear, isObfuscated := false, true
+
+	minimum := FirmwarePolicy{Kind: FirmwarePolicyMinimum, Version: "7.86"}
+	vulnerable := FirmwarePolicy{Manufacturer: "ifx", Kind: FirmwarePolicyVulnerable, Version: "7.85.4555.0"}
+	otherVendor := FirmwarePolicy{Manufacturer: "STM", Kind: FirmwarePolicyMinimum, Version: "8"}
+	older := FirmwarePolicy{Kind: FirmwarePolicyMinimum, Version: "7.85"}
+
+	cases := []struct {
+		name       string
+		policies   []FirmwarePolicy
+		obfuscated *bool
+		kinds      []string
+		breaks     bool
+	}{
+		{"no policies", nil, &clear, nil, false},
+		{"allowed", []FirmwarePolicy{older, otherVendor}, &clear, nil, false},
+		{"broken", []FirmwarePolicy{minimum, vulnerable, otherVendor}, &clear, []string{AlertFirmwareBelowMinimum, AlertFirmwareVulnerable}, true},
+		{"may be obfuscated", []FirmwarePolicy{minimum}, nil, []string{AlertFirmwareBelowMinimum}, true},
+		{"obfuscated", []FirmwarePolicy{minimum, vulnerable}, &isObfuscated, []string{AlertFirmwareUnenforceable}, false},
+		{"obfuscated, other vendor", []FirmwarePolicy{otherVendor}, &isObfuscated, nil, false},
+	}
+
+	for _, c := range cases {
+		alerts := firmwareAlerts(c.policies, node, version, c.obfuscated)
+
+		var kinds []string
+		for _, alert := range alerts {
+			kinds = append(kinds, alert.Kind)
+		}
+
+		if len(kinds) != len(c.kinds) {
+			t.Errorf("%s: alerts %v", c.name, kinds)
+			continue
+		}
+		for i := range kinds {
+			if kinds[i] != c.kinds[i] {
+				t.Errorf("%s: alerts %v", c.name, kinds)
+				break
+			}
+		}
+
+		if breaksFirmwarePolicy(alerts) != c.breaks {
+			t.Errorf("%s: breaks policy %v", c.name, !c.breaks)
+		}
+	}
+}
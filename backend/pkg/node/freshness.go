@@ -0,0 +1,113 @@
+// Copyright 2023 EnactTrust LTD All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+
+package node
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/veraison/enact-demo/pkg/session"
+)
+
+var (
+	// The quote answers a challenge whose session has expired
+	ErrStaleNonce = errors.New("evidence answers an expired challenge")
+	// The quote does not answer the challenge issued to the node
+	ErrNonceMismatch = errors.New("quote does not answer the session nonce")
+	// The quote answers a challenge that was already answered
+	ErrReplayedNonce = errors.New("evidence answers a challenge that was already used")
+	// The quote signature does not verify with the AK of the node
+	ErrBadSignature = errors.New("quote is not signed by the AK of the node")
+)
+
+// checkSignature verifies the quote signature with the AK of the node, so
+// that only the node can use up its challenge
+func (n *NodeService) checkSignature(nodeID uuid.UUID, et EnactToken) error {
+	node, err := n.repo.GetNodeById(nodeID.String())
+	if err != nil {
+		return err
+	}
+
+	key, err := parseKey(node.AK_Pub)
+	if err != nil {
+		return err
+	}
+
+	err = et.VerifySignature(key)
+	if err != nil && !errors.Is(err, ErrUnsupportedSignature) && !errors.Is(err, ErrUnsupportedAK) {
+		return fmt.Errorf("%w: %v", ErrBadSignature, err)
+	}
+
+	return err
+}
+
+// checkFreshness makes sure that the quote nonce (extraData) is the one
+// issued to the node by /node/secret, that the session is still valid and
+// that no evidence answering it was accepted before. On success the nonce
+// is consumed, so the same quote can never be processed twice. The quote
+// signature must have been checked first.
+func (n *NodeService) checkFreshness(nodeID uuid.UUID, nonce []byte) error {
+	s, err := n.sessions.Get(nodeID.String())
+	if err != nil && !errors.Is(err, session.ErrNotFound) {
+		return err
+	}
+
+	if s == nil || subtle.ConstantTimeCompare(s.Nonce, nonce) != 1 {
+		// Sessions are deleted once answered, so a replay usually shows up
+		// as a nonce that no longer matches any session
+		consumed, err := n.sessions.Consumed(nonce)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case consumed:
+			return ErrReplayedNonce
+		case s == nil:
+			return session.ErrNotFound
+		default:
+			return ErrNonceMismatch
+		}
+	}
+
+	if s.Expired(time.Now()) {
+		err = n.sessions.Delete(nodeID.String())
+		if err != nil {
+			log.Println(err)
+		}
+
+		return ErrStaleNonce
+	}
+
+	err = n.sessions.Consume(nodeID.String(), nonce)
+	if errors.Is(err, session.ErrNonceConsumed) {
+		return ErrReplayedNonce
+	}
+	if err != nil {
+		return err
+	}
+
+	// Past the session TTL a replayed nonce no longer matches any session,
+	// so consumed nonces need not be kept longer
+	err = n.sessions.PurgeConsumed(time.Now().Add(-n.cfg.Sessions.SessionTTL()))
+	if err != nil {
+		log.Println(err)
+	}
+
+	return nil
+}
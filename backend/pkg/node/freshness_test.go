@@ -0,0 +1,201 @@
+// Copyright 2023 EnactTrust LTD All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+
+package node
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/uuid"
+	"github.com/veraison/enact-demo/config"
+	"github.com/veraison/enact-demo/pkg/session"
+)
+
+// nodeStub serves the nodes of the node service
+type nodeStub struct {
+	NodeRepository
+	nodes map[string]*Node
+}
+
+func (r nodeStub) GetNodeById(node_id string) (*Node, error) {
+	node, ok := r.nodes[node_id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	return node, nil
+}
+
+func TestCheckFreshness(t *testing.T) {
+	nodeID := uuid.New()
+	nonce := bytes.Repeat([]byte{0x4e}, 16)
+	now := time.Now().UTC()
+
+	active := session.Session{NodeID: nodeID.String(), Nonce: nonce, CreatedAt: now, ExpiresAt: now.Add(time.Minute)}
+	expired := session.Session{NodeID: nodeID.String(), Nonce: nonce, CreatedAt: now.Add(-time.Hour), ExpiresAt: now.Add(-time.Minute)}
+
+	cases := []struct {
+		name    string
+		session *session.Session
+		// Nonces consumed before the check
+		consumed [][]byte
+		nonce    []byte
+		err      error
+	}{
+		{name: "fresh", session: &active, nonce: nonce},
+		{name: "expired", session: &expired, nonce: nonce, err: ErrStaleNonce},
+		{name: "mismatched", session: &active, nonce: bytes.Repeat([]byte{0x6d}, 16), err: ErrNonceMismatch},
+		{name: "truncated", session: &active, nonce: nonce[:8], err: ErrNonceMismatch},
+		{name: "replayed", session: &active, consumed: [][]byte{nonce}, nonce: nonce, err: ErrReplayedNonce},
+		{name: "replayed after the session", consumed: [][]byte{nonce}, nonce: nonce, err: ErrReplayedNonce},
+		{name: "replayed to a new session", session: &active, consumed: [][]byte{nonce[:8]}, nonce: nonce[:8], err: ErrReplayedNonce},
+		{name: "unknown session", nonce: nonce, err: session.ErrNotFound},
+	}
+
+	for _, c := range cases {
+		sessions := session.NewMemoryStore()
+		if c.session != nil {
+			if err := sessions.Put(*c.session); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, consumed := range c.consumed {
+			if err := sessions.Consume(nodeID.String(), consumed); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		n := NewService(config.Default(), Deps{Sessions: sessions})
+
+		err := n.checkFreshness(nodeID, c.nonce)
+		if (c.err == nil) != (err == nil) || (c.err != nil && !errors.Is(err, c.err)) {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+
+		consumed, err := sessions.Consumed(c.nonce)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if wantConsumed := c.err == nil || errors.Is(c.err, ErrReplayedNonce); consumed != wantConsumed {
+			t.Errorf("%s: nonce consumed %v", c.name, consumed)
+		}
+
+		// Expired sessions are dropped, the others kept
+		if c.session != nil {
+			_, err := sessions.Get(nodeID.String())
+			if dropped := errors.Is(err, session.ErrNotFound); dropped != errors.Is(c.err, ErrStaleNonce) {
+				t.Errorf("%s: session dropped %v", c.name, dropped)
+			}
+		}
+	}
+}
+
+func TestCheckFreshnessConcurrently(t *testing.T) {
+	const workers = 16
+
+	nodeID := uuid.New()
+	nonce := bytes.Repeat([]byte{0x4e}, 16)
+	now := time.Now().UTC()
+
+	sessions := session.NewMemoryStore()
+	err := sessions.Put(session.Session{NodeID: nodeID.String(), Nonce: nonce, CreatedAt: now, ExpiresAt: now.Add(time.Minute)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n := NewService(config.Default(), Deps{Sessions: sessions})
+
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+
+	// Evidences answering the same challenge
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- n.checkFreshness(nodeID, nonce)
+		}()
+	}
+
+	wg.Wait()
+	close(errs)
+
+	accepted, replayed := 0, 0
+	for err := range errs {
+		switch {
+		case err == nil:
+			accepted++
+		case errors.Is(err, ErrReplayedNonce):
+			replayed++
+		default:
+			t.Error(err)
+		}
+	}
+
+	if accepted != 1 || replayed != workers-1 {
+		t.Errorf("%d accepted, %d replayed", accepted, replayed)
+	}
+}
+
+func TestCheckSignature(t *testing.T) {
+	ak := newTestAK(t, testAKAttributes)
+	other := newTestAK(t, testAKAttributes)
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	node := &Node{ID: uuid.New(), AK_Pub: ak.pem(t)}
+	badKey := &Node{ID: uuid.New(), AK_Pub: "not a key"}
+
+	n := NewService(config.Default(), Deps{
+		Nodes:    nodeStub{nodes: map[string]*Node{node.ID.String(): node, badKey.ID.String(): badKey}},
+		Sessions: session.NewMemoryStore(),
+	})
+
+	quote := testQuote(tpm2.AlgSHA256, []int{0, 1, 2, 3}, bytes.Repeat([]byte{0x60}, 32), bytes.Repeat([]byte{0x4e}, 16))
+
+	cases := []struct {
+		name   string
+		nodeID uuid.UUID
+		token  []byte
+		err    error
+	}{
+		{"signed by the AK", node.ID, signToken(t, quote, ak.key, tpm2.AlgECDSA, tpm2.AlgSHA256), nil},
+		{"signed by another key", node.ID, signToken(t, quote, other.key, tpm2.AlgECDSA, tpm2.AlgSHA256), ErrBadSignature},
+		{"RSA signature for an ECDSA AK", node.ID, signToken(t, quote, rsaKey, tpm2.AlgRSASSA, tpm2.AlgSHA256), ErrUnsupportedSignature},
+		{"unknown node", uuid.New(), signToken(t, quote, ak.key, tpm2.AlgECDSA, tpm2.AlgSHA256), ErrNotFound},
+		{"malformed AK", badKey.ID, signToken(t, quote, ak.key, tpm2.AlgECDSA, tpm2.AlgSHA256), ErrInvalidAKPub},
+	}
+
+	for _, c := range cases {
+		et := EnactToken{}
+		if err := et.Decode(c.token); err != nil {
+			t.Fatal(err)
+		}
+
+		err := n.checkSignature(c.nodeID, et)
+		if (c.err == nil) != (err == nil) || (c.err != nil && !errors.Is(err, c.err)) {
+			t.Errorf("%s: %v", c.name, err)
+		}
+	}
+}
@@ -0,0 +1,258 @@
+// Copyright 2023 EnactTrust LTD All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+
+package node
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/jmoiron/sqlx"
+)
+
+// GoldenValue is a reference PCR digest of a node, taken from the quote it
+// sent to /node/golden
+type GoldenValue struct {
+	ID        int64  `db:"id" json:"id"`
+	NodeID    string `db:"node_id" json:"node_id"`
+	PCRDigest []byte `db:"pcr_digest" json:"pcr_digest"`
+	// TPM algorithm ID of the hash of the PCR digest, that of the quote
+	// signature scheme
+	PCRDigestAlg uint16 `db:"pcr_digest_alg" json:"pcr_digest_alg"`
+	// PCRs the digest covers, as formatted by formatPCRSelection. Empty for
+	// golden values recorded before selections were stored.
+	PCRSelection string `db:"pcr_selection" json:"pcr_selection"`
+	// Individual PCRs of the golden quote, when the agent sent them
+	PCRValues PCRValues `db:"pcr_values" json:"pcr_values,omitempty"`
+	// Tag-version of the node's golden values CoMID the value was submitted
+	// to the verifier with
+	Version    uint   `db:"version" json:"version"`
+	Created_At string `db:"created_at" json:"created_at"`
+	// Time an approved update replaced the golden value, nil while it is
+	// in force. A value the verifier refused is superseded as of its own
+	// creation.
+	Superseded_At *string `db:"superseded_at" json:"superseded_at,omitempty"`
+}
+
+// Matches tells whether a quote over the given PCRs with the given digest
+// agrees with the golden value
+func (g GoldenValue) Matches(digest []byte, selection string) bool {
+	if g.PCRSelection != "" && g.PCRSelection != selection {
+		return false
+	}
+
+	return bytes.Equal(g.PCRDigest, digest)
+}
+
+// formatPCRSelection renders a PCR selection as "<bank>:<pcr>,<pcr>,...",
+// e.g. "sha256:0,1,2,3", with the PCRs in ascending order
+func formatPCRSelection(sel tpm2.PCRSelection) string {
+	pcrs := append([]int(nil), sel.PCRs...)
+	sort.Ints(pcrs)
+
+	s := make([]string, len(pcrs))
+	for i, pcr := range pcrs {
+		s[i] = fmt.Sprint(pcr)
+	}
+
+	return fmt.Sprintf("%s:%s", strings.ToLower(sel.Hash.String()), strings.Join(s, ","))
+}
+
+type GoldenValueRepository interface {
+	InsertGoldenValue(golden GoldenValue) (int64, error)
+	// ListGoldenValues returns the node's golden values in force, oldest
+	// first
+	ListGoldenValues(node_id string) ([]GoldenValue, error)
+	// ReplaceGoldenValues takes the node's golden values out of force as of
+	// the creation of golden, and inserts golden in their place with the
+	// next tag-version of the node, in a single transaction. It returns the
+	// ID and version of the inserted value.
+	ReplaceGoldenValues(golden GoldenValue) (int64, uint, error)
+	// WithdrawGoldenValue undoes ReplaceGoldenValues, unless a later value
+	// already replaced golden. Its row is kept, so that its version is never
+	// reused.
+	WithdrawGoldenValue(golden GoldenValue) error
+}
+
+type SQLiteGoldenValueRepo struct {
+	db *sqlx.DB
+}
+
+func NewGoldenValueRepo(db *sqlx.DB) GoldenValueRepository {
+	return &SQLiteGoldenValueRepo{
+		db: db,
+	}
+}
+
+func (repo SQLiteGoldenValueRepo) InsertGoldenValue(golden GoldenValue) (int64, error) {
+	const query = `
+		INSERT INTO golden_values (
+			node_id,
+			pcr_digest,
+			pcr_digest_alg,
+			pcr_selection,
+			pcr_values,
+			version,
+			created_at
+		)
+		VALUES (
+			:node_id,
+			:pcr_digest,
+			:pcr_digest_alg,
+			:pcr_selection,
+			:pcr_values,
+			:version,
+			:created_at
+		);`
+
+	response, err := repo.db.NamedExec(query, &golden)
+	if err != nil {
+		log.Println(err.Error())
+		return 0, err
+	}
+
+	return response.LastInsertId()
+}
+
+func (repo SQLiteGoldenValueRepo) ListGoldenValues(node_id string) ([]GoldenValue, error) {
+	var golden []GoldenValue = []GoldenValue{}
+
+	const query = `
+		SELECT
+			id,
+			node_id,
+			pcr_digest,
+			pcr_digest_alg,
+			pcr_selection,
+			pcr_values,
+			version,
+			created_at,
+			superseded_at
+		FROM golden_values
+		WHERE node_id = $1 AND superseded_at IS NULL
+		ORDER BY id;`
+
+	err := repo.db.Select(&golden, query, node_id)
+	if err != nil {
+		return nil, err
+	}
+
+	return golden, nil
+}
+
+func (repo SQLiteGoldenValueRepo) ReplaceGoldenValues(golden GoldenValue) (int64, uint, error) {
+	const supersede = `
+		UPDATE golden_values
+		SET superseded_at = $1
+		WHERE node_id = $2 AND superseded_at IS NULL;`
+
+	const nextVersion = `
+		SELECT COALESCE(MAX(version) + 1, 0)
+		FROM golden_values
+		WHERE node_id = $1;`
+
+	const insert = `
+		INSERT INTO golden_values (
+			node_id,
+			pcr_digest,
+			pcr_digest_alg,
+			pcr_selection,
+			pcr_values,
+			version,
+			created_at
+		)
+		VALUES (
+			:node_id,
+			:pcr_digest,
+			:pcr_digest_alg,
+			:pcr_selection,
+			:pcr_values,
+			:version,
+			:created_at
+		);`
+
+	tx, err := repo.db.Beginx()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback()
+
+	// The update takes the write lock first, so that concurrent replacements
+	// read the version after one another
+	_, err = tx.Exec(supersede, golden.Created_At, golden.NodeID)
+	if err != nil {
+		log.Println(err.Error())
+		return 0, 0, err
+	}
+
+	err = tx.Get(&golden.Version, nextVersion, golden.NodeID)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	response, err := tx.NamedExec(insert, &golden)
+	if err != nil {
+		log.Println(err.Error())
+		return 0, 0, err
+	}
+
+	id, err := response.LastInsertId()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return id, golden.Version, tx.Commit()
+}
+
+func (repo SQLiteGoldenValueRepo) WithdrawGoldenValue(golden GoldenValue) error {
+	const withdraw = `
+		UPDATE golden_values
+		SET superseded_at = created_at
+		WHERE id = $1 AND superseded_at IS NULL;`
+
+	const restore = `
+		UPDATE golden_values
+		SET superseded_at = NULL
+		WHERE node_id = $1 AND superseded_at = $2 AND id <> $3;`
+
+	tx, err := repo.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	response, err := tx.Exec(withdraw, golden.ID)
+	if err != nil {
+		log.Println(err.Error())
+		return err
+	}
+
+	if count, err := response.RowsAffected(); err != nil {
+		return err
+	} else if count == 0 {
+		// A later value replaced it, the values it replaced stay out of force
+		return tx.Commit()
+	}
+
+	_, err = tx.Exec(restore, golden.NodeID, golden.Created_At, golden.ID)
+	if err != nil {
+		log.Println(err.Error())
+		return err
+	}
+
+	return tx.Commit()
+}
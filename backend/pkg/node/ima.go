@@ -0,0 +1,358 @@
+// Copyright 2023 EnactTrust LTD All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+
+package node
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/veraison/enact-demo/pkg/ima"
+)
+
+var (
+	// The IMA measurement list sent along a quote cannot be parsed
+	ErrInvalidIMALog = errors.New("invalid IMA measurement list")
+	// No prefix of the IMA measurement list replays to the quoted PCR 10
+	ErrIMALogMismatch        = errors.New("IMA measurement list does not match the quoted PCR 10")
+	ErrInvalidAllowlistEntry = errors.New("invalid IMA allow-list entry")
+)
+
+// PCR extended by IMA
+const imaPCR = 10
+
+// File digest sizes by IMA hash algorithm name
+var imaDigestSizes = map[string]int{
+	"sha1":   20,
+	"sha256": 32,
+	"sha384": 48,
+	"sha512": 64,
+}
+
+// IMAAllowlistEntry is a known-good file: its path and the digest IMA
+// measures for it, formatted as in the ascii measurement list, e.g.
+// "sha256:ab01...". A path may have several known-good digests.
+type IMAAllowlistEntry struct {
+	ID         int64  `db:"id" json:"id"`
+	Path       string `db:"path" json:"path" binding:"required"`
+	Digest     string `db:"digest" json:"digest" binding:"required"`
+	Created_At string `db:"created_at" json:"created_at"`
+}
+
+// IMAResult is the appraisal of the IMA measurement list sent along a quote
+type IMAResult struct {
+	// Entries of the list covered by the quote. Entries appended after the
+	// quote was taken are not appraised.
+	Entries int `json:"entries"`
+	// Measurement violations, reported by IMA when a file is measured while
+	// open for writing
+	Violations int `json:"violations"`
+	// Files whose path is not in the allow-list
+	Unknown []IMAFile `json:"unknown,omitempty"`
+	// Files whose path is in the allow-list with other digests
+	Tampered []IMAFile `json:"tampered,omitempty"`
+	// Entries of templates whose fields are not decoded, which are not
+	// appraised
+	Undecoded int `json:"undecoded,omitempty"`
+}
+
+type IMAFile struct {
+	Path   string `json:"path"`
+	Digest string `json:"digest"`
+}
+
+type IMAAllowlistRepository interface {
+	// AddIMAAllowlistEntries adds the entries not in the allow-list yet and
+	// returns how many were added
+	AddIMAAllowlistEntries(entries []IMAAllowlistEntry) (int, error)
+	ListIMAAllowlist() ([]IMAAllowlistEntry, error)
+	// DeleteIMAAllowlistEntry returns ErrNotFound for an unknown ID
+	DeleteIMAAllowlistEntry(id int64) error
+}
+
+type SQLiteIMAAllowlistRepo struct {
+	db *sqlx.DB
+}
+
+func NewIMAAllowlistRepo(db *sqlx.DB) IMAAllowlistRepository {
+	return &SQLiteIMAAllowlistRepo{
+		db: db,
+	}
+}
+
+func (repo SQLiteIMAAllowlistRepo) AddIMAAllowlistEntries(entries []IMAAllowlistEntry) (int, error) {
+	const query = `
+		INSERT OR IGNORE INTO ima_allowlist (
+			path,
+			digest,
+			created_at
+		)
+		VALUES (
+			:path,
+			:digest,
+			:created_at
+		);`
+
+	tx, err := repo.db.Beginx()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	added := 0
+	for _, entry := range entries {
+		response, err := tx.NamedExec(query, &entry)
+		if err != nil {
+			log.Println(err.Error())
+			return 0, err
+		}
+
+		count, err := response.RowsAffected()
+		if err != nil {
+			return 0, err
+		}
+		added += int(count)
+	}
+
+	return added, tx.Commit()
+}
+
+func (repo SQLiteIMAAllowlistRepo) ListIMAAllowlist() ([]IMAAllowlistEntry, error) {
+	var entries []IMAAllowlistEntry = []IMAAllowlistEntry{}
+
+	const query = `
+		SELECT
+			id,
+			path,
+			digest,
+			created_at
+		FROM ima_allowlist
+		ORDER BY path, id;`
+
+	err := repo.db.Select(&entries, query)
+	if err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+func (repo SQLiteIMAAllowlistRepo) DeleteIMAAllowlistEntry(id int64) error {
+	const query = `DELETE FROM ima_allowlist WHERE id = $1;`
+
+	response, err := repo.db.Exec(query, id)
+	if err != nil {
+		log.Println(err.Error())
+		return err
+	}
+
+	if count, err := response.RowsAffected(); err != nil {
+		return err
+	} else if count == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+// parseIMADigest checks an "<algorithm>:<hex digest>" file digest and
+// returns it lower case
+func parseIMADigest(s string) (string, error) {
+	parts := strings.SplitN(strings.ToLower(strings.TrimSpace(s)), ":", 2)
+	if len(parts) != 2 {
+		return "", fmt.Errorf("%w: digest %q: expected <algorithm>:<hex>", ErrInvalidAllowlistEntry, s)
+	}
+
+	size, ok := imaDigestSizes[parts[0]]
+	if !ok {
+		return "", fmt.Errorf("%w: digest %q: unknown algorithm", ErrInvalidAllowlistEntry, s)
+	}
+
+	if d, err := hex.DecodeString(parts[1]); err != nil || len(d) != size {
+		return "", fmt.Errorf("%w: digest %q: expected %d hex bytes", ErrInvalidAllowlistEntry, s, size)
+	}
+
+	return parts[0] + ":" + parts[1], nil
+}
+
+// AddIMAAllowlistEntries adds known-good files to the allow-list the IMA
+// measurement lists of all nodes are checked against
+func (n *NodeService) AddIMAAllowlistEntries(entries []IMAAllowlistEntry) (int, error) {
+	now := time.Now().UTC().String()
+
+	for i := range entries {
+		if !strings.HasPrefix(entries[i].Path, "/") {
+			return 0, fmt.Errorf("%w: path %q is not absolute", ErrInvalidAllowlistEntry, entries[i].Path)
+		}
+
+		digest, err := parseIMADigest(entries[i].Digest)
+		if err != nil {
+			return 0, err
+		}
+
+		entries[i].Digest = digest
+		entries[i].Created_At = now
+	}
+
+	return n.allowlist.AddIMAAllowlistEntries(entries)
+}
+
+func (n *NodeService) ListIMAAllowlist() ([]IMAAllowlistEntry, error) {
+	return n.allowlist.ListIMAAllowlist()
+}
+
+func (n *NodeService) DeleteIMAAllowlistEntry(id int64) error {
+	return n.allowlist.DeleteIMAAllowlistEntry(id)
+}
+
+// imaLogOf parses the IMA measurement list sent along the quote of the big
+// endian token and replays it in the bank of the quote. The agent reads the
+// list after quoting, so it may hold entries the quote does not cover: the
+// shortest prefix replaying to the quoted PCR 10 is the part of the list
+// the quote vouches for, and its length is returned. The quoted PCR 10 is
+// taken from the individual PCR values or, when the quote selects PCR 10
+// alone, checked against the quote PCR digest. A nil list gives a nil log.
+func imaLogOf(token []byte, raw []byte, values PCRValues) (*ima.Log, int, error) {
+	if raw == nil {
+		return nil, 0, nil
+	}
+
+	et := EnactToken{}
+	if err := et.Decode(token); err != nil {
+		return nil, 0, err
+	}
+
+	quote := et.AttestationData.AttestedQuoteInfo
+	if quote == nil {
+		return nil, 0, errors.New("token is not a quote")
+	}
+
+	selected := false
+	for _, pcr := range quote.PCRSelection.PCRs {
+		selected = selected || pcr == imaPCR
+	}
+	if !selected {
+		return nil, 0, fmt.Errorf("%w: the quote does not select PCR %d", ErrIMALogMismatch, imaPCR)
+	}
+	if values == nil && len(quote.PCRSelection.PCRs) != 1 {
+		return nil, 0, fmt.Errorf("%w: pcr_values are needed unless the quote selects PCR %d alone", ErrIMALogMismatch, imaPCR)
+	}
+
+	l, err := ima.Parse(raw)
+	if err != nil {
+		return nil, 0, fmt.Errorf("%w: %v", ErrInvalidIMALog, err)
+	}
+
+	replayed, err := l.Replay(quote.PCRSelection.Hash, imaPCR)
+	if err != nil {
+		return nil, 0, fmt.Errorf("%w: %v", ErrInvalidIMALog, err)
+	}
+
+	// Whether the PCR value is the quoted one
+	quoted := func(v []byte) bool { return bytes.Equal(v, values.Get(imaPCR)) }
+
+	if values == nil {
+		alg, err := signatureHash(et.Signature)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		h, err := alg.Hash()
+		if err != nil {
+			return nil, 0, err
+		}
+
+		quoted = func(v []byte) bool { return bytes.Equal(hashOf(h, v), quote.PCRDigest) }
+	}
+
+	for i, v := range replayed {
+		if l.Entries[i].PCR == imaPCR && quoted(v) {
+			return l, i + 1, nil
+		}
+	}
+
+	return nil, 0, ErrIMALogMismatch
+}
+
+// appraiseIMA checks the files measured by the first covered entries of the
+// log against the allow-list
+func (n *NodeService) appraiseIMA(l *ima.Log, covered int) (*IMAResult, error) {
+	entries, err := n.allowlist.ListIMAAllowlist()
+	if err != nil {
+		return nil, err
+	}
+
+	allowed := map[string]map[string]bool{}
+	for _, entry := range entries {
+		if allowed[entry.Path] == nil {
+			allowed[entry.Path] = map[string]bool{}
+		}
+		allowed[entry.Path][entry.Digest] = true
+	}
+
+	result := &IMAResult{Entries: covered}
+	seen := map[IMAFile]bool{}
+
+	for _, e := range l.Entries[:covered] {
+		if e.PCR != imaPCR || e.Path == ima.BootAggregate {
+			continue
+		}
+
+		if e.Violation() {
+			result.Violations++
+			continue
+		}
+
+		if !e.Decoded() {
+			result.Undecoded++
+			continue
+		}
+
+		file := IMAFile{Path: e.Path, Digest: strings.ToLower(e.Digest())}
+		if seen[file] {
+			continue
+		}
+		seen[file] = true
+
+		if digests, ok := allowed[file.Path]; !ok {
+			result.Unknown = append(result.Unknown, file)
+		} else if !digests[file.Digest] {
+			result.Tampered = append(result.Tampered, file)
+		}
+	}
+
+	return result, nil
+}
+
+// imaResult appraises the IMA measurement list and returns the result to
+// store with the attestation, logging the files that failed the allow-list
+func (n *NodeService) imaResult(nodeID string, l *ima.Log, covered int) (JSON, error) {
+	result, err := n.appraiseIMA(l, covered)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(result.Unknown) > 0 || len(result.Tampered) > 0 {
+		log.Printf("node %s ran %d unknown and %d tampered files",
+			nodeID, len(result.Unknown), len(result.Tampered))
+	}
+
+	return json.Marshal(result)
+}
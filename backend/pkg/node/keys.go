@@ -0,0 +1,109 @@
+// Copyright 2023 EnactTrust LTD All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+
+package node
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/google/go-tpm/tpm2"
+)
+
+var (
+	ErrInvalidAKName = errors.New("invalid AK name")
+	ErrInvalidAKPub  = errors.New("invalid AK public key")
+	// The AK is neither an ECDSA key nor an RSA key of at least minRSAKeyBits
+	ErrUnsupportedAK = errors.New("unsupported AK type")
+	// The quote is signed with a scheme other than ECDSA, RSASSA or RSAPSS
+	ErrUnsupportedSignature = errors.New("unsupported signature scheme")
+)
+
+// Smallest RSA AK accepted, the size TPMs provision by default
+const minRSAKeyBits = 2048
+
+// parsePublicKey accepts a SubjectPublicKeyInfo either PEM encoded or as bare
+// base64, which is what the agent uploads to /node/pem
+func parsePublicKey(keyString string) (crypto.PublicKey, error) {
+	var der []byte
+
+	block, _ := pem.Decode([]byte(keyString))
+	if block != nil {
+		if block.Type != "PUBLIC KEY" {
+			return nil, ErrorPEMNotPublicKey
+		}
+		der = block.Bytes
+	} else {
+		buf, err := base64.StdEncoding.DecodeString(strings.TrimSpace(keyString))
+		if err != nil {
+			return nil, fmt.Errorf("public key is neither PEM nor base64: %v", err)
+		}
+		der = buf
+	}
+
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse public key: %v", err)
+	}
+
+	return key, nil
+}
+
+// publicKeyPEM encodes the key as a PEM SubjectPublicKeyInfo
+func publicKeyPEM(key crypto.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return "", err
+	}
+
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})), nil
+}
+
+// parseAKName decodes the hex encoded TPM name of the AK, i.e. the big endian
+// name algorithm followed by the digest of the AK's TPMT_PUBLIC
+func parseAKName(akName string) (*tpm2.HashValue, error) {
+	return parseName(akName, ErrInvalidAKName)
+}
+
+// parseName decodes a hex encoded TPM name or qualified name, reporting
+// errors as invalid
+func parseName(s string, invalid error) (*tpm2.HashValue, error) {
+	buf, err := hex.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", invalid, err)
+	}
+
+	if len(buf) < 2 {
+		return nil, fmt.Errorf("%w: too short (%d bytes)", invalid, len(buf))
+	}
+
+	alg := tpm2.Algorithm(binary.BigEndian.Uint16(buf[:2]))
+	hash, err := alg.Hash()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", invalid, err)
+	}
+
+	if len(buf)-2 != hash.Size() {
+		return nil, fmt.Errorf("%w: expected %d bytes of %v digest, got %d",
+			invalid, hash.Size(), alg, len(buf)-2)
+	}
+
+	return &tpm2.HashValue{Alg: alg, Value: buf[2:]}, nil
+}
@@ -16,47 +16,213 @@ package node
 import (
 	// "backend/pkg/enactcorim"
 	"bytes"
-	"crypto/dsa"
+	"crypto"
 	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rsa"
-	"crypto/sha256"
-	"crypto/x509"
-	"encoding/base64"
 	"encoding/binary"
 	"encoding/gob"
-	"encoding/pem"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
-	"math/big"
-	"os"
+	"strings"
 	"time"
 
 	"github.com/google/go-tpm/tpm2"
 	"github.com/google/uuid"
-	"github.com/veraison/apiclient/verification"
-	"github.com/veraison/enact-demo/pkg/enactcorim"
-	"github.com/veraison/enact-demo/pkg/veraison"
+	"github.com/veraison/enact-demo/config"
+	"github.com/veraison/enact-demo/pkg/ekcert"
+	"github.com/veraison/enact-demo/pkg/session"
 )
 
 type NodeService struct {
-	repo NodeRepository
+	cfg          *config.Config
+	repo         NodeRepository
+	attestations AttestationRepository
+	golden       GoldenValueRepository
+	drift        DriftRepository
+	baseline     BaselineRepository
+	policies     PCRPolicyRepository
+	allowlist    IMAAllowlistRepository
+	sessions     session.SessionStore
+	verifier     Verifier
+	// Validates EK certificates at registration, nil when they are not
+	// required
+	ekVerifier *ekcert.Verifier
+	firmware   FirmwarePolicyRepository
+	alerts     AlertRepository
 }
 type Node struct {
-	ID         uuid.UUID `db:"id"`
-	AK_Pub     string    `db:"ak_pub"`
-	EK_Pub     string    `db:"ek_pub"`
-	Created_At string    `db:"created_at"`
+	ID         uuid.UUID `db:"id" json:"id"`
+	AK_Pub     string    `db:"ak_pub" json:"ak_pub"`
+	EK_Pub     string    `db:"ek_pub" json:"ek_pub"`
+	AK_Name    string    `db:"ak_name" json:"ak_name,omitempty"`
+	Label      string    `db:"label" json:"label"`
+	Created_At string    `db:"created_at" json:"created_at"`
+	State      State     `db:"state" json:"state"`
+	// Outcome of the last appraisal, nil if the node was never appraised
+	In_Good_State    *bool   `db:"in_good_state" json:"in_good_state"`
+	Last_Attested_At *string `db:"last_attested_at" json:"last_attested_at"`
+	// PEM EK certificate and the TPM it certifies, empty if the node
+	// registered with a bare EK public key
+	EK_Cert         string `db:"ek_cert" json:"ek_cert,omitempty"`
+	EK_Manufacturer string `db:"ek_manufacturer" json:"ek_manufacturer,omitempty"`
+	EK_Model        string `db:"ek_model" json:"ek_model,omitempty"`
+	// Hex encoded TPMT_PUBLIC of the AK, empty if the node registered with a
+	// bare AK public key
+	AK_Public string `db:"ak_public" json:"ak_public,omitempty"`
+	// Hex encoded qualified name of the key the AK was created under, empty
+	// for a primary AK
+	AK_Parent_QN string `db:"ak_parent_qn" json:"ak_parent_qn,omitempty"`
+	// TPM firmware version of the last quote, empty if the node never
+	// attested
+	Firmware_Version string `db:"firmware_version" json:"firmware_version"`
+	// Whether the TPM obfuscated the firmware version, nil if the hierarchy
+	// of the AK is not known and it may have
+	Firmware_Obfuscated *bool `db:"firmware_obfuscated" json:"firmware_obfuscated"`
 }
 
-func NewService(repo NodeRepository) *NodeService {
+// Deps are the repositories and collaborators of the node service
+type Deps struct {
+	Nodes        NodeRepository
+	Attestations AttestationRepository
+	Golden       GoldenValueRepository
+	Drift        DriftRepository
+	Baseline     BaselineRepository
+	Policies     PCRPolicyRepository
+	Allowlist    IMAAllowlistRepository
+	Firmware     FirmwarePolicyRepository
+	Alerts       AlertRepository
+	Sessions     session.SessionStore
+	Verifier     Verifier
+	// Validates EK certificates at registration, nil when they are not
+	// required
+	EKVerifier *ekcert.Verifier
+}
+
+func NewService(cfg *config.Config, deps Deps) *NodeService {
 	return &NodeService{
-		repo: repo,
+		cfg:          cfg,
+		repo:         deps.Nodes,
+		attestations: deps.Attestations,
+		golden:       deps.Golden,
+		drift:        deps.Drift,
+		baseline:     deps.Baseline,
+		policies:     deps.Policies,
+		allowlist:    deps.Allowlist,
+		sessions:     deps.Sessions,
+		verifier:     deps.Verifier,
+		ekVerifier:   deps.EKVerifier,
+		firmware:     deps.Firmware,
+		alerts:       deps.Alerts,
+	}
+}
+
+func (n *NodeService) ListNodes(query ListNodesQuery) ([]Node, int, error) {
+	return n.repo.ListNodes(query)
+}
+
+func (n *NodeService) GetNode(nodeID string) (*Node, error) {
+	return n.repo.GetNodeById(nodeID)
+}
+
+// ListAttestations returns the appraisal history of the node, newest first
+func (n *NodeService) ListAttestations(nodeID string, limit int, offset int) ([]Attestation, int, error) {
+	_, err := n.repo.GetNodeById(nodeID)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return n.attestations.ListAttestations(nodeID, limit, offset)
+}
+
+// ListGoldenValues returns the golden values provisioned for the node,
+// oldest first
+func (n *NodeService) ListGoldenValues(nodeID string) ([]GoldenValue, error) {
+	_, err := n.repo.GetNodeById(nodeID)
+	if err != nil {
+		return nil, err
+	}
+
+	return n.golden.ListGoldenValues(nodeID)
+}
+
+// ListDriftEvents returns the evidence of the node that diverged from its
+// golden values, newest first
+func (n *NodeService) ListDriftEvents(nodeID string, limit int, offset int) ([]DriftEvent, int, error) {
+	_, err := n.repo.GetNodeById(nodeID)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return n.drift.ListDriftEvents(nodeID, limit, offset)
+}
+
+func (n *NodeService) SetLabel(nodeID string, label string) error {
+	return n.repo.UpdateNodeLabel(nodeID, label)
+}
+
+// Revoke moves the node to the revoked state, after which all of its calls
+// are refused
+func (n *NodeService) Revoke(nodeID string) error {
+	node, err := n.repo.GetNodeById(nodeID)
+	if err != nil {
+		return err
 	}
+
+	err = checkTransition(node.State, StateRevoked)
+	if err != nil {
+		return err
+	}
+
+	err = n.sessions.Delete(nodeID)
+	if err != nil {
+		log.Println(err)
+	}
+
+	return n.repo.UpdateNodeState(nodeID, node.State, StateRevoked)
+}
+
+// nodeForTransition loads the node and checks that it may move to the given
+// state, so that out-of-order calls are refused before contacting Veraison
+func (n *NodeService) nodeForTransition(nodeID uuid.UUID, to State) (*Node, error) {
+	node, err := n.repo.GetNodeById(nodeID.String())
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkTransition(node.State, to)
+	if err != nil {
+		return nil, err
+	}
+
+	return node, nil
 }
 
-func (n *NodeService) HandleReceivePEM(akPub string, ekPub string) (uuid.UUID, error) {
-	// 1. From the agent: `POST /node/pem, Body: { AK_pub, EK_pub }`
+func (n *NodeService) HandleReceivePEM(akPub string, akPublic []byte, ekPub string, ekCert string, akName string, akParentQN string, label string) (uuid.UUID, error) {
+	// 1. From the agent: `POST /node/pem, Body: { AK_pub, AK_public, EK_pub, EK_cert, AK_name, AK_parent_qn }`
+	ak, err := checkAK(akPub, akPublic, akName, akParentQN)
+	if err != nil {
+		return uuid.UUID{}, err
+	}
+
+	// The AK name is needed to bind the challenge to the AK in /node/secret
+	if ak.name != "" {
+		if _, err := parseAKName(ak.name); err != nil {
+			return uuid.UUID{}, err
+		}
+	} else if n.cfg.Challenge.Mode == config.ChallengeModeCredential {
+		return uuid.UUID{}, ErrNoAKName
+	}
+
+	// Only TPMs vouched for by their manufacturer may register
+	ek, err := n.checkEK(ekPub, ekCert)
+	if err != nil {
+		log.Println(err)
+		return uuid.UUID{}, err
+	}
+
 	// 2. Generate node_id (UUID v4)
 	nodeID, err := uuid.NewUUID()
 	if err != nil {
@@ -68,10 +234,18 @@ func (n *NodeService) HandleReceivePEM(akPub string, ekPub string) (uuid.UUID, e
 
 	// 3. Init node entity and store it in the db
 	node := Node{
-		ID:         nodeID,
-		AK_Pub:     akPub,
-		EK_Pub:     ekPub,
-		Created_At: time.Now().UTC().String(),
+		ID:              nodeID,
+		AK_Pub:          ak.pub,
+		AK_Public:       ak.public,
+		AK_Parent_QN:    ak.parentQN,
+		EK_Pub:          ek.pub,
+		EK_Cert:         ek.cert,
+		EK_Manufacturer: ek.manufacturer,
+		EK_Model:        ek.model,
+		AK_Name:         ak.name,
+		Label:           label,
+		Created_At:      time.Now().UTC().String(),
+		State:           StateRegistered,
 	}
 
 	err = n.repo.InsertNode(node)
@@ -80,31 +254,49 @@ func (n *NodeService) HandleReceivePEM(akPub string, ekPub string) (uuid.UUID, e
 		return nodeID, err
 	}
 
-	// 4. Repackage node_id and AK pub as CoRIM
-	corim, err := enactcorim.RepackageNodePEM(akPub, nodeID)
+	// 4. Provision the AK as trust anchor of the node with the verifier
+	err = n.verifier.RegisterNode(&node)
 	if err != nil {
 		log.Println(err)
 		return nodeID, err
 	}
 
-	log.Println(`successfully repacked node PEM as corim`)
+	return nodeID, nil
+}
 
-	cbor, err := corim.ToCBOR()
+// NewChallenge opens a challenge-response session with the verifier and
+// stores it, replacing any pending session of the same node. It returns the
+// challenge to send to the node: depending on the configured mode, either the
+// session nonce protected with TPM2_MakeCredential or the bare nonce.
+func (n *NodeService) NewChallenge(nodeID uuid.UUID) ([]byte, error) {
+	node, err := n.repo.GetNodeById(nodeID.String())
 	if err != nil {
-		log.Fatal(err)
-		return nodeID, err
+		return nil, err
 	}
 
-	log.Println(`successfully converted corim to cbor`)
+	if node.State == StateRevoked {
+		return nil, ErrNodeRevoked
+	}
 
-	// 5. `POST /submit, Body: { CoRIM }` to veraison backend and forward response to agent
-	err = veraison.SendCborToVeraison(cbor)
+	s, err := n.verifier.NewSession(nodeID, n.cfg.Sessions.SessionTTL())
 	if err != nil {
-		log.Println(err)
-		return nodeID, err
+		return nil, err
 	}
 
-	return nodeID, nil
+	challenge := s.Nonce
+	if n.cfg.Challenge.Mode == config.ChallengeModeCredential {
+		challenge, err = makeCredentialChallenge(node, s.Nonce)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = n.sessions.Put(s)
+	if err != nil {
+		return nil, err
+	}
+
+	return challenge, nil
 }
 
 func concatBuffers(firstBlob *bytes.Buffer, secondBlob *bytes.Buffer) *bytes.Buffer {
@@ -126,16 +318,37 @@ type TokenDescription struct {
 	Type            uint16 `json:"type"`
 }
 
+// Hash algorithms of TPM names, by digest size
+var nameAlgorithms = map[int]tpm2.Algorithm{
+	20: tpm2.AlgSHA1,
+	32: tpm2.AlgSHA256,
+	48: tpm2.AlgSHA384,
+	64: tpm2.AlgSHA512,
+}
+
+// makeAttestationData builds the TPMS_ATTEST of a quote. The PCR bank is the
+// description Algorithm, SHA-256 if unset, and the name algorithm of the
+// qualified signer follows from its size.
 func makeAttestationData(desc *TokenDescription) tpm2.AttestationData {
+	bank := tpm2.Algorithm(desc.Algorithm)
+	if bank == 0 {
+		bank = tpm2.AlgSHA256
+	}
+
+	nameAlg, ok := nameAlgorithms[len(desc.QualifiedSigner)]
+	if !ok {
+		nameAlg = tpm2.AlgSHA256
+	}
+
 	return tpm2.AttestationData{
 		Magic: 0xff544347,
 		QualifiedSigner: tpm2.Name{
-			Digest: &tpm2.HashValue{Alg: tpm2.AlgSHA256, Value: desc.QualifiedSigner},
+			Digest: &tpm2.HashValue{Alg: nameAlg, Value: desc.QualifiedSigner},
 		},
 		FirmwareVersion: desc.FirmwareVersion,
 		Type:            tpm2.TagAttestQuote,
 		AttestedQuoteInfo: &tpm2.QuoteInfo{
-			PCRSelection: tpm2.PCRSelection{Hash: tpm2.AlgSHA256, PCRs: desc.PCRs},
+			PCRSelection: tpm2.PCRSelection{Hash: bank, PCRs: desc.PCRs},
 			PCRDigest:    desc.Digest,
 		},
 	}
@@ -200,387 +413,387 @@ func (t *Token) Decode(data []byte) error {
 	return nil
 }
 
-func (t Token) VerifySignature(key *ecdsa.PublicKey) error {
-	digest := sha256.Sum256(t.Raw)
+func (t Token) VerifySignature(key crypto.PublicKey) error {
+	return verifyQuoteSignature(key, t.Signature, t.Raw)
+}
 
-	if !ecdsa.Verify(key, digest[:], t.Signature.ECC.R, t.Signature.ECC.S) {
-		return fmt.Errorf("failed to verify signature")
+// parseKey parses the public key of an AK, which is either an ECDSA key on a
+// NIST curve or an RSA key
+func parseKey(keyString string) (crypto.PublicKey, error) {
+	key, err := parsePublicKey(keyString)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidAKPub, err)
 	}
 
-	return nil
+	switch k := key.(type) {
+	case *ecdsa.PublicKey:
+		switch k.Curve {
+		case elliptic.P256(), elliptic.P384(), elliptic.P521():
+		default:
+			return nil, fmt.Errorf("%w: ECDSA key on curve %s", ErrUnsupportedAK, k.Curve.Params().Name)
+		}
+		return k, nil
+	case *rsa.PublicKey:
+		if k.N.BitLen() < minRSAKeyBits {
+			return nil, fmt.Errorf("%w: %d bits RSA key", ErrUnsupportedAK, k.N.BitLen())
+		}
+		return k, nil
+	default:
+		return nil, fmt.Errorf("%w: %T", ErrUnsupportedAK, key)
+	}
 }
 
-func parseKey(keyString string) (*ecdsa.PublicKey, error) {
-	buf, err := base64.StdEncoding.DecodeString(keyString)
+// golden value is node_id, tmps_attest_length, tpms_attest. Just concatenate it with signature blob.
+func (n *NodeService) RouteGoldenValueToVeraison(nodeID uuid.UUID, bigEndianBuf []byte, evidenceDigest []byte, attachments EvidenceAttachments) error {
+	// Golden values are only accepted once, right after registration
+	node, err := n.nodeForTransition(nodeID, StateGoldenProvisioned)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	key, err := x509.ParsePKIXPublicKey(buf)
+	selection, err := quoteSelection(bigEndianBuf)
 	if err != nil {
-		return nil, fmt.Errorf("could not parse public key: %v", err)
+		return err
 	}
 
-	ret, ok := key.(*ecdsa.PublicKey)
-	if !ok {
-		return nil, fmt.Errorf("could not extract EC public key; got [%T]: %v", key, err)
+	digestAlg, err := quoteDigestAlg(bigEndianBuf)
+	if err != nil {
+		return err
 	}
 
-	return ret, nil
-}
+	values, err := pcrValuesOf(bigEndianBuf, attachments.PCRValues)
+	if err != nil {
+		return err
+	}
 
-// golden value is node_id, tmps_attest_length, tpms_attest. Just concatenate it with signature blob.
-func (n *NodeService) RouteGoldenValueToVeraison(cfg *verification.ChallengeResponseConfig, sessionId string, nodeID uuid.UUID, bigEndianBuf []byte, evidenceDigest []byte) error {
-	// concatenate bytes, because Veraison expects a continious array
-	// fmt.Printf("RouteGolden NodeID Raw bytes: %x\n", [16]byte(nodeID))
-	// var concatenatedData []byte = append(nodeID[:], bigEndianBuf...)
-	// log.Println("concatenatedData length: ", len(concatenatedData))
-	// fmt.Printf("%x", concatenatedData)
-	_ = nodeID
-	_ = bigEndianBuf
-
-	// POST to Veraison
-	// attestationResultJSON, err := veraison.SendEvidenceAndSignature(cfg, sessionId, concatenatedData)
-	// if err != nil {
-	// 	log.Println("SendEvidenceAndSignature result: FAILURE %v", err)
-	// 	return err
-	// }
-
-	// // Parse attestation result
-	// err = veraison.EarCheck(attestationResultJSON)
-	// if err != nil {
-	// 	log.Println("Attestation result: FAILURE %v", err)
-	// 	return err
-	// }
-	//
-	//log.Println("Attestation result: SUCCESS")
-
-	// after the attestation result is parsed, we repackage the golden value and
-	// perform POST /submit, Body: { CoRIM }`
-	evidenceCbor, err := enactcorim.RepackageEvidence(nodeID, evidenceDigest)
+	_, _, err = n.recordFirmwareVersion(node, bigEndianBuf)
+	if err != nil {
+		return err
+	}
+
+	golden := GoldenValue{
+		NodeID:       nodeID.String(),
+		PCRDigest:    evidenceDigest,
+		PCRDigestAlg: uint16(digestAlg),
+		PCRSelection: selection,
+		PCRValues:    values,
+		Created_At:   time.Now().UTC().String(),
+	}
+
+	err = n.verifier.ProvisionGolden(node, golden, 0)
 	if err != nil {
 		log.Println(err)
 		return err
 	}
 
-	err = veraison.SendCborToVeraison(evidenceCbor)
+	// Keep the golden value whatever the verifier, to detect drift locally
+	_, err = n.golden.InsertGoldenValue(golden)
 	if err != nil {
 		log.Println(err)
 		return err
 	}
+
+	// The challenge has been answered, the node needs a new one for its
+	// next quote
+	err = n.sessions.Delete(nodeID.String())
+	if err != nil {
+		log.Println(err)
+	}
+
+	err = n.repo.UpdateNodeState(nodeID.String(), node.State, StateGoldenProvisioned)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+
 	return nil
 }
 
 // golden value is node_id, tmps_attest_length, tpms_attest. Just concatenate it with signature blob.
-func (n *NodeService) RouteEvidenceToVeraison(cfg *verification.ChallengeResponseConfig, sessionId string, nodeID uuid.UUID, bigEndianBuf []byte, evidenceDigest []byte) error {
-	// concatenate bytes, because Veraison expects a continious array
-	fmt.Printf("RouteGolden NodeID Raw bytes: %x\n", [16]byte(nodeID))
-	var concatenatedData []byte = append(nodeID[:], bigEndianBuf...)
-	log.Println("concatenatedData length: ", len(concatenatedData))
-	fmt.Printf("%x", concatenatedData)
+func (n *NodeService) RouteEvidenceToVeraison(nodeID uuid.UUID, bigEndianBuf []byte, evidenceDigest []byte, attachments EvidenceAttachments) error {
+	// Evidence can only be appraised once golden values are provisioned
+	node, err := n.nodeForTransition(nodeID, StateAttestingOK)
+	if err != nil {
+		return err
+	}
 
-	// POST to Veraison
-	attestationResultJSON, err := veraison.SendEvidenceAndSignature(cfg, sessionId, concatenatedData)
+	s, err := n.sessions.Get(nodeID.String())
 	if err != nil {
-		log.Println(err)
+		return err
 	}
 
-	// Parse attestation result
-	err = veraison.EarCheck(attestationResultJSON)
+	selection, err := quoteSelection(bigEndianBuf)
 	if err != nil {
-		log.Println("Attestation result: FAILURE")
 		return err
 	}
 
-	log.Println("Attestation result: SUCCESS")
+	values, err := pcrValuesOf(bigEndianBuf, attachments.PCRValues)
+	if err != nil {
+		return err
+	}
 
-	return nil
-}
+	claims, err := eventLogClaims(bigEndianBuf, attachments.EventLog, values)
+	if err != nil {
+		return err
+	}
 
-// Relies on token.Decode instead of fully parsing the blob manually.
-func (n *NodeService) ProcessEvidence(node_id string, evidenceBlob *bytes.Buffer, signatureBlob *bytes.Buffer) ([]byte, []byte, []byte, uuid.UUID, error) {
-	log.Println("goldenBlob + signature bytes:", len(evidenceBlob.Bytes())+len(signatureBlob.Bytes()))
+	imaLog, covered, err := imaLogOf(bigEndianBuf, attachments.IMALog, values)
+	if err != nil {
+		return err
+	}
 
-	buffer, node_uuid, err := parseEvidenceAndSignatureBlobs(evidenceBlob, signatureBlob)
+	clock, err := clockInfoOf(node, bigEndianBuf)
 	if err != nil {
-		log.Println(err)
-		return nil, nil, nil, uuid.UUID{}, errors.New("error parsing evidence and signature blobs")
+		return err
 	}
 
-	token := EnactToken{}
-	err = token.Decode(buffer.Bytes())
+	// Reboots are only recorded, rollbacks and replays fail the appraisal
+	prevClock, err := n.attestations.LastClockInfo(nodeID.String())
 	if err != nil {
-		log.Println(err)
-		return nil, nil, nil, uuid.UUID{}, errors.New("error decoding token")
+		return err
 	}
 
-	nonce := token.AttestationData.ExtraData
+	clockEvts := clockEvents(prevClock, clock)
 
-	// TODO: determine if this check is needed
-	if len(token.AttestationData.AttestedQuoteInfo.PCRDigest) == 0 {
-		return nil, nil, nil, node_uuid, errors.New("blob doesn't contain PCR Digest")
+	// Firmware below the minimum or known vulnerable fails the appraisal
+	alerts, err := n.checkFirmware(node, bigEndianBuf)
+	if err != nil {
+		return err
 	}
 
-	return buffer.Bytes(), token.AttestationData.AttestedQuoteInfo.PCRDigest, nonce, node_uuid, nil
-}
+	golden, err := n.golden.ListGoldenValues(nodeID.String())
+	if err != nil {
+		return err
+	}
 
-// read node_id, the rest is the token
-// rm NVChip
-// tpm sim -> go to git repo -> ./tpm-server
-func (n *NodeService) HandleGoldenValue(nodeID string, goldenBlob *bytes.Buffer, signatureBlob *bytes.Buffer) ([]byte, uuid.UUID, error) {
-	log.Println("goldenBlob + signature bytes:", len(goldenBlob.Bytes())+len(signatureBlob.Bytes()))
+	drift := detectDrift(golden, nodeID.String(), evidenceDigest, selection, values)
 
-	bigEndianBuf := &bytes.Buffer{}
+	result, attestationResultJSON, earErr := n.verifier.Appraise(node, s, bigEndianBuf)
+	if attestationResultJSON == nil {
+		log.Println(earErr)
+		n.recordDrift(drift, nil)
+		n.raiseAlerts(alerts, nil)
+		n.captureCandidate(node, bigEndianBuf, evidenceDigest, selection, values, nil)
+		return earErr
+	}
 
-	log.Println(len(bigEndianBuf.Bytes()))
+	// The verifier is done with the session once it has produced a result
+	err = n.sessions.Delete(nodeID.String())
+	if err != nil {
+		log.Println(err)
+	}
 
-	// Read 16 byte node_id from the beginning of the whole blob
-	val := goldenBlob.Next(16)
-	uuidNodeId, err := uuid.FromBytes(val)
+	now := time.Now().UTC().String()
 
-	log.Println(fmt.Sprintf("%x", uuidNodeId))
+	// Keep a record of every appraisal, successful or not
+	attestation := newAttestation(result, attestationResultJSON)
+	attestation.NodeID = nodeID.String()
+	attestation.Created_At = now
+	attestation.SessionURI = s.URI
+	attestation.Nonce = s.Nonce
+	attestation.PCRDigest = evidenceDigest
+	attestation.PCRValues = values
+	attestation.ClockInfo = clock
+	attestation.ClockEvents = strings.Join(clockEvts, ",")
 
+	if err := checkClockEvents(clockEvts); err != nil {
+		log.Printf("node %s: %v", nodeID, err)
+		if earErr == nil {
+			earErr = err
+		}
+	}
+
+	if breaksFirmwarePolicy(alerts) && earErr == nil {
+		earErr = ErrFirmwarePolicy
+	}
+
+	if claims != nil {
+		attestation.EventLogClaims, err = json.Marshal(claims)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+
+	if imaLog != nil {
+		attestation.IMAResult, err = n.imaResult(nodeID.String(), imaLog, covered)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+
+	var attestationRef *int64
+
+	attestationID, err := n.attestations.InsertAttestation(attestation)
 	if err != nil {
 		log.Println(err)
+	} else {
+		attestationRef = &attestationID
 	}
 
-	/* Parse TPMS_ATTEST */
-	// 0. TPMS_ATTEST Size
-	val = goldenBlob.Next(2)
-	tpmsAttestSize := binary.LittleEndian.Uint16(val)
-	// Convert to Big Endian
-	sizeBuf := make([]byte, 2)
-	binary.BigEndian.PutUint16(sizeBuf, tpmsAttestSize)
-	// Write the Big Endian byte array to the buffer
-	binary.Write(bigEndianBuf, binary.BigEndian, sizeBuf)
-	log.Println(len(bigEndianBuf.Bytes()))
-
-	// 1. TPM_Magic
-	val = goldenBlob.Next(4)
-	tpmMagic := binary.BigEndian.Uint32(val)
-	// Data is already Big Endian, writing directly to buffer
-	binary.Write(bigEndianBuf, binary.BigEndian, tpmMagic)
-	log.Println(len(bigEndianBuf.Bytes()))
-
-	// 2. attest type
-	val = goldenBlob.Next(2)
-	attestType := binary.BigEndian.Uint16(val)
-	// Data is already Big Endian
-	binary.Write(bigEndianBuf, binary.BigEndian, attestType)
-	log.Println(len(bigEndianBuf.Bytes()))
-
-	// 3. qualifiedSigner
-	val = goldenBlob.Next(2)
-	nestedBufferSize := binary.BigEndian.Uint16(val)
-	qualifiedSigner := goldenBlob.Next(int(nestedBufferSize))
-	// Size field is already Big Endian
-	binary.Write(bigEndianBuf, binary.BigEndian, nestedBufferSize)
-	log.Println(len(bigEndianBuf.Bytes()))
-	// Qualified buffer is already Big Endian
-	binary.Write(bigEndianBuf, binary.BigEndian, qualifiedSigner)
-	log.Println(len(bigEndianBuf.Bytes()))
-
-	// 4. extra data - secret nonce
-	val = goldenBlob.Next(2)
-	nestedBufferSize = binary.BigEndian.Uint16(val)
-	extraData := goldenBlob.Next(int(nestedBufferSize))
-	// Size field is already Big Endian
-	binary.Write(bigEndianBuf, binary.BigEndian, nestedBufferSize)
-	log.Println(len(bigEndianBuf.Bytes()))
-	// Extra data buffer is already Big Endian
-	binary.Write(bigEndianBuf, binary.BigEndian, extraData)
-	log.Println(len(bigEndianBuf.Bytes()))
-
-	// 5. Digest
-	val = goldenBlob.Next(2)
-	digestSize := binary.BigEndian.Uint16(val)
-	evidenceDigest := goldenBlob.Next(int(digestSize))
-	// Size field is already Big Endian
-	binary.Write(bigEndianBuf, binary.BigEndian, digestSize)
-	log.Println(len(bigEndianBuf.Bytes()))
-	// Digest is already Big Endian
-	binary.Write(bigEndianBuf, binary.BigEndian, evidenceDigest)
-	log.Println(len(bigEndianBuf.Bytes()))
-
-	/* Parse signature struct */
-	// https://dox.ipxe.org/structTPMT__SIGNATURE.html
-
-	// 0. TPMI_ALG_SIG_SCHEME
-	val = signatureBlob.Next(2)
-	sigAlgId := binary.LittleEndian.Uint16(val)
-	// Convert to Big Endian
-	tempBuf := make([]byte, 2)
-	binary.BigEndian.PutUint16(tempBuf, sigAlgId)
-	// Write the Big Endian byte array to buffer
-	binary.Write(bigEndianBuf, binary.BigEndian, tempBuf)
-	log.Println(len(bigEndianBuf.Bytes()))
-
-	// 1. TPMU_SIGNATURE
-	// 		struct TPMS_SIGNATURE_ECC {
-	// 			TPMI_ALG_HASH hash; - UINT16
-	// 			TPM2B_ECC_PARAMETER signatureR; - UINT16 size + BYTE buffer[MAX_ECC_KEY_BYTES];
-	// 			TPM2B_ECC_PARAMETER signatureS; - UINT16 size + BYTE buffer[MAX_ECC_KEY_BYTES];
-	// 		}
-
-	val = signatureBlob.Next(2)
-	tpmiAlgHash := binary.LittleEndian.Uint16(val)
-	// Swap endiannnes of tpmiAlgHash
-	tempBuf = make([]byte, 2)
-	binary.BigEndian.PutUint16(tempBuf, tpmiAlgHash)
-	binary.Write(bigEndianBuf, binary.BigEndian, tempBuf)
-	log.Println(len(bigEndianBuf.Bytes()))
-
-	// Parsing signature R
-	val = signatureBlob.Next(2)
-	sizeR := binary.LittleEndian.Uint16(val)
-	sigR := signatureBlob.Next(int(sizeR))
-
-	// Swap endiannnes of sizeR
-	tempBuf = make([]byte, 2)
-	binary.BigEndian.PutUint16(tempBuf, sizeR)
-	// Size field
-	binary.Write(bigEndianBuf, binary.BigEndian, tempBuf)
-	log.Println(len(bigEndianBuf.Bytes()))
-	// SigR part
-	binary.Write(bigEndianBuf, binary.BigEndian, sigR)
-	log.Println(len(bigEndianBuf.Bytes()))
-
-	// Parsing signature S
-	val = signatureBlob.Next(2)
-	sizeS := binary.LittleEndian.Uint16(val)
-	sigS := signatureBlob.Next(int(sizeS))
-
-	// Swap endiannnes of sizeS
-	tempBuf = make([]byte, 2)
-	binary.BigEndian.PutUint16(tempBuf, sizeS)
-	// Size field
-	binary.Write(bigEndianBuf, binary.BigEndian, tempBuf)
-	log.Println(len(bigEndianBuf.Bytes()))
-	// SigS part
-	binary.Write(bigEndianBuf, binary.BigEndian, sigS)
-	log.Println(len(bigEndianBuf.Bytes()))
-
-	t := Token{}
-	err = t.Decode(bigEndianBuf.Bytes())
+	n.recordDrift(drift, attestationRef)
+	n.raiseAlerts(alerts, attestationRef)
+	n.captureCandidate(node, bigEndianBuf, evidenceDigest, selection, values, attestationRef)
+
+	err = n.repo.UpdateAttestationOutcome(nodeID.String(), node.State, earErr == nil, now)
 	if err != nil {
 		log.Println(err)
+		if earErr == nil {
+			return err
+		}
 	}
 
-	// Read secret (nonce) from extraData
-	nonce := extraData
-	log.Println("nonce:", nonce)
+	if earErr != nil {
+		log.Println("Attestation result: FAILURE")
+		return earErr
+	}
 
-	node, err := n.repo.GetNodeById(nodeID)
-	if err != nil {
-		return nil, uuid.UUID{}, err
+	log.Println("Attestation result: SUCCESS")
+
+	return nil
+}
+
+// recordDrift stores the drift event, if any, linking it to the attestation
+// of the drifted evidence when there is one. Failures are only logged: the
+// appraisal itself is recorded regardless.
+func (n *NodeService) recordDrift(drift *DriftEvent, attestationID *int64) {
+	if drift == nil {
+		return
 	}
 
-	key, err := parseKey(node.AK_Pub)
+	drift.AttestationID = attestationID
+	drift.Created_At = time.Now().UTC().String()
+
+	log.Printf("node %s drifted from its golden values: expected %x (%s), got %x (%s)",
+		drift.NodeID, drift.ExpectedDigest, drift.ExpectedPCRSelection,
+		drift.ObservedDigest, drift.ObservedPCRSelection)
+
+	err := n.drift.InsertDriftEvent(*drift)
 	if err != nil {
 		log.Println(err)
 	}
+}
 
-	err = t.VerifySignature(key)
-	if err != nil {
-		return nil, uuid.UUID{}, err
-	} else {
-		log.Println("Signature check is GOOD.")
-		//Store golden PCR value in Enact DB
-		//Mark node as onboarded
+// quoteSelection returns the formatted PCR selection of the quote in the
+// big endian token
+func quoteSelection(token []byte) (string, error) {
+	et := EnactToken{}
+	if err := et.Decode(token); err != nil {
+		return "", err
 	}
 
-	// Write to a file
-	writeErr := os.WriteFile("big.blob", bigEndianBuf.Bytes(), 0666)
-	if writeErr != nil {
-		log.Println("error outputting blob")
+	if et.AttestationData.AttestedQuoteInfo == nil {
+		return "", errors.New("token is not a quote")
 	}
-	log.Println("wrote blob to file")
 
-	return evidenceDigest, uuidNodeId, nil
+	return formatPCRSelection(et.AttestationData.AttestedQuoteInfo.PCRSelection), nil
 }
 
-func (n *NodeService) HandleEvidence(nodeID string, evidenceBlob *bytes.Buffer, signatureBlob *bytes.Buffer) error {
-	node, err := n.repo.GetNodeById(nodeID)
-	if err != nil {
-		return err
+// quoteDigestAlg returns the hash algorithm of the PCR digest of the quote in
+// the big endian token
+func quoteDigestAlg(token []byte) (tpm2.Algorithm, error) {
+	et := EnactToken{}
+	if err := et.Decode(token); err != nil {
+		return tpm2.AlgNull, err
 	}
 
-	log.Println(node)
+	return signatureHash(et.Signature)
+}
 
-	/* Similar to Golden endpoint, parse evidenceBlog as goldenBlob and signatureBlob the same */
+// EvidenceAttachments are the optional uploads accompanying a quote, each nil
+// when the agent did not send it
+type EvidenceAttachments struct {
+	// Values of the quoted PCRs, concatenated in ascending PCR order
+	PCRValues []byte
+	// Binary TCG PC Client event log
+	EventLog []byte
+	// Linux IMA runtime measurement list, ascii or binary
+	IMALog []byte
+}
+
+// Relies on token.Decode instead of fully parsing the blob manually.
+func (n *NodeService) ProcessEvidence(node_id string, evidenceBlob *bytes.Buffer, signatureBlob *bytes.Buffer, attachments EvidenceAttachments) ([]byte, []byte, []byte, uuid.UUID, error) {
+	log.Println("goldenBlob + signature bytes:", len(evidenceBlob.Bytes())+len(signatureBlob.Bytes()))
 
-	// First we need to see if the data source is legit
-	_, err = verifySignature(node.AK_Pub, signatureBlob)
+	buffer, node_uuid, err := parseEvidenceAndSignatureBlobs(evidenceBlob, signatureBlob)
 	if err != nil {
-		return err
+		log.Println(err)
+		return nil, nil, nil, uuid.UUID{}, fmt.Errorf("error parsing evidence and signature blobs: %w", err)
 	}
 
-	return nil
-}
+	token := EnactToken{}
+	err = token.Decode(buffer.Bytes())
+	if err != nil {
+		log.Println(err)
+		return nil, nil, nil, uuid.UUID{}, errors.New("error decoding token")
+	}
 
-var ErrorPEMDecode = errors.New("not found")
-var ErrorPEMNotPublicKey = errors.New("pem block is not a public key type")
-var ErrorMarshallingPublicKey = errors.New("error marshalling public key type")
+	nonce := token.AttestationData.ExtraData
 
-func verifySignature(pemStr string, evidenceBlob *bytes.Buffer) (bool, error) {
-	akPemBlock, _ := pem.Decode([]byte(pemStr))
-	if akPemBlock == nil {
-		log.Println("failed to parse PEM block containing the public key")
-		return false, ErrorPEMDecode
+	// TODO: determine if this check is needed
+	if token.AttestationData.AttestedQuoteInfo == nil || len(token.AttestationData.AttestedQuoteInfo.PCRDigest) == 0 {
+		return nil, nil, nil, node_uuid, errors.New("blob doesn't contain PCR Digest")
 	}
 
-	if akPemBlock.Type != "PUBLIC KEY" {
-		log.Println("akPemBlock.Type != PUBLIC KEY, but: ", akPemBlock.Type)
-		return false, ErrorPEMNotPublicKey
+	// The TPM computes the PCR digest with the hash algorithm of the signing
+	// scheme, which the golden values CoRIM tags it with
+	err = checkDigestAlgorithm(token)
+	if err != nil {
+		log.Println(err)
+		return nil, nil, nil, node_uuid, err
 	}
 
-	publicKeyBytes, err := x509.MarshalPKIXPublicKey(akPemBlock.Bytes)
+	// The quote must come from the AK registered by the node
+	err = n.checkQualifiedSigner(node_uuid, token)
 	if err != nil {
-		log.Println(err.Error())
-		return false, ErrorMarshallingPublicKey
+		log.Println(err)
+		return nil, nil, nil, node_uuid, err
 	}
 
-	akECDSAPublicKey, _ := x509.ParsePKIXPublicKey(publicKeyBytes)
-	switch pub := akECDSAPublicKey.(type) {
-	case *rsa.PublicKey:
-		log.Println("pub is of type RSA:", pub)
-	case *dsa.PublicKey:
-		log.Println("pub is of type DSA:", pub)
-	case *ecdsa.PublicKey:
-		log.Println("pub is of type ECDSA:", pub)
-	default:
-		log.Println("pub:", pub)
-		log.Println("unknown type of public key")
+	// Refuse quotes over no PCRs, or over PCRs the node policy does not ask for
+	err = n.checkPCRSelection(node_uuid.String(), token.AttestationData.AttestedQuoteInfo.PCRSelection)
+	if err != nil {
+		log.Println(err)
+		return nil, nil, nil, node_uuid, err
 	}
 
-	pubKey, _ := akECDSAPublicKey.(*ecdsa.PublicKey)
-
-	hash := sha256.Sum256(evidenceBlob.Bytes())
-	var hashCast []byte = hash[:]
+	// The PCR values and the event log, if any, must be the ones the quote
+	// digest covers
+	values, err := pcrValuesOf(buffer.Bytes(), attachments.PCRValues)
+	if err != nil {
+		log.Println(err)
+		return nil, nil, nil, node_uuid, err
+	}
 
-	// Read the r size and chunk from the signature blob
-	val := evidenceBlob.Next(2)
-	sizeR := binary.LittleEndian.Uint16(val)
-	log.Println("Size R: ", sizeR)
-	sigR := evidenceBlob.Next(int(sizeR))
+	_, err = eventLogClaims(buffer.Bytes(), attachments.EventLog, values)
+	if err != nil {
+		log.Println(err)
+		return nil, nil, nil, node_uuid, err
+	}
 
-	// Read the s size and chunk from the signature blob
-	val = evidenceBlob.Next(2)
-	sizeS := binary.LittleEndian.Uint16(val)
-	log.Println("Size S: ", sizeS)
-	sigS := evidenceBlob.Next(int(sizeS))
+	_, _, err = imaLogOf(buffer.Bytes(), attachments.IMALog, values)
+	if err != nil {
+		log.Println(err)
+		return nil, nil, nil, node_uuid, err
+	}
 
-	numSigR := new(big.Int)
-	numSigR.SetBytes(sigR)
-	numSigS := new(big.Int)
-	numSigS.SetBytes(sigS)
+	// Only the node may consume its challenge, whichever verifier appraises
+	// the quote afterwards
+	err = n.checkSignature(node_uuid, token)
+	if err != nil {
+		log.Println(err)
+		return nil, nil, nil, node_uuid, err
+	}
 
-	isValid := ecdsa.Verify(pubKey, hashCast, numSigR, numSigS)
-	if isValid {
-		log.Println("Signature IS valid")
-	} else {
-		log.Println("Signature IS NOT valid")
+	// Refuse stale, foreign and replayed quotes before they reach the verifier
+	err = n.checkFreshness(node_uuid, nonce)
+	if err != nil {
+		log.Println(err)
+		return nil, nil, nil, node_uuid, err
 	}
 
-	return isValid, nil
+	return buffer.Bytes(), token.AttestationData.AttestedQuoteInfo.PCRDigest, nonce, node_uuid, nil
 }
+
+var ErrorPEMDecode = errors.New("not found")
+var ErrorPEMNotPublicKey = errors.New("pem block is not a public key type")
+var ErrorMarshallingPublicKey = errors.New("error marshalling public key type")
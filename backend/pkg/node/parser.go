@@ -15,91 +15,27 @@ package node
 
 import (
 	"bytes"
-	"encoding/binary"
-	"fmt"
 	"log"
 
 	"github.com/google/uuid"
+	"github.com/veraison/enact-demo/pkg/wire"
 )
 
+// parseEvidenceAndSignatureBlobs decodes the evidence and signature blobs of
+// the agent, legacy or versioned, and returns the big endian token they make
+// up: the TPMS_ATTEST size, the TPMS_ATTEST and the TPMT_SIGNATURE
 func parseEvidenceAndSignatureBlobs(evidenceBlob *bytes.Buffer, signatureBlob *bytes.Buffer) (*bytes.Buffer, uuid.UUID, error) {
-	bigEndianBuf := &bytes.Buffer{}
-
 	log.Println(`Beginning evidence and signature processing`)
 
-	/* Parse TPMS_ATTEST */
-
-	// First 16 bytes are the node_id
-
-	// Read 16 byte node_id from the beginning of the whole blob
-	val := evidenceBlob.Next(16)
-	uuidNodeId, err := uuid.FromBytes(val)
-	//uuidNodeId, err := uuid.Parse(string(val[:])
-	//uuidNodeId := base64.RawURLEncoding.EncodeToString(val[:])
+	quote, err := wire.Decode(evidenceBlob.Bytes(), signatureBlob.Bytes())
 	if err != nil {
 		log.Println(err)
 		return nil, uuid.UUID{}, err
 	}
-	//log.Println(fmt.Sprintf("%x", uuidNodeId))
-	fmt.Printf("parseEvidence uuidNodeID Raw bytes: %x\n", [16]byte(uuidNodeId))
-
-	// 0. TPMS_ATTEST Size
-	val = evidenceBlob.Next(2)
-	tpmsAttestSize := binary.LittleEndian.Uint16(val)
-	// Convert to Big Endian
-	sizeBuf := make([]byte, 2)
-	binary.BigEndian.PutUint16(sizeBuf, tpmsAttestSize)
-	// Write the Big Endian byte array to the buffer
-	binary.Write(bigEndianBuf, binary.BigEndian, sizeBuf)
-
-	binary.Write(bigEndianBuf, binary.BigEndian, evidenceBlob.Next(int(tpmsAttestSize)))
-
-	// /* Parse signature struct */
-	// // https://dox.ipxe.org/structTPMT__SIGNATURE.html
-
-	// 0. TPMI_ALG_SIG_SCHEME
-	val = signatureBlob.Next(2)
-	sigAlgId := binary.LittleEndian.Uint16(val)
-	// Convert to Big Endian
-	tempBuf := make([]byte, 2)
-	binary.BigEndian.PutUint16(tempBuf, sigAlgId)
-	// Write the Big Endian byte array to buffer
-	binary.Write(bigEndianBuf, binary.BigEndian, tempBuf)
-
-	val = signatureBlob.Next(2)
-	tpmiAlgHash := binary.LittleEndian.Uint16(val)
-	// Swap endiannnes of tpmiAlgHash
-	tempBuf = make([]byte, 2)
-	binary.BigEndian.PutUint16(tempBuf, tpmiAlgHash)
-	binary.Write(bigEndianBuf, binary.BigEndian, tempBuf)
-
-	// Parsing signature R
-	val = signatureBlob.Next(2)
-	sizeR := binary.LittleEndian.Uint16(val)
-	sigR := signatureBlob.Next(int(sizeR))
-
-	// Swap endiannnes of sizeR
-	tempBuf = make([]byte, 2)
-	binary.BigEndian.PutUint16(tempBuf, sizeR)
-	// Size field
-	binary.Write(bigEndianBuf, binary.BigEndian, tempBuf)
-	// SigR part
-	binary.Write(bigEndianBuf, binary.BigEndian, sigR)
-
-	// Parsing signature S
-	val = signatureBlob.Next(2)
-	sizeS := binary.LittleEndian.Uint16(val)
-	sigS := signatureBlob.Next(int(sizeS))
 
-	// Swap endiannnes of sizeS
-	tempBuf = make([]byte, 2)
-	binary.BigEndian.PutUint16(tempBuf, sizeS)
-	// Size field
-	binary.Write(bigEndianBuf, binary.BigEndian, tempBuf)
-	// SigS part
-	binary.Write(bigEndianBuf, binary.BigEndian, sigS)
+	bigEndianBuf := bytes.NewBuffer(quote.Token())
 
-	log.Println(`Finished processing evidence with byte size`, len(bigEndianBuf.Bytes()))
+	log.Println(`Finished processing version`, quote.Version, `evidence with byte size`, len(bigEndianBuf.Bytes()))
 
-	return bigEndianBuf, uuidNodeId, nil
+	return bigEndianBuf, quote.NodeID, nil
 }
@@ -0,0 +1,184 @@
+// Copyright 2023 EnactTrust LTD All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+
+package node
+
+import (
+	"bytes"
+	"crypto"
+	_ "crypto/sha1"
+	_ "crypto/sha512"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/google/go-tpm/tpm2"
+)
+
+// The PCR values sent along a quote do not hash to its PCR digest
+var ErrPCRValuesMismatch = errors.New("PCR values do not match the quote PCR digest")
+
+// PCRValue is the value of a single PCR, in the bank of the quote selection
+type PCRValue struct {
+	PCR    int    `json:"pcr"`
+	Digest []byte `json:"digest"`
+}
+
+// PCRValues are the individual PCRs covered by a quote, in ascending PCR
+// order. They are stored as JSON, NULL when the agent did not send them.
+type PCRValues []PCRValue
+
+func (v PCRValues) Value() (driver.Value, error) {
+	if len(v) == 0 {
+		return nil, nil
+	}
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	return string(b), nil
+}
+
+func (v *PCRValues) Scan(src interface{}) error {
+	switch s := src.(type) {
+	case nil:
+		*v = nil
+		return nil
+	case string:
+		return json.Unmarshal([]byte(s), v)
+	case []byte:
+		return json.Unmarshal(s, v)
+	default:
+		return fmt.Errorf("cannot scan %T into PCRValues", src)
+	}
+}
+
+// Get returns the value of the PCR, nil if it is not covered
+func (v PCRValues) Get(pcr int) []byte {
+	for _, p := range v {
+		if p.PCR == pcr {
+			return p.Digest
+		}
+	}
+
+	return nil
+}
+
+// signatureHash returns the hash algorithm of the quote signing scheme, which
+// the TPM also uses to compute the quote PCR digest
+func signatureHash(sig *tpm2.Signature) (tpm2.Algorithm, error) {
+	switch {
+	case sig == nil:
+		return tpm2.AlgNull, errors.New("no signature")
+	case sig.ECC != nil:
+		return sig.ECC.HashAlg, nil
+	case sig.RSA != nil:
+		return sig.RSA.HashAlg, nil
+	default:
+		return tpm2.AlgNull, fmt.Errorf("unsupported signature algorithm %v", sig.Alg)
+	}
+}
+
+// pcrValuesOf splits raw, the values of the PCRs selected by the quote of the
+// big endian token concatenated in ascending PCR order, as returned by
+// TPM2_PCR_Read. It checks that they hash to the quote PCR digest. A nil raw
+// means that the agent sent no PCR values and gives nil PCRValues.
+func pcrValuesOf(token []byte, raw []byte) (PCRValues, error) {
+	if raw == nil {
+		return nil, nil
+	}
+
+	et := EnactToken{}
+	if err := et.Decode(token); err != nil {
+		return nil, err
+	}
+
+	quote := et.AttestationData.AttestedQuoteInfo
+	if quote == nil {
+		return nil, errors.New("token is not a quote")
+	}
+
+	bank, err := quote.PCRSelection.Hash.Hash()
+	if err != nil {
+		return nil, err
+	}
+
+	pcrs := append([]int(nil), quote.PCRSelection.PCRs...)
+	sort.Ints(pcrs)
+
+	size := bank.Size()
+	if len(raw) != len(pcrs)*size {
+		return nil, fmt.Errorf("%w: expected %d bytes for %d %s PCRs, got %d",
+			ErrPCRValuesMismatch, len(pcrs)*size, len(pcrs), bank, len(raw))
+	}
+
+	alg, err := signatureHash(et.Signature)
+	if err != nil {
+		return nil, err
+	}
+
+	h, err := alg.Hash()
+	if err != nil {
+		return nil, err
+	}
+
+	if !bytes.Equal(hashOf(h, raw), quote.PCRDigest) {
+		return nil, ErrPCRValuesMismatch
+	}
+
+	values := make(PCRValues, len(pcrs))
+	for i, pcr := range pcrs {
+		values[i] = PCRValue{
+			PCR:    pcr,
+			Digest: raw[i*size : (i+1)*size],
+		}
+	}
+
+	return values, nil
+}
+
+func hashOf(h crypto.Hash, data []byte) []byte {
+	hh := h.New()
+	hh.Write(data)
+
+	return hh.Sum(nil)
+}
+
+// changedPCRs lists the PCRs whose observed value differs from the expected
+// one, in the bank of the quote selection, e.g. "sha256:7,9". It is empty
+// unless both sides carry PCR values.
+func changedPCRs(expected PCRValues, observed PCRValues, selection string) string {
+	if len(expected) == 0 || len(observed) == 0 {
+		return ""
+	}
+
+	var changed []string
+	for _, o := range observed {
+		if !bytes.Equal(expected.Get(o.PCR), o.Digest) {
+			changed = append(changed, fmt.Sprint(o.PCR))
+		}
+	}
+
+	if len(changed) == 0 {
+		return ""
+	}
+
+	bank := strings.SplitN(selection, ":", 2)[0]
+
+	return fmt.Sprintf("%s:%s", bank, strings.Join(changed, ","))
+}
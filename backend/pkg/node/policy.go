@@ -0,0 +1,281 @@
+// Copyright 2023 EnactTrust LTD All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+
+package node
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/jmoiron/sqlx"
+)
+
+var (
+	// The quote selects no PCR at all
+	ErrEmptyPCRSelection = errors.New("quote selects no PCRs")
+	// The quote selects other PCRs than the policy of the node requires
+	ErrPCRSelectionPolicy  = errors.New("quote PCR selection does not match the node policy")
+	ErrInvalidPCRSelection = errors.New("invalid PCR selection")
+)
+
+// Highest PCR index of a TPM with 24 PCRs
+const maxPCR = 23
+
+// PCR banks a policy may require, by their formatPCRSelection name
+var pcrBanks = map[string]tpm2.Algorithm{
+	"sha1":   tpm2.AlgSHA1,
+	"sha256": tpm2.AlgSHA256,
+	"sha384": tpm2.AlgSHA384,
+	"sha512": tpm2.AlgSHA512,
+}
+
+// PCRPolicy sets the PCRs that the quotes of a node, or of all the nodes
+// carrying a label, must select. A node policy takes precedence over the
+// policy of its label.
+type PCRPolicy struct {
+	ID int64 `db:"id" json:"id"`
+	// Exactly one of NodeID and Label is set
+	NodeID string `db:"node_id" json:"node_id,omitempty"`
+	Label  string `db:"label" json:"label,omitempty"`
+	// Required selection, as formatted by formatPCRSelection
+	PCRSelection string `db:"pcr_selection" json:"pcr_selection"`
+	Created_At   string `db:"created_at" json:"created_at"`
+}
+
+// parsePCRSelection parses a "<bank>:<pcr>,<pcr>,..." selection, e.g.
+// "sha256:0,1,2,3", and returns it in its canonical form
+func parsePCRSelection(s string) (string, error) {
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) != 2 {
+		return "", fmt.Errorf("%w %q: expected <bank>:<pcr>,<pcr>,...", ErrInvalidPCRSelection, s)
+	}
+
+	bank, ok := pcrBanks[strings.ToLower(strings.TrimSpace(parts[0]))]
+	if !ok {
+		return "", fmt.Errorf("%w %q: unknown PCR bank", ErrInvalidPCRSelection, s)
+	}
+
+	sel := tpm2.PCRSelection{Hash: bank}
+	seen := map[int]bool{}
+
+	for _, f := range strings.Split(parts[1], ",") {
+		if f = strings.TrimSpace(f); f == "" {
+			continue
+		}
+
+		pcr, err := strconv.Atoi(f)
+		if err != nil || pcr < 0 || pcr > maxPCR {
+			return "", fmt.Errorf("%w %q: PCR %q out of range", ErrInvalidPCRSelection, s, f)
+		}
+
+		if !seen[pcr] {
+			seen[pcr] = true
+			sel.PCRs = append(sel.PCRs, pcr)
+		}
+	}
+
+	if len(sel.PCRs) == 0 {
+		return "", fmt.Errorf("%w %q: no PCRs", ErrInvalidPCRSelection, s)
+	}
+
+	return formatPCRSelection(sel), nil
+}
+
+type PCRPolicyRepository interface {
+	// SetPCRPolicy creates or replaces the policy of the node or label
+	SetPCRPolicy(policy PCRPolicy) (int64, error)
+	// DeletePCRPolicy returns ErrNotFound if the node or label has no policy
+	DeletePCRPolicy(node_id string, label string) error
+	// GetPCRPolicy returns the policy of the node if it has one, else that
+	// of its label, else nil
+	GetPCRPolicy(node_id string, label string) (*PCRPolicy, error)
+	// ListPCRPolicies returns all the policies, node ones first
+	ListPCRPolicies() ([]PCRPolicy, error)
+}
+
+type SQLitePCRPolicyRepo struct {
+	db *sqlx.DB
+}
+
+func NewPCRPolicyRepo(db *sqlx.DB) PCRPolicyRepository {
+	return &SQLitePCRPolicyRepo{
+		db: db,
+	}
+}
+
+func (repo SQLitePCRPolicyRepo) SetPCRPolicy(policy PCRPolicy) (int64, error) {
+	const query = `
+		INSERT OR REPLACE INTO pcr_policies (
+			node_id,
+			label,
+			pcr_selection,
+			created_at
+		)
+		VALUES (
+			:node_id,
+			:label,
+			:pcr_selection,
+			:created_at
+		);`
+
+	response, err := repo.db.NamedExec(query, &policy)
+	if err != nil {
+		log.Println(err.Error())
+		return 0, err
+	}
+
+	return response.LastInsertId()
+}
+
+func (repo SQLitePCRPolicyRepo) DeletePCRPolicy(node_id string, label string) error {
+	const query = `DELETE FROM pcr_policies WHERE node_id = $1 AND label = $2;`
+
+	response, err := repo.db.Exec(query, node_id, label)
+	if err != nil {
+		log.Println(err.Error())
+		return err
+	}
+
+	if count, err := response.RowsAffected(); err != nil {
+		return err
+	} else if count == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+func (repo SQLitePCRPolicyRepo) GetPCRPolicy(node_id string, label string) (*PCRPolicy, error) {
+	policy := PCRPolicy{}
+
+	// A node policy has a node_id and comes first in descending order
+	const query = `
+		SELECT
+			id,
+			node_id,
+			label,
+			pcr_selection,
+			created_at
+		FROM pcr_policies
+		WHERE (node_id = $1 AND label = '') OR (node_id = '' AND label != '' AND label = $2)
+		ORDER BY node_id DESC
+		LIMIT 1;`
+
+	err := repo.db.Get(&policy, query, node_id, label)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &policy, nil
+}
+
+func (repo SQLitePCRPolicyRepo) ListPCRPolicies() ([]PCRPolicy, error) {
+	var policies []PCRPolicy = []PCRPolicy{}
+
+	const query = `
+		SELECT
+			id,
+			node_id,
+			label,
+			pcr_selection,
+			created_at
+		FROM pcr_policies
+		ORDER BY node_id DESC, label;`
+
+	err := repo.db.Select(&policies, query)
+	if err != nil {
+		return nil, err
+	}
+
+	return policies, nil
+}
+
+// SetPCRPolicy requires the quotes of the node with the given ID, or of the
+// nodes carrying the label, to select exactly the given PCRs
+func (n *NodeService) SetPCRPolicy(nodeID string, label string, selection string) (*PCRPolicy, error) {
+	if (nodeID == "") == (label == "") {
+		return nil, fmt.Errorf("%w: a policy is set either for a node or for a label", ErrInvalidPCRSelection)
+	}
+
+	if nodeID != "" {
+		if _, err := n.repo.GetNodeById(nodeID); err != nil {
+			return nil, err
+		}
+	}
+
+	canonical, err := parsePCRSelection(selection)
+	if err != nil {
+		return nil, err
+	}
+
+	policy := PCRPolicy{
+		NodeID:       nodeID,
+		Label:        label,
+		PCRSelection: canonical,
+		Created_At:   time.Now().UTC().String(),
+	}
+
+	policy.ID, err = n.policies.SetPCRPolicy(policy)
+	if err != nil {
+		return nil, err
+	}
+
+	return &policy, nil
+}
+
+func (n *NodeService) DeletePCRPolicy(nodeID string, label string) error {
+	return n.policies.DeletePCRPolicy(nodeID, label)
+}
+
+// GetPCRPolicy returns the policy in force for the node, its own or that of
+// its label, or nil if its quotes may select any PCRs
+func (n *NodeService) GetPCRPolicy(nodeID string) (*PCRPolicy, error) {
+	node, err := n.repo.GetNodeById(nodeID)
+	if err != nil {
+		return nil, err
+	}
+
+	return n.policies.GetPCRPolicy(nodeID, node.Label)
+}
+
+func (n *NodeService) ListPCRPolicies() ([]PCRPolicy, error) {
+	return n.policies.ListPCRPolicies()
+}
+
+// checkPCRSelection refuses quotes that select no PCRs, or other PCRs than
+// the policy in force for the node
+func (n *NodeService) checkPCRSelection(nodeID string, sel tpm2.PCRSelection) error {
+	if len(sel.PCRs) == 0 {
+		return ErrEmptyPCRSelection
+	}
+
+	policy, err := n.GetPCRPolicy(nodeID)
+	if err != nil || policy == nil {
+		return err
+	}
+
+	if selection := formatPCRSelection(sel); selection != policy.PCRSelection {
+		return fmt.Errorf("%w: want %s, got %s", ErrPCRSelectionPolicy, policy.PCRSelection, selection)
+	}
+
+	return nil
+}
@@ -16,7 +16,9 @@ package node
 import (
 	"database/sql"
 	"errors"
+	"fmt"
 	"log"
+	"strings"
 
 	"github.com/jmoiron/sqlx"
 	_ "github.com/mattn/go-sqlite3"
@@ -24,8 +26,44 @@ import (
 
 type NodeRepository interface {
 	InsertNode(node Node) error
-	ListNodes() ([]Node, error)
+	// ListNodes returns the page of nodes selected by query, and the total
+	// number of nodes matching its filters
+	ListNodes(query ListNodesQuery) ([]Node, int, error)
 	GetNodeById(node_id string) (*Node, error)
+	UpdateNodeLabel(node_id string, label string) error
+	// UpdateNodeState moves the node from one state to another. It returns
+	// ErrStateConflict if the node is no longer in the from state.
+	UpdateNodeState(node_id string, from State, to State) error
+	// UpdateAttestationOutcome records the result of an appraisal and moves
+	// the node from the given state to attesting-ok or attesting-failed
+	UpdateAttestationOutcome(node_id string, from State, inGoodState bool, attestedAt string) error
+	UpdateFirmwareVersion(node_id string, version string, obfuscated *bool) error
+}
+
+// Columns ListNodes can sort on
+const (
+	SortByCreatedAt = "created_at"
+	SortByState     = "state"
+	SortByLabel     = "label"
+)
+
+type ListNodesQuery struct {
+	Limit  int
+	Offset int
+	// One of the SortBy* constants
+	SortBy     string
+	Descending bool
+
+	// Filters, ignored when empty. Creation dates are compared as strings
+	// against the stored created_at, so they must be "2006-01-02" or
+	// "2006-01-02 15:04:05" formatted.
+	CreatedAfter  string
+	CreatedBefore string
+	State         State
+	Label         string
+	InGoodState   *bool
+	// TPM firmware version, as formatted in Node.Firmware_Version
+	FirmwareVersion string
 }
 
 type SQLiteNodeRepo struct {
@@ -48,13 +86,29 @@ func (repo SQLiteNodeRepo) InsertNode(node Node) error {
 			id,
 			ak_pub,
 			ek_pub,
-			created_at
+			ek_cert,
+			ek_manufacturer,
+			ek_model,
+			ak_name,
+			ak_public,
+			ak_parent_qn,
+			label,
+			created_at,
+			state
 		)
 		VALUES (
 			:id,
 			:ak_pub,
 			:ek_pub,
-			:created_at
+			:ek_cert,
+			:ek_manufacturer,
+			:ek_model,
+			:ak_name,
+			:ak_public,
+			:ak_parent_qn,
+			:label,
+			:created_at,
+			:state
 		);`
 
 	log.Println(`db`, repo.db)
@@ -82,10 +136,91 @@ func (repo SQLiteNodeRepo) InsertNode(node Node) error {
 	return nil
 }
 
-func (repo SQLiteNodeRepo) ListNodes() ([]Node, error) {
+func (repo SQLiteNodeRepo) ListNodes(query ListNodesQuery) ([]Node, int, error) {
 	var nodes_list []Node = []Node{}
 
-	return nodes_list, nil
+	var where []string
+	var args []interface{}
+
+	if query.CreatedAfter != "" {
+		where = append(where, "created_at >= ?")
+		args = append(args, query.CreatedAfter)
+	}
+	if query.CreatedBefore != "" {
+		where = append(where, "created_at < ?")
+		args = append(args, query.CreatedBefore)
+	}
+	if query.State != "" {
+		where = append(where, "state = ?")
+		args = append(args, query.State)
+	}
+	if query.Label != "" {
+		where = append(where, "label = ?")
+		args = append(args, query.Label)
+	}
+	if query.InGoodState != nil {
+		where = append(where, "in_good_state = ?")
+		args = append(args, *query.InGoodState)
+	}
+	if query.FirmwareVersion != "" {
+		where = append(where, "firmware_version = ?")
+		args = append(args, query.FirmwareVersion)
+	}
+
+	whereClause := ""
+	if len(where) > 0 {
+		whereClause = "WHERE " + strings.Join(where, " AND ")
+	}
+
+	var total int
+	err := repo.db.Get(&total, "SELECT COUNT(*) FROM nodes "+whereClause, args...)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// The sort column can't be a bound parameter, only allow known ones
+	switch query.SortBy {
+	case SortByCreatedAt, SortByState, SortByLabel:
+	case "":
+		query.SortBy = SortByCreatedAt
+	default:
+		return nil, 0, fmt.Errorf("cannot sort nodes by %q", query.SortBy)
+	}
+
+	order := "ASC"
+	if query.Descending {
+		order = "DESC"
+	}
+
+	q := fmt.Sprintf(`
+		SELECT
+			id,
+			ak_pub,
+			ek_pub,
+			ek_cert,
+			ek_manufacturer,
+			ek_model,
+			ak_name,
+			ak_public,
+			ak_parent_qn,
+			label,
+			created_at,
+			state,
+			in_good_state,
+			last_attested_at,
+			firmware_version,
+			firmware_obfuscated
+		FROM nodes
+		%s
+		ORDER BY %s %s, id
+		LIMIT ? OFFSET ?;`, whereClause, query.SortBy, order)
+
+	err = repo.db.Select(&nodes_list, q, append(args, query.Limit, query.Offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return nodes_list, total, nil
 }
 
 func (repo SQLiteNodeRepo) GetNodeById(node_id string) (*Node, error) {
@@ -96,10 +231,21 @@ func (repo SQLiteNodeRepo) GetNodeById(node_id string) (*Node, error) {
 			id,
 			ak_pub,
 			ek_pub,
-			created_at
+			ek_cert,
+			ek_manufacturer,
+			ek_model,
+			ak_name,
+			ak_public,
+			ak_parent_qn,
+			label,
+			created_at,
+			state,
+			in_good_state,
+			last_attested_at,
+			firmware_version,
+			firmware_obfuscated
 		FROM nodes
-		WHERE id = $1;
-		);`
+		WHERE id = $1;`
 
 	statement, err := repo.db.Preparex(query)
 	if err != nil {
@@ -117,3 +263,69 @@ func (repo SQLiteNodeRepo) GetNodeById(node_id string) (*Node, error) {
 
 	return &node, nil
 }
+
+func (repo SQLiteNodeRepo) UpdateNodeLabel(node_id string, label string) error {
+	const query = `UPDATE nodes SET label = $1 WHERE id = $2;`
+
+	return repo.updateNode(query, label, node_id)
+}
+
+func (repo SQLiteNodeRepo) UpdateFirmwareVersion(node_id string, version string, obfuscated *bool) error {
+	const query = `UPDATE nodes SET firmware_version = $1, firmware_obfuscated = $2 WHERE id = $3;`
+
+	return repo.updateNode(query, version, obfuscated, node_id)
+}
+
+func (repo SQLiteNodeRepo) UpdateNodeState(node_id string, from State, to State) error {
+	const query = `UPDATE nodes SET state = $1 WHERE id = $2 AND state = $3;`
+
+	return repo.transitionNode(query, node_id, to, node_id, from)
+}
+
+func (repo SQLiteNodeRepo) UpdateAttestationOutcome(node_id string, from State, inGoodState bool, attestedAt string) error {
+	const query = `
+		UPDATE nodes
+		SET state = $1, in_good_state = $2, last_attested_at = $3
+		WHERE id = $4 AND state = $5;`
+
+	to := StateAttestingFailed
+	if inGoodState {
+		to = StateAttestingOK
+	}
+
+	return repo.transitionNode(query, node_id, to, inGoodState, attestedAt, node_id, from)
+}
+
+// transitionNode runs a compare-and-set UPDATE of the node state: when no row
+// is affected, it tells a missing node from one whose state moved on
+func (repo SQLiteNodeRepo) transitionNode(query string, node_id string, args ...interface{}) error {
+	err := repo.updateNode(query, args...)
+	if !errors.Is(err, ErrNotFound) {
+		return err
+	}
+
+	if _, err := repo.GetNodeById(node_id); err != nil {
+		return err
+	}
+
+	return ErrStateConflict
+}
+
+// updateNode runs an UPDATE on a single node, returning ErrNotFound when no
+// row was affected
+func (repo SQLiteNodeRepo) updateNode(query string, args ...interface{}) error {
+	response, err := repo.db.Exec(query, args...)
+	if err != nil {
+		log.Println(err.Error())
+		return err
+	}
+
+	if count, err := response.RowsAffected(); err != nil {
+		log.Println("Could not check RowsAffected", err)
+		return err
+	} else if count == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
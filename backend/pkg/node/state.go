@@ -0,0 +1,80 @@
+// Copyright 2023 EnactTrust LTD All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+
+package node
+
+import (
+	"errors"
+	"fmt"
+)
+
+// State is the lifecycle state of a node, persisted in nodes.state
+type State string
+
+const (
+	// AK and EK received, node ID assigned
+	StateRegistered State = "registered"
+	// Golden values submitted to Veraison
+	StateGoldenProvisioned State = "golden-provisioned"
+	// Last evidence was appraised as affirming
+	StateAttestingOK State = "attesting-ok"
+	// Last evidence was not appraised as affirming
+	StateAttestingFailed State = "attesting-failed"
+	// Node is no longer trusted, no further calls are accepted
+	StateRevoked State = "revoked"
+)
+
+var (
+	ErrInvalidTransition = errors.New("invalid node state transition")
+	// The node state changed between reading and updating it
+	ErrStateConflict = errors.New("node state changed concurrently")
+	ErrNodeRevoked   = errors.New("node has been revoked")
+)
+
+// transitions lists, for each state, the states a node may move to
+var transitions = map[State][]State{
+	StateRegistered:        {StateGoldenProvisioned, StateRevoked},
+	StateGoldenProvisioned: {StateAttestingOK, StateAttestingFailed, StateRevoked},
+	StateAttestingOK:       {StateAttestingOK, StateAttestingFailed, StateRevoked},
+	StateAttestingFailed:   {StateAttestingOK, StateAttestingFailed, StateRevoked},
+	StateRevoked:           {},
+}
+
+func (s State) Valid() bool {
+	_, ok := transitions[s]
+	return ok
+}
+
+func (s State) CanTransition(to State) bool {
+	for _, allowed := range transitions[s] {
+		if allowed == to {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkTransition returns ErrNodeRevoked or ErrInvalidTransition if the node
+// may not move from its current state to the given one
+func checkTransition(from State, to State) error {
+	if from == StateRevoked {
+		return ErrNodeRevoked
+	}
+
+	if !from.CanTransition(to) {
+		return fmt.Errorf("%w: %s -> %s", ErrInvalidTransition, from, to)
+	}
+
+	return nil
+}
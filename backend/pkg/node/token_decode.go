@@ -15,9 +15,11 @@ package node
 
 import (
 	"bytes"
+	"crypto"
 	"crypto/ecdsa"
-	"crypto/sha256"
+	"crypto/rsa"
 	"encoding/binary"
+	"errors"
 	"fmt"
 
 	"github.com/google/go-tpm/tpm2"
@@ -62,11 +64,80 @@ func (et *EnactToken) Decode(data []byte) error {
 	return nil
 }
 
-func (et EnactToken) VerifySignature(key *ecdsa.PublicKey) error {
-	digest := sha256.Sum256(et.Raw)
+// The quote is inconsistent with its signature
+var ErrMalformedQuote = errors.New("malformed quote")
 
-	if !ecdsa.Verify(key, digest[:], et.Signature.ECC.R, et.Signature.ECC.S) {
-		return fmt.Errorf("failed to verify signature")
+// checkDigestAlgorithm checks that the quote PCR digest has the size of the
+// hash algorithm of the signature scheme
+func checkDigestAlgorithm(et EnactToken) error {
+	alg, err := signatureHash(et.Signature)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrUnsupportedSignature, err)
+	}
+
+	h, err := alg.Hash()
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrUnsupportedSignature, err)
+	}
+
+	if size := len(et.AttestationData.AttestedQuoteInfo.PCRDigest); size != h.Size() {
+		return fmt.Errorf("%w: %d bytes PCR digest signed with %v", ErrMalformedQuote, size, alg)
+	}
+
+	return nil
+}
+
+// VerifySignature verifies the TPMT_SIGNATURE over the TPMS_ATTEST with the
+// AK public key: ECDSA for an EC key, RSASSA-PKCS1-v1_5 or RSA-PSS for an
+// RSA key
+func (et EnactToken) VerifySignature(key crypto.PublicKey) error {
+	return verifyQuoteSignature(key, et.Signature, et.Raw)
+}
+
+// verifyQuoteSignature verifies sig over data, hashed with the hash algorithm
+// of the signature scheme
+func verifyQuoteSignature(key crypto.PublicKey, sig *tpm2.Signature, data []byte) error {
+	alg, err := signatureHash(sig)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrUnsupportedSignature, err)
+	}
+
+	h, err := alg.Hash()
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrUnsupportedSignature, err)
+	}
+
+	digest := hashOf(h, data)
+
+	switch k := key.(type) {
+	case *ecdsa.PublicKey:
+		if sig.Alg != tpm2.AlgECDSA || sig.ECC == nil {
+			return fmt.Errorf("%w %v for an ECDSA AK", ErrUnsupportedSignature, sig.Alg)
+		}
+
+		if !ecdsa.Verify(k, digest, sig.ECC.R, sig.ECC.S) {
+			return fmt.Errorf("failed to verify signature")
+		}
+	case *rsa.PublicKey:
+		if sig.RSA == nil {
+			return fmt.Errorf("%w %v for an RSA AK", ErrUnsupportedSignature, sig.Alg)
+		}
+
+		switch sig.Alg {
+		case tpm2.AlgRSASSA:
+			err = rsa.VerifyPKCS1v15(k, h, digest, sig.RSA.Signature)
+		case tpm2.AlgRSAPSS:
+			// TPMs use either the largest salt or one the size of the digest
+			err = rsa.VerifyPSS(k, h, digest, sig.RSA.Signature, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthAuto})
+		default:
+			return fmt.Errorf("%w %v for an RSA AK", ErrUnsupportedSignature, sig.Alg)
+		}
+
+		if err != nil {
+			return fmt.Errorf("failed to verify signature: %v", err)
+		}
+	default:
+		return fmt.Errorf("%w: %T", ErrUnsupportedAK, key)
 	}
 
 	return nil
@@ -0,0 +1,184 @@
+// Copyright 2023 EnactTrust LTD All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+
+package node
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"testing"
+
+	"github.com/google/go-tpm/tpm2"
+)
+
+func TestVerifyQuoteSignature(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherRSAKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p256Key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p384Key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := []byte("TPMS_ATTEST")
+
+	cases := []struct {
+		name       string
+		key        crypto.Signer
+		verifyWith crypto.PublicKey
+		scheme     tpm2.Algorithm
+		hashAlg    tpm2.Algorithm
+		saltLength int
+		// Scheme and hash announced by the TPMT_SIGNATURE, the signing ones
+		// if unset
+		announced     tpm2.Algorithm
+		announcedHash tpm2.Algorithm
+		data          []byte
+		err           error
+		// Whether verification fails, for errors without a sentinel
+		fails bool
+	}{
+		{name: "RSA-2048 RSASSA SHA-256", key: rsaKey, scheme: tpm2.AlgRSASSA, hashAlg: tpm2.AlgSHA256},
+		{name: "RSA-2048 RSA-PSS SHA-256, largest salt", key: rsaKey, scheme: tpm2.AlgRSAPSS, hashAlg: tpm2.AlgSHA256, saltLength: rsa.PSSSaltLengthAuto},
+		{name: "RSA-2048 RSA-PSS SHA-256, digest size salt", key: rsaKey, scheme: tpm2.AlgRSAPSS, hashAlg: tpm2.AlgSHA256, saltLength: rsa.PSSSaltLengthEqualsHash},
+		{name: "ECDSA P-256 SHA-256", key: p256Key, scheme: tpm2.AlgECDSA, hashAlg: tpm2.AlgSHA256},
+		{name: "ECDSA P-384 SHA-384", key: p384Key, scheme: tpm2.AlgECDSA, hashAlg: tpm2.AlgSHA384},
+		{name: "ECDSA P-384 SHA-256", key: p384Key, scheme: tpm2.AlgECDSA, hashAlg: tpm2.AlgSHA256},
+		{name: "RSA-2048 RSASSA SHA-384", key: rsaKey, scheme: tpm2.AlgRSASSA, hashAlg: tpm2.AlgSHA384},
+		{name: "RSA-2048 RSA-PSS SHA-512", key: rsaKey, scheme: tpm2.AlgRSAPSS, hashAlg: tpm2.AlgSHA512, saltLength: rsa.PSSSaltLengthAuto},
+		{name: "ECDSA P-384 other key", key: p384Key, verifyWith: p256Key.Public(), scheme: tpm2.AlgECDSA, hashAlg: tpm2.AlgSHA384, fails: true},
+		{name: "ECDSA P-384 announced hash", key: p384Key, scheme: tpm2.AlgECDSA, hashAlg: tpm2.AlgSHA384, announcedHash: tpm2.AlgSHA256, fails: true},
+		{name: "RSA-2048 RSASSA other key", key: otherRSAKey, verifyWith: rsaKey.Public(), scheme: tpm2.AlgRSASSA, hashAlg: tpm2.AlgSHA256, fails: true},
+		{name: "RSA-2048 RSA-PSS other key", key: otherRSAKey, verifyWith: rsaKey.Public(), scheme: tpm2.AlgRSAPSS, hashAlg: tpm2.AlgSHA256, saltLength: rsa.PSSSaltLengthAuto, fails: true},
+		{name: "RSA-2048 RSASSA other data", key: rsaKey, scheme: tpm2.AlgRSASSA, hashAlg: tpm2.AlgSHA256, data: []byte("TPMS_ATTEST'"), fails: true},
+		{name: "RSA-PSS announced as RSASSA", key: rsaKey, scheme: tpm2.AlgRSAPSS, hashAlg: tpm2.AlgSHA256, saltLength: rsa.PSSSaltLengthAuto, announced: tpm2.AlgRSASSA, fails: true},
+		{name: "RSASSA announced as RSA-PSS", key: rsaKey, scheme: tpm2.AlgRSASSA, hashAlg: tpm2.AlgSHA256, announced: tpm2.AlgRSAPSS, fails: true},
+		{name: "RSA signature announced as ECDSA", key: rsaKey, scheme: tpm2.AlgRSASSA, hashAlg: tpm2.AlgSHA256, announced: tpm2.AlgECDSA, err: ErrUnsupportedSignature},
+		{name: "RSA signature for an ECDSA AK", key: rsaKey, verifyWith: p256Key.Public(), scheme: tpm2.AlgRSASSA, hashAlg: tpm2.AlgSHA256, err: ErrUnsupportedSignature},
+		{name: "ECDSA signature for an RSA AK", key: p256Key, verifyWith: rsaKey.Public(), scheme: tpm2.AlgECDSA, hashAlg: tpm2.AlgSHA256, err: ErrUnsupportedSignature},
+	}
+
+	for _, c := range cases {
+		sig := quoteSignature(t, c.key, c.scheme, c.hashAlg, c.saltLength, data)
+		if c.announced != 0 {
+			sig.Alg = c.announced
+		}
+		if c.announcedHash != 0 {
+			sig.ECC.HashAlg = c.announcedHash
+		}
+
+		key := c.verifyWith
+		if key == nil {
+			key = c.key.Public()
+		}
+
+		signed := data
+		if c.data != nil {
+			signed = c.data
+		}
+
+		err := verifyQuoteSignature(key, sig, signed)
+		switch {
+		case c.err != nil:
+			if !errors.Is(err, c.err) {
+				t.Errorf("%s: %v", c.name, err)
+			}
+		case c.fails:
+			if err == nil || errors.Is(err, ErrUnsupportedSignature) || errors.Is(err, ErrUnsupportedAK) {
+				t.Errorf("%s: %v", c.name, err)
+			}
+		case err != nil:
+			t.Errorf("%s: %v", c.name, err)
+		}
+	}
+}
+
+func TestVerifySignatureToken(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, scheme := range []tpm2.Algorithm{tpm2.AlgRSASSA, tpm2.AlgRSAPSS} {
+		quote := testQuote(tpm2.AlgSHA256, []int{0, 7}, make([]byte, 32), make([]byte, 16))
+
+		et := EnactToken{}
+		if err := et.Decode(signToken(t, quote, rsaKey, scheme, tpm2.AlgSHA256)); err != nil {
+			t.Fatal(err)
+		}
+
+		if et.Signature.Alg != scheme || et.Signature.RSA == nil {
+			t.Fatalf("%v: decoded %+v", scheme, et.Signature)
+		}
+
+		if err := et.VerifySignature(rsaKey.Public()); err != nil {
+			t.Errorf("%v: %v", scheme, err)
+		}
+
+		if err := checkDigestAlgorithm(et); err != nil {
+			t.Errorf("%v: %v", scheme, err)
+		}
+	}
+}
+
+func TestCheckDigestAlgorithm(t *testing.T) {
+	p384Key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name    string
+		bank    tpm2.Algorithm
+		digest  []byte
+		hashAlg tpm2.Algorithm
+		err     error
+	}{
+		{"SHA-384 digest of a SHA-384 bank", tpm2.AlgSHA384, make([]byte, 48), tpm2.AlgSHA384, nil},
+		{"SHA-384 digest of a SHA-256 bank", tpm2.AlgSHA256, make([]byte, 48), tpm2.AlgSHA384, nil},
+		{"SHA-256 digest of a SHA-384 bank", tpm2.AlgSHA384, make([]byte, 32), tpm2.AlgSHA256, nil},
+		{"SHA-256 digest signed with SHA-384", tpm2.AlgSHA384, make([]byte, 32), tpm2.AlgSHA384, ErrMalformedQuote},
+	}
+
+	for _, c := range cases {
+		token := signToken(t, testQuote(c.bank, []int{0}, c.digest, make([]byte, 16)), p384Key, tpm2.AlgECDSA, c.hashAlg)
+
+		et := EnactToken{}
+		if err := et.Decode(token); err != nil {
+			t.Fatal(err)
+		}
+
+		err := checkDigestAlgorithm(et)
+		if (c.err == nil) != (err == nil) || (c.err != nil && !errors.Is(err, c.err)) {
+			t.Errorf("%s: %v", c.name, err)
+		}
+
+		// The digest algorithm is that of the signature, whatever the bank
+		if alg, err := quoteDigestAlg(token); err != nil || alg != c.hashAlg {
+			t.Errorf("%s: digest algorithm %v, %v", c.name, alg, err)
+		}
+	}
+}
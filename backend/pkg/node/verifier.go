@@ -0,0 +1,314 @@
+// Copyright 2023 EnactTrust LTD All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+
+package node
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/uuid"
+	"github.com/veraison/ear"
+	"github.com/veraison/enact-demo/pkg/enactcorim"
+	"github.com/veraison/enact-demo/pkg/session"
+	"github.com/veraison/enact-demo/pkg/veraison"
+	"github.com/veraison/swid"
+)
+
+// Verifier appraises node evidence. It is given the trust anchor and the
+// golden values of each node as they are provisioned, opens the sessions
+// that /node/secret challenges nodes with, and turns the evidence answering
+// them into an EAR.
+type Verifier interface {
+	// RegisterNode provisions the node's AK as its trust anchor
+	RegisterNode(node *Node) error
+	// ProvisionGolden provisions the PCR digest of the node's golden quote,
+	// and its individual PCR values if any, as its reference values. Version is 0 for the first golden values of
+	// the node; approved updates use increasing versions and supersede the
+	// golden values provisioned with lower ones.
+	ProvisionGolden(node *Node, golden GoldenValue, version uint) error
+	// NewSession opens a challenge-response session for the node
+	NewSession(nodeID uuid.UUID, ttl time.Duration) (session.Session, error)
+	// Appraise appraises the big endian token (TPMS_ATTEST size, TPMS_ATTEST,
+	// TPMT_SIGNATURE) answering the session. Whenever an EAR was produced,
+	// it is returned decoded and raw, also alongside an error when the
+	// appraisal is not affirming.
+	Appraise(node *Node, s *session.Session, token []byte) (*ear.AttestationResult, []byte, error)
+}
+
+// VeraisonVerifier delegates appraisal to the Veraison services
+type VeraisonVerifier struct {
+	client *veraison.Client
+}
+
+func NewVeraisonVerifier(client *veraison.Client) Verifier {
+	return &VeraisonVerifier{
+		client: client,
+	}
+}
+
+func (v VeraisonVerifier) RegisterNode(node *Node) error {
+	// The agent may upload the AK as bare base64, the CoMID carries it as
+	// PEM whatever its type
+	key, err := parseKey(node.AK_Pub)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+
+	akPEM, err := publicKeyPEM(key)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+
+	// Repackage node_id and AK pub as CoRIM
+	corim, err := enactcorim.RepackageNodePEM(akPEM, node.ID)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+
+	log.Println(`successfully repacked node PEM as corim`)
+
+	cbor, err := corim.ToCBOR()
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+
+	log.Println(`successfully converted corim to cbor`)
+
+	// `POST /submit, Body: { CoRIM }` to veraison backend
+	return v.client.SendCborToVeraison(cbor)
+}
+
+func (v VeraisonVerifier) ProvisionGolden(node *Node, golden GoldenValue, version uint) error {
+	measurements, err := goldenMeasurements(golden)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+
+	// repackage the golden values and perform POST /submit, Body: { CoRIM }
+	evidenceCbor, err := enactcorim.RepackageGoldenValues(node.ID, version, measurements)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+
+	return v.client.SendCborToVeraison(evidenceCbor)
+}
+
+// Named information hash algorithms of the PCR banks. SHA-1 has none, so
+// SHA-1 PCR values are not provisioned individually.
+var bankAlgIDs = map[string]uint64{
+	"sha256": swid.Sha256,
+	"sha384": swid.Sha384,
+	"sha512": swid.Sha512,
+}
+
+// goldenMeasurements returns the CoMID measurements of a golden value: the
+// composite PCR digest, keyless as in the first EnactTrust golden values,
+// followed by one measurement keyed by PCR index per individual PCR value
+func goldenMeasurements(golden GoldenValue) ([]enactcorim.Measurement, error) {
+	digestAlg, err := enactcorim.DigestAlgID(tpm2.Algorithm(golden.PCRDigestAlg))
+	if err != nil {
+		return nil, err
+	}
+
+	measurements := []enactcorim.Measurement{
+		{
+			Digests: []enactcorim.Digest{{AlgID: digestAlg, Value: golden.PCRDigest}},
+		},
+	}
+
+	if len(golden.PCRValues) == 0 {
+		return measurements, nil
+	}
+
+	bank := strings.SplitN(golden.PCRSelection, ":", 2)[0]
+
+	bankAlg, ok := bankAlgIDs[bank]
+	if !ok {
+		log.Printf("not provisioning individual %s PCR values", bank)
+		return measurements, nil
+	}
+
+	for _, v := range golden.PCRValues {
+		pcr := uint64(v.PCR)
+
+		measurements = append(measurements, enactcorim.Measurement{
+			PCR:     &pcr,
+			Digests: []enactcorim.Digest{{AlgID: bankAlg, Value: v.Digest}},
+		})
+	}
+
+	return measurements, nil
+}
+
+func (v VeraisonVerifier) NewSession(nodeID uuid.UUID, ttl time.Duration) (session.Session, error) {
+	cfg, sessionCtx, sessionURI, err := v.client.CreateVeraisonSession()
+	if err != nil {
+		return session.Session{}, err
+	}
+
+	log.Println("nonce:", sessionCtx.Nonce)
+	log.Println(`sessionURI: `, sessionURI)
+
+	return session.New(nodeID.String(), cfg, sessionURI, sessionCtx.Nonce, ttl), nil
+}
+
+func (v VeraisonVerifier) Appraise(node *Node, s *session.Session, token []byte) (*ear.AttestationResult, []byte, error) {
+	// concatenate bytes, because Veraison expects a continious array
+	var concatenatedData []byte = append(node.ID[:], token...)
+	log.Println("concatenatedData length: ", len(concatenatedData))
+
+	// POST to Veraison
+	attestationResultJSON, err := v.client.SendEvidenceAndSignature(s.ChallengeResponseConfig(), s.URI, concatenatedData)
+	if err != nil {
+		log.Println(err)
+		return nil, nil, err
+	}
+
+	result, err := v.client.EarCheck(attestationResultJSON)
+
+	return result, attestationResultJSON, err
+}
+
+// Prefix of the URIs of local verifier sessions
+const localSessionScheme = "local:"
+
+var ErrNoGoldenValues = errors.New("no golden values provisioned for node")
+
+// LocalVerifier appraises evidence in-process: it checks the quote
+// signature against the registered AK, the nonce against the session and
+// the PCR digest against the golden values stored in the backend database.
+// Its EARs are unsigned JSON.
+type LocalVerifier struct {
+	golden GoldenValueRepository
+	// Size in bytes of the session nonces
+	nonceSize uint
+}
+
+func NewLocalVerifier(golden GoldenValueRepository, nonceSize uint) Verifier {
+	return &LocalVerifier{
+		golden:    golden,
+		nonceSize: nonceSize,
+	}
+}
+
+// RegisterNode only checks that the AK can verify quotes, the node record
+// itself is the trust anchor
+func (v LocalVerifier) RegisterNode(node *Node) error {
+	_, err := parseKey(node.AK_Pub)
+	return err
+}
+
+// ProvisionGolden has nothing to do: NodeService stores the golden values
+// of every node in the GoldenValueRepository the local verifier reads
+func (v LocalVerifier) ProvisionGolden(node *Node, golden GoldenValue, version uint) error {
+	return nil
+}
+
+func (v LocalVerifier) NewSession(nodeID uuid.UUID, ttl time.Duration) (session.Session, error) {
+	nonce := make([]byte, v.nonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return session.Session{}, err
+	}
+
+	now := time.Now().UTC()
+
+	return session.Session{
+		NodeID:    nodeID.String(),
+		URI:       localSessionScheme + uuid.New().String(),
+		Nonce:     nonce,
+		NonceSize: v.nonceSize,
+		CreatedAt: now,
+		ExpiresAt: now.Add(ttl),
+	}, nil
+}
+
+func (v LocalVerifier) Appraise(node *Node, s *session.Session, token []byte) (*ear.AttestationResult, []byte, error) {
+	et := EnactToken{}
+	if err := et.Decode(token); err != nil {
+		return nil, nil, err
+	}
+
+	if et.AttestationData.AttestedQuoteInfo == nil {
+		return nil, nil, errors.New("token is not a quote")
+	}
+
+	if subtle.ConstantTimeCompare(et.AttestationData.ExtraData, s.Nonce) != 1 {
+		return nil, nil, ErrNonceMismatch
+	}
+
+	golden, err := v.golden.ListGoldenValues(node.ID.String())
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(golden) == 0 {
+		return nil, nil, ErrNoGoldenValues
+	}
+
+	key, err := parseKey(node.AK_Pub)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	result := ear.NewAttestationResult(veraison.EnactTrustSubmod, "enact-demo-local", "EnactTrust")
+
+	nonce := base64.RawURLEncoding.EncodeToString(s.Nonce)
+	result.Nonce = &nonce
+
+	appraisal := result.Submods[veraison.EnactTrustSubmod]
+
+	// The quote is only attributable to the node if its AK signed it
+	if err := et.VerifySignature(key); err != nil {
+		appraisal.TrustVector.InstanceIdentity = ear.UntrustworthyInstanceClaim
+	} else {
+		appraisal.TrustVector.InstanceIdentity = ear.TrustworthyInstanceClaim
+		appraisal.TrustVector.Executables = ear.UnrecognizedRuntimeClaim
+
+		quote := et.AttestationData.AttestedQuoteInfo
+		selection := formatPCRSelection(quote.PCRSelection)
+
+		for _, g := range golden {
+			if g.Matches(quote.PCRDigest, selection) {
+				appraisal.TrustVector.Executables = ear.ApprovedRuntimeClaim
+				break
+			}
+		}
+	}
+
+	appraisal.UpdateStatusFromTrustVector()
+
+	raw, err := json.Marshal(result)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if *appraisal.Status != ear.TrustTierAffirming {
+		return result, raw, fmt.Errorf(`want "affirming", got %s`, *appraisal.Status)
+	}
+
+	return result, raw, nil
+}
@@ -0,0 +1,308 @@
+// Copyright 2023 EnactTrust LTD All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+
+package node
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/binary"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/uuid"
+	"github.com/veraison/ear"
+	"github.com/veraison/enact-demo/pkg/session"
+	"github.com/veraison/enact-demo/pkg/veraison"
+	"github.com/veraison/swid"
+)
+
+// testQuote returns the TPMS_ATTEST of a quote of the PCRs with the digest
+// and nonce
+func testQuote(bank tpm2.Algorithm, pcrs []int, digest []byte, nonce []byte) tpm2.AttestationData {
+	return tpm2.AttestationData{
+		Magic:           0xff544347,
+		Type:            tpm2.TagAttestQuote,
+		QualifiedSigner: tpm2.Name{Digest: &tpm2.HashValue{Alg: tpm2.AlgSHA256, Value: make([]byte, 32)}},
+		ExtraData:       nonce,
+		AttestedQuoteInfo: &tpm2.QuoteInfo{
+			PCRSelection: tpm2.PCRSelection{Hash: bank, PCRs: pcrs},
+			PCRDigest:    digest,
+		},
+	}
+}
+
+// quoteSignature signs data with the key, as a TPM does with the scheme and
+// hash algorithm. RSA-PSS signatures use the given salt length.
+func quoteSignature(t *testing.T, key crypto.Signer, scheme tpm2.Algorithm, hashAlg tpm2.Algorithm, saltLength int, data []byte) *tpm2.Signature {
+	t.Helper()
+
+	h, err := hashAlg.Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := hashOf(h, data)
+
+	sig := &tpm2.Signature{Alg: scheme}
+	switch scheme {
+	case tpm2.AlgECDSA:
+		r, s, err := ecdsa.Sign(rand.Reader, key.(*ecdsa.PrivateKey), digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig.ECC = &tpm2.SignatureECC{HashAlg: hashAlg, R: r, S: s}
+	case tpm2.AlgRSASSA, tpm2.AlgRSAPSS:
+		var opts crypto.SignerOpts = h
+		if scheme == tpm2.AlgRSAPSS {
+			opts = &rsa.PSSOptions{SaltLength: saltLength, Hash: h}
+		}
+		s, err := key.Sign(rand.Reader, digest, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig.RSA = &tpm2.SignatureRSA{HashAlg: hashAlg, Signature: s}
+	default:
+		t.Fatalf("scheme %v", scheme)
+	}
+
+	return sig
+}
+
+// signToken returns the big endian token of the quote signed by the key with
+// the scheme and hash algorithm: TPMS_ATTEST size, TPMS_ATTEST and
+// TPMT_SIGNATURE. RSA-PSS signatures use the largest salt.
+func signToken(t *testing.T, attest tpm2.AttestationData, key crypto.Signer, scheme tpm2.Algorithm, hashAlg tpm2.Algorithm) []byte {
+	t.Helper()
+
+	raw, err := attest.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encoded, err := quoteSignature(t, key, scheme, hashAlg, rsa.PSSSaltLengthAuto, raw).Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	size := make([]byte, 2)
+	binary.BigEndian.PutUint16(size, uint16(len(raw)))
+
+	return append(append(size, raw...), encoded...)
+}
+
+// goldenStub serves the golden values of the local verifier
+type goldenStub struct {
+	GoldenValueRepository
+	golden []GoldenValue
+}
+
+func (g goldenStub) ListGoldenValues(node_id string) ([]GoldenValue, error) {
+	return g.golden, nil
+}
+
+func TestLocalVerifierNewSession(t *testing.T) {
+	v := NewLocalVerifier(goldenStub{}, 16)
+	nodeID := uuid.New()
+
+	s, err := v.NewSession(nodeID, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(s.Nonce) != 16 || s.NonceSize != 16 {
+		t.Errorf("%d bytes nonce, size %d", len(s.Nonce), s.NonceSize)
+	}
+
+	if s.NodeID != nodeID.String() || !s.ExpiresAt.After(s.CreatedAt) {
+		t.Errorf("session %+v", s)
+	}
+
+	other, err := v.NewSession(nodeID, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes.Equal(s.Nonce, other.Nonce) || s.URI == other.URI {
+		t.Error("sessions share a nonce or URI")
+	}
+}
+
+func TestLocalVerifierAppraise(t *testing.T) {
+	ak := newTestAK(t, testAKAttributes)
+	other := newTestAK(t, testAKAttributes)
+	node := &Node{ID: uuid.New(), AK_Pub: ak.pem(t)}
+
+	nonce := bytes.Repeat([]byte{0x4e}, 16)
+	s := &session.Session{NodeID: node.ID.String(), Nonce: nonce, NonceSize: 16}
+
+	pcrs := []int{0, 1, 2, 3, 7}
+	goldenDigest := bytes.Repeat([]byte{0x60}, 32)
+	drifted := bytes.Repeat([]byte{0xd1}, 32)
+
+	golden := []GoldenValue{
+		{PCRDigest: bytes.Repeat([]byte{0x01}, 32), PCRSelection: "sha256:0,1,2,3,7"},
+		{PCRDigest: goldenDigest, PCRSelection: "sha256:0,1,2,3,7"},
+	}
+
+	cases := []struct {
+		name       string
+		golden     []GoldenValue
+		token      []byte
+		err        error
+		status     ear.TrustTier
+		identity   ear.TrustClaim
+		executable ear.TrustClaim
+	}{
+		{
+			name:       "matching golden value",
+			golden:     golden,
+			token:      signToken(t, testQuote(tpm2.AlgSHA256, pcrs, goldenDigest, nonce), ak.key, tpm2.AlgECDSA, tpm2.AlgSHA256),
+			status:     ear.TrustTierAffirming,
+			identity:   ear.TrustworthyInstanceClaim,
+			executable: ear.ApprovedRuntimeClaim,
+		},
+		{
+			name:       "legacy golden value without selection",
+			golden:     []GoldenValue{{PCRDigest: goldenDigest}},
+			token:      signToken(t, testQuote(tpm2.AlgSHA256, []int{0}, goldenDigest, nonce), ak.key, tpm2.AlgECDSA, tpm2.AlgSHA256),
+			status:     ear.TrustTierAffirming,
+			identity:   ear.TrustworthyInstanceClaim,
+			executable: ear.ApprovedRuntimeClaim,
+		},
+		{
+			name:       "drifted",
+			golden:     golden,
+			token:      signToken(t, testQuote(tpm2.AlgSHA256, pcrs, drifted, nonce), ak.key, tpm2.AlgECDSA, tpm2.AlgSHA256),
+			status:     ear.TrustTierWarning,
+			identity:   ear.TrustworthyInstanceClaim,
+			executable: ear.UnrecognizedRuntimeClaim,
+		},
+		{
+			name:       "other selection",
+			golden:     golden,
+			token:      signToken(t, testQuote(tpm2.AlgSHA256, []int{0, 1, 2, 3}, goldenDigest, nonce), ak.key, tpm2.AlgECDSA, tpm2.AlgSHA256),
+			status:     ear.TrustTierWarning,
+			identity:   ear.TrustworthyInstanceClaim,
+			executable: ear.UnrecognizedRuntimeClaim,
+		},
+		{
+			name:     "other AK",
+			golden:   golden,
+			token:    signToken(t, testQuote(tpm2.AlgSHA256, pcrs, goldenDigest, nonce), other.key, tpm2.AlgECDSA, tpm2.AlgSHA256),
+			status:   ear.TrustTierContraindicated,
+			identity: ear.UntrustworthyInstanceClaim,
+		},
+		{
+			name:   "other nonce",
+			golden: golden,
+			token:  signToken(t, testQuote(tpm2.AlgSHA256, pcrs, goldenDigest, make([]byte, 16)), ak.key, tpm2.AlgECDSA, tpm2.AlgSHA256),
+			err:    ErrNonceMismatch,
+		},
+		{
+			name:  "no golden values",
+			token: signToken(t, testQuote(tpm2.AlgSHA256, pcrs, goldenDigest, nonce), ak.key, tpm2.AlgECDSA, tpm2.AlgSHA256),
+			err:   ErrNoGoldenValues,
+		},
+	}
+
+	for _, c := range cases {
+		v := NewLocalVerifier(goldenStub{golden: c.golden}, 16)
+
+		result, raw, err := v.Appraise(node, s, c.token)
+		if c.err != nil {
+			if !errors.Is(err, c.err) || result != nil {
+				t.Errorf("%s: %v", c.name, err)
+			}
+			continue
+		}
+
+		if result == nil || raw == nil {
+			t.Fatalf("%s: no EAR, %v", c.name, err)
+		}
+
+		if (c.status == ear.TrustTierAffirming) != (err == nil) {
+			t.Errorf("%s: %v", c.name, err)
+		}
+
+		appraisal := result.Submods[veraison.EnactTrustSubmod]
+		if appraisal == nil {
+			t.Fatalf("%s: no %s submod", c.name, veraison.EnactTrustSubmod)
+		}
+
+		tv := appraisal.TrustVector
+		if *appraisal.Status != c.status || tv.InstanceIdentity != c.identity || tv.Executables != c.executable {
+			t.Errorf("%s: status %v, instance identity %v, executables %v", c.name, *appraisal.Status, tv.InstanceIdentity, tv.Executables)
+		}
+
+		if result.Nonce == nil {
+			t.Errorf("%s: no nonce", c.name)
+		}
+	}
+}
+
+func TestGoldenMeasurements(t *testing.T) {
+	cases := []struct {
+		name   string
+		golden GoldenValue
+		algID  uint64
+		pcrs   int
+	}{
+		{
+			name:   "SHA-384 digest of SHA-256 PCRs",
+			golden: GoldenValue{PCRDigest: make([]byte, 48), PCRDigestAlg: uint16(tpm2.AlgSHA384), PCRSelection: "sha256:0,7", PCRValues: PCRValues{{PCR: 0, Digest: make([]byte, 32)}, {PCR: 7, Digest: make([]byte, 32)}}},
+			algID:  swid.Sha384,
+			pcrs:   2,
+		},
+		{
+			name:   "SHA-256 digest",
+			golden: GoldenValue{PCRDigest: make([]byte, 32), PCRDigestAlg: uint16(tpm2.AlgSHA256), PCRSelection: "sha256:0"},
+			algID:  swid.Sha256,
+		},
+		{
+			name:   "SHA-512 digest of SHA-1 PCRs",
+			golden: GoldenValue{PCRDigest: make([]byte, 64), PCRDigestAlg: uint16(tpm2.AlgSHA512), PCRSelection: "sha1:0", PCRValues: PCRValues{{PCR: 0, Digest: make([]byte, 20)}}},
+			algID:  swid.Sha512,
+		},
+	}
+
+	for _, c := range cases {
+		measurements, err := goldenMeasurements(c.golden)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+
+		if len(measurements) != 1+c.pcrs || measurements[0].PCR != nil {
+			t.Fatalf("%s: measurements %+v", c.name, measurements)
+		}
+
+		if d := measurements[0].Digests; len(d) != 1 || d[0].AlgID != c.algID {
+			t.Errorf("%s: composite digest %+v", c.name, d)
+		}
+
+		for _, m := range measurements[1:] {
+			if m.PCR == nil || m.Digests[0].AlgID != swid.Sha256 {
+				t.Errorf("%s: PCR measurement %+v", c.name, m)
+			}
+		}
+	}
+
+	// The algorithm is not guessed from the digest size
+	if _, err := goldenMeasurements(GoldenValue{PCRDigest: make([]byte, 32)}); err == nil {
+		t.Error("golden value without digest algorithm")
+	}
+}
@@ -0,0 +1,100 @@
+// Copyright 2023 EnactTrust LTD All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+
+package session
+
+import (
+	"sync"
+	"time"
+)
+
+// MemorySessionStore keeps sessions in process memory. Sessions are lost on
+// restart, which makes it mostly useful for development.
+type MemorySessionStore struct {
+	mu       sync.RWMutex
+	sessions map[string]Session
+	// Times at which nonces were consumed, keyed by the nonce bytes
+	consumed map[string]time.Time
+}
+
+func NewMemoryStore() SessionStore {
+	return &MemorySessionStore{
+		sessions: map[string]Session{},
+		consumed: map[string]time.Time{},
+	}
+}
+
+func (store *MemorySessionStore) Put(s Session) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	s.Nonce = append([]byte(nil), s.Nonce...)
+	store.sessions[s.NodeID] = s
+
+	return nil
+}
+
+func (store *MemorySessionStore) Get(nodeID string) (*Session, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	s, ok := store.sessions[nodeID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	return &s, nil
+}
+
+func (store *MemorySessionStore) Delete(nodeID string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	delete(store.sessions, nodeID)
+
+	return nil
+}
+
+func (store *MemorySessionStore) Consume(nodeID string, nonce []byte) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if _, ok := store.consumed[string(nonce)]; ok {
+		return ErrNonceConsumed
+	}
+	store.consumed[string(nonce)] = time.Now()
+
+	return nil
+}
+
+func (store *MemorySessionStore) Consumed(nonce []byte) (bool, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	_, ok := store.consumed[string(nonce)]
+
+	return ok, nil
+}
+
+func (store *MemorySessionStore) PurgeConsumed(before time.Time) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	for nonce, consumedAt := range store.consumed {
+		if consumedAt.Before(before) {
+			delete(store.consumed, nonce)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,140 @@
+// Copyright 2023 EnactTrust LTD All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+
+package session
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// SQLiteSessionStore persists sessions in the veraison_sessions table, so
+// that nodes can finish an attestation across backend restarts. SQLite
+// serialises writers; the busy timeout set by db.InitDatabaseConnection makes
+// concurrent handlers wait for each other rather than fail.
+type SQLiteSessionStore struct {
+	db *sqlx.DB
+}
+
+func NewSQLiteStore(db *sqlx.DB) SessionStore {
+	return &SQLiteSessionStore{
+		db: db,
+	}
+}
+
+func (store SQLiteSessionStore) Put(s Session) error {
+	const query = `
+		INSERT OR REPLACE INTO veraison_sessions (
+			node_id,
+			session_uri,
+			nonce,
+			new_session_uri,
+			nonce_size,
+			delete_session,
+			created_at,
+			expires_at
+		)
+		VALUES (
+			:node_id,
+			:session_uri,
+			:nonce,
+			:new_session_uri,
+			:nonce_size,
+			:delete_session,
+			:created_at,
+			:expires_at
+		);`
+
+	_, err := store.db.NamedExec(query, &s)
+	if err != nil {
+		log.Println(err.Error())
+		return err
+	}
+
+	return nil
+}
+
+func (store SQLiteSessionStore) Get(nodeID string) (*Session, error) {
+	s := Session{}
+
+	const query = `
+		SELECT
+			node_id,
+			session_uri,
+			nonce,
+			new_session_uri,
+			nonce_size,
+			delete_session,
+			created_at,
+			expires_at
+		FROM veraison_sessions
+		WHERE node_id = $1;`
+
+	err := store.db.Get(&s, query, nodeID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+
+		return nil, err
+	}
+
+	return &s, nil
+}
+
+func (store SQLiteSessionStore) Delete(nodeID string) error {
+	const query = `DELETE FROM veraison_sessions WHERE node_id = $1;`
+
+	_, err := store.db.Exec(query, nodeID)
+
+	return err
+}
+
+func (store SQLiteSessionStore) Consume(nodeID string, nonce []byte) error {
+	const query = `INSERT INTO consumed_nonces (nonce, node_id, consumed_at) VALUES ($1, $2, $3);`
+
+	_, err := store.db.Exec(query, nonce, nodeID, time.Now().UTC())
+	if err != nil {
+		// The primary key makes the check and the insert a single step
+		if strings.Contains(err.Error(), "UNIQUE constraint failed") {
+			return ErrNonceConsumed
+		}
+
+		log.Println(err.Error())
+		return err
+	}
+
+	return nil
+}
+
+func (store SQLiteSessionStore) Consumed(nonce []byte) (bool, error) {
+	var count int
+
+	err := store.db.Get(&count, `SELECT COUNT(*) FROM consumed_nonces WHERE nonce = $1;`, nonce)
+	if err != nil {
+		return false, err
+	}
+
+	return count > 0, nil
+}
+
+func (store SQLiteSessionStore) PurgeConsumed(before time.Time) error {
+	_, err := store.db.Exec(`DELETE FROM consumed_nonces WHERE consumed_at < $1;`, before.UTC())
+
+	return err
+}
@@ -0,0 +1,90 @@
+// Copyright 2023 EnactTrust LTD All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+
+package session
+
+import (
+	"errors"
+	"time"
+
+	"github.com/veraison/apiclient/common"
+	"github.com/veraison/apiclient/verification"
+)
+
+var (
+	ErrNotFound      = errors.New("no Veraison session for node")
+	ErrNonceConsumed = errors.New("nonce already consumed")
+)
+
+// Session is the Veraison challenge-response session opened on behalf of a
+// node by /node/secret and consumed by /node/golden or /node/evidence
+type Session struct {
+	NodeID string `db:"node_id"`
+	// Session URI returned by Veraison in the Location header
+	URI string `db:"session_uri"`
+	// Nonce issued by Veraison for this session
+	Nonce []byte `db:"nonce"`
+	// Parameters of the ChallengeResponseConfig that opened the session
+	NewSessionURI string `db:"new_session_uri"`
+	NonceSize     uint   `db:"nonce_size"`
+	DeleteSession bool   `db:"delete_session"`
+
+	CreatedAt time.Time `db:"created_at"`
+	ExpiresAt time.Time `db:"expires_at"`
+}
+
+// SessionStore keeps at most one active session per node
+type SessionStore interface {
+	// Put stores the session, replacing any previous session for the node
+	Put(s Session) error
+	// Get returns the node's session, expired or not, or ErrNotFound
+	Get(nodeID string) (*Session, error)
+	Delete(nodeID string) error
+	// Consume records that evidence answering the nonce was accepted, or
+	// returns ErrNonceConsumed if it was recorded before
+	Consume(nodeID string, nonce []byte) error
+	// Consumed tells whether the nonce was consumed
+	Consumed(nonce []byte) (bool, error)
+	// PurgeConsumed forgets the nonces consumed before the given time
+	PurgeConsumed(before time.Time) error
+}
+
+func New(nodeID string, cfg *verification.ChallengeResponseConfig, uri string, nonce []byte, ttl time.Duration) Session {
+	now := time.Now().UTC()
+
+	return Session{
+		NodeID:        nodeID,
+		URI:           uri,
+		Nonce:         nonce,
+		NewSessionURI: cfg.NewSessionURI,
+		NonceSize:     cfg.NonceSz,
+		DeleteSession: cfg.DeleteSession,
+		CreatedAt:     now,
+		ExpiresAt:     now.Add(ttl),
+	}
+}
+
+// ChallengeResponseConfig rebuilds the api-client configuration needed to
+// continue the session, e.g. after a backend restart
+func (s Session) ChallengeResponseConfig() *verification.ChallengeResponseConfig {
+	return &verification.ChallengeResponseConfig{
+		NonceSz:       s.NonceSize,
+		NewSessionURI: s.NewSessionURI,
+		Client:        common.NewClient(),
+		DeleteSession: s.DeleteSession,
+	}
+}
+
+func (s Session) Expired(now time.Time) bool {
+	return now.After(s.ExpiresAt)
+}
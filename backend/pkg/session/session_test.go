@@ -0,0 +1,256 @@
+// Copyright 2023 EnactTrust LTD All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+
+package session
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/veraison/enact-demo/pkg/db"
+)
+
+// newSQLiteStore returns a store over a fresh database file, and its path
+func newSQLiteStore(t *testing.T) (SessionStore, string) {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "enact.db")
+
+	return openSQLiteStore(t, path), path
+}
+
+func openSQLiteStore(t *testing.T, path string) SessionStore {
+	t.Helper()
+
+	conn, err := db.InitDatabaseConnection(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return NewSQLiteStore(conn)
+}
+
+func testSession(nodeID string, nonce byte) Session {
+	now := time.Now().UTC().Truncate(time.Second)
+
+	return Session{
+		NodeID:        nodeID,
+		URI:           "http://localhost:8080/challenge-response/v1/session/" + nodeID,
+		Nonce:         bytes.Repeat([]byte{nonce}, 16),
+		NewSessionURI: "http://localhost:8080/challenge-response/v1/newSession",
+		NonceSize:     16,
+		DeleteSession: true,
+		CreatedAt:     now,
+		ExpiresAt:     now.Add(5 * time.Minute),
+	}
+}
+
+func sameSession(a, b *Session) bool {
+	return a.NodeID == b.NodeID && a.URI == b.URI && bytes.Equal(a.Nonce, b.Nonce) &&
+		a.NewSessionURI == b.NewSessionURI && a.NonceSize == b.NonceSize && a.DeleteSession == b.DeleteSession &&
+		a.CreatedAt.Equal(b.CreatedAt) && a.ExpiresAt.Equal(b.ExpiresAt)
+}
+
+// stores returns a fresh store of every kind
+func stores(t *testing.T) map[string]SessionStore {
+	sqlite, _ := newSQLiteStore(t)
+
+	return map[string]SessionStore{
+		"memory": NewMemoryStore(),
+		"sqlite": sqlite,
+	}
+}
+
+func TestSessions(t *testing.T) {
+	for name, store := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			if _, err := store.Get("node-a"); !errors.Is(err, ErrNotFound) {
+				t.Fatalf("get before put: %v", err)
+			}
+
+			first := testSession("node-a", 0x01)
+			if err := store.Put(first); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := store.Get("node-a")
+			if err != nil || !sameSession(got, &first) {
+				t.Fatalf("got %+v, %v", got, err)
+			}
+
+			// A node has at most one session
+			second := testSession("node-a", 0x02)
+			if err := store.Put(second); err != nil {
+				t.Fatal(err)
+			}
+			if got, err := store.Get("node-a"); err != nil || !sameSession(got, &second) {
+				t.Fatalf("replaced session %+v, %v", got, err)
+			}
+
+			other := testSession("node-b", 0x03)
+			if err := store.Put(other); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := store.Delete("node-a"); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := store.Get("node-a"); !errors.Is(err, ErrNotFound) {
+				t.Errorf("get after delete: %v", err)
+			}
+			if got, err := store.Get("node-b"); err != nil || !sameSession(got, &other) {
+				t.Errorf("other node session %+v, %v", got, err)
+			}
+
+			// Deleting no session is not an error
+			if err := store.Delete("node-a"); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestConsume(t *testing.T) {
+	for name, store := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			nonce := bytes.Repeat([]byte{0x01}, 16)
+			other := bytes.Repeat([]byte{0x02}, 16)
+
+			if consumed, err := store.Consumed(nonce); err != nil || consumed {
+				t.Fatalf("consumed before Consume: %v, %v", consumed, err)
+			}
+
+			if err := store.Consume("node-a", nonce); err != nil {
+				t.Fatal(err)
+			}
+
+			if consumed, err := store.Consumed(nonce); err != nil || !consumed {
+				t.Fatalf("not consumed: %v", err)
+			}
+			if consumed, err := store.Consumed(other); err != nil || consumed {
+				t.Fatalf("other nonce consumed: %v", err)
+			}
+
+			// Whichever node answers with it
+			for _, nodeID := range []string{"node-a", "node-b"} {
+				if err := store.Consume(nodeID, nonce); !errors.Is(err, ErrNonceConsumed) {
+					t.Errorf("%s consuming again: %v", nodeID, err)
+				}
+			}
+
+			if err := store.Consume("node-a", other); err != nil {
+				t.Fatal(err)
+			}
+
+			// Nonces consumed after the time are kept
+			if err := store.PurgeConsumed(time.Now().Add(-time.Hour)); err != nil {
+				t.Fatal(err)
+			}
+			if consumed, err := store.Consumed(nonce); err != nil || !consumed {
+				t.Fatalf("purged too early: %v", err)
+			}
+
+			if err := store.PurgeConsumed(time.Now().Add(time.Hour)); err != nil {
+				t.Fatal(err)
+			}
+			for _, n := range [][]byte{nonce, other} {
+				if consumed, err := store.Consumed(n); err != nil || consumed {
+					t.Errorf("%x not purged: %v", n, err)
+				}
+			}
+
+			// A purged nonce can be consumed again
+			if err := store.Consume("node-a", nonce); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestConsumeConcurrently(t *testing.T) {
+	const workers = 16
+
+	for name, store := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			nonce := bytes.Repeat([]byte{0x5a}, 16)
+
+			var wg sync.WaitGroup
+			errs := make(chan error, workers)
+
+			for i := 0; i < workers; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					errs <- store.Consume("node-a", nonce)
+				}()
+			}
+
+			wg.Wait()
+			close(errs)
+
+			accepted, refused := 0, 0
+			for err := range errs {
+				switch {
+				case err == nil:
+					accepted++
+				case errors.Is(err, ErrNonceConsumed):
+					refused++
+				default:
+					t.Error(err)
+				}
+			}
+
+			if accepted != 1 || refused != workers-1 {
+				t.Errorf("%d accepted, %d refused", accepted, refused)
+			}
+		})
+	}
+}
+
+func TestSQLiteReopen(t *testing.T) {
+	store, path := newSQLiteStore(t)
+
+	s := testSession("node-a", 0x01)
+	if err := store.Put(s); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Consume("node-b", s.Nonce); err != nil {
+		t.Fatal(err)
+	}
+
+	// As after a backend restart
+	reopened := openSQLiteStore(t, path)
+
+	got, err := reopened.Get("node-a")
+	if err != nil || !sameSession(got, &s) {
+		t.Fatalf("got %+v, %v", got, err)
+	}
+
+	if err := reopened.Consume("node-b", s.Nonce); !errors.Is(err, ErrNonceConsumed) {
+		t.Errorf("consuming after restart: %v", err)
+	}
+}
+
+func TestExpired(t *testing.T) {
+	s := testSession("node-a", 0x01)
+
+	if s.Expired(s.CreatedAt) || s.Expired(s.ExpiresAt) || !s.Expired(s.ExpiresAt.Add(time.Second)) {
+		t.Error("expiry is not at ExpiresAt")
+	}
+}
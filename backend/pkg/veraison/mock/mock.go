@@ -0,0 +1,385 @@
+// Copyright 2023 EnactTrust LTD All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+
+// Package mock is a stand-in for the Veraison provisioning and verification
+// services. It implements just enough of the REST APIs for the backend to
+// run without a Veraison deployment: CoRIM submission, challenge-response
+// sessions, and EARs signed with an ES256 key whose verdict is chosen by the
+// caller rather than by appraising the evidence.
+package mock
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/veraison/ear"
+	"github.com/veraison/enact-demo/config"
+)
+
+const (
+	SubmitPath     = "/endorsement-provisioning/v1/submit"
+	NewSessionPath = "/challenge-response/v1/newSession"
+	SessionPath    = "/challenge-response/v1/session/"
+
+	CoRIMMediaType    = "application/corim-unsigned+cbor"
+	EvidenceMediaType = "application/vnd.enacttrust.tpm-evidence"
+
+	submod         = "TPM_ENACTTRUST"
+	maxNonceSize   = 64
+	sessionTimeout = 5 * time.Minute
+)
+
+// session mirrors the challenge-response session resource returned by the
+// Veraison verification API
+type session struct {
+	Nonce    []byte    `json:"nonce"`
+	Expiry   time.Time `json:"expiry"`
+	Accept   []string  `json:"accept"`
+	Status   string    `json:"status"`
+	Evidence *evidence `json:"evidence,omitempty"`
+	Result   *string   `json:"result,omitempty"`
+}
+
+type evidence struct {
+	Type  string `json:"type"`
+	Value []byte `json:"value"`
+}
+
+// Server is an in-memory mock of the Veraison services. The zero value is
+// not usable, use New.
+type Server struct {
+	key *ecdsa.PrivateKey
+
+	mu           sync.Mutex
+	verdict      ear.TrustTier
+	sessions     map[string]*session
+	endorsements [][]byte
+}
+
+// New returns a mock signing EARs with key. If key is nil a fresh P-256 key
+// is generated. The initial verdict is affirming.
+func New(key *ecdsa.PrivateKey) (*Server, error) {
+	if key == nil {
+		k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, fmt.Errorf("generating EAR signing key: %w", err)
+		}
+		key = k
+	}
+
+	if key.Curve != elliptic.P256() {
+		return nil, errors.New("EAR signing key must be on P-256 for ES256")
+	}
+
+	return &Server{
+		key:      key,
+		verdict:  ear.TrustTierAffirming,
+		sessions: make(map[string]*session),
+	}, nil
+}
+
+// NewTestServer starts an httptest server backed by a new mock. Both the
+// provisioning and the verification APIs are served from the same address;
+// use Server.Config to point the backend at it. The caller must Close the
+// returned httptest.Server.
+func NewTestServer() (*httptest.Server, *Server, error) {
+	m, err := New(nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return httptest.NewServer(m), m, nil
+}
+
+// SetVerdict selects the status reported in subsequent EARs
+func (s *Server) SetVerdict(tier ear.TrustTier) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.verdict = tier
+}
+
+// Endorsements returns a copy of every CoRIM received on the submit endpoint,
+// in arrival order
+func (s *Server) Endorsements() [][]byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	out := make([][]byte, len(s.endorsements))
+	copy(out, s.endorsements)
+
+	return out
+}
+
+// PublicKeyJWK returns the JWK encoding of the EAR verification key, as
+// expected by the veraison.ear_public_key configuration setting
+func (s *Server) PublicKeyJWK() ([]byte, error) {
+	k, err := jwk.FromRaw(&s.key.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	if err := k.Set(jwk.AlgorithmKey, jwa.ES256); err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(k)
+}
+
+// Config returns a VeraisonConfig pointing at a mock served on baseURL
+func (s *Server) Config(baseURL string) (config.VeraisonConfig, error) {
+	pub, err := s.PublicKeyJWK()
+	if err != nil {
+		return config.VeraisonConfig{}, err
+	}
+
+	baseURL = strings.TrimSuffix(baseURL, "/")
+
+	return config.VeraisonConfig{
+		NewSessionURI: baseURL + NewSessionPath,
+		SubmitURI:     baseURL + SubmitPath,
+		NonceSize:     32,
+		EARPublicKey:  string(pub),
+	}, nil
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == SubmitPath:
+		s.handleSubmit(w, r)
+	case r.URL.Path == NewSessionPath:
+		s.handleNewSession(w, r)
+	case strings.HasPrefix(r.URL.Path, SessionPath):
+		s.handleSession(w, r, strings.TrimPrefix(r.URL.Path, SessionPath))
+	default:
+		problem(w, http.StatusNotFound, "no such endpoint")
+	}
+}
+
+func (s *Server) handleSubmit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		problem(w, http.StatusMethodNotAllowed, "only POST is allowed")
+		return
+	}
+
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), CoRIMMediaType) {
+		problem(w, http.StatusUnsupportedMediaType, "expecting "+CoRIMMediaType)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil || len(body) == 0 {
+		problem(w, http.StatusBadRequest, "empty or unreadable CoRIM")
+		return
+	}
+
+	s.mu.Lock()
+	s.endorsements = append(s.endorsements, body)
+	s.mu.Unlock()
+
+	log.Printf("mock-veraison: stored %d bytes of endorsements", len(body))
+
+	w.Header().Set("Content-Type", "application/vnd.veraison.provisioning-session+json")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(map[string]string{
+		"status": "success",
+		"expiry": time.Now().Add(sessionTimeout).UTC().Format(time.RFC3339),
+	})
+}
+
+func (s *Server) handleNewSession(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		problem(w, http.StatusMethodNotAllowed, "only POST is allowed")
+		return
+	}
+
+	nonce, err := requestedNonce(r)
+	if err != nil {
+		problem(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	id := uuid.New().String()
+	sess := &session{
+		Nonce:  nonce,
+		Expiry: time.Now().Add(sessionTimeout).UTC(),
+		Accept: []string{EvidenceMediaType},
+		Status: "waiting",
+	}
+
+	s.mu.Lock()
+	s.sessions[id] = sess
+	s.mu.Unlock()
+
+	w.Header().Set("Location", "http://"+r.Host+SessionPath+id)
+	writeSession(w, http.StatusCreated, sess)
+}
+
+func (s *Server) handleSession(w http.ResponseWriter, r *http.Request, id string) {
+	s.mu.Lock()
+	sess, ok := s.sessions[id]
+	var snapshot session
+	if ok {
+		snapshot = *sess
+	}
+	s.mu.Unlock()
+
+	if !ok {
+		problem(w, http.StatusNotFound, "no such session")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writeSession(w, http.StatusOK, &snapshot)
+	case http.MethodDelete:
+		s.mu.Lock()
+		delete(s.sessions, id)
+		s.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodPost:
+		s.handleEvidence(w, r, sess)
+	default:
+		problem(w, http.StatusMethodNotAllowed, "unsupported method")
+	}
+}
+
+func (s *Server) handleEvidence(w http.ResponseWriter, r *http.Request, sess *session) {
+	ct := r.Header.Get("Content-Type")
+	if !strings.HasPrefix(ct, EvidenceMediaType) {
+		problem(w, http.StatusUnsupportedMediaType, "expecting "+EvidenceMediaType)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil || len(body) == 0 {
+		problem(w, http.StatusBadRequest, "empty or unreadable evidence")
+		return
+	}
+
+	s.mu.Lock()
+	verdict := s.verdict
+	s.mu.Unlock()
+
+	result, err := s.sign(sess.Nonce, verdict)
+	if err != nil {
+		problem(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	s.mu.Lock()
+	sess.Status = "complete"
+	sess.Evidence = &evidence{Type: ct, Value: body}
+	sess.Result = &result
+	snapshot := *sess
+	s.mu.Unlock()
+
+	writeSession(w, http.StatusOK, &snapshot)
+}
+
+// sign produces an EAR for the TPM_ENACTTRUST submodule with the trust
+// vector one would expect from Veraison for the given verdict
+func (s *Server) sign(nonce []byte, verdict ear.TrustTier) (string, error) {
+	r := ear.NewAttestationResult(submod, "mock-veraison", "EnactTrust")
+
+	n := base64.RawURLEncoding.EncodeToString(nonce)
+	r.Nonce = &n
+
+	appraisal := r.Submods[submod]
+	appraisal.Status = &verdict
+
+	switch verdict {
+	case ear.TrustTierAffirming:
+		appraisal.TrustVector.InstanceIdentity = ear.TrustworthyInstanceClaim
+		appraisal.TrustVector.Executables = ear.ApprovedRuntimeClaim
+		appraisal.TrustVector.Hardware = ear.GenuineHardwareClaim
+	case ear.TrustTierWarning:
+		appraisal.TrustVector.InstanceIdentity = ear.TrustworthyInstanceClaim
+		appraisal.TrustVector.Executables = ear.UnsafeRuntimeClaim
+		appraisal.TrustVector.Hardware = ear.GenuineHardwareClaim
+	case ear.TrustTierContraindicated:
+		appraisal.TrustVector.InstanceIdentity = ear.TrustworthyInstanceClaim
+		appraisal.TrustVector.Executables = ear.ContraindicatedRuntimeClaim
+		appraisal.TrustVector.Hardware = ear.GenuineHardwareClaim
+	default:
+		appraisal.TrustVector.InstanceIdentity = ear.UnrecognizedInstanceClaim
+	}
+
+	token, err := r.Sign(jwa.ES256, s.key)
+	if err != nil {
+		return "", fmt.Errorf("signing EAR: %w", err)
+	}
+
+	return string(token), nil
+}
+
+// requestedNonce honours the nonce and nonceSize query parameters of
+// newSession, defaulting to a random 32-byte nonce
+func requestedNonce(r *http.Request) ([]byte, error) {
+	q := r.URL.Query()
+
+	if v := q.Get("nonce"); v != "" {
+		nonce, err := base64.URLEncoding.DecodeString(v)
+		if err != nil {
+			return nil, fmt.Errorf("nonce is not base64url: %w", err)
+		}
+		return nonce, nil
+	}
+
+	size := 32
+	if v := q.Get("nonceSize"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > maxNonceSize {
+			return nil, fmt.Errorf("nonceSize must be between 1 and %d", maxNonceSize)
+		}
+		size = n
+	}
+
+	nonce := make([]byte, size)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return nonce, nil
+}
+
+func writeSession(w http.ResponseWriter, code int, sess *session) {
+	w.Header().Set("Content-Type", "application/vnd.veraison.challenge-response-session+json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(sess)
+}
+
+func problem(w http.ResponseWriter, code int, detail string) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"title":  http.StatusText(code),
+		"status": code,
+		"detail": detail,
+	})
+}
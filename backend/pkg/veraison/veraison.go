@@ -25,25 +25,43 @@ import (
 	"github.com/veraison/apiclient/provisioning"
 	"github.com/veraison/apiclient/verification"
 	"github.com/veraison/ear"
+	"github.com/veraison/enact-demo/config"
 )
 
 var TPMEvidenceMediaType = "application/vnd.enacttrust.tpm-evidence"
-var VeraisonECDSAPublicKey = `{
-	"kty": "EC",
-	"crv": "P-256",
-	"x": "usWxHK2PmfnHKwXPS54m0kTcGJ90UiglWiGahtagnv8",
-	"y": "IBOL-C3BttVivg-lSreASjpkttcsz-1rb7btKLv8EX4"
-}`
+
+// EnactTrustSubmod is the EAR submodule carrying the appraisal of EnactTrust
+// TPM evidence
+const EnactTrustSubmod = "TPM_ENACTTRUST"
+
+// Client talks to the Veraison provisioning and verification services
+// configured in config.VeraisonConfig
+type Client struct {
+	cfg    config.VeraisonConfig
+	earKey jwk.Key
+}
+
+func NewClient(cfg config.VeraisonConfig) (*Client, error) {
+	k, err := jwk.ParseKey([]byte(cfg.EARPublicKey))
+	if err != nil {
+		return nil, fmt.Errorf("parsing EAR public key: %w", err)
+	}
+
+	return &Client{
+		cfg:    cfg,
+		earKey: k,
+	}, nil
+}
 
 func SendTPMEvidenceToVeraison(cbor []byte) error {
 	// vnd-enacttrust.tpm-evidence from the diagram
 	return nil
 }
 
-func SendCborToVeraison(cbor []byte) error {
+func (c *Client) SendCborToVeraison(cbor []byte) error {
 	// This uses the Veraison api-client
 	cfg := provisioning.SubmitConfig{
-		SubmitURI: "http://localhost:8888/endorsement-provisioning/v1/submit",
+		SubmitURI: c.cfg.SubmitURI,
 	}
 	// The Run method is invoked on the instantiated SubmitConfig object to
 	// trigger the protocol FSM, hiding any details about the synchronus / async nature
@@ -55,11 +73,6 @@ func SendCborToVeraison(cbor []byte) error {
 		return err
 	}
 
-	if err != nil {
-		log.Println(err.Error())
-		return err
-	}
-
 	log.Println("CORIM cbor successfully sent to Veraison")
 
 	return nil
@@ -67,7 +80,7 @@ func SendCborToVeraison(cbor []byte) error {
 
 // this corresponds to phase2 from
 // https://github.com/veraison/enact-demo/blob/38e97e32d302d8627489de6127839d4929dfc819/examples/async-apiclient/main.go#L51
-func SendEvidenceAndSignature(cfg *verification.ChallengeResponseConfig, sessionId string, data []byte) ([]byte, error) {
+func (c *Client) SendEvidenceAndSignature(cfg *verification.ChallengeResponseConfig, sessionId string, data []byte) ([]byte, error) {
 	// TODO: check if the session exists
 	// if !ok {
 	// 	return nil, fmt.Errorf("no session URI found for node %q", FakeNodeID)
@@ -78,8 +91,6 @@ func SendEvidenceAndSignature(cfg *verification.ChallengeResponseConfig, session
 	log.Println("sessionId: ", sessionId)
 	log.Println("data length: ", len(data))
 
-	// extract golden values from body
-	fmt.Printf("\n%x\n", data)
 	attestationResultRawMessage, err := cfg.ChallengeResponse(data, TPMEvidenceMediaType, sessionId)
 	if err != nil {
 		return nil, fmt.Errorf("challenge-response session failed: %v", err)
@@ -101,13 +112,10 @@ func RepackageEvidenceAndSendToVeraison(cfg *verification.ChallengeResponseConfi
 	// TODO: POST /submit
 }
 
-func CreateVeraisonSession() (*verification.ChallengeResponseConfig, *verification.ChallengeResponseSession, string, error) {
-	// localhost?
-	var sessionURI = "http://localhost:8080/challenge-response/v1/newSession"
-
+func (c *Client) CreateVeraisonSession() (*verification.ChallengeResponseConfig, *verification.ChallengeResponseSession, string, error) {
 	cfg := verification.ChallengeResponseConfig{
-		NonceSz:       16,
-		NewSessionURI: sessionURI,
+		NonceSz:       c.cfg.NonceSize,
+		NewSessionURI: c.cfg.NewSessionURI,
 		Client:        common.NewClient(),
 		DeleteSession: true,
 	}
@@ -120,57 +128,27 @@ func CreateVeraisonSession() (*verification.ChallengeResponseConfig, *verificati
 	return &cfg, newSession, sessionURI, nil
 }
 
-// This is the attestation result check
-func EarCheck(b []byte) error {
-	k, _ := jwk.ParseKey([]byte(VeraisonECDSAPublicKey))
-
+// This is the attestation result check. The decoded result is returned
+// whenever the EAR signature verifies, even if the appraisal is not
+// affirming, so that callers can record it.
+func (c *Client) EarCheck(b []byte) (*ear.AttestationResult, error) {
 	var r ear.AttestationResult
 
-	s := fmt.Sprintf("%x", b)
-	fmt.Println(s)
 	log.Println("Length of EarCheck byte slice=", len(b))
 
-	if err := r.Verify(b, jwa.KeyAlgorithmFrom(jwa.ES256), k); err != nil {
-		return fmt.Errorf("verification failed: %w", err)
+	if err := r.Verify(b, jwa.KeyAlgorithmFrom(jwa.ES256), c.earKey); err != nil {
+		return nil, fmt.Errorf("verification failed: %w", err)
 	}
 
-	appraisal, ok := r.Submods["TPM_ENACTTRUST"]
+	appraisal, ok := r.Submods[EnactTrustSubmod]
 	if !ok {
-		return errors.New("unexpected format: missing TPM_ENACTTRUST submod")
+		return &r, errors.New("unexpected format: missing TPM_ENACTTRUST submod")
 	}
 
 	// at a minimum, one needs to check the overall status
 	if *appraisal.Status != ear.TrustTierAffirming {
-		return fmt.Errorf(`want "affirming", got %s`, *appraisal.Status)
+		return &r, fmt.Errorf(`want "affirming", got %s`, *appraisal.Status)
 	}
 
-	return nil
-}
-
-func dumpByteSlice(b []byte) {
-	var a [16]byte
-	n := (len(b) + 15) &^ 15
-	for i := 0; i < n; i++ {
-		if i%16 == 0 {
-			fmt.Printf("%4d", i)
-		}
-		if i%8 == 0 {
-			fmt.Print(" ")
-		}
-		if i < len(b) {
-			fmt.Printf(" %02X", b[i])
-		} else {
-			fmt.Print("   ")
-		}
-		if i >= len(b) {
-			a[i%16] = ' '
-		} else if b[i] < 32 || b[i] > 126 {
-			a[i%16] = '.'
-		} else {
-			a[i%16] = b[i]
-		}
-		if i%16 == 15 {
-			fmt.Printf("  %s\n", string(a[:]))
-		}
-	}
+	return &r, nil
 }
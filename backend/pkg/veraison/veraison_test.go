@@ -0,0 +1,166 @@
+// Copyright 2023 EnactTrust LTD All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+
+package veraison
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/veraison/ear"
+	"github.com/veraison/enact-demo/pkg/veraison/mock"
+)
+
+// newTestClient returns a client of a mock Veraison served by httptest
+func newTestClient(t *testing.T) (*Client, *mock.Server, string) {
+	srv, m, err := mock.NewTestServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(srv.Close)
+
+	cfg, err := m.Config(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := NewClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return c, m, srv.URL
+}
+
+func TestSendCborToVeraison(t *testing.T) {
+	c, m, baseURL := newTestClient(t)
+
+	corim := []byte{0xd9, 0x01, 0xf5, 0xa0}
+	if err := c.SendCborToVeraison(corim); err != nil {
+		t.Fatal(err)
+	}
+
+	endorsements := m.Endorsements()
+	if len(endorsements) != 1 || !bytes.Equal(endorsements[0], corim) {
+		t.Fatalf("mock received %x", endorsements)
+	}
+
+	c.cfg.SubmitURI = baseURL + "/no-such-endpoint"
+	if err := c.SendCborToVeraison(corim); err == nil {
+		t.Fatal("submitting to a missing endpoint succeeded")
+	}
+
+	if n := len(m.Endorsements()); n != 1 {
+		t.Fatalf("mock stored %d endorsements", n)
+	}
+}
+
+func TestCreateVeraisonSession(t *testing.T) {
+	c, _, baseURL := newTestClient(t)
+
+	cfg, session, sessionURI, err := c.CreateVeraisonSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.NonceSz != 32 || len(session.Nonce) != 32 {
+		t.Fatalf("nonce size %d, nonce %x", cfg.NonceSz, session.Nonce)
+	}
+
+	if session.Status != "waiting" || len(session.Accept) != 1 || session.Accept[0] != TPMEvidenceMediaType {
+		t.Fatalf("session %+v", session)
+	}
+
+	if !strings.HasPrefix(sessionURI, baseURL+mock.SessionPath) {
+		t.Fatalf("session URI %s", sessionURI)
+	}
+
+	c.cfg.NewSessionURI = baseURL + "/no-such-endpoint"
+	if _, _, _, err := c.CreateVeraisonSession(); err == nil {
+		t.Fatal("creating a session on a missing endpoint succeeded")
+	}
+}
+
+func TestSendEvidenceAndSignature(t *testing.T) {
+	cases := []struct {
+		verdict   ear.TrustTier
+		affirming bool
+	}{
+		{ear.TrustTierAffirming, true},
+		{ear.TrustTierWarning, false},
+		{ear.TrustTierContraindicated, false},
+	}
+
+	for _, tc := range cases {
+		c, m, _ := newTestClient(t)
+		m.SetVerdict(tc.verdict)
+
+		cfg, _, sessionURI, err := c.CreateVeraisonSession()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		token, err := c.SendEvidenceAndSignature(cfg, sessionURI, []byte("evidence"))
+		if err != nil {
+			t.Fatal(tc.verdict, err)
+		}
+
+		result, err := c.EarCheck(token)
+		if tc.affirming != (err == nil) {
+			t.Fatalf("%v: %v", tc.verdict, err)
+		}
+
+		// The result is returned with a non affirming verdict too
+		if result == nil || *result.Submods[EnactTrustSubmod].Status != tc.verdict {
+			t.Fatalf("%v: result %+v", tc.verdict, result)
+		}
+	}
+}
+
+func TestSendEvidenceAndSignatureUnknownSession(t *testing.T) {
+	c, _, baseURL := newTestClient(t)
+
+	cfg, _, _, err := c.CreateVeraisonSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.SendEvidenceAndSignature(cfg, baseURL+mock.SessionPath+"unknown", []byte("evidence")); err == nil {
+		t.Fatal("sending evidence to an unknown session succeeded")
+	}
+}
+
+func TestEarCheckWrongKey(t *testing.T) {
+	c, _, _ := newTestClient(t)
+	other, _, _ := newTestClient(t)
+
+	cfg, _, sessionURI, err := c.CreateVeraisonSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := c.SendEvidenceAndSignature(cfg, sessionURI, []byte("evidence"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// An EAR signed by another verifier is neither trusted nor returned
+	if result, err := other.EarCheck(token); err == nil || result != nil {
+		t.Fatalf("result %+v, error %v", result, err)
+	}
+
+	if result, err := c.EarCheck([]byte("not a JWT")); err == nil || result != nil {
+		t.Fatalf("result %+v, error %v", result, err)
+	}
+}
@@ -0,0 +1,567 @@
+// Copyright 2023 EnactTrust LTD All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+
+// Package wire encodes and decodes the quotes EnactTrust agents upload to
+// /node/golden and /node/evidence, as an evidence blob and a signature blob.
+//
+// Legacy agents send blobs without a header:
+//
+//	evidence:  node_id[16] | size (uint16 LE) | TPMS_ATTEST[size]
+//	signature: sigAlg (uint16 LE) | hashAlg (uint16 LE) | size (uint16 LE) | value[size] ...
+//
+// where the TPMS_ATTEST is big endian, as the TPM produced it, and the
+// TPMT_SIGNATURE fields are little endian except for the signature values, R
+// and S for ECDSA or the RSA signature. Versioned blobs start with a header,
+// the Magic followed by the version (uint16 BE). Version 2 carries the TPM
+// structures in their canonical big endian TPM marshalling:
+//
+//	evidence:  header | node_id[16] | TPM2B_ATTEST
+//	signature: header | TPMT_SIGNATURE
+//
+// The seventh byte of a UUID holds its version, 1 to 8, in its high nibble,
+// while that of a header is the high byte of a version below 256: a legacy
+// blob is never mistaken for a versioned one. Neither is a legacy signature
+// blob, whose first two bytes are a signature scheme.
+package wire
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+	"github.com/google/uuid"
+)
+
+// Version of the wire format
+type Version uint16
+
+const (
+	// Legacy blobs, without a header
+	Legacy Version = 1
+	// Canonical big endian TPM marshalling
+	V2 Version = 2
+)
+
+// Magic starts the header of versioned blobs
+var Magic = [6]byte{0x89, 'E', 'N', 'A', 'C', 'T'}
+
+var (
+	// A field extends past the end of the blob, or of its TPMS_ATTEST
+	ErrTruncated = errors.New("truncated")
+	// Bytes remain after the last field of the blob, or of its TPMS_ATTEST
+	ErrTrailingData = errors.New("trailing data")
+	// A field holds a value the agent cannot have sent, e.g. a size larger
+	// than the TPM structure allows
+	ErrInvalidField = errors.New("invalid value")
+	// The signature scheme is neither ECDSA, RSASSA nor RSA-PSS
+	ErrUnsupportedSignature = errors.New("unsupported signature algorithm")
+	ErrUnsupportedVersion   = errors.New("unsupported wire format version")
+	// The evidence and signature blobs of a quote have different versions
+	ErrVersionMismatch = errors.New("wire format version mismatch")
+)
+
+// Error names the field of a blob that could not be decoded or encoded
+type Error struct {
+	// "evidence" or "signature"
+	Blob string
+	// TPM structure member, e.g. "extraData" or "pcrSelect[0].sizeofSelect"
+	Field string
+	// Offset of the field in the blob
+	Offset int
+	Err    error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s blob: %s at offset %d: %v", e.Blob, e.Field, e.Offset, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Largest values the TPM structures of the blobs may hold
+const (
+	// TPM_GENERATED_VALUE, the magic of every TPMS_ATTEST
+	tpmGeneratedValue = 0xff544347
+	// TPMU_NAME: a TPMT_HA, the largest of which carries a SHA-512 digest
+	maxNameSize = 2 + 64
+	// TPMT_HA digest, of TPM2B_DATA and TPM2B_DIGEST
+	maxDigestSize = 64
+	// TPML_PCR_SELECTION entries, one per PCR bank: quotes are appraised
+	// over a single bank
+	maxPCRBanks = 1
+	// TPMS_PCR_SELECTION bitmap, of up to 256 PCRs
+	maxSizeofSelect = 32
+	// ECC parameter of TPMS_SIGNATURE_ECC, of a P-521 key
+	maxECCParameterSize = 66
+	// TPM2B_PUBLIC_KEY_RSA of TPMS_SIGNATURE_RSA, of a 4096 bits key
+	maxRSASignatureSize = 512
+)
+
+// Quote is a quote as uploaded by an agent
+type Quote struct {
+	// Wire format of the blobs the quote was decoded from, or to encode it in
+	Version Version
+	NodeID  uuid.UUID
+	// TPMS_ATTEST of the quote
+	Attest []byte
+	// TPMT_SIGNATURE of the quote, big endian
+	Signature []byte
+}
+
+// Decode decodes the evidence and signature blobs of a quote, in the same
+// wire format version. Every field is checked to lie within its blob, and
+// within the TPMS_ATTEST for the fields of the quote.
+func Decode(evidence []byte, signature []byte) (*Quote, error) {
+	q := &Quote{}
+
+	var err error
+
+	q.NodeID, q.Attest, q.Version, err = decodeEvidence(evidence)
+	if err != nil {
+		return nil, err
+	}
+
+	var version Version
+
+	q.Signature, version, err = decodeSignature(signature)
+	if err != nil {
+		return nil, err
+	}
+
+	if version != q.Version {
+		return nil, fmt.Errorf("%w: version %d evidence blob, version %d signature blob", ErrVersionMismatch, q.Version, version)
+	}
+
+	return q, nil
+}
+
+// Encode encodes the quote as evidence and signature blobs in its version of
+// the wire format, refusing quotes Decode would refuse
+func (q Quote) Encode() ([]byte, []byte, error) {
+	var evidence, signature bytes.Buffer
+
+	switch q.Version {
+	case Legacy:
+		if hasHeader(q.NodeID[:]) {
+			return nil, nil, fmt.Errorf("%w: node ID %v reads as a header", ErrInvalidField, q.NodeID)
+		}
+		evidence.Write(q.NodeID[:])
+		binary.Write(&evidence, binary.LittleEndian, uint16(len(q.Attest)))
+	case V2:
+		writeHeader(&evidence, q.Version)
+		evidence.Write(q.NodeID[:])
+		binary.Write(&evidence, binary.BigEndian, uint16(len(q.Attest)))
+		writeHeader(&signature, q.Version)
+	default:
+		return nil, nil, fmt.Errorf("%w %d", ErrUnsupportedVersion, q.Version)
+	}
+
+	if len(q.Attest) > 0xffff {
+		return nil, nil, &Error{Blob: "evidence", Field: "TPMS_ATTEST", Offset: evidence.Len(), Err: fmt.Errorf("%w: %d bytes", ErrInvalidField, len(q.Attest))}
+	}
+
+	evidence.Write(q.Attest)
+
+	// The signature is walked in its canonical form, and converted on the
+	// way for legacy blobs
+	r := &reader{blob: "signature", data: q.Signature}
+	if err := r.signature(binary.BigEndian, &signature, q.Version == Legacy); err != nil {
+		return nil, nil, err
+	}
+
+	// Check the TPMS_ATTEST the way Decode will
+	if _, _, _, err := decodeEvidence(evidence.Bytes()); err != nil {
+		return nil, nil, err
+	}
+
+	return evidence.Bytes(), signature.Bytes(), nil
+}
+
+// Token returns the big endian token of the quote: the TPMS_ATTEST size, the
+// TPMS_ATTEST and the TPMT_SIGNATURE
+func (q Quote) Token() []byte {
+	token := &bytes.Buffer{}
+
+	binary.Write(token, binary.BigEndian, uint16(len(q.Attest)))
+	token.Write(q.Attest)
+	token.Write(q.Signature)
+
+	return token.Bytes()
+}
+
+// hasHeader reports whether data starts with the magic and the high byte of
+// a version, which the version nibble of a legacy node ID never is
+func hasHeader(data []byte) bool {
+	return bytes.HasPrefix(data, Magic[:]) && len(data) > len(Magic) && data[len(Magic)] == 0
+}
+
+func writeHeader(buf *bytes.Buffer, v Version) {
+	buf.Write(Magic[:])
+	binary.Write(buf, binary.BigEndian, uint16(v))
+}
+
+// reader reads the fields of a blob, checking that each one lies within the
+// blob
+type reader struct {
+	blob string
+	data []byte
+	off  int
+}
+
+func (r *reader) fail(field string, offset int, err error) error {
+	return &Error{Blob: r.blob, Field: field, Offset: offset, Err: err}
+}
+
+func (r *reader) next(field string, n int) ([]byte, error) {
+	if left := len(r.data) - r.off; n > left {
+		return nil, r.fail(field, r.off, fmt.Errorf("%w: %d bytes needed, %d left", ErrTruncated, n, left))
+	}
+
+	val := r.data[r.off : r.off+n]
+	r.off += n
+
+	return val, nil
+}
+
+func (r *reader) uint8(field string) (uint8, error) {
+	val, err := r.next(field, 1)
+	if err != nil {
+		return 0, err
+	}
+
+	return val[0], nil
+}
+
+func (r *reader) uint16(field string, order binary.ByteOrder) (uint16, error) {
+	val, err := r.next(field, 2)
+	if err != nil {
+		return 0, err
+	}
+
+	return order.Uint16(val), nil
+}
+
+func (r *reader) uint32(field string, order binary.ByteOrder) (uint32, error) {
+	val, err := r.next(field, 4)
+	if err != nil {
+		return 0, err
+	}
+
+	return order.Uint32(val), nil
+}
+
+// sized reads a TPM2B field, a 16 bits size followed by at most max bytes
+func (r *reader) sized(field string, order binary.ByteOrder, max int) ([]byte, error) {
+	offset := r.off
+
+	size, err := r.uint16(field+".size", order)
+	if err != nil {
+		return nil, err
+	}
+
+	if int(size) > max {
+		return nil, r.fail(field+".size", offset, fmt.Errorf("%w: %d bytes, at most %d", ErrInvalidField, size, max))
+	}
+
+	return r.next(field, int(size))
+}
+
+// end checks that the whole blob was read
+func (r *reader) end(field string) error {
+	if left := len(r.data) - r.off; left != 0 {
+		return r.fail(field, r.off, fmt.Errorf("%w: %d bytes", ErrTrailingData, left))
+	}
+
+	return nil
+}
+
+// version reads the header of a versioned blob, and returns Legacy for blobs
+// without one
+func (r *reader) version() (Version, error) {
+	if !hasHeader(r.data) {
+		return Legacy, nil
+	}
+
+	r.off = len(Magic)
+
+	v, err := r.uint16("version", binary.BigEndian)
+	if err != nil {
+		return 0, err
+	}
+
+	if Version(v) != V2 {
+		return 0, r.fail("version", len(Magic), fmt.Errorf("%w %d", ErrUnsupportedVersion, v))
+	}
+
+	return V2, nil
+}
+
+// decodeEvidence decodes an evidence or golden value blob and returns the
+// node ID, the TPMS_ATTEST and the wire format version of the blob
+func decodeEvidence(blob []byte) (uuid.UUID, []byte, Version, error) {
+	r := &reader{blob: "evidence", data: blob}
+
+	version, err := r.version()
+	if err != nil {
+		return uuid.UUID{}, nil, 0, err
+	}
+
+	offset := r.off
+
+	val, err := r.next("node_id", 16)
+	if err != nil {
+		return uuid.UUID{}, nil, 0, err
+	}
+
+	nodeID, err := uuid.FromBytes(val)
+	if err != nil {
+		return uuid.UUID{}, nil, 0, r.fail("node_id", offset, err)
+	}
+
+	// The TPMS_ATTEST size is the only little endian field of legacy blobs
+	var order binary.ByteOrder = binary.BigEndian
+	if version == Legacy {
+		order = binary.LittleEndian
+	}
+
+	size, err := r.uint16("TPMS_ATTEST.size", order)
+	if err != nil {
+		return uuid.UUID{}, nil, 0, err
+	}
+
+	start := r.off
+
+	attest, err := r.next("TPMS_ATTEST", int(size))
+	if err != nil {
+		return uuid.UUID{}, nil, 0, err
+	}
+
+	if err := r.end("TPMS_ATTEST"); err != nil {
+		return uuid.UUID{}, nil, 0, err
+	}
+
+	// Offsets of the TPMS_ATTEST fields are kept relative to the blob
+	ar := &reader{blob: r.blob, data: blob[:start+int(size)], off: start}
+	if err := ar.quote(); err != nil {
+		return uuid.UUID{}, nil, 0, err
+	}
+
+	return nodeID, attest, version, nil
+}
+
+// quote walks a TPMS_ATTEST of type TPM_ST_ATTEST_QUOTE (Table 116 and 120)
+func (r *reader) quote() error {
+	offset := r.off
+
+	magic, err := r.uint32("magic", binary.BigEndian)
+	if err != nil {
+		return err
+	}
+
+	if magic != tpmGeneratedValue {
+		return r.fail("magic", offset, fmt.Errorf("%w: 0x%08x", ErrInvalidField, magic))
+	}
+
+	offset = r.off
+
+	attestType, err := r.uint16("type", binary.BigEndian)
+	if err != nil {
+		return err
+	}
+
+	if tpmutil.Tag(attestType) != tpm2.TagAttestQuote {
+		return r.fail("type", offset, fmt.Errorf("%w: 0x%04x is not a quote", ErrInvalidField, attestType))
+	}
+
+	offset = r.off
+
+	name, err := r.sized("qualifiedSigner", binary.BigEndian, maxNameSize)
+	if err != nil {
+		return err
+	}
+
+	if err := checkName(name); err != nil {
+		return r.fail("qualifiedSigner", offset+2, err)
+	}
+
+	if _, err := r.sized("extraData", binary.BigEndian, maxDigestSize); err != nil {
+		return err
+	}
+
+	// TPMS_CLOCK_INFO: clock, resetCount and restartCount, then safe
+	if _, err := r.next("clockInfo", 8+4+4); err != nil {
+		return err
+	}
+
+	offset = r.off
+
+	safe, err := r.uint8("clockInfo.safe")
+	if err != nil {
+		return err
+	}
+
+	if safe > 1 {
+		return r.fail("clockInfo.safe", offset, fmt.Errorf("%w: %d is not a TPMI_YES_NO", ErrInvalidField, safe))
+	}
+
+	if _, err := r.next("firmwareVersion", 8); err != nil {
+		return err
+	}
+
+	offset = r.off
+
+	count, err := r.uint32("pcrSelect.count", binary.BigEndian)
+	if err != nil {
+		return err
+	}
+
+	if count > maxPCRBanks {
+		return r.fail("pcrSelect.count", offset, fmt.Errorf("%w: %d banks, at most %d", ErrInvalidField, count, maxPCRBanks))
+	}
+
+	for i := 0; i < int(count); i++ {
+		field := fmt.Sprintf("pcrSelect[%d]", i)
+
+		if _, err := r.uint16(field+".hash", binary.BigEndian); err != nil {
+			return err
+		}
+
+		offset = r.off
+
+		sizeofSelect, err := r.uint8(field + ".sizeofSelect")
+		if err != nil {
+			return err
+		}
+
+		if sizeofSelect > maxSizeofSelect {
+			return r.fail(field+".sizeofSelect", offset, fmt.Errorf("%w: %d bytes, at most %d", ErrInvalidField, sizeofSelect, maxSizeofSelect))
+		}
+
+		if _, err := r.next(field+".pcrSelect", int(sizeofSelect)); err != nil {
+			return err
+		}
+	}
+
+	if _, err := r.sized("pcrDigest", binary.BigEndian, maxDigestSize); err != nil {
+		return err
+	}
+
+	return r.end("TPMS_ATTEST")
+}
+
+// checkName checks that a TPM2B_NAME holds no name, a handle, or a digest of
+// the size of its hash algorithm
+func checkName(name []byte) error {
+	if len(name) == 0 || len(name) == 4 {
+		return nil
+	}
+
+	if len(name) < 2 {
+		return fmt.Errorf("%w: %d bytes name", ErrInvalidField, len(name))
+	}
+
+	alg := tpm2.Algorithm(binary.BigEndian.Uint16(name))
+
+	h, err := alg.Hash()
+	if err != nil {
+		return fmt.Errorf("%w: name algorithm 0x%04x", ErrInvalidField, uint16(alg))
+	}
+
+	if len(name) != 2+h.Size() {
+		return fmt.Errorf("%w: %d bytes %v name", ErrInvalidField, len(name), alg)
+	}
+
+	return nil
+}
+
+// decodeSignature decodes a signature blob and returns its TPMT_SIGNATURE,
+// big endian, and the wire format version of the blob
+func decodeSignature(blob []byte) ([]byte, Version, error) {
+	r := &reader{blob: "signature", data: blob}
+
+	version, err := r.version()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var order binary.ByteOrder = binary.BigEndian
+	if version == Legacy {
+		order = binary.LittleEndian
+	}
+
+	signature := &bytes.Buffer{}
+	if err := r.signature(order, signature, false); err != nil {
+		return nil, 0, err
+	}
+
+	return signature.Bytes(), version, nil
+}
+
+// signature walks a TPMT_SIGNATURE whose algorithm, hash and size fields are
+// in the given byte order, and writes it to out with these fields in little
+// endian if legacy is set, big endian otherwise. The signature values are
+// big endian in both layouts.
+func (r *reader) signature(order binary.ByteOrder, out *bytes.Buffer, legacy bool) error {
+	var outOrder binary.ByteOrder = binary.BigEndian
+	if legacy {
+		outOrder = binary.LittleEndian
+	}
+
+	offset := r.off
+
+	// 0. TPMI_ALG_SIG_SCHEME
+	sigAlg, err := r.uint16("sigAlg", order)
+	if err != nil {
+		return err
+	}
+
+	// Size prefixed values: R and S of TPMS_SIGNATURE_ECC, or the single
+	// TPM2B_PUBLIC_KEY_RSA of TPMS_SIGNATURE_RSA
+	var fields []string
+	var max int
+
+	switch tpm2.Algorithm(sigAlg) {
+	case tpm2.AlgECDSA:
+		fields, max = []string{"signatureR", "signatureS"}, maxECCParameterSize
+	case tpm2.AlgRSASSA, tpm2.AlgRSAPSS:
+		fields, max = []string{"sig"}, maxRSASignatureSize
+	default:
+		return r.fail("sigAlg", offset, fmt.Errorf("%w 0x%04x", ErrUnsupportedSignature, sigAlg))
+	}
+
+	binary.Write(out, outOrder, sigAlg)
+
+	// 1. TPMU_SIGNATURE, starting with the TPMI_ALG_HASH of the scheme
+	hashAlg, err := r.uint16("hash", order)
+	if err != nil {
+		return err
+	}
+
+	binary.Write(out, outOrder, hashAlg)
+
+	for _, field := range fields {
+		value, err := r.sized(field, order, max)
+		if err != nil {
+			return err
+		}
+
+		binary.Write(out, outOrder, uint16(len(value)))
+		out.Write(value)
+	}
+
+	return r.end("TPMT_SIGNATURE")
+}
@@ -0,0 +1,332 @@
+// Copyright 2023 EnactTrust LTD All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+
+package wire
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/uuid"
+)
+
+var testNodeID = uuid.MustParse("7dd5db06-d2f5-4e0d-8a9c-9baaa5a446ef")
+
+// testQuote returns the TPMS_ATTEST of a quote over the SHA-256 PCRs 0 to 7
+func testQuote(t testing.TB) []byte {
+	attest, err := tpm2.AttestationData{
+		Magic: tpmGeneratedValue,
+		Type:  tpm2.TagAttestQuote,
+		QualifiedSigner: tpm2.Name{
+			Digest: &tpm2.HashValue{Alg: tpm2.AlgSHA256, Value: bytes.Repeat([]byte{0x51}, 32)},
+		},
+		ExtraData:       bytes.Repeat([]byte{0xed}, 32),
+		ClockInfo:       tpm2.ClockInfo{Clock: 1000, ResetCount: 3, RestartCount: 1, Safe: 1},
+		FirmwareVersion: 0x0007005511cb0000,
+		AttestedQuoteInfo: &tpm2.QuoteInfo{
+			PCRSelection: tpm2.PCRSelection{Hash: tpm2.AlgSHA256, PCRs: []int{0, 1, 2, 3, 4, 5, 6, 7}},
+			PCRDigest:    bytes.Repeat([]byte{0xd1}, 32),
+		},
+	}.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return attest
+}
+
+// testSignature returns an ECDSA TPMT_SIGNATURE, big endian
+func testSignature() []byte {
+	sig := []byte{0x00, 0x18, 0x00, 0x0b}
+	for _, v := range []byte{0x52, 0x53} {
+		sig = append(sig, 0, 32)
+		sig = append(sig, bytes.Repeat([]byte{v}, 32)...)
+	}
+
+	return sig
+}
+
+// testEvidenceBlob lays out the TPMS_ATTEST the way legacy agents upload it
+func testEvidenceBlob(attest []byte) []byte {
+	blob := append([]byte{}, testNodeID[:]...)
+	blob = append(blob, byte(len(attest)), byte(len(attest)>>8))
+
+	return append(blob, attest...)
+}
+
+// testSignatureBlob returns the ECDSA signature in the legacy layout
+func testSignatureBlob() []byte {
+	blob := []byte{0x18, 0x00, 0x0b, 0x00}
+	for _, v := range []byte{0x52, 0x53} {
+		blob = append(blob, 32, 0)
+		blob = append(blob, bytes.Repeat([]byte{v}, 32)...)
+	}
+
+	return blob
+}
+
+// withAttest returns the legacy evidence blob of the quote patched by patch
+func withAttest(t *testing.T, patch func(attest []byte) []byte) []byte {
+	return testEvidenceBlob(patch(testQuote(t)))
+}
+
+func TestEncodeDecode(t *testing.T) {
+	for _, version := range []Version{Legacy, V2} {
+		q := Quote{Version: version, NodeID: testNodeID, Attest: testQuote(t), Signature: testSignature()}
+
+		evidence, signature, err := q.Encode()
+		if err != nil {
+			t.Fatal(version, err)
+		}
+
+		if version == Legacy && (!bytes.Equal(evidence, testEvidenceBlob(q.Attest)) || !bytes.Equal(signature, testSignatureBlob())) {
+			t.Fatalf("legacy blobs %x %x", evidence, signature)
+		}
+
+		if version == V2 && (!bytes.HasPrefix(evidence, []byte("\x89ENACT\x00\x02")) || !bytes.Equal(signature[8:], q.Signature)) {
+			t.Fatalf("version 2 blobs %x %x", evidence, signature)
+		}
+
+		decoded, err := Decode(evidence, signature)
+		if err != nil {
+			t.Fatal(version, err)
+		}
+
+		if decoded.Version != version || decoded.NodeID != testNodeID || !bytes.Equal(decoded.Attest, q.Attest) || !bytes.Equal(decoded.Signature, q.Signature) {
+			t.Fatalf("decoded %+v", decoded)
+		}
+
+		token, err := tpm2.DecodeSignature(bytes.NewBuffer(decoded.Token()[2+len(q.Attest):]))
+		if err != nil || token.Alg != tpm2.AlgECDSA || token.ECC.HashAlg != tpm2.AlgSHA256 {
+			t.Fatal(token, err)
+		}
+	}
+
+	legacy, _, _ := Quote{Version: Legacy, NodeID: testNodeID, Attest: testQuote(t), Signature: testSignature()}.Encode()
+	_, v2, _ := Quote{Version: V2, NodeID: testNodeID, Attest: testQuote(t), Signature: testSignature()}.Encode()
+	if _, err := Decode(legacy, v2); !errors.Is(err, ErrVersionMismatch) {
+		t.Fatal(err)
+	}
+
+	if _, _, err := (Quote{Version: 3, NodeID: testNodeID}).Encode(); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Fatal(err)
+	}
+
+	// Node IDs are UUIDs, whose version nibble is never 0
+	var header uuid.UUID
+	copy(header[:], "\x89ENACT\x00\x02")
+	if _, _, err := (Quote{Version: Legacy, NodeID: header, Attest: testQuote(t), Signature: testSignature()}).Encode(); !errors.Is(err, ErrInvalidField) {
+		t.Fatal(err)
+	}
+}
+
+func TestDecodeEvidence(t *testing.T) {
+	attest := testQuote(t)
+
+	nodeID, decoded, version, err := decodeEvidence(testEvidenceBlob(attest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nodeID != testNodeID || !bytes.Equal(decoded, attest) || version != Legacy {
+		t.Fatalf("decoded %v %x %d", nodeID, decoded, version)
+	}
+
+	// Offsets of the TPMS_ATTEST fields past the node_id and size
+	const (
+		qualifiedSigner = 4 + 2
+		extraData       = qualifiedSigner + 2 + 34
+		safe            = extraData + 2 + 32 + 16
+		pcrSelect       = safe + 1 + 8
+		pcrDigest       = pcrSelect + 4 + 2 + 1 + 3
+	)
+
+	v2, _, err := Quote{Version: V2, NodeID: testNodeID, Attest: attest, Signature: testSignature()}.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unsupported := append([]byte{}, v2...)
+	unsupported[7] = 3
+
+	cases := []struct {
+		name   string
+		blob   []byte
+		err    error
+		field  string
+		offset int
+	}{
+		{"empty", nil, ErrTruncated, "node_id", 0},
+		{"short node_id", testNodeID[:10], ErrTruncated, "node_id", 0},
+		{"no size", testNodeID[:], ErrTruncated, "TPMS_ATTEST.size", 16},
+		{"size past end", testEvidenceBlob(attest)[:30], ErrTruncated, "TPMS_ATTEST", 18},
+		{"trailing data", append(testEvidenceBlob(attest), 0), ErrTrailingData, "TPMS_ATTEST", 18 + len(attest)},
+		{"bad magic", withAttest(t, func(a []byte) []byte {
+			a[0] = 0
+			return a
+		}), ErrInvalidField, "magic", 18},
+		{"not a quote", withAttest(t, func(a []byte) []byte {
+			binary.BigEndian.PutUint16(a[4:], uint16(tpm2.TagAttestCertify))
+			return a
+		}), ErrInvalidField, "type", 22},
+		{"qualifiedSigner too large", withAttest(t, func(a []byte) []byte {
+			binary.BigEndian.PutUint16(a[qualifiedSigner:], maxNameSize+1)
+			return a
+		}), ErrInvalidField, "qualifiedSigner.size", 18 + qualifiedSigner},
+		{"unknown name algorithm", withAttest(t, func(a []byte) []byte {
+			binary.BigEndian.PutUint16(a[qualifiedSigner+2:], 0x9999)
+			return a
+		}), ErrInvalidField, "qualifiedSigner", 18 + qualifiedSigner + 2},
+		{"extraData past attest", withAttest(t, func(a []byte) []byte {
+			return a[:extraData+10]
+		}), ErrTruncated, "extraData", 18 + extraData + 2},
+		{"safe not a boolean", withAttest(t, func(a []byte) []byte {
+			a[safe] = 2
+			return a
+		}), ErrInvalidField, "clockInfo.safe", 18 + safe},
+		{"too many banks", withAttest(t, func(a []byte) []byte {
+			binary.BigEndian.PutUint32(a[pcrSelect:], 2)
+			return a
+		}), ErrInvalidField, "pcrSelect.count", 18 + pcrSelect},
+		{"sizeofSelect too large", withAttest(t, func(a []byte) []byte {
+			a[pcrSelect+4+2] = 0xff
+			return a
+		}), ErrInvalidField, "pcrSelect[0].sizeofSelect", 18 + pcrSelect + 6},
+		{"pcrDigest past attest", withAttest(t, func(a []byte) []byte {
+			binary.BigEndian.PutUint16(a[pcrDigest:], 33)
+			return a
+		}), ErrTruncated, "pcrDigest", 18 + pcrDigest + 2},
+		{"trailing data in attest", withAttest(t, func(a []byte) []byte {
+			return append(a, 0, 0)
+		}), ErrTrailingData, "TPMS_ATTEST", 18 + len(attest)},
+		{"version 2 without version", v2[:7], ErrTruncated, "version", 6},
+		{"unsupported version", unsupported, ErrUnsupportedVersion, "version", 6},
+		{"version 2 trailing data", append(v2, 0), ErrTrailingData, "TPMS_ATTEST", 8 + 18 + len(attest)},
+		{"version 2 bad magic", append(append([]byte{}, v2[:26]...), append([]byte{0}, v2[27:]...)...), ErrInvalidField, "magic", 8 + 18},
+	}
+
+	for _, c := range cases {
+		_, _, _, err := decodeEvidence(c.blob)
+		checkError(t, c.name, err, c.err, "evidence", c.field, c.offset)
+	}
+}
+
+func TestDecodeSignature(t *testing.T) {
+	sig, version, err := decodeSignature(testSignatureBlob())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != Legacy || !bytes.Equal(sig, testSignature()) {
+		t.Fatalf("decoded %x %d", sig, version)
+	}
+
+	valid := testSignatureBlob()
+	rsa := append([]byte{0x14, 0x00, 0x0b, 0x00, 0x01, 0x02}, make([]byte, 0x201)...)
+	v2 := append([]byte("\x89ENACT\x00\x02"), testSignature()...)
+
+	cases := []struct {
+		name   string
+		blob   []byte
+		err    error
+		field  string
+		offset int
+	}{
+		{"empty", nil, ErrTruncated, "sigAlg", 0},
+		{"unknown algorithm", []byte{0x99, 0x00, 0x0b, 0x00}, ErrUnsupportedSignature, "sigAlg", 0},
+		{"no hash", valid[:3], ErrTruncated, "hash", 2},
+		{"R past end", valid[:20], ErrTruncated, "signatureR", 6},
+		{"R too large", append([]byte{0x18, 0x00, 0x0b, 0x00, 0xff, 0x00}, valid[6:]...), ErrInvalidField, "signatureR.size", 4},
+		{"no S", valid[:38], ErrTruncated, "signatureS.size", 38},
+		{"RSA signature too large", rsa, ErrInvalidField, "sig.size", 4},
+		{"trailing data", append(valid, 0), ErrTrailingData, "TPMT_SIGNATURE", len(valid)},
+		{"version 2 little endian", append([]byte("\x89ENACT\x00\x02"), valid...), ErrUnsupportedSignature, "sigAlg", 8},
+		{"version 2 no S", v2[:8+38], ErrTruncated, "signatureS.size", 8 + 38},
+	}
+
+	for _, c := range cases {
+		_, _, err := decodeSignature(c.blob)
+		checkError(t, c.name, err, c.err, "signature", c.field, c.offset)
+	}
+}
+
+func checkError(t *testing.T, name string, err error, want error, blob string, field string, offset int) {
+	t.Helper()
+
+	var wireErr *Error
+	if !errors.As(err, &wireErr) {
+		t.Errorf("%s: got %v, want a wire.Error", name, err)
+		return
+	}
+
+	if !errors.Is(err, want) || wireErr.Blob != blob || wireErr.Field != field || wireErr.Offset != offset {
+		t.Errorf("%s: got %v, want %v on %s at offset %d", name, err, want, field, offset)
+	}
+}
+
+func FuzzDecodeEvidence(f *testing.F) {
+	f.Add(testEvidenceBlob(testQuote(f)))
+
+	f.Fuzz(func(t *testing.T, blob []byte) {
+		nodeID, attest, version, err := decodeEvidence(blob)
+		if err != nil {
+			var wireErr *Error
+			if !errors.As(err, &wireErr) || wireErr.Offset < 0 || wireErr.Offset > len(blob) {
+				t.Fatalf("%x: %v", blob, err)
+			}
+			return
+		}
+
+		// Whatever the decoder accepts encodes back to the same blob
+		evidence, _, err := Quote{Version: version, NodeID: nodeID, Attest: attest, Signature: testSignature()}.Encode()
+		if err != nil || !bytes.Equal(evidence, blob) {
+			t.Fatalf("%x: encoded %x, %v", blob, evidence, err)
+		}
+
+		// and is a quote go-tpm can decode
+		ad, err := tpm2.DecodeAttestationData(attest)
+		if err != nil {
+			t.Fatalf("%x: %v", blob, err)
+		}
+		if ad.AttestedQuoteInfo == nil {
+			t.Fatalf("%x: not a quote", blob)
+		}
+	})
+}
+
+func FuzzDecodeSignature(f *testing.F) {
+	f.Add(testSignatureBlob())
+
+	f.Fuzz(func(t *testing.T, blob []byte) {
+		sig, version, err := decodeSignature(blob)
+		if err != nil {
+			var wireErr *Error
+			if !errors.As(err, &wireErr) || wireErr.Offset < 0 || wireErr.Offset > len(blob) {
+				t.Fatalf("%x: %v", blob, err)
+			}
+			return
+		}
+
+		// Whatever the decoder accepts encodes back to the same blob
+		_, signature, err := Quote{Version: version, NodeID: testNodeID, Attest: testQuote(t), Signature: sig}.Encode()
+		if err != nil || !bytes.Equal(signature, blob) {
+			t.Fatalf("%x: encoded %x, %v", blob, signature, err)
+		}
+
+		// and is a signature go-tpm can decode
+		if _, err := tpm2.DecodeSignature(bytes.NewBuffer(sig)); err != nil {
+			t.Fatalf("%x: %v", blob, err)
+		}
+	})
+}
@@ -0,0 +1,110 @@
+// Copyright 2023 EnactTrust LTD All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+
+package main
+
+import (
+	"log"
+
+	"github.com/gin-gonic/gin"
+	"github.com/veraison/enact-demo/pkg/node"
+)
+
+// PCR selection policies: the PCRs the quotes of a node, or of the nodes
+// carrying a label, must select
+func setupPolicyRoutes(r *gin.Engine, nodeService *node.NodeService, operator gin.HandlerFunc) {
+	r.GET("/pcr-policies", func(c *gin.Context) {
+		policies, err := nodeService.ListPCRPolicies()
+		if err != nil {
+			log.Println(err.Error())
+			c.JSON(500, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+
+		c.JSON(200, gin.H{
+			"pcr_policies": policies,
+		})
+	})
+
+	// Policy in force for the node, its own or that of its label
+	r.GET("/nodes/:id/pcr-policy", func(c *gin.Context) {
+		policy, err := nodeService.GetPCRPolicy(c.Param("id"))
+		if err != nil {
+			log.Println(err.Error())
+			c.JSON(errorStatus(err), gin.H{
+				"error": err.Error(),
+			})
+		} else if policy == nil {
+			c.JSON(404, gin.H{
+				"error": "no PCR policy for node",
+			})
+		} else {
+			c.JSON(200, policy)
+		}
+	})
+
+	// PUT /nodes/:id/pcr-policy, Body: {"pcr_selection": "sha256:0,1,2,3"}
+	r.PUT("/nodes/:id/pcr-policy", operator, func(c *gin.Context) {
+		setPCRPolicy(c, nodeService, c.Param("id"), "")
+	})
+
+	r.DELETE("/nodes/:id/pcr-policy", operator, func(c *gin.Context) {
+		deletePCRPolicy(c, nodeService, c.Param("id"), "")
+	})
+
+	// PUT /labels/:label/pcr-policy, Body: {"pcr_selection": "sha256:0,1,2,3"}
+	r.PUT("/labels/:label/pcr-policy", operator, func(c *gin.Context) {
+		setPCRPolicy(c, nodeService, "", c.Param("label"))
+	})
+
+	r.DELETE("/labels/:label/pcr-policy", operator, func(c *gin.Context) {
+		deletePCRPolicy(c, nodeService, "", c.Param("label"))
+	})
+}
+
+func setPCRPolicy(c *gin.Context, nodeService *node.NodeService, nodeID string, label string) {
+	var body struct {
+		PCRSelection string `json:"pcr_selection" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(400, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	policy, err := nodeService.SetPCRPolicy(nodeID, label, body.PCRSelection)
+	if err != nil {
+		log.Println(err.Error())
+		c.JSON(errorStatus(err), gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(200, policy)
+}
+
+func deletePCRPolicy(c *gin.Context, nodeService *node.NodeService, nodeID string, label string) {
+	err := nodeService.DeletePCRPolicy(nodeID, label)
+	if err != nil {
+		log.Println(err.Error())
+		c.JSON(errorStatus(err), gin.H{
+			"error": err.Error(),
+		})
+	} else {
+		c.Status(204)
+	}
+}